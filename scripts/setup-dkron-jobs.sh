@@ -1,6 +1,15 @@
 #!/bin/bash
 # filepath: /Users/miapalovaara/dalam-kemasan/scripts/setup-dkron-jobs.sh
 
+# the scheduler endpoints only accept requests carrying SCHEDULER_TOKEN, taken from the environment or service/.env
+if [ -z "$SCHEDULER_TOKEN" ] && [ -f "$(dirname "$0")/../service/.env" ]; then
+    SCHEDULER_TOKEN=$(grep -E '^SCHEDULER_TOKEN=' "$(dirname "$0")/../service/.env" | cut -d= -f2-)
+fi
+if [ -z "$SCHEDULER_TOKEN" ]; then
+    echo "❌ SCHEDULER_TOKEN is not set, add it to service/.env first"
+    exit 1
+fi
+
 # Wait for dkron to be ready
 echo "🔄 Waiting for Dkron to be ready..."
 until curl -f http://localhost:8080/health > /dev/null 2>&1; do
@@ -20,7 +29,7 @@ JOB_RESPONSE=$(curl -s -X POST http://localhost:8080/v1/jobs \
     "executor_config": {
       "method": "POST",
       "url": "http://service-api:8081/api/v1/internal/scheduler/check-expired-packages",
-      "headers": "Content-Type:application/json,User-Agent:Dkron",
+      "headers": "Content-Type:application/json,User-Agent:Dkron,X-Scheduler-Token:'"$SCHEDULER_TOKEN"'",
       "timeout": "30s",
       "expectCode": "200"
     },
@@ -34,6 +43,126 @@ JOB_RESPONSE=$(curl -s -X POST http://localhost:8080/v1/jobs \
 
 echo "📋 Job Response: $JOB_RESPONSE"
 
+# Create the account purge job, accounts whose deletion grace period is over are purged
+PURGE_JOB_RESPONSE=$(curl -s -X POST http://localhost:8080/v1/jobs \
+  -H "Content-Type: application/json" \
+  -d '{
+    "name": "purge-deleted-accounts",
+    "schedule": "@every 10m",
+    "executor": "http",
+    "executor_config": {
+      "method": "POST",
+      "url": "http://service-api:8081/api/v1/internal/scheduler/purge-deleted-accounts",
+      "headers": "Content-Type:application/json,User-Agent:Dkron,X-Scheduler-Token:'"$SCHEDULER_TOKEN"'",
+      "timeout": "120s",
+      "expectCode": "200"
+    },
+    "retries": 2,
+    "disabled": false,
+    "tags": {
+      "environment": "development",
+      "service": "dalam-kemasan"
+    }
+  }')
+
+echo "📋 Purge Job Response: $PURGE_JOB_RESPONSE"
+
+# Create the audit retention job, audit events older than AUDIT_RETENTION are deleted
+AUDIT_JOB_RESPONSE=$(curl -s -X POST http://localhost:8080/v1/jobs \
+  -H "Content-Type: application/json" \
+  -d '{
+    "name": "prune-audit-events",
+    "schedule": "@every 24h",
+    "executor": "http",
+    "executor_config": {
+      "method": "POST",
+      "url": "http://service-api:8081/api/v1/internal/scheduler/prune-audit-events",
+      "headers": "Content-Type:application/json,User-Agent:Dkron,X-Scheduler-Token:'"$SCHEDULER_TOKEN"'",
+      "timeout": "300s",
+      "expectCode": "200"
+    },
+    "retries": 2,
+    "disabled": false,
+    "tags": {
+      "environment": "development",
+      "service": "dalam-kemasan"
+    }
+  }')
+
+echo "📋 Audit Job Response: $AUDIT_JOB_RESPONSE"
+
+# Create the throttle pruning job, counters without a recent failure are deleted
+THROTTLE_JOB_RESPONSE=$(curl -s -X POST http://localhost:8080/v1/jobs \
+  -H "Content-Type: application/json" \
+  -d '{
+    "name": "prune-auth-throttles",
+    "schedule": "@every 1h",
+    "executor": "http",
+    "executor_config": {
+      "method": "POST",
+      "url": "http://service-api:8081/api/v1/internal/scheduler/prune-auth-throttles",
+      "headers": "Content-Type:application/json,User-Agent:Dkron,X-Scheduler-Token:'"$SCHEDULER_TOKEN"'",
+      "timeout": "300s",
+      "expectCode": "200"
+    },
+    "retries": 2,
+    "disabled": false,
+    "tags": {
+      "environment": "development",
+      "service": "dalam-kemasan"
+    }
+  }')
+
+echo "📋 Throttle Job Response: $THROTTLE_JOB_RESPONSE"
+
+# Create the notification job, it queues expiry reminders and sends due lifecycle emails
+NOTIFICATION_JOB_RESPONSE=$(curl -s -X POST http://localhost:8080/v1/jobs \
+  -H "Content-Type: application/json" \
+  -d '{
+    "name": "send-notifications",
+    "schedule": "@every 5m",
+    "executor": "http",
+    "executor_config": {
+      "method": "POST",
+      "url": "http://service-api:8081/api/v1/internal/scheduler/send-notifications",
+      "headers": "Content-Type:application/json,User-Agent:Dkron,X-Scheduler-Token:'"$SCHEDULER_TOKEN"'",
+      "timeout": "300s",
+      "expectCode": "200"
+    },
+    "retries": 2,
+    "disabled": false,
+    "tags": {
+      "environment": "development",
+      "service": "dalam-kemasan"
+    }
+  }')
+
+echo "📋 Notification Job Response: $NOTIFICATION_JOB_RESPONSE"
+
+# Create the usage snapshot job, the last run of a day is that day's storage
+USAGE_JOB_RESPONSE=$(curl -s -X POST http://localhost:8080/v1/jobs \
+  -H "Content-Type: application/json" \
+  -d '{
+    "name": "snapshot-usage",
+    "schedule": "@every 1h",
+    "executor": "http",
+    "executor_config": {
+      "method": "POST",
+      "url": "http://service-api:8081/api/v1/internal/scheduler/snapshot-usage",
+      "headers": "Content-Type:application/json,User-Agent:Dkron,X-Scheduler-Token:'"$SCHEDULER_TOKEN"'",
+      "timeout": "300s",
+      "expectCode": "200"
+    },
+    "retries": 2,
+    "disabled": false,
+    "tags": {
+      "environment": "development",
+      "service": "dalam-kemasan"
+    }
+  }')
+
+echo "📋 Usage Job Response: $USAGE_JOB_RESPONSE"
+
 # Verify the job was created
 echo "🔍 Verifying job creation..."
 JOBS_LIST=$(curl -s http://localhost:8080/v1/jobs)
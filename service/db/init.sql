@@ -1,25 +1,63 @@
+-- Plan catalog, users.package and files.uploaded_with_package refer to plan_id.
+-- Exactly one plan is the default, new users start on it and expired plans fall back to it.
+CREATE TABLE IF NOT EXISTS plans (
+    plan_id VARCHAR(32) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    tier_rank INT NOT NULL, -- files uploaded on a plan stay usable on plans of the same or a higher rank
+    storage_quota BIGINT NOT NULL, -- bytes per user, admins can override it in user_storage
+    max_file_size BIGINT NOT NULL,
+    features TEXT[] NOT NULL DEFAULT '{}',
+    duration_seconds BIGINT, -- how long the plan lasts once bought, NULL never expires
+    trial_seconds BIGINT, -- length of the free trial, NULL has none
+    price_amount BIGINT NOT NULL DEFAULT 0, -- smallest currency unit
+    currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    purchasable BOOLEAN NOT NULL DEFAULT FALSE, -- the others are only granted by admins
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_plans_default ON plans(is_default) WHERE is_default;
+
+INSERT INTO plans (plan_id, name, tier_rank, storage_quota, max_file_size, features, duration_seconds, price_amount, currency, is_default, purchasable) VALUES
+    ('free', 'Free', 0, 2097152, 5242880, '{}', NULL, 0, 'USD', TRUE, TRUE), -- 2MB quota
+    ('premium', 'Premium', 10, 5242880, 5242880, '{priority_support}', 2592000, 499, 'USD', FALSE, TRUE) -- 5MB quota, 30 days
+ON CONFLICT (plan_id) DO NOTHING;
+
 CREATE TABLE IF NOT EXISTS users(
     user_id SERIAL PRIMARY KEY,
     email VARCHAR(255) UNIQUE NOT NULL,
     username VARCHAR(255) NOT NULL,
-    reset_token VARCHAR(255),
+    reset_token_hash VARCHAR(64), -- sha256 hex of the emailed reset token, never the raw token
     reset_token_expiry TIMESTAMP,
+    pending_email VARCHAR(255), -- new address waiting for confirmation, email only changes once it is confirmed
+    email_change_token_hash VARCHAR(64),
+    email_change_expiry TIMESTAMP,
+    magic_link_token_hash VARCHAR(64), -- emailed one time login link
+    magic_link_nonce_hash VARCHAR(64), -- cookie of the browser that asked for the link, the link only works there
+    magic_link_expiry TIMESTAMP,
     password VARCHAR(255) NOT NUll,
-    package VARCHAR(50) NOT NULL DEFAULT 'free',
-    free_storage_used BIGINT DEFAULT 0,
-    free_storage_limit BIGINT DEFAULT 2097152, -- 2MB in bytes
-    premium_storage_used BIGINT DEFAULT 0,
-    premium_storage_limit BIGINT DEFAULT 5242880, -- 5MB in bytes
-    package_expiry TIMESTAMP -- Added package expiry field
+    package VARCHAR(32) NOT NULL DEFAULT 'free' REFERENCES plans(plan_id),
+    role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'support', 'admin')),
+    package_expiry TIMESTAMP, -- Added package expiry field
+    disabled_at TIMESTAMP, -- set by an admin, a disabled account can't log in
+    disabled_reason VARCHAR(255)
 );
 
 CREATE TABLE IF NOT EXISTS refresh_tokens (
     refresh_token_id SERIAL PRIMARY KEY,
     user_id INT NOT NULL,
-    refresh_token_value VARCHAR(255) NOT NULL,
+    refresh_token_hash VARCHAR(64) NOT NULL, -- sha256 hex of the refresh token cookie, never the raw token
     expired_at TIMESTAMP NOT NULL,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    -- session (device) info, copied to the new row every time the refresh token is rotated
+    session_id VARCHAR(64) NOT NULL,
+    session_label VARCHAR(255) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    session_created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    remember_me BOOLEAN NOT NULL DEFAULT FALSE, -- picks the long refresh lifetime, kept on rotation
     FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
 );
 
@@ -30,13 +68,309 @@ CREATE TABLE IF NOT EXISTS files (
     file_size BIGINT NOT NULL,
     s3_object_key VARCHAR(1024) UNIQUE NOT NULL,
     content_type VARCHAR(255) NOT NULL,
-    uploaded_with_package VARCHAR(50) NOT NULL, -- Added package type at upload
+    uploaded_with_package VARCHAR(32) NOT NULL REFERENCES plans(plan_id), -- plan at upload, its storage pool is charged
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    archived_at TIMESTAMP, -- moved under the user's .archive/ prefix after a downgrade
     FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
 );
 
+-- Storage used per user and plan, storage_limit overrides the plan quota when an admin set one
+CREATE TABLE IF NOT EXISTS user_storage (
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    plan_id VARCHAR(32) NOT NULL REFERENCES plans(plan_id),
+    storage_used BIGINT NOT NULL DEFAULT 0,
+    storage_limit BIGINT,
+    downgraded_at TIMESTAMP, -- when the user lost the plan, its files are read only for a while then archived or locked
+    PRIMARY KEY (user_id, plan_id)
+);
+
 CREATE INDEX idx_users_email ON users(email);
 CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id);
-CREATE INDEX idx_refresh_tokens_refresh_token_value ON refresh_tokens(refresh_token_value);
+CREATE INDEX idx_refresh_tokens_refresh_token_hash ON refresh_tokens(refresh_token_hash);
+CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+CREATE INDEX idx_users_reset_token_hash ON users(reset_token_hash);
+CREATE INDEX idx_users_email_change_token_hash ON users(email_change_token_hash);
+CREATE INDEX idx_users_magic_link_token_hash ON users(magic_link_token_hash);
 CREATE INDEX idx_files_user_id ON files(user_id);
-CREATE INDEX idx_files_s3_object_key ON files(s3_object_key);
\ No newline at end of file
+CREATE INDEX idx_files_s3_object_key ON files(s3_object_key);
+CREATE INDEX idx_user_storage_downgraded_at ON user_storage(downgraded_at) WHERE downgraded_at IS NOT NULL;
+-- JWT signing keys, the newest row whose active_from has passed signs, rotated keys keep verifying for a grace period
+CREATE TABLE IF NOT EXISTS jwt_signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(16) NOT NULL,
+    encrypted_private_key TEXT NOT NULL, -- pkcs#8 pem sealed with AES-GCM under JWT_KEY_ENCRYPTION_KEY
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    active_from TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- signs from here on, a rotated in key is published in the JWKS first
+    rotated_at TIMESTAMP
+);
+
+-- Access token denylist, a row revokes either one token (jti) or every token of a user issued at or before issued_before.
+-- Rows are deleted after expires_at, by then the tokens they cover are expired anyway.
+CREATE TABLE IF NOT EXISTS access_token_revocations (
+    revocation_id SERIAL PRIMARY KEY,
+    jti VARCHAR(64),
+    user_id INT REFERENCES users(user_id) ON DELETE CASCADE,
+    issued_before TIMESTAMP,
+    reason VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (jti IS NOT NULL OR (user_id IS NOT NULL AND issued_before IS NOT NULL))
+);
+
+CREATE INDEX idx_access_token_revocations_expires_at ON access_token_revocations(expires_at);
+CREATE INDEX idx_access_token_revocations_created_at ON access_token_revocations(created_at);
+
+-- Personal access tokens for scripted access, only the hash of the secret is stored
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    token_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_prefix VARCHAR(16) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMP, -- NULL means the token never expires
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+
+-- Failed login / password reset counters per account and per ip (throttle_key is action:scope:subject)
+CREATE TABLE IF NOT EXISTS auth_throttles (
+    throttle_key VARCHAR(320) PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP,
+    unlock_token_hash VARCHAR(64) -- set when a locked account was emailed an unlock link
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_throttles_unlock_token_hash ON auth_throttles(unlock_token_hash);
+
+-- Account deletions, the row outlives the user so an interrupted purge can be resumed; the email is dropped once the purge is confirmed
+CREATE TABLE IF NOT EXISTS account_deletions (
+    user_id INT PRIMARY KEY, -- no foreign key, the users row is deleted by the purge
+    email VARCHAR(255),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, purging, completed
+    requested_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    purge_after TIMESTAMP NOT NULL,
+    claimed_at TIMESTAMP,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_deletions_status_purge_after ON account_deletions(status, purge_after);
+
+-- Every package change, appended by the same statement that changes users.package
+CREATE TABLE IF NOT EXISTS package_history (
+    change_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    package VARCHAR(50) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_package_history_user_id ON package_history(user_id);
+
+-- Personal data exports, the queue for the export worker and the record of the archive in minio
+CREATE TABLE IF NOT EXISTS data_exports (
+    export_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, running, ready, failed, expired
+    object_key VARCHAR(255),
+    size_bytes BIGINT,
+    download_token_hash VARCHAR(64) UNIQUE, -- sha256 hex of the emailed download token
+    error TEXT,
+    requested_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id);
+CREATE INDEX IF NOT EXISTS idx_data_exports_status ON data_exports(status);
+
+-- Security relevant events (logins, token use, password and package changes, file access, admin actions),
+-- no foreign keys so the record outlives a purged account
+CREATE TABLE IF NOT EXISTS audit_events (
+    event_id BIGSERIAL PRIMARY KEY,
+    actor_id INT,
+    action VARCHAR(64) NOT NULL,
+    target_user_id INT,
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    result VARCHAR(20) NOT NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_target_user_id ON audit_events(target_user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+
+-- One attempt to buy a plan through the payment provider, only a verified webhook moves it out of pending.
+-- No foreign key on user_id, payment records are kept after an account is purged.
+CREATE TABLE IF NOT EXISTS checkouts (
+    checkout_id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    plan_id VARCHAR(32) NOT NULL REFERENCES plans(plan_id),
+    provider VARCHAR(32) NOT NULL,
+    provider_session_id VARCHAR(255),
+    provider_payment_id VARCHAR(255), -- set once paid, refund events only name the payment
+    checkout_url TEXT,
+    amount BIGINT NOT NULL, -- copied from the plan when the checkout started
+    refunded_amount BIGINT NOT NULL DEFAULT 0, -- total refunded so far, the checkout is only refunded once it covers amount
+    currency VARCHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'paid', 'failed', 'refunded')),
+    idempotency_key VARCHAR(64) NOT NULL,
+    failure_reason TEXT,
+    promo_code VARCHAR(32), -- amount already has the discount taken off
+    discount_amount BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    UNIQUE (user_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_checkouts_provider_payment_id ON checkouts(provider, provider_payment_id);
+
+-- Webhook events already handled, a redelivered event finds its row and is skipped
+CREATE TABLE IF NOT EXISTS payment_events (
+    provider VARCHAR(32) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(32) NOT NULL,
+    checkout_id VARCHAR(64), -- set once the event is matched to a checkout, NULL for events that aren't ours
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (provider, event_id)
+);
+CREATE INDEX IF NOT EXISTS idx_payment_events_checkout_id ON payment_events(checkout_id);
+
+-- A user's time on a plan, users.package and users.package_expiry mirror the running subscription.
+-- At most one subscription per user is running, canceled and expired ones are kept as history.
+CREATE TABLE IF NOT EXISTS subscriptions (
+    subscription_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    plan_id VARCHAR(32) NOT NULL REFERENCES plans(plan_id),
+    status VARCHAR(20) NOT NULL CHECK (status IN ('trialing', 'active', 'past_due', 'grace', 'canceled', 'expired')),
+    current_period_start TIMESTAMP NOT NULL,
+    current_period_end TIMESTAMP, -- NULL for plans granted without an end
+    auto_renew BOOLEAN NOT NULL DEFAULT FALSE,
+    cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+    ended_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_subscriptions_running ON subscriptions(user_id) WHERE status NOT IN ('canceled', 'expired');
+CREATE INDEX IF NOT EXISTS idx_subscriptions_due ON subscriptions(status, current_period_end);
+
+-- Every state a subscription went through and why
+CREATE TABLE IF NOT EXISTS subscription_transitions (
+    transition_id SERIAL PRIMARY KEY,
+    subscription_id INT NOT NULL REFERENCES subscriptions(subscription_id) ON DELETE CASCADE,
+    from_status VARCHAR(20), -- NULL for the row that created the subscription
+    to_status VARCHAR(20) NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_subscription_transitions_subscription_id ON subscription_transitions(subscription_id);
+
+-- An invoice for every successful charge, user_id has no foreign key so finance keeps the records of purged accounts.
+CREATE TABLE IF NOT EXISTS invoices (
+    invoice_id SERIAL PRIMARY KEY,
+    invoice_number VARCHAR(32) GENERATED ALWAYS AS ('INV-' || LPAD(invoice_id::text, 8, '0')) STORED UNIQUE,
+    user_id INT NOT NULL,
+    checkout_id VARCHAR(64) NOT NULL UNIQUE REFERENCES checkouts(checkout_id), -- one invoice per charge, redelivered webhooks don't issue another
+    status VARCHAR(20) NOT NULL CHECK (status IN ('paid', 'refunded')),
+    billing_email VARCHAR(255) NOT NULL, -- copied when issued
+    currency VARCHAR(3) NOT NULL,
+    subtotal BIGINT NOT NULL, -- smallest currency unit, without tax
+    tax_rate_bps INT NOT NULL DEFAULT 0, -- basis points, prices include the tax
+    tax_amount BIGINT NOT NULL DEFAULT 0,
+    total BIGINT NOT NULL, -- what was charged
+    provider VARCHAR(32) NOT NULL,
+    issued_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    refunded_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_invoices_user_id ON invoices(user_id, issued_at);
+CREATE INDEX IF NOT EXISTS idx_invoices_issued_at ON invoices(issued_at);
+
+CREATE TABLE IF NOT EXISTS invoice_lines (
+    line_id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL REFERENCES invoices(invoice_id) ON DELETE CASCADE,
+    description VARCHAR(255) NOT NULL,
+    plan_id VARCHAR(32) REFERENCES plans(plan_id),
+    quantity INT NOT NULL DEFAULT 1,
+    unit_amount BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    period_start TIMESTAMP, -- the subscription period the line pays for
+    period_end TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS promo_codes (
+    code VARCHAR(32) PRIMARY KEY, -- stored upper case
+    description TEXT NOT NULL DEFAULT '',
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('percent', 'fixed', 'free_days')),
+    percent_off INT CHECK (percent_off BETWEEN 1 AND 99),
+    amount_off BIGINT CHECK (amount_off > 0), -- smallest unit of currency
+    currency VARCHAR(3),
+    free_days INT CHECK (free_days > 0),
+    grant_plan_id VARCHAR(32) REFERENCES plans(plan_id),
+    plan_ids TEXT[] NOT NULL DEFAULT '{}', -- discounts only apply to these plans, empty means every plan
+    max_redemptions INT, -- NULL for no overall limit
+    max_per_user INT NOT NULL DEFAULT 1,
+    valid_from TIMESTAMP,
+    valid_until TIMESTAMP,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Uses of the codes, a checkout's redemption is pending until paid and released if the payment never happens
+CREATE TABLE IF NOT EXISTS promo_redemptions (
+    redemption_id SERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL REFERENCES promo_codes(code),
+    user_id INT NOT NULL,
+    checkout_id VARCHAR(64) UNIQUE, -- NULL for free days, the checkout is written after its redemption
+    plan_id VARCHAR(32) NOT NULL,
+    discount_amount BIGINT NOT NULL DEFAULT 0,
+    currency VARCHAR(3),
+    free_days INT,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'redeemed', 'released')),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    redeemed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_code ON promo_redemptions(code, status);
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_user_id ON promo_redemptions(user_id);
+
+-- Lifecycle emails, the dedupe key names the event so it is queued once and the status tracks its delivery
+CREATE TABLE IF NOT EXISTS notifications (
+    notification_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    kind VARCHAR(32) NOT NULL CHECK (kind IN ('expiry_reminder_7d', 'expiry_reminder_1d', 'plan_expired', 'payment_failed', 'downgrade', 'welcome')),
+    dedupe_key VARCHAR(128) NOT NULL UNIQUE,
+    data JSONB NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'sending', 'sent', 'failed', 'skipped')),
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    claimed_at TIMESTAMP,
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_due ON notifications(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, created_at);
+
+-- Usage per user and UTC day, bandwidth is counted as files go through and storage is snapshotted by the scheduler (NULL until it runs)
+CREATE TABLE IF NOT EXISTS usage_daily (
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    storage_bytes BIGINT,
+    file_count INT,
+    storage_snapshot_at TIMESTAMP,
+    download_bytes BIGINT NOT NULL DEFAULT 0,
+    upload_bytes BIGINT NOT NULL DEFAULT 0,
+    download_count INT NOT NULL DEFAULT 0,
+    upload_count INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day)
+);
+CREATE INDEX IF NOT EXISTS idx_usage_daily_day ON usage_daily(day);
@@ -0,0 +1,20 @@
+-- Migration for databases created before refresh and reset tokens were hashed at rest.
+-- New databases get the final schema straight from init.sql.
+--
+-- The raw tokens are digested so none stay readable, and revoked: the service may hash with TOKEN_HASH_PEPPER,
+-- which a migration can't know, so users log in again and request a new reset link.
+BEGIN;
+
+ALTER TABLE refresh_tokens RENAME COLUMN refresh_token_value TO refresh_token_hash;
+UPDATE refresh_tokens SET refresh_token_hash = encode(sha256(refresh_token_hash::bytea), 'hex'), revoked = TRUE;
+ALTER TABLE refresh_tokens ALTER COLUMN refresh_token_hash TYPE VARCHAR(64);
+
+ALTER TABLE users RENAME COLUMN reset_token TO reset_token_hash;
+UPDATE users SET reset_token_hash = NULL, reset_token_expiry = NULL WHERE reset_token_hash IS NOT NULL;
+ALTER TABLE users ALTER COLUMN reset_token_hash TYPE VARCHAR(64);
+
+DROP INDEX IF EXISTS idx_refresh_tokens_refresh_token_value;
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_refresh_token_hash ON refresh_tokens(refresh_token_hash);
+CREATE INDEX IF NOT EXISTS idx_users_reset_token_hash ON users(reset_token_hash);
+
+COMMIT;
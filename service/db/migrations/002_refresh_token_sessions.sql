@@ -0,0 +1,24 @@
+-- Migration adding session (device) information to refresh tokens.
+-- Rows that existed before get their own session id, so every old login shows up as a separate unknown device.
+BEGIN;
+
+ALTER TABLE refresh_tokens
+    ADD COLUMN IF NOT EXISTS session_id VARCHAR(64),
+    ADD COLUMN IF NOT EXISTS session_label VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS session_created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+UPDATE refresh_tokens
+SET session_id = md5(random()::text || refresh_token_id::text),
+    session_label = 'Unknown device',
+    session_created_at = created_at,
+    last_used_at = created_at
+WHERE session_id IS NULL;
+
+ALTER TABLE refresh_tokens ALTER COLUMN session_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Migration moving access tokens from a shared HS256 secret to rotating asymmetric keys.
+-- The service creates the first key on startup. Access tokens signed with JWT_ACCESS_SECRET stop
+-- validating after the deploy, clients get a new one through /api/v1/user/refresh.
+CREATE TABLE IF NOT EXISTS jwt_signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(16) NOT NULL,
+    encrypted_private_key TEXT NOT NULL, -- pkcs#8 pem sealed with AES-GCM under JWT_KEY_ENCRYPTION_KEY
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    active_from TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- signs from here on, a rotated in key is published in the JWKS first
+    rotated_at TIMESTAMP
+);
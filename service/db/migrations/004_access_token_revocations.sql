@@ -0,0 +1,14 @@
+-- Migration adding the access token denylist.
+CREATE TABLE IF NOT EXISTS access_token_revocations (
+    revocation_id SERIAL PRIMARY KEY,
+    jti VARCHAR(64),
+    user_id INT REFERENCES users(user_id) ON DELETE CASCADE,
+    issued_before TIMESTAMP,
+    reason VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (jti IS NOT NULL OR (user_id IS NOT NULL AND issued_before IS NOT NULL))
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_token_revocations_expires_at ON access_token_revocations(expires_at);
+CREATE INDEX IF NOT EXISTS idx_access_token_revocations_created_at ON access_token_revocations(created_at);
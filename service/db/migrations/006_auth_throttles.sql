@@ -0,0 +1,10 @@
+-- Migration adding brute force throttling for login and password reset.
+CREATE TABLE IF NOT EXISTS auth_throttles (
+    throttle_key VARCHAR(320) PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP,
+    unlock_token_hash VARCHAR(64)
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_throttles_unlock_token_hash ON auth_throttles(unlock_token_hash);
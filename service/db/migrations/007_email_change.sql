@@ -0,0 +1,6 @@
+-- Migration adding confirmed email changes, the new address is parked until the link sent to it is opened.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email VARCHAR(255);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_change_token_hash VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_change_expiry TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_users_email_change_token_hash ON users(email_change_token_hash);
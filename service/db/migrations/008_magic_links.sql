@@ -0,0 +1,6 @@
+-- Migration adding passwordless login by emailed one time link.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS magic_link_token_hash VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS magic_link_nonce_hash VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS magic_link_expiry TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_users_magic_link_token_hash ON users(magic_link_token_hash);
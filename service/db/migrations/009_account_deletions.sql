@@ -0,0 +1,14 @@
+-- Migration adding self-service account deletion with a grace period.
+CREATE TABLE IF NOT EXISTS account_deletions (
+    user_id INT PRIMARY KEY,
+    email VARCHAR(255),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    requested_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    purge_after TIMESTAMP NOT NULL,
+    claimed_at TIMESTAMP,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_deletions_status_purge_after ON account_deletions(status, purge_after);
@@ -0,0 +1,32 @@
+-- Migration adding package history and personal data exports.
+
+-- Every package change, appended by the same statement that changes users.package
+CREATE TABLE IF NOT EXISTS package_history (
+    change_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    package VARCHAR(50) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_package_history_user_id ON package_history(user_id);
+
+-- Personal data exports, the queue for the export worker and the record of the archive in minio
+CREATE TABLE IF NOT EXISTS data_exports (
+    export_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, running, ready, failed, expired
+    object_key VARCHAR(255),
+    size_bytes BIGINT,
+    download_token_hash VARCHAR(64) UNIQUE, -- sha256 hex of the emailed download token
+    error TEXT,
+    requested_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id);
+CREATE INDEX IF NOT EXISTS idx_data_exports_status ON data_exports(status);
+
+-- seed the history with every user's current package so exports aren't empty for existing accounts
+INSERT INTO package_history (user_id, package) SELECT user_id, package FROM users;
@@ -0,0 +1,3 @@
+-- Migration adding roles, every existing account starts as a plain user.
+-- Promote the first admin by hand: UPDATE users SET role = 'admin' WHERE email = '...';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'support', 'admin'));
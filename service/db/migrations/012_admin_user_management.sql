@@ -0,0 +1,15 @@
+-- Migration adding disabled accounts and the audit event table admin actions are recorded in,
+-- no foreign keys so the record outlives a purged account.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_reason VARCHAR(255);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    event_id BIGSERIAL PRIMARY KEY,
+    actor_id INT NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    target_user_id INT NOT NULL,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_target_user_id ON audit_events(target_user_id, created_at);
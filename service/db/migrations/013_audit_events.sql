@@ -0,0 +1,11 @@
+-- Migration extending the audit events from admin actions to every security relevant event, events of anonymous
+-- requests have no actor and the request's client and result are recorded; earlier events were all successful.
+ALTER TABLE audit_events ALTER COLUMN actor_id DROP NOT NULL;
+ALTER TABLE audit_events ALTER COLUMN target_user_id DROP NOT NULL;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS ip_address VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS result VARCHAR(20) NOT NULL DEFAULT 'success';
+ALTER TABLE audit_events ALTER COLUMN result DROP DEFAULT;
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
@@ -0,0 +1,2 @@
+-- Migration adding "remember me" to sessions, existing sessions keep the short refresh lifetime.
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS remember_me BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,56 @@
+-- Migration moving the hardcoded free and premium packages into a plan catalog, and the four storage
+-- columns of users into one storage pool per user and plan.
+CREATE TABLE IF NOT EXISTS plans (
+    plan_id VARCHAR(32) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    tier_rank INT NOT NULL,
+    storage_quota BIGINT NOT NULL,
+    max_file_size BIGINT NOT NULL,
+    features TEXT[] NOT NULL DEFAULT '{}',
+    duration_seconds BIGINT,
+    price_amount BIGINT NOT NULL DEFAULT 0,
+    currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    purchasable BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_plans_default ON plans(is_default) WHERE is_default;
+
+-- the same limits the code used to hardcode
+INSERT INTO plans (plan_id, name, tier_rank, storage_quota, max_file_size, features, duration_seconds, price_amount, currency, is_default, purchasable) VALUES
+    ('free', 'Free', 0, 2097152, 5242880, '{}', NULL, 0, 'USD', TRUE, TRUE),
+    ('premium', 'Premium', 10, 5242880, 5242880, '{priority_support}', 2592000, 499, 'USD', FALSE, TRUE)
+ON CONFLICT (plan_id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS user_storage (
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    plan_id VARCHAR(32) NOT NULL REFERENCES plans(plan_id),
+    storage_used BIGINT NOT NULL DEFAULT 0,
+    storage_limit BIGINT,
+    PRIMARY KEY (user_id, plan_id)
+);
+
+-- limits only become overrides where an admin changed them from the old column defaults
+INSERT INTO user_storage (user_id, plan_id, storage_used, storage_limit)
+SELECT user_id, 'free', COALESCE(free_storage_used, 0), NULLIF(free_storage_limit, 2097152)
+FROM users
+WHERE COALESCE(free_storage_used, 0) <> 0 OR free_storage_limit IS DISTINCT FROM 2097152
+ON CONFLICT (user_id, plan_id) DO NOTHING;
+
+INSERT INTO user_storage (user_id, plan_id, storage_used, storage_limit)
+SELECT user_id, 'premium', COALESCE(premium_storage_used, 0), NULLIF(premium_storage_limit, 5242880)
+FROM users
+WHERE COALESCE(premium_storage_used, 0) <> 0 OR premium_storage_limit IS DISTINCT FROM 5242880
+ON CONFLICT (user_id, plan_id) DO NOTHING;
+
+ALTER TABLE users ALTER COLUMN package TYPE VARCHAR(32);
+ALTER TABLE users ADD CONSTRAINT users_package_fkey FOREIGN KEY (package) REFERENCES plans(plan_id);
+ALTER TABLE files ALTER COLUMN uploaded_with_package TYPE VARCHAR(32);
+ALTER TABLE files ADD CONSTRAINT files_uploaded_with_package_fkey FOREIGN KEY (uploaded_with_package) REFERENCES plans(plan_id);
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS free_storage_used,
+    DROP COLUMN IF EXISTS free_storage_limit,
+    DROP COLUMN IF EXISTS premium_storage_used,
+    DROP COLUMN IF EXISTS premium_storage_limit;
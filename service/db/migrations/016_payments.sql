@@ -0,0 +1,33 @@
+-- Migration adding checkouts and handled payment webhook events, plans are only applied by verified webhooks now.
+CREATE TABLE IF NOT EXISTS checkouts (
+    checkout_id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    plan_id VARCHAR(32) NOT NULL REFERENCES plans(plan_id),
+    provider VARCHAR(32) NOT NULL,
+    provider_session_id VARCHAR(255),
+    provider_payment_id VARCHAR(255), -- set once paid, refund events only name the payment
+    checkout_url TEXT,
+    amount BIGINT NOT NULL, -- copied from the plan when the checkout started
+    refunded_amount BIGINT NOT NULL DEFAULT 0, -- total refunded so far, the checkout is only refunded once it covers amount
+    currency VARCHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'paid', 'failed', 'refunded')),
+    idempotency_key VARCHAR(64) NOT NULL,
+    failure_reason TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    UNIQUE (user_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_checkouts_provider_payment_id ON checkouts(provider, provider_payment_id);
+
+-- Webhook events already handled, a redelivered event finds its row and is skipped
+CREATE TABLE IF NOT EXISTS payment_events (
+    provider VARCHAR(32) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(32) NOT NULL,
+    checkout_id VARCHAR(64), -- set once the event is matched to a checkout, NULL for events that aren't ours
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (provider, event_id)
+);
+CREATE INDEX IF NOT EXISTS idx_payment_events_checkout_id ON payment_events(checkout_id);
@@ -0,0 +1,42 @@
+-- Migration adding subscriptions with trials, renewals, past due and grace periods, users.package and
+-- users.package_expiry now only change together with a subscription.
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS trial_seconds BIGINT;
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    subscription_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    plan_id VARCHAR(32) NOT NULL REFERENCES plans(plan_id),
+    status VARCHAR(20) NOT NULL CHECK (status IN ('trialing', 'active', 'past_due', 'grace', 'canceled', 'expired')),
+    current_period_start TIMESTAMP NOT NULL,
+    current_period_end TIMESTAMP,
+    auto_renew BOOLEAN NOT NULL DEFAULT FALSE,
+    cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+    ended_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_subscriptions_running ON subscriptions(user_id) WHERE status NOT IN ('canceled', 'expired');
+CREATE INDEX IF NOT EXISTS idx_subscriptions_due ON subscriptions(status, current_period_end);
+
+CREATE TABLE IF NOT EXISTS subscription_transitions (
+    transition_id SERIAL PRIMARY KEY,
+    subscription_id INT NOT NULL REFERENCES subscriptions(subscription_id) ON DELETE CASCADE,
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_subscription_transitions_subscription_id ON subscription_transitions(subscription_id);
+
+-- users on another plan than the default keep it until their current expiry, without renewing
+INSERT INTO subscriptions (user_id, plan_id, status, current_period_start, current_period_end, auto_renew)
+SELECT u.user_id, u.package, 'active', CURRENT_TIMESTAMP, u.package_expiry, FALSE
+FROM users u
+JOIN plans p ON p.plan_id = u.package
+WHERE NOT p.is_default
+  AND NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = u.user_id);
+
+INSERT INTO subscription_transitions (subscription_id, from_status, to_status, reason)
+SELECT s.subscription_id, NULL, s.status, 'migrated'
+FROM subscriptions s
+WHERE NOT EXISTS (SELECT 1 FROM subscription_transitions t WHERE t.subscription_id = s.subscription_id);
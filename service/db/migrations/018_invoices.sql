@@ -0,0 +1,31 @@
+-- Migration adding invoices, issued for every successful charge from now on.
+CREATE TABLE IF NOT EXISTS invoices (
+    invoice_id SERIAL PRIMARY KEY,
+    invoice_number VARCHAR(32) GENERATED ALWAYS AS ('INV-' || LPAD(invoice_id::text, 8, '0')) STORED UNIQUE,
+    user_id INT NOT NULL,
+    checkout_id VARCHAR(64) NOT NULL UNIQUE REFERENCES checkouts(checkout_id), -- one invoice per charge, redelivered webhooks don't issue another
+    status VARCHAR(20) NOT NULL CHECK (status IN ('paid', 'refunded')),
+    billing_email VARCHAR(255) NOT NULL, -- copied when issued
+    currency VARCHAR(3) NOT NULL,
+    subtotal BIGINT NOT NULL, -- smallest currency unit, without tax
+    tax_rate_bps INT NOT NULL DEFAULT 0, -- basis points, prices include the tax
+    tax_amount BIGINT NOT NULL DEFAULT 0,
+    total BIGINT NOT NULL, -- what was charged
+    provider VARCHAR(32) NOT NULL,
+    issued_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    refunded_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_invoices_user_id ON invoices(user_id, issued_at);
+CREATE INDEX IF NOT EXISTS idx_invoices_issued_at ON invoices(issued_at);
+
+CREATE TABLE IF NOT EXISTS invoice_lines (
+    line_id SERIAL PRIMARY KEY,
+    invoice_id INT NOT NULL REFERENCES invoices(invoice_id) ON DELETE CASCADE,
+    description VARCHAR(255) NOT NULL,
+    plan_id VARCHAR(32) REFERENCES plans(plan_id),
+    quantity INT NOT NULL DEFAULT 1,
+    unit_amount BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    period_start TIMESTAMP, -- the subscription period the line pays for
+    period_end TIMESTAMP
+);
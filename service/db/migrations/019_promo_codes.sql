@@ -0,0 +1,39 @@
+-- Migration adding promo codes, checkouts remember the code and the discount it gave.
+ALTER TABLE checkouts ADD COLUMN IF NOT EXISTS promo_code VARCHAR(32);
+ALTER TABLE checkouts ADD COLUMN IF NOT EXISTS discount_amount BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS promo_codes (
+    code VARCHAR(32) PRIMARY KEY, -- stored upper case
+    description TEXT NOT NULL DEFAULT '',
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('percent', 'fixed', 'free_days')),
+    percent_off INT CHECK (percent_off BETWEEN 1 AND 99),
+    amount_off BIGINT CHECK (amount_off > 0), -- smallest unit of currency
+    currency VARCHAR(3),
+    free_days INT CHECK (free_days > 0),
+    grant_plan_id VARCHAR(32) REFERENCES plans(plan_id),
+    plan_ids TEXT[] NOT NULL DEFAULT '{}', -- discounts only apply to these plans, empty means every plan
+    max_redemptions INT, -- NULL for no overall limit
+    max_per_user INT NOT NULL DEFAULT 1,
+    valid_from TIMESTAMP,
+    valid_until TIMESTAMP,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Uses of the codes, a checkout's redemption is pending until paid and released if the payment never happens
+CREATE TABLE IF NOT EXISTS promo_redemptions (
+    redemption_id SERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL REFERENCES promo_codes(code),
+    user_id INT NOT NULL,
+    checkout_id VARCHAR(64) UNIQUE, -- NULL for free days, the checkout is written after its redemption
+    plan_id VARCHAR(32) NOT NULL,
+    discount_amount BIGINT NOT NULL DEFAULT 0,
+    currency VARCHAR(3),
+    free_days INT,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'redeemed', 'released')),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    redeemed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_code ON promo_redemptions(code, status);
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_user_id ON promo_redemptions(user_id);
@@ -0,0 +1,5 @@
+-- Migration adding the downgrade policy, pools of a lost plan are stamped by the scheduler and their files archived or locked
+-- once the read only period is over; pools lost before this migration get a fresh read only period from the first run.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
+ALTER TABLE user_storage ADD COLUMN IF NOT EXISTS downgraded_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_user_storage_downgraded_at ON user_storage(downgraded_at) WHERE downgraded_at IS NOT NULL;
@@ -0,0 +1,14 @@
+-- Migration adding usage metering, storage snapshots come from the snapshot-usage scheduler job.
+CREATE TABLE IF NOT EXISTS usage_daily (
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    storage_bytes BIGINT,
+    file_count INT,
+    storage_snapshot_at TIMESTAMP,
+    download_bytes BIGINT NOT NULL DEFAULT 0,
+    upload_bytes BIGINT NOT NULL DEFAULT 0,
+    download_count INT NOT NULL DEFAULT 0,
+    upload_count INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day)
+);
+CREATE INDEX IF NOT EXISTS idx_usage_daily_day ON usage_daily(day);
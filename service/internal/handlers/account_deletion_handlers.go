@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+	"service/internal/logger"
+	"service/internal/services"
+	"service/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AccountDeletionHandler struct {
+	deletionService services.AccountDeletionService
+}
+
+func NewAccountDeletionHandler(deletionService services.AccountDeletionService) *AccountDeletionHandler {
+	return &AccountDeletionHandler{deletionService: deletionService}
+}
+
+func (h *AccountDeletionHandler) RequestDeletionHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized", "error": err.Error()})
+		return
+	}
+
+	var deleteStruct struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&deleteStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	deletion, err := h.deletionService.RequestDeletion(userID, deleteStruct.CurrentPassword, c.ClientIP())
+	if respondIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to delete account", "error": err.Error()})
+		return
+	}
+
+	// every session was revoked, clear this browser's cookies too
+	utils.ClearCookie(c, "access_token")
+	utils.ClearCookie(c, "refresh_token")
+	c.JSON(http.StatusAccepted, gin.H{"message": "Account scheduled for deletion, log in again before it runs to cancel", "deletion": deletion})
+}
+
+func (h *AccountDeletionHandler) GetDeletionHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized", "error": err.Error()})
+		return
+	}
+
+	deletion, err := h.deletionService.GetDeletion(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Failed to get account deletion", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deletion": deletion})
+}
+
+func (h *AccountDeletionHandler) CancelDeletionHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized", "error": err.Error()})
+		return
+	}
+
+	if err := h.deletionService.CancelDeletion(userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to cancel account deletion", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account deletion cancelled"})
+}
+
+// ListPendingDeletionsHandler is the admin view of accounts waiting for or in the middle of a purge
+func (h *AccountDeletionHandler) ListPendingDeletionsHandler(c *gin.Context) {
+	deletions, err := h.deletionService.ListPendingDeletions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list pending deletions", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deletions": deletions})
+}
+
+// PurgeDeletedAccountsHandler handles the cron job request from dkron, the route checks the scheduler token
+func (h *AccountDeletionHandler) PurgeDeletedAccountsHandler(c *gin.Context) {
+	count, err := h.deletionService.PurgeDueAccounts(c.Request.Context())
+	if err != nil {
+		logger.LogError(err, "Failed to purge deleted accounts", map[string]interface{}{"layer": "handler", "operation": "PurgeDeletedAccountsHandler"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge deleted accounts", "message": err.Error()})
+		return
+	}
+
+	logger.Log.Info().Int("purged_count", count).Msg("Account purge completed")
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Account purge completed", "purged_count": count})
+}
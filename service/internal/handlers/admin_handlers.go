@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"net/http"
+	"service/internal/models"
+	"service/internal/services"
+	"service/internal/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminHandler struct {
+	adminService services.AdminService
+	audit        services.AuditLogger
+}
+
+func NewAdminHandler(adminService services.AdminService, audit services.AuditLogger) *AdminHandler {
+	return &AdminHandler{adminService: adminService, audit: audit}
+}
+
+func (h *AdminHandler) SearchUsersHandler(c *gin.Context) {
+	limit, offset := pageFromQuery(c)
+	users, err := h.adminService.SearchUsers(c.Query("q"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to search users", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+func (h *AdminHandler) GetUserHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	user, err := h.adminService.GetUser(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Failed to get user", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+func (h *AdminHandler) OverridePackageHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	var packageStruct struct {
+		Package   string     `json:"package" binding:"required"`
+		ExpiresAt *time.Time `json:"expires_at"` // ignored for the default plan, omit for no expiry
+	}
+	if err := c.ShouldBindJSON(&packageStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.OverridePackage(actor, userID, packageStruct.Package, packageStruct.ExpiresAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to override package", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Package updated"})
+}
+
+func (h *AdminHandler) AdjustStorageLimitHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	var storageStruct struct {
+		Plan         string `json:"plan" binding:"required"`
+		StorageLimit *int64 `json:"storage_limit"` // null goes back to the plan quota
+	}
+	if err := c.ShouldBindJSON(&storageStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.AdjustStorageLimit(actor, userID, storageStruct.Plan, storageStruct.StorageLimit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to update storage limit", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Storage limit updated"})
+}
+
+func (h *AdminHandler) GrantPlanHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	var planStruct struct {
+		Plan      string    `json:"plan" binding:"required"`
+		ExpiresAt time.Time `json:"expires_at" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&planStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.GrantPlan(actor, userID, planStruct.Plan, planStruct.ExpiresAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to grant plan", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Plan granted", "plan": planStruct.Plan, "expires_at": planStruct.ExpiresAt})
+}
+
+func (h *AdminHandler) ReconcileStorageHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	report, err := h.adminService.ReconcileStorage(c.Request.Context(), actor, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to reconcile storage", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Storage reconciled", "reconciliation": report})
+}
+
+func (h *AdminHandler) DisableUserHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	var disableStruct struct {
+		Reason string `json:"reason" binding:"required,max=255"`
+	}
+	if err := c.ShouldBindJSON(&disableStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.DisableUser(actor, userID, disableStruct.Reason); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to disable user", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled"})
+}
+
+func (h *AdminHandler) EnableUserHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.EnableUser(actor, userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to enable user", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User enabled"})
+}
+
+func (h *AdminHandler) RevokeSessionHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.RevokeSession(actor, userID, c.Param("sessionID")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to revoke session", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+func (h *AdminHandler) ForceLogoutHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.ForceLogout(actor, userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to log the user out", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User logged out everywhere"})
+}
+
+func (h *AdminHandler) SetRoleHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	var roleStruct struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&roleStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.SetRole(actor, userID, roleStruct.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to set role", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
+}
+
+func (h *AdminHandler) StartImpersonationHandler(c *gin.Context) {
+	actor, userID, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+
+	var impersonationStruct struct {
+		Reason      string `json:"reason" binding:"required,max=500"`
+		AllowWrites bool   `json:"allow_writes"`
+		NotifyUser  bool   `json:"notify_user"`
+	}
+	if err := c.ShouldBindJSON(&impersonationStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+	if impersonationStruct.AllowWrites && !utils.HasPermission(c, models.PermissionImpersonateWrite) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Missing the " + models.PermissionImpersonateWrite + " permission"})
+		return
+	}
+
+	token, expiresAt, err := h.adminService.StartImpersonation(actor, userID, impersonationStruct.Reason, impersonationStruct.AllowWrites, impersonationStruct.NotifyUser)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to start impersonation", "error": err.Error()})
+		return
+	}
+	// sent as "Authorization: Bearer", not as a cookie, so the admin's own session stays untouched
+	c.JSON(http.StatusOK, gin.H{"message": "Impersonation started", "access_token": token, "expires_at": expiresAt})
+}
+
+// EndImpersonationHandler is called with the impersonation token itself
+func (h *AdminHandler) EndImpersonationHandler(c *gin.Context) {
+	value, _ := c.Get("access_token_claims")
+	claims, ok := value.(*utils.AccessTokenClaims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	if err := h.adminService.EndImpersonation(claims, clientInfoFromContext(c)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to end impersonation", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Impersonation ended"})
+}
+
+// ListAuditLogHandler lists audit events of every user, filtered by ?user_id=, ?actor_id=, ?action= (a trailing dot matches
+// a prefix, e.g. "admin."), ?since= and ?until= (RFC 3339)
+func (h *AdminHandler) ListAuditLogHandler(c *gin.Context) {
+	var filter models.AuditEventFilter
+	var err error
+	if filter.TargetUserID, err = optionalIntQuery(c, "user_id"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if filter.ActorID, err = optionalIntQuery(c, "actor_id"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid actor ID"})
+		return
+	}
+	if filter.Since, err = optionalTimeQuery(c, "since"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, use RFC 3339"})
+		return
+	}
+	if filter.Until, err = optionalTimeQuery(c, "until"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, use RFC 3339"})
+		return
+	}
+	filter.Action = c.Query("action")
+
+	limit, offset := pageFromQuery(c)
+	events, err := h.audit.ListEvents(filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list audit log", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+func optionalIntQuery(c *gin.Context, key string) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func optionalTimeQuery(c *gin.Context, key string) (*time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// Helper function to read ?limit= and ?offset=, anything unparsable falls back to the service defaults
+func pageFromQuery(c *gin.Context) (int, int) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	return limit, offset
+}
+
+// Helper function to read the acting admin from the context and the target user from the path, answers the request itself when either is missing
+func adminTarget(c *gin.Context) (models.AdminActor, int, bool) {
+	actorID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return models.AdminActor{}, 0, false
+	}
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return models.AdminActor{}, 0, false
+	}
+	return models.AdminActor{UserID: actorID, Client: clientInfoFromContext(c)}, userID, true
+}
@@ -1,32 +1,41 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"service/internal/models"
 	"service/internal/services"
 	"service/internal/utils"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
 type UserHandler struct {
-	authService  services.AuthService
-	tokenService services.RefreshTokenService
+	authService       services.AuthService
+	tokenService      services.RefreshTokenService
+	revocationService services.TokenRevocationService
+	throttleService   services.AuthThrottleService
+	audit             services.AuditLogger
 }
 
-func NewUserHandler(authService services.AuthService, tokenService services.RefreshTokenService) *UserHandler {
-	return &UserHandler{authService: authService, tokenService: tokenService}
+func NewUserHandler(authService services.AuthService, tokenService services.RefreshTokenService, revocationService services.TokenRevocationService, throttleService services.AuthThrottleService, audit services.AuditLogger) *UserHandler {
+	return &UserHandler{authService: authService, tokenService: tokenService, revocationService: revocationService, throttleService: throttleService, audit: audit}
 }
 
-func (h *UserHandler) RegisterUserHandler(c *gin.Context) {
-	var userStructThatWantsToRegister models.User
-
-	// check if the password is more than 72 characters (bcrypt limitation)
-	if len(userStructThatWantsToRegister.Password) > 72 {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Password maximum length is 72 characters"})
+// CSRFTokenHandler hands out the token every cookie authenticated POST, PUT and DELETE has to send in the X-CSRF-Token header
+func (h *UserHandler) CSRFTokenHandler(c *gin.Context) {
+	token, err := utils.IssueCSRFToken(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to create csrf token", "error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"csrf_token": token})
+}
+
+func (h *UserHandler) RegisterUserHandler(c *gin.Context) {
+	var userStructThatWantsToRegister models.User
 
 	// bind the json input to the user struct so that it matches the user models
 	if err := c.ShouldBindJSON(&userStructThatWantsToRegister); err != nil {
@@ -35,7 +44,11 @@ func (h *UserHandler) RegisterUserHandler(c *gin.Context) {
 	}
 
 	// call the register user function from the auth service
-	if err := h.authService.RegisterUser(&userStructThatWantsToRegister); err != nil {
+	err := h.authService.RegisterUser(&userStructThatWantsToRegister)
+	if respondIfPasswordRejected(c, err) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to register user", "error": err.Error()})
 		return
 	}
@@ -47,8 +60,10 @@ func (h *UserHandler) RegisterUserHandler(c *gin.Context) {
 func (h *UserHandler) LoginUserHandler(c *gin.Context) {
 	// create a struct to hold the login request that will be sent by the client
 	var loginRequestStruct struct {
-		Email    string `json:"email" binding:"required"`
-		Password string `json:"password" binding:"required"`
+		Email        string `json:"email" binding:"required"`
+		Password     string `json:"password" binding:"required"`
+		SessionLabel string `json:"session_label" binding:"max=100"` // optional device name shown in the sessions list
+		RememberMe   bool   `json:"remember_me"`                     // long refresh lifetime instead of the short one
 	}
 
 	// bind the json input to the login request struct
@@ -58,14 +73,20 @@ func (h *UserHandler) LoginUserHandler(c *gin.Context) {
 	}
 
 	// call the login user function from the auth service
-	accessToken, refreshToken, err := h.authService.LoginUser(loginRequestStruct.Email, loginRequestStruct.Password)
+	client := clientInfoFromContext(c)
+	client.SessionLabel = loginRequestStruct.SessionLabel
+	client.RememberMe = loginRequestStruct.RememberMe
+	tokens, err := h.authService.LoginUser(loginRequestStruct.Email, loginRequestStruct.Password, client)
+	if respondIfThrottled(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to login", "error": err.Error()})
 		return
 	}
 
 	// set the access and refresh token in the cookie
-	if err := utils.SetAccessAndRefresh(c, accessToken, refreshToken); err != nil {
+	if err := utils.SetAccessAndRefresh(c, tokens); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to set cookie", "error": err.Error()})
 		return
 	}
@@ -89,9 +110,19 @@ func (h *UserHandler) LogoutUserHandler(c *gin.Context) {
 		return
 	}
 
+	// the access token would otherwise stay usable until it expires
+	if claims, ok := c.Get("access_token_claims"); ok {
+		accessTokenClaims := claims.(*utils.AccessTokenClaims)
+		if err := h.revocationService.RevokeAccessToken(accessTokenClaims.ID, accessTokenClaims.ExpiresAt.Time, "logout"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to revoke access token", "error": err.Error()})
+			return
+		}
+	}
+
 	// clear cookies after blacklisting the refresh token
 	utils.ClearCookie(c, "access_token")
 	utils.ClearCookie(c, "refresh_token")
+	recordAudit(c, h.audit, models.AuditActionLogout, nil, nil)
 
 	// return a success message and status code 200
 	c.JSON(http.StatusOK, gin.H{"message": "Logout successful"})
@@ -110,20 +141,20 @@ func (h *UserHandler) RefreshTokenHandler(c *gin.Context) {
 	}
 
 	// validate the refresh token and generate a new token pair from the validate refresh token function from the service layer
-	newAccessToken, newRefreshToken, err := h.tokenService.ValidateRefreshToken(refreshToken)
+	tokens, err := h.tokenService.ValidateRefreshToken(refreshToken, clientInfoFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "Failed to validate refresh token", "error": err.Error()})
 		return
 	}
 
 	// set the new access and refresh token in the cookie
-	if err := utils.SetAccessAndRefresh(c, newAccessToken, newRefreshToken); err != nil {
+	if err := utils.SetAccessAndRefresh(c, tokens); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to set cookie after refreshing tokens", "error": err.Error()})
 		return
 	}
 
 	// return a success message and status code 200
-	c.JSON(http.StatusOK, gin.H{"message": "Token refreshed", "newAccessToken": newAccessToken, "newRefreshToken": newRefreshToken})
+	c.JSON(http.StatusOK, gin.H{"message": "Token refreshed", "newAccessToken": tokens.AccessToken, "newRefreshToken": tokens.RefreshToken})
 }
 
 func (h *UserHandler) ValidateUserAndGetInfoHandler(c *gin.Context) {
@@ -149,7 +180,11 @@ func (h *UserHandler) RequestPasswordResetHandler(c *gin.Context) {
 	}
 
 	// call the request password reset function from the auth service
-	if err := h.authService.RequestPasswordReset(emailStruct.Email); err != nil {
+	err := h.authService.RequestPasswordReset(emailStruct.Email, c.ClientIP())
+	if respondIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to request password reset", "error": err.Error()})
 		return
 	}
@@ -158,6 +193,59 @@ func (h *UserHandler) RequestPasswordResetHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Password reset requested, check your spam folder if you receive nothing"})
 }
 
+func (h *UserHandler) RequestMagicLinkHandler(c *gin.Context) {
+	var magicLinkStruct struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&magicLinkStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	nonce, err := h.authService.RequestMagicLink(magicLinkStruct.Email, c.ClientIP())
+	if respondIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to request login link", "error": err.Error()})
+		return
+	}
+
+	// the link only logs in the browser holding this cookie, a forwarded or intercepted email is useless elsewhere
+	utils.SetMagicLinkNonce(c, nonce)
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered, a login link is on its way, open it in this browser"})
+}
+
+func (h *UserHandler) MagicLinkLoginHandler(c *gin.Context) {
+	var consumeStruct struct {
+		LoginToken   string `json:"login_token" binding:"required"`
+		SessionLabel string `json:"session_label" binding:"max=100"`
+		RememberMe   bool   `json:"remember_me"`
+	}
+	if err := c.ShouldBindJSON(&consumeStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	nonce, _ := c.Cookie("magic_link_nonce")
+	client := clientInfoFromContext(c)
+	client.SessionLabel = consumeStruct.SessionLabel
+	client.RememberMe = consumeStruct.RememberMe
+	tokens, err := h.authService.LoginWithMagicLink(consumeStruct.LoginToken, nonce, client)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to login", "error": err.Error()})
+		return
+	}
+
+	utils.ClearCookie(c, "magic_link_nonce")
+	if err := utils.SetAccessAndRefresh(c, tokens); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to set cookie", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful"})
+}
+
 func (h *UserHandler) ResetPasswordHandler(c *gin.Context) {
 	// create a struct to hold the reset token and the new password that will be sent by the client
 	var resetPasswordStruct struct {
@@ -172,7 +260,11 @@ func (h *UserHandler) ResetPasswordHandler(c *gin.Context) {
 	}
 
 	// call the reset password function from the auth service
-	if err := h.authService.ResetPassword(resetPasswordStruct.ResetToken, resetPasswordStruct.NewPassword); err != nil {
+	err := h.authService.ResetPassword(resetPasswordStruct.ResetToken, resetPasswordStruct.NewPassword, c.ClientIP())
+	if respondIfPasswordRejected(c, err) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to reset password", "error": err.Error()})
 		return
 	}
@@ -181,6 +273,103 @@ func (h *UserHandler) ResetPasswordHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Password reset successful"})
 }
 
+func (h *UserHandler) ChangePasswordHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized", "error": err.Error()})
+		return
+	}
+
+	var changePasswordStruct struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&changePasswordStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	err = h.authService.ChangePassword(userID, c.GetString("session_id"), changePasswordStruct.CurrentPassword, changePasswordStruct.NewPassword, c.ClientIP())
+	if respondIfThrottled(c, err) || respondIfPasswordRejected(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to change password", "error": err.Error()})
+		return
+	}
+
+	// every access token was revoked, this device gets a fresh pair in the same session
+	if err := h.rotateCurrentSession(c, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Password changed, please log in again", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully, other devices have been logged out"})
+}
+
+func (h *UserHandler) ChangeEmailHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized", "error": err.Error()})
+		return
+	}
+
+	var changeEmailStruct struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewEmail        string `json:"new_email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&changeEmailStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	err = h.authService.RequestEmailChange(userID, changeEmailStruct.CurrentPassword, changeEmailStruct.NewEmail, c.ClientIP())
+	if respondIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to request email change", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Check the new address for a confirmation link, your email changes once it is confirmed"})
+}
+
+func (h *UserHandler) ConfirmEmailChangeHandler(c *gin.Context) {
+	var confirmStruct struct {
+		ConfirmationToken string `json:"confirmation_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&confirmStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	if err := h.authService.ConfirmEmailChange(confirmStruct.ConfirmationToken); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to confirm email change", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed successfully"})
+}
+
+func (h *UserHandler) UnlockAccountHandler(c *gin.Context) {
+	var unlockStruct struct {
+		UnlockToken string `json:"unlock_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&unlockStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	if err := h.throttleService.UnlockAccount(unlockStruct.UnlockToken, c.ClientIP()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to unlock account", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked, you can log in again"})
+}
+
 func (h *UserHandler) UpgradePackageHandler(c *gin.Context) {
 	userID, err := getUserIDFromContext(c)
 	if err != nil {
@@ -198,29 +387,159 @@ func (h *UserHandler) UpgradePackageHandler(c *gin.Context) {
 		return
 	}
 
-	if req.Package != "free" && req.Package != "premium" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid package type. Must be 'free' or 'premium'."})
+	err = h.authService.UpgradeUserPackage(userID, req.Package)
+	recordAudit(c, h.audit, models.AuditActionPackageChange, err, models.AuditDetails{"package": req.Package})
+	if errors.Is(err, services.ErrUnknownPlan) || errors.Is(err, services.ErrPlanNotAvailable) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid package type, see /api/v1/user/plans for the available plans."})
+		return
+	}
+	if errors.Is(err, services.ErrPaymentRequired) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "This plan has to be paid for, start a checkout at /api/v1/auth/billing/checkout."})
 		return
 	}
-
-	err = h.authService.UpgradeUserPackage(userID, req.Package)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upgrade package: %s", err.Error())})
 		return
 	}
 
-	// after upgrading the package, generate new access and refresh tokens
-	accessToken, refreshToken, err := h.tokenService.GenerateAccessRefreshTokenPair(userID)
-	if err != nil {
+	// after upgrading the package, rotate the current session so the new access token carries the new package
+	if err := h.rotateCurrentSession(c, userID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to generate new tokens: %s", err.Error())})
 		return
 	}
 
-	// set the access and refresh token in the cookie
-	if err := utils.SetAccessAndRefresh(c, accessToken, refreshToken); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to set cookie", "error": err.Error()})
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("User package successfully upgraded to %s", req.Package)})
+}
+
+func (h *UserHandler) ListSessionsHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("User package successfully upgraded to %s", req.Package)})
+	sessions, err := h.tokenService.ListSessions(userID, c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list sessions", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+func (h *UserHandler) RevokeSessionHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	if err := h.tokenService.RevokeSession(userID, c.Param("sessionID")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Failed to revoke session", "error": err.Error()})
+		return
+	}
+
+	// revoking the session we are using is the same as logging out
+	if c.Param("sessionID") == c.GetString("session_id") {
+		utils.ClearCookie(c, "access_token")
+		utils.ClearCookie(c, "refresh_token")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+func (h *UserHandler) RevokeOtherSessionsHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	if err := h.tokenService.RevokeOtherSessions(userID, c.GetString("session_id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to log out other sessions", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all other sessions"})
+}
+
+func (h *UserHandler) ListAuditEventsHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	limit, offset := pageFromQuery(c)
+	events, err := h.audit.ListUserEvents(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list audit events", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// Helper function to record an audit event about the authenticated user, during impersonation the staff member is the actor
+func recordAudit(c *gin.Context, audit services.AuditLogger, action string, err error, details models.AuditDetails) {
+	userID, _ := getUserIDFromContext(c)
+	actorID := userID
+	if impersonatorID, ok := c.Get("impersonator_id"); ok {
+		actorID = impersonatorID.(int)
+	}
+
+	result := models.AuditResultSuccess
+	if err != nil {
+		result = models.AuditResultFailure
+		if details == nil {
+			details = models.AuditDetails{}
+		}
+		details["error"] = err.Error()
+	}
+	audit.Record(models.NewAuditEvent(action, actorID, userID, clientInfoFromContext(c), result, details))
+}
+
+// Helper function to describe the device making the request, stored on the session
+func clientInfoFromContext(c *gin.Context) models.ClientInfo {
+	return models.ClientInfo{
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+}
+
+// Helper function to issue a new token pair in the current session and set the cookies,
+// falls back to a fresh session if the refresh cookie is missing
+func (h *UserHandler) rotateCurrentSession(c *gin.Context, userID int) error {
+	var tokens *models.TokenPair
+	var err error
+	if currentRefreshToken, cookieErr := c.Cookie("refresh_token"); cookieErr == nil && currentRefreshToken != "" {
+		tokens, err = h.tokenService.ValidateRefreshToken(currentRefreshToken, clientInfoFromContext(c))
+	} else {
+		tokens, err = h.tokenService.GenerateAccessRefreshTokenPair(userID, clientInfoFromContext(c))
+	}
+	if err != nil {
+		return err
+	}
+	return utils.SetAccessAndRefresh(c, tokens)
+}
+
+// Helper function to answer 429 with Retry-After when the service refused because of brute force throttling
+func respondIfThrottled(c *gin.Context, err error) bool {
+	var throttled *services.ThrottledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many attempts", "error": throttled.Error()})
+	return true
+}
+
+// Helper function to answer 400 with the structured reasons when the password policy rejected a password
+func respondIfPasswordRejected(c *gin.Context, err error) bool {
+	var rejected *services.PasswordPolicyError
+	if !errors.As(err, &rejected) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"message": "Password does not meet the requirements", "error": rejected.Error(), "reasons": rejected.Violations})
+	return true
 }
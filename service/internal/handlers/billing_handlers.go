@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/services"
+	"service/internal/utils"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhook bodies are small json documents, anything bigger isn't from the provider
+const maxWebhookBodySize = 1 << 20
+
+type BillingHandler struct {
+	billingService services.BillingService
+	subscriptions  services.SubscriptionService
+	invoices       services.InvoiceService
+}
+
+func NewBillingHandler(billingService services.BillingService, subscriptions services.SubscriptionService, invoices services.InvoiceService) *BillingHandler {
+	return &BillingHandler{billingService: billingService, subscriptions: subscriptions, invoices: invoices}
+}
+
+// CreateCheckoutHandler starts paying for a plan, clients should send an Idempotency-Key header so a retried request
+// returns the same checkout instead of opening a second one
+func (h *BillingHandler) CreateCheckoutHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var checkoutStruct struct {
+		Plan      string `json:"plan" binding:"required"`
+		PromoCode string `json:"promo_code"`
+	}
+	if err := c.ShouldBindJSON(&checkoutStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	checkout, err := h.billingService.StartCheckout(c.Request.Context(), userID, checkoutStruct.Plan, checkoutStruct.PromoCode, c.GetHeader("Idempotency-Key"), clientInfoFromContext(c))
+	if errors.Is(err, services.ErrIdempotencyKeyReused) || errors.Is(err, services.ErrPromoCodeUsedUp) || errors.Is(err, services.ErrPromoCodeAlreadyUsed) {
+		c.JSON(http.StatusConflict, gin.H{"message": "Failed to start checkout", "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to start checkout", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"checkout": checkout})
+}
+
+// GetCheckoutHandler lets the success page poll until the webhook has applied the plan
+func (h *BillingHandler) GetCheckoutHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	checkout, err := h.billingService.GetCheckout(userID, c.Param("checkoutID"))
+	if errors.Is(err, services.ErrCheckoutNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to get checkout", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"checkout": checkout})
+}
+
+// PaymentWebhookHandler receives the provider's events, anything but a 2xx makes the provider deliver the event again
+func (h *BillingHandler) PaymentWebhookHandler(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBodySize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+		return
+	}
+
+	if err := h.billingService.HandleWebhook(payload, c.Request.Header); err != nil {
+		if errors.Is(err, services.ErrInvalidWebhookSignature) {
+			logger.Log.Warn().Str("ip", c.ClientIP()).Msg("Payment webhook with invalid signature")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle event"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// GetSubscriptionHandler returns the running subscription with every state it went through
+func (h *BillingHandler) GetSubscriptionHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	subscription, transitions, err := h.subscriptions.GetCurrent(userID)
+	if errors.Is(err, services.ErrNoSubscription) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to get subscription", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": subscription, "transitions": transitions})
+}
+
+// CancelSubscriptionHandler keeps the plan until the current period ends and doesn't renew it after
+func (h *BillingHandler) CancelSubscriptionHandler(c *gin.Context) {
+	h.setCancelAtPeriodEnd(c, true)
+}
+
+// ResumeSubscriptionHandler takes back a cancellation while the period is still running
+func (h *BillingHandler) ResumeSubscriptionHandler(c *gin.Context) {
+	h.setCancelAtPeriodEnd(c, false)
+}
+
+func (h *BillingHandler) setCancelAtPeriodEnd(c *gin.Context, cancel bool) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	subscription, err := h.subscriptions.SetCancelAtPeriodEnd(userID, cancel)
+	if errors.Is(err, services.ErrNoSubscription) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to update subscription", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": subscription})
+}
+
+// SetAutoRenewHandler turns renewals off, without auto renew the subscription expires at the end of the period
+// instead of going past due; nothing charges renewals yet so turning them on is refused
+func (h *BillingHandler) SetAutoRenewHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var autoRenewStruct struct {
+		AutoRenew *bool `json:"auto_renew" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&autoRenewStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	subscription, err := h.subscriptions.SetAutoRenew(userID, *autoRenewStruct.AutoRenew)
+	if errors.Is(err, services.ErrNoSubscription) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, services.ErrAutoRenewUnavailable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to update subscription", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": subscription})
+}
+
+// StartTrialHandler starts the plan's trial, a paid checkout during the trial converts it to an active subscription
+func (h *BillingHandler) StartTrialHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var trialStruct struct {
+		Plan string `json:"plan" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&trialStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	subscription, err := h.subscriptions.StartTrial(userID, trialStruct.Plan)
+	if errors.Is(err, services.ErrSubscriptionRunning) {
+		c.JSON(http.StatusConflict, gin.H{"message": "Failed to start trial", "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to start trial", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"subscription": subscription})
+}
+
+// ListInvoicesHandler is the user's billing history, newest first
+func (h *BillingHandler) ListInvoicesHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	limit, offset := pageFromQuery(c)
+	invoices, err := h.invoices.ListInvoices(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list invoices", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invoices": invoices})
+}
+
+func (h *BillingHandler) GetInvoiceHandler(c *gin.Context) {
+	invoice, ok := h.userInvoice(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invoice": invoice})
+}
+
+// DownloadInvoiceHandler renders the invoice, ?format=html for a printable page and pdf otherwise
+func (h *BillingHandler) DownloadInvoiceHandler(c *gin.Context) {
+	invoice, ok := h.userInvoice(c)
+	if !ok {
+		return
+	}
+	writeInvoice(c, invoice)
+}
+
+// SearchInvoicesHandler lists invoices of every user for finance, with totals per currency and status over the whole filter
+func (h *BillingHandler) SearchInvoicesHandler(c *gin.Context) {
+	var filter models.InvoiceFilter
+	var err error
+	if filter.UserID, err = optionalIntQuery(c, "user_id"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if filter.Since, err = optionalTimeQuery(c, "since"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, use RFC 3339"})
+		return
+	}
+	if filter.Until, err = optionalTimeQuery(c, "until"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, use RFC 3339"})
+		return
+	}
+	filter.Status = c.Query("status")
+
+	limit, offset := pageFromQuery(c)
+	invoices, totals, err := h.invoices.SearchInvoices(filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list invoices", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invoices": invoices, "totals": totals})
+}
+
+func (h *BillingHandler) AdminGetInvoiceHandler(c *gin.Context) {
+	invoice, ok := h.anyInvoice(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invoice": invoice})
+}
+
+func (h *BillingHandler) AdminDownloadInvoiceHandler(c *gin.Context) {
+	invoice, ok := h.anyInvoice(c)
+	if !ok {
+		return
+	}
+	writeInvoice(c, invoice)
+}
+
+// Helper function to load the authenticated user's invoice named in the path, it writes the error response itself
+func (h *BillingHandler) userInvoice(c *gin.Context) (*models.Invoice, bool) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+	invoiceID, err := strconv.Atoi(c.Param("invoiceID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID"})
+		return nil, false
+	}
+
+	invoice, err := h.invoices.GetInvoice(userID, invoiceID)
+	return invoiceResult(c, invoice, err)
+}
+
+func (h *BillingHandler) anyInvoice(c *gin.Context) (*models.Invoice, bool) {
+	invoiceID, err := strconv.Atoi(c.Param("invoiceID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID"})
+		return nil, false
+	}
+
+	invoice, err := h.invoices.GetAnyInvoice(invoiceID)
+	return invoiceResult(c, invoice, err)
+}
+
+func invoiceResult(c *gin.Context, invoice *models.Invoice, err error) (*models.Invoice, bool) {
+	if errors.Is(err, services.ErrInvoiceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to get invoice", "error": err.Error()})
+		return nil, false
+	}
+	return invoice, true
+}
+
+func writeInvoice(c *gin.Context, invoice *models.Invoice) {
+	switch c.DefaultQuery("format", "pdf") {
+	case "html":
+		c.Header("Content-Disposition", "inline; filename=\""+invoice.InvoiceNumber+".html\"")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(utils.RenderInvoiceHTML(invoice)))
+	case "pdf":
+		c.Header("Content-Disposition", "attachment; filename=\""+invoice.InvoiceNumber+".pdf\"")
+		c.Data(http.StatusOK, "application/pdf", utils.RenderInvoicePDF(invoice))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, use pdf or html"})
+	}
+}
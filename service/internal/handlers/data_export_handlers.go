@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"service/internal/logger"
+	"service/internal/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DataExportHandler struct {
+	exportService services.DataExportService
+}
+
+func NewDataExportHandler(exportService services.DataExportService) *DataExportHandler {
+	return &DataExportHandler{exportService: exportService}
+}
+
+func (h *DataExportHandler) RequestExportHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized", "error": err.Error()})
+		return
+	}
+
+	export, err := h.exportService.RequestExport(userID)
+	if err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": "Failed to request data export", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Export started, you will get an email with the download link", "export": export})
+}
+
+func (h *DataExportHandler) ListExportsHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized", "error": err.Error()})
+		return
+	}
+
+	exports, err := h.exportService.ListExports(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list data exports", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"exports": exports})
+}
+
+// DownloadExportHandler serves the archive behind the emailed link, the token is the only credential
+func (h *DataExportHandler) DownloadExportHandler(c *gin.Context) {
+	archive, export, err := h.exportService.OpenExport(c.Param("downloadToken"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Failed to download data export", "error": err.Error()})
+		return
+	}
+	defer archive.Close()
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"dalam-kemasan-export-%d.zip\"", export.ExportID))
+	c.Header("Content-Type", "application/zip")
+	if export.SizeBytes != nil {
+		c.Header("Content-Length", strconv.FormatInt(*export.SizeBytes, 10))
+	}
+	c.Header("Cache-Control", "no-store")
+
+	if _, err := io.Copy(c.Writer, archive); err != nil {
+		logger.LogError(err, "Failed to stream data export", map[string]interface{}{"layer": "handler", "operation": "DownloadExportHandler", "exportID": export.ExportID})
+	}
+}
@@ -1,23 +1,25 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"service/internal/models"
 	"service/internal/services"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
-const maxFileSize = 5 * 1024 * 1024 // 5MB
-
 type FileHandler struct {
 	fileService services.FileService
+	usage       services.UsageService
+	audit       services.AuditLogger
 }
 
-func NewFileHandler(fileService services.FileService) *FileHandler {
-	return &FileHandler{fileService: fileService}
+func NewFileHandler(fileService services.FileService, usage services.UsageService, audit services.AuditLogger) *FileHandler {
+	return &FileHandler{fileService: fileService, usage: usage, audit: audit}
 }
 
 func (h *FileHandler) UploadFileHandler(c *gin.Context) {
@@ -40,17 +42,23 @@ func (h *FileHandler) UploadFileHandler(c *gin.Context) {
 		return
 	}
 
-	if fileHeader.Size > maxFileSize {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File size exceeds the limit of %d bytes", maxFileSize)})
+	fileMetadata, err := h.fileService.UploadFile(c.Request.Context(), userID, fileHeader, currentUserPackage.(string)) // Pass package to service
+	details := models.AuditDetails{"file_name": fileHeader.Filename, "file_size": fileHeader.Size}
+	if fileMetadata != nil {
+		details["file_id"] = fileMetadata.FileID
+	}
+	recordAudit(c, h.audit, models.AuditActionFileUpload, err, details)
+	// the file size limit and the quota come from the user's plan
+	if errors.Is(err, services.ErrFileTooLarge) || errors.Is(err, services.ErrStorageLimitExceeded) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	fileMetadata, err := h.fileService.UploadFile(c.Request.Context(), userID, fileHeader, currentUserPackage.(string)) // Pass package to service
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upload file: %s", err.Error())})
 		return
 	}
 
+	h.usage.RecordUpload(userID, fileMetadata.FileSize)
 	c.JSON(http.StatusCreated, fileMetadata)
 }
 
@@ -76,6 +84,16 @@ func (h *FileHandler) DownloadFileHandler(c *gin.Context) {
 	}
 
 	object, fileMetadata, err := h.fileService.DownloadFile(c.Request.Context(), userID, fileID, currentUserPackage.(string)) // Pass package to service
+	details := models.AuditDetails{"file_id": fileID}
+	if fileMetadata != nil {
+		details["file_name"] = fileMetadata.FileName
+		details["file_size"] = fileMetadata.FileSize
+	}
+	recordAudit(c, h.audit, models.AuditActionFileDownload, err, details)
+	if errors.Is(err, services.ErrFileNotAccessible) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to download file: %s", err.Error())})
 		return
@@ -86,7 +104,9 @@ func (h *FileHandler) DownloadFileHandler(c *gin.Context) {
 	c.Header("Content-Type", fileMetadata.ContentType)
 	c.Header("Content-Length", strconv.FormatInt(fileMetadata.FileSize, 10))
 
-	_, err = io.Copy(c.Writer, object)
+	// bandwidth is what actually went out, an interrupted download counts as far as it got
+	written, err := io.Copy(c.Writer, object)
+	h.usage.RecordDownload(userID, written)
 	if err != nil {
 		// Log error, but headers might have already been sent
 		fmt.Println("Error copying file to response:", err) // Or use your logger
@@ -109,6 +129,11 @@ func (h *FileHandler) DeleteFileHandler(c *gin.Context) {
 	}
 
 	err = h.fileService.DeleteFile(c.Request.Context(), userID, fileID)
+	recordAudit(c, h.audit, models.AuditActionFileDelete, err, models.AuditDetails{"file_id": fileID})
+	if errors.Is(err, services.ErrFileNotAccessible) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete file: %s", err.Error())})
 		return
@@ -149,6 +174,53 @@ func (h *FileHandler) ListFilesHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, files)
 }
 
+// PreviewDowngradeHandler shows which files lose full access when the plan ends, until when they stay read only and what happens next
+func (h *FileHandler) PreviewDowngradeHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	preview, err := h.fileService.PreviewDowngrade(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to preview downgrade"})
+		return
+	}
+
+	c.JSON(http.StatusOK, preview)
+}
+
+// KeepFilesHandler moves files of a lost plan into the current plan's storage, so they stay usable after the read only period
+func (h *FileHandler) KeepFilesHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var keepStruct struct {
+		FileIDs []int `json:"file_ids" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&keepStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	storageInfo, err := h.fileService.KeepFiles(userID, keepStruct.FileIDs)
+	recordAudit(c, h.audit, models.AuditActionFileKeep, err, models.AuditDetails{"file_ids": keepStruct.FileIDs})
+	if errors.Is(err, services.ErrFileNotAffected) || errors.Is(err, services.ErrFileTooLarge) || errors.Is(err, services.ErrStorageLimitExceeded) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to keep files: %s", err.Error())})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Files kept", "storage": storageInfo})
+}
+
 // Helper function to get user ID from context
 func getUserIDFromContext(c *gin.Context) (int, error) {
 	userIDInterface, exists := c.Get("user_id")
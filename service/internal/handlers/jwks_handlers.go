@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"service/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JWKSHandler struct {
+	keyManager services.KeyManagerService
+}
+
+func NewJWKSHandler(keyManager services.KeyManagerService) *JWKSHandler {
+	return &JWKSHandler{keyManager: keyManager}
+}
+
+// GetJWKSHandler publishes the public keys so other services can verify our access tokens without sharing a secret
+func (h *JWKSHandler) GetJWKSHandler(c *gin.Context) {
+	// short cache, a new key is published for longer than this before it signs anything
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(services.JWKSCacheMaxAge/time.Second)))
+	c.JSON(http.StatusOK, gin.H{"keys": h.keyManager.JWKS()})
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"service/internal/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type NotificationHandler struct {
+	notifications services.NotificationService
+}
+
+func NewNotificationHandler(notifications services.NotificationService) *NotificationHandler {
+	return &NotificationHandler{notifications: notifications}
+}
+
+// AdminListNotificationsHandler shows support which lifecycle emails a user was sent and how each delivery went
+func (h *NotificationHandler) AdminListNotificationsHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	limit, offset := pageFromQuery(c)
+	notifications, err := h.notifications.ListNotifications(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list notifications", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications})
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"service/internal/models"
+	"service/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PlanHandler struct {
+	plans services.PlanCatalog
+	audit services.AuditLogger
+}
+
+func NewPlanHandler(plans services.PlanCatalog, audit services.AuditLogger) *PlanHandler {
+	return &PlanHandler{plans: plans, audit: audit}
+}
+
+// ListPlansHandler lists the plans users can buy, public so the pricing page needs no session
+func (h *PlanHandler) ListPlansHandler(c *gin.Context) {
+	plans, err := h.plans.ListPlans(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list plans", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// AdminListPlansHandler lists every plan, including the ones only admins can grant
+func (h *PlanHandler) AdminListPlansHandler(c *gin.Context) {
+	plans, err := h.plans.ListPlans(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list plans", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// SavePlanHandler creates or replaces the plan with the id from the path, users already on it pick up the new limits
+func (h *PlanHandler) SavePlanHandler(c *gin.Context) {
+	var planStruct struct {
+		Name            string   `json:"name" binding:"required"`
+		TierRank        int      `json:"tier_rank"`
+		StorageQuota    int64    `json:"storage_quota"`
+		MaxFileSize     int64    `json:"max_file_size" binding:"required"`
+		Features        []string `json:"features"`
+		DurationSeconds *int64   `json:"duration_seconds"` // omit for a plan that doesn't expire
+		TrialSeconds    *int64   `json:"trial_seconds"`    // omit for a plan without a trial
+		PriceAmount     int64    `json:"price_amount"`
+		Currency        string   `json:"currency" binding:"required"`
+		IsDefault       bool     `json:"is_default"`
+		Purchasable     bool     `json:"purchasable"`
+	}
+	if err := c.ShouldBindJSON(&planStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	plan := &models.Plan{
+		PlanID:          c.Param("planID"),
+		Name:            planStruct.Name,
+		TierRank:        planStruct.TierRank,
+		StorageQuota:    planStruct.StorageQuota,
+		MaxFileSize:     planStruct.MaxFileSize,
+		Features:        planStruct.Features,
+		DurationSeconds: planStruct.DurationSeconds,
+		TrialSeconds:    planStruct.TrialSeconds,
+		PriceAmount:     planStruct.PriceAmount,
+		Currency:        planStruct.Currency,
+		IsDefault:       planStruct.IsDefault,
+		Purchasable:     planStruct.Purchasable,
+	}
+	err := h.plans.SavePlan(plan)
+	recordAudit(c, h.audit, models.AuditActionAdminPrefix+"plan_saved", err, models.AuditDetails{"plan": plan.PlanID})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to save plan", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Plan saved", "plan": plan})
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"service/internal/models"
+	"service/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PromoHandler struct {
+	promos services.PromoService
+	audit  services.AuditLogger
+}
+
+func NewPromoHandler(promos services.PromoService, audit services.AuditLogger) *PromoHandler {
+	return &PromoHandler{promos: promos, audit: audit}
+}
+
+// RedeemPromoCodeHandler applies a free days code right away, discount codes are entered at checkout instead
+func (h *PromoHandler) RedeemPromoCodeHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var redeemStruct struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&redeemStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	redemption, subscription, err := h.promos.Redeem(userID, redeemStruct.Code)
+	recordAudit(c, h.audit, models.AuditActionPromoRedeemed, err, models.AuditDetails{"code": services.NormalizePromoCode(redeemStruct.Code)})
+	if errors.Is(err, services.ErrPromoCodeUsedUp) || errors.Is(err, services.ErrPromoCodeAlreadyUsed) || errors.Is(err, services.ErrSubscriptionRunning) {
+		c.JSON(http.StatusConflict, gin.H{"message": "Failed to redeem code", "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to redeem code", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Code redeemed", "redemption": redemption, "subscription": subscription})
+}
+
+func (h *PromoHandler) ListPromoCodesHandler(c *gin.Context) {
+	limit, offset := pageFromQuery(c)
+	promos, err := h.promos.ListCodes(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list promo codes", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"promo_codes": promos})
+}
+
+func (h *PromoHandler) GetPromoCodeHandler(c *gin.Context) {
+	promo, err := h.promos.GetCode(c.Param("code"))
+	if errors.Is(err, services.ErrPromoCodeNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to get promo code", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"promo_code": promo})
+}
+
+// SavePromoCodeHandler creates or replaces the code from the path, deactivating a code is saving it with active false
+func (h *PromoHandler) SavePromoCodeHandler(c *gin.Context) {
+	var promoStruct struct {
+		Description    string     `json:"description"`
+		Kind           string     `json:"kind" binding:"required"`
+		PercentOff     *int       `json:"percent_off"`
+		AmountOff      *int64     `json:"amount_off"`
+		Currency       *string    `json:"currency"`
+		FreeDays       *int       `json:"free_days"`
+		GrantPlanID    *string    `json:"grant_plan_id"`
+		PlanIDs        []string   `json:"plan_ids"`        // omit to allow every plan
+		MaxRedemptions *int       `json:"max_redemptions"` // omit for no overall limit
+		MaxPerUser     *int       `json:"max_per_user"`    // defaults to 1
+		ValidFrom      *time.Time `json:"valid_from"`
+		ValidUntil     *time.Time `json:"valid_until"`
+		Active         *bool      `json:"active"` // defaults to true
+	}
+	if err := c.ShouldBindJSON(&promoStruct); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid input", "error": err.Error()})
+		return
+	}
+
+	promo := &models.PromoCode{
+		Code:           c.Param("code"),
+		Description:    promoStruct.Description,
+		Kind:           promoStruct.Kind,
+		PercentOff:     promoStruct.PercentOff,
+		AmountOff:      promoStruct.AmountOff,
+		Currency:       promoStruct.Currency,
+		FreeDays:       promoStruct.FreeDays,
+		GrantPlanID:    promoStruct.GrantPlanID,
+		PlanIDs:        promoStruct.PlanIDs,
+		MaxRedemptions: promoStruct.MaxRedemptions,
+		MaxPerUser:     1,
+		ValidFrom:      promoStruct.ValidFrom,
+		ValidUntil:     promoStruct.ValidUntil,
+		Active:         true,
+	}
+	if promoStruct.MaxPerUser != nil {
+		promo.MaxPerUser = *promoStruct.MaxPerUser
+	}
+	if promoStruct.Active != nil {
+		promo.Active = *promoStruct.Active
+	}
+	err := h.promos.SaveCode(promo)
+	recordAudit(c, h.audit, models.AuditActionAdminPrefix+"promo_code_saved", err, models.AuditDetails{"code": promo.Code, "kind": promo.Kind, "active": promo.Active})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Failed to save promo code", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Promo code saved", "promo_code": promo})
+}
+
+// DeletePromoCodeHandler removes a code nobody used, used codes are kept for the reports
+func (h *PromoHandler) DeletePromoCodeHandler(c *gin.Context) {
+	code := services.NormalizePromoCode(c.Param("code"))
+	err := h.promos.DeleteCode(code)
+	recordAudit(c, h.audit, models.AuditActionAdminPrefix+"promo_code_deleted", err, models.AuditDetails{"code": code})
+	if errors.Is(err, services.ErrPromoCodeNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, services.ErrPromoCodeInUse) {
+		c.JSON(http.StatusConflict, gin.H{"message": "Failed to delete promo code", "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to delete promo code", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Promo code deleted"})
+}
+
+func (h *PromoHandler) ListRedemptionsHandler(c *gin.Context) {
+	limit, offset := pageFromQuery(c)
+	redemptions, err := h.promos.ListRedemptions(c.Param("code"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to list redemptions", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redemptions": redemptions})
+}
+
+// PromoReportHandler sums the redeemed uses of every code, optionally between since and until
+func (h *PromoHandler) PromoReportHandler(c *gin.Context) {
+	since, err := optionalTimeQuery(c, "since")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, use RFC 3339"})
+		return
+	}
+	until, err := optionalTimeQuery(c, "until")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, use RFC 3339"})
+		return
+	}
+
+	report, err := h.promos.Report(since, until)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to report redemptions", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
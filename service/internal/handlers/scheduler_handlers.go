@@ -10,24 +10,20 @@ import (
 
 type SchedulerHandler struct {
 	schedulerService services.SchedulerService
+	throttleService  services.AuthThrottleService
+	audit            services.AuditLogger
 }
 
-func NewSchedulerHandler(schedulerService services.SchedulerService) *SchedulerHandler {
+func NewSchedulerHandler(schedulerService services.SchedulerService, throttleService services.AuthThrottleService, audit services.AuditLogger) *SchedulerHandler {
 	return &SchedulerHandler{
 		schedulerService: schedulerService,
+		throttleService:  throttleService,
+		audit:            audit,
 	}
 }
 
-// CheckExpiredPackagesHandler handles the cron job request from dkron
+// CheckExpiredPackagesHandler handles the cron job request from dkron, the scheduler routes check the scheduler token
 func (h *SchedulerHandler) CheckExpiredPackagesHandler(c *gin.Context) {
-	// Verify the request is coming from dkron (optional security measure)
-	userAgent := c.GetHeader("User-Agent")
-	if userAgent != "Dkron" && userAgent != "curl/7.68.0" && userAgent != "Go-http-client/1.1" && userAgent != "" {
-		logger.Log.Warn().Str("user_agent", userAgent).Msg("Unauthorized scheduler request")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
-	}
-
 	logger.Log.Info().Msg("Starting package expiration check via dkron")
 
 	count, err := h.schedulerService.CheckAndDowngradeExpiredPackages()
@@ -58,3 +54,52 @@ func (h *SchedulerHandler) CheckExpiredPackagesHandler(c *gin.Context) {
 		},
 	})
 }
+
+// PruneAuditEventsHandler handles the cron job request from dkron that enforces the audit retention period
+func (h *SchedulerHandler) PruneAuditEventsHandler(c *gin.Context) {
+	count, err := h.audit.PruneExpiredEvents()
+	if err != nil {
+		logger.LogError(err, "Failed to prune audit events", map[string]interface{}{"layer": "handler", "operation": "PruneAuditEventsHandler"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prune audit events", "message": err.Error()})
+		return
+	}
+
+	logger.Log.Info().Int64("pruned_count", count).Msg("Audit event pruning completed")
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Audit event pruning completed", "pruned_count": count})
+}
+
+// PruneAuthThrottlesHandler handles the cron job request from dkron that deletes stale login and reset throttle counters
+func (h *SchedulerHandler) PruneAuthThrottlesHandler(c *gin.Context) {
+	count, err := h.throttleService.PruneStaleThrottles()
+	if err != nil {
+		logger.LogError(err, "Failed to prune auth throttles", map[string]interface{}{"layer": "handler", "operation": "PruneAuthThrottlesHandler"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prune auth throttles", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Auth throttle pruning completed", "pruned_count": count})
+}
+
+// SendNotificationsHandler handles the cron job request from dkron that queues the expiry reminders and sends the lifecycle emails
+func (h *SchedulerHandler) SendNotificationsHandler(c *gin.Context) {
+	count, err := h.schedulerService.SendNotifications()
+	if err != nil {
+		logger.LogError(err, "Failed to send notifications", map[string]interface{}{"layer": "handler", "operation": "SendNotificationsHandler"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send notifications", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Notifications sent", "sent_count": count})
+}
+
+// SnapshotUsageHandler handles the cron job request from dkron that records the storage of every user for the day
+func (h *SchedulerHandler) SnapshotUsageHandler(c *gin.Context) {
+	count, err := h.schedulerService.SnapshotUsage()
+	if err != nil {
+		logger.LogError(err, "Failed to snapshot usage", map[string]interface{}{"layer": "handler", "operation": "SnapshotUsageHandler"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to snapshot usage", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Usage snapshot completed", "snapshot_count": count})
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"service/internal/services"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UsageHandler struct {
+	usage services.UsageService
+}
+
+func NewUsageHandler(usage services.UsageService) *UsageHandler {
+	return &UsageHandler{usage: usage}
+}
+
+// GetUsageHandler returns the caller's storage and bandwidth per day, the last 30 days unless since and until say otherwise
+func (h *UsageHandler) GetUsageHandler(c *gin.Context) {
+	userID, err := getUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	h.respondUsage(c, userID)
+}
+
+// AdminGetUserUsageHandler returns a user's usage per day for support
+func (h *UsageHandler) AdminGetUserUsageHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	h.respondUsage(c, userID)
+}
+
+func (h *UsageHandler) respondUsage(c *gin.Context, userID int) {
+	since, until, ok := usageRangeFromQuery(c)
+	if !ok {
+		return
+	}
+	usage, err := h.usage.GetUserUsage(userID, since, until)
+	if errors.Is(err, services.ErrInvalidUsageRange) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to get usage", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// UsageReportHandler sums the usage of every user per day and lists the heaviest users, paged with limit and offset
+func (h *UsageHandler) UsageReportHandler(c *gin.Context) {
+	since, until, ok := usageRangeFromQuery(c)
+	if !ok {
+		return
+	}
+	limit, offset := pageFromQuery(c)
+	report, err := h.usage.Report(since, until, limit, offset)
+	if errors.Is(err, services.ErrInvalidUsageRange) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to report usage", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
+
+// Helper function to read ?since= and ?until=, answers the request itself when either is invalid
+func usageRangeFromQuery(c *gin.Context) (*time.Time, *time.Time, bool) {
+	since, err := optionalTimeQuery(c, "since")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, use RFC 3339"})
+		return nil, nil, false
+	}
+	until, err := optionalTimeQuery(c, "until")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, use RFC 3339"})
+		return nil, nil, false
+	}
+	return since, until, true
+}
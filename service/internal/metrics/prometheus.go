@@ -21,9 +21,29 @@ var (
 		},
 		[]string{"method", "path"},
 	)
+
+	AuthFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "auth_service",
+			Name:      "auth_failures_total",
+			Help:      "Failed login and throttled password reset attempts",
+		},
+		[]string{"action", "reason"},
+	)
+
+	AuthLockouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "auth_service",
+			Name:      "auth_lockouts_total",
+			Help:      "Temporary lockouts caused by repeated failures",
+		},
+		[]string{"action", "scope"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(HTTPReqs)
 	prometheus.MustRegister(HTTPDur)
+	prometheus.MustRegister(AuthFailures)
+	prometheus.MustRegister(AuthLockouts)
 }
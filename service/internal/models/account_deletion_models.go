@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// account deletion states, a deletion stays "purging" until every step succeeded so an interrupted purge is picked up again
+const (
+	AccountDeletionPending   = "pending"
+	AccountDeletionPurging   = "purging"
+	AccountDeletionCompleted = "completed"
+)
+
+// AccountDeletion outlives the users row it points to, the email is kept only until the confirmation is sent
+type AccountDeletion struct {
+	UserID      int        `db:"user_id" json:"user_id"`
+	Email       *string    `db:"email" json:"email,omitempty"`
+	Status      string     `db:"status" json:"status"`
+	RequestedAt time.Time  `db:"requested_at" json:"requested_at"`
+	PurgeAfter  time.Time  `db:"purge_after" json:"purge_after"`
+	ClaimedAt   *time.Time `db:"claimed_at" json:"-"`
+	Attempts    int        `db:"attempts" json:"attempts"`
+	LastError   *string    `db:"last_error" json:"last_error,omitempty"`
+	CompletedAt *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// AdminUserView is what admin routes show about a user, never the password hash or pending tokens
+type AdminUserView struct {
+	UserID         int          `json:"user_id"`
+	Email          string       `json:"email"`
+	Username       string       `json:"username"`
+	Role           string       `json:"role"`
+	Package        string       `json:"package"`
+	PackageExpiry  *time.Time   `json:"package_expiry"`
+	DisabledAt     *time.Time   `json:"disabled_at"`
+	DisabledReason *string      `json:"disabled_reason"`
+	Storage        *UserStorage `json:"storage"`
+	Sessions       []*Session   `json:"sessions"`
+	Files          []*File      `json:"files"`
+}
+
+func NewAdminUserView(user *User, storage *UserStorage, sessions []*Session, files []*File) *AdminUserView {
+	return &AdminUserView{
+		UserID:         user.UserID,
+		Email:          user.Email,
+		Username:       user.Username,
+		Role:           user.Role,
+		Package:        user.Package,
+		PackageExpiry:  user.PackageExpiry,
+		DisabledAt:     user.DisabledAt,
+		DisabledReason: user.DisabledReason,
+		Storage:        storage,
+		Sessions:       sessions,
+		Files:          files,
+	}
+}
+
+// AdminUserSummary is one row of the admin user search
+type AdminUserSummary struct {
+	UserID        int        `db:"user_id" json:"user_id"`
+	Email         string     `db:"email" json:"email"`
+	Username      string     `db:"username" json:"username"`
+	Role          string     `db:"role" json:"role"`
+	Package       string     `db:"package" json:"package"`
+	PackageExpiry *time.Time `db:"package_expiry" json:"package_expiry"`
+	DisabledAt    *time.Time `db:"disabled_at" json:"disabled_at"`
+}
+
+// StorageReconciliation reports what reconciling one user's storage found and changed,
+// usage is recalculated from the file rows, objects without a row and rows without an object are only reported
+type StorageReconciliation struct {
+	UserID            int              `json:"user_id"`
+	StorageUsedBefore map[string]int64 `json:"storage_used_before"` // by plan
+	StorageUsedAfter  map[string]int64 `json:"storage_used_after"`
+	MissingObjects    []string         `json:"missing_objects"`
+	OrphanedObjects   []string         `json:"orphaned_objects"`
+}
+
+// AdminActor is the admin performing an action and the client they did it from, both go into the audit log
+type AdminActor struct {
+	UserID int
+	Client ClientInfo
+}
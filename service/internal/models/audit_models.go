@@ -0,0 +1,107 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// audit event results
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+	AuditResultDenied  = "denied" // refused before it was tried, e.g. throttled or blocked while impersonating
+)
+
+// audit event actions, admin actions are recorded as "admin." followed by the admin action
+const (
+	AuditActionLogin                  = "login"
+	AuditActionLogout                 = "logout"
+	AuditActionTokenRefresh           = "token_refresh"
+	AuditActionTokenReuse             = "token_reuse"
+	AuditActionPasswordResetRequested = "password_reset_requested"
+	AuditActionPasswordReset          = "password_reset"
+	AuditActionPasswordChange         = "password_change"
+	AuditActionAccountLockout         = "account_lockout"
+	AuditActionAccountUnlock          = "account_unlock"
+	AuditActionPackageChange          = "package_change"
+	AuditActionFileUpload             = "file_upload"
+	AuditActionFileDownload           = "file_download"
+	AuditActionFileDelete             = "file_delete"
+	AuditActionFileKeep               = "file_keep"
+	AuditActionDeletionRequested      = "account_deletion_requested"
+	AuditActionDeletionCancelled      = "account_deletion_cancelled"
+	AuditActionAccountPurged          = "account_purged"
+	AuditActionDataExportReady        = "data_export_ready"
+	AuditActionCheckoutStarted        = "checkout_started"
+	AuditActionPaymentSucceeded       = "payment_succeeded"
+	AuditActionPaymentFailed          = "payment_failed"
+	AuditActionPaymentRefunded        = "payment_refunded"
+	AuditActionPromoRedeemed          = "promo_redeemed"
+	AuditActionAdminPrefix            = "admin."
+)
+
+// AuditEvent is one row of audit_events, ActorID is nil for anonymous requests and the scheduler
+type AuditEvent struct {
+	EventID      int64        `db:"event_id" json:"event_id"`
+	ActorID      *int         `db:"actor_id" json:"actor_id"`
+	Action       string       `db:"action" json:"action"`
+	TargetUserID *int         `db:"target_user_id" json:"target_user_id"`
+	IPAddress    string       `db:"ip_address" json:"ip_address"`
+	UserAgent    string       `db:"user_agent" json:"user_agent"`
+	Result       string       `db:"result" json:"result"`
+	Details      AuditDetails `db:"details" json:"details"`
+	CreatedAt    time.Time    `db:"created_at" json:"created_at"`
+}
+
+// AuditDetails is stored as jsonb, it never holds passwords or raw tokens
+type AuditDetails map[string]interface{}
+
+func (d AuditDetails) Value() (driver.Value, error) {
+	if d == nil {
+		return "{}", nil
+	}
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+func (d *AuditDetails) Scan(value interface{}) error {
+	if value == nil {
+		*d = AuditDetails{}
+		return nil
+	}
+	raw, ok := value.([]byte)
+	if !ok {
+		text, isText := value.(string)
+		if !isText {
+			return errors.New("audit details must be json")
+		}
+		raw = []byte(text)
+	}
+	return json.Unmarshal(raw, d)
+}
+
+// AuditEventFilter narrows the admin listing, zero values don't filter
+type AuditEventFilter struct {
+	TargetUserID int
+	ActorID      int
+	Action       string
+	Since        *time.Time
+	Until        *time.Time
+}
+
+// NewAuditEvent fills an event in, an actorID or targetUserID of 0 is stored as null
+func NewAuditEvent(action string, actorID, targetUserID int, client ClientInfo, result string, details AuditDetails) *AuditEvent {
+	event := &AuditEvent{Action: action, IPAddress: client.IPAddress, UserAgent: client.UserAgent, Result: result, Details: details}
+	if actorID != 0 {
+		event.ActorID = &actorID
+	}
+	if targetUserID != 0 {
+		event.TargetUserID = &targetUserID
+	}
+	return event
+}
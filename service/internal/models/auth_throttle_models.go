@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// AuthThrottle counts recent failures for one throttle key, e.g. "login:account:<email>" or "login:ip:<ip>"
+type AuthThrottle struct {
+	ThrottleKey     string     `db:"throttle_key" json:"throttle_key"`
+	Failures        int        `db:"failures" json:"failures"`
+	LastFailureAt   time.Time  `db:"last_failure_at" json:"last_failure_at"`
+	LockedUntil     *time.Time `db:"locked_until" json:"locked_until"`
+	UnlockTokenHash *string    `db:"unlock_token_hash" json:"-"`
+}
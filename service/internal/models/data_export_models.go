@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// data export states, pending exports are picked up by the export worker
+const (
+	DataExportPending = "pending"
+	DataExportRunning = "running"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+	DataExportExpired = "expired"
+)
+
+type DataExport struct {
+	ExportID          int        `db:"export_id" json:"export_id"`
+	UserID            int        `db:"user_id" json:"-"`
+	Status            string     `db:"status" json:"status"`
+	ObjectKey         *string    `db:"object_key" json:"-"`
+	SizeBytes         *int64     `db:"size_bytes" json:"size_bytes,omitempty"`
+	DownloadTokenHash *string    `db:"download_token_hash" json:"-"`
+	Error             *string    `db:"error" json:"error,omitempty"`
+	RequestedAt       time.Time  `db:"requested_at" json:"requested_at"`
+	StartedAt         *time.Time `db:"started_at" json:"-"`
+	CompletedAt       *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+	ExpiresAt         *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+}
+
+// PackageChange is one row of a user's package history
+type PackageChange struct {
+	Package   string    `db:"package" json:"package"`
+	ChangedAt time.Time `db:"changed_at" json:"changed_at"`
+}
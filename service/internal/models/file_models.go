@@ -11,12 +11,94 @@ type File struct {
 	ContentType         string    `db:"content_type" json:"content_type" binding:"required"`
 	UploadedWithPackage string    `db:"uploaded_with_package" json:"uploaded_with_package"`
 	CreatedAt           time.Time `db:"created_at" json:"created_at"`
+	// ArchivedAt is set once the file was moved to the archive prefix after a downgrade, S3ObjectKey then points there
+	ArchivedAt *time.Time `db:"archived_at" json:"archived_at,omitempty"`
+	// Access and ReadOnlyUntil are worked out from the user's plan when the file is listed
+	Access        string     `db:"-" json:"access,omitempty"`
+	ReadOnlyUntil *time.Time `db:"-" json:"read_only_until,omitempty"`
 }
 
+// what a user can do with a file, files of a plan they lost are read only for a while and then archived or locked
+const (
+	FileAccessFull     = "full"
+	FileAccessReadOnly = "read_only" // download and delete only
+	FileAccessLocked   = "locked"    // listed to be kept or deleted, no download
+	FileAccessArchived = "archived"  // hidden until the user is back on the plan
+)
+
+// downgrade policies, what happens to the files of a lost plan once they were read only long enough
+const (
+	DowngradeArchive = "archive" // move them to the archive prefix and hide them
+	DowngradeChoose  = "choose"  // lock them until the user keeps some within their quota and deletes the rest
+)
+
+// StoragePool is the usage of one plan's storage, files count against the pool of the plan they were uploaded on
+type StoragePool struct {
+	PlanID          string `json:"plan_id" db:"plan_id"`
+	StorageUsed     int64  `json:"storage_used" db:"storage_used"`
+	StorageLimit    int64  `json:"storage_limit" db:"storage_limit"`       // the plan quota unless an admin overrode it
+	LimitOverridden bool   `json:"limit_overridden" db:"limit_overridden"` // the limit was set for this user by an admin
+	// DowngradedAt is when the user lost the pool's plan, nil while they have it
+	DowngradedAt *time.Time `json:"downgraded_at,omitempty" db:"downgraded_at"`
+}
+
+// UserStorage lists the pools the user has files in plus the pool of their current plan
 type UserStorage struct {
-	UserID              int   `json:"user_id" db:"user_id"`
-	FreeStorageUsed     int64 `json:"free_storage_used" db:"free_storage_used"`
-	FreeStorageLimit    int64 `json:"free_storage_limit" db:"free_storage_limit"`
-	PremiumStorageUsed  int64 `json:"premium_storage_used" db:"premium_storage_used"`
-	PremiumStorageLimit int64 `json:"premium_storage_limit" db:"premium_storage_limit"`
+	UserID int            `json:"user_id"`
+	Pools  []*StoragePool `json:"pools"`
+}
+
+// Pool returns the pool of the plan, nil when the user has none
+func (s *UserStorage) Pool(planID string) *StoragePool {
+	for _, pool := range s.Pools {
+		if pool.PlanID == planID {
+			return pool
+		}
+	}
+	return nil
+}
+
+// UsedByPlan maps each plan to its usage, for audit records and reports
+func (s *UserStorage) UsedByPlan() map[string]int64 {
+	used := make(map[string]int64, len(s.Pools))
+	for _, pool := range s.Pools {
+		used[pool.PlanID] = pool.StorageUsed
+	}
+	return used
+}
+
+// DowngradePreview tells the user what happens to their files when they lose their plan, or what is happening since they did
+type DowngradePreview struct {
+	CurrentPlan string `json:"current_plan"`
+	TargetPlan  string `json:"target_plan"`
+	// DowngradeAt is when the plan ends, nil when it doesn't end on its own and the preview assumes it ended now
+	DowngradeAt           *time.Time              `json:"downgrade_at"`
+	Policy                string                  `json:"policy"`
+	ReadOnlyPeriodSeconds int64                   `json:"read_only_period_seconds"`
+	TargetStorageLimit    int64                   `json:"target_storage_limit"`
+	TargetStorageFree     int64                   `json:"target_storage_free"` // room for files the user keeps
+	AffectedSize          int64                   `json:"affected_size"`
+	Files                 []*DowngradePreviewFile `json:"files"`
+}
+
+// DowngradePreviewFile is one file the downgrade affects
+type DowngradePreviewFile struct {
+	FileID        int        `json:"file_id"`
+	FileName      string     `json:"file_name"`
+	FileSize      int64      `json:"file_size"`
+	PlanID        string     `json:"plan_id"`
+	Access        string     `json:"access"` // right now
+	ReadOnlyUntil *time.Time `json:"read_only_until"`
+	Outcome       string     `json:"outcome"`  // access once the read only period is over, archived or locked
+	Keepable      bool       `json:"keepable"` // small enough for the target plan, if there is room
+}
+
+// DowngradedPool is a pool the scheduler found the user lost the plan of, with what the downgrade notice tells them
+type DowngradedPool struct {
+	UserID        int       `db:"user_id"`
+	PlanID        string    `db:"plan_id"`
+	DowngradedAt  time.Time `db:"downgraded_at"`
+	ReadOnlyUntil time.Time `db:"-"`
+	Outcome       string    `db:"-"`
+	Files         []string  `db:"-"` // names of the pool's files
 }
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// invoice states, an invoice is only issued once the payment went through
+const (
+	InvoicePaid     = "paid"
+	InvoiceRefunded = "refunded"
+)
+
+// Invoice is issued for every successful charge, amounts are in the smallest currency unit and prices include the tax
+type Invoice struct {
+	InvoiceID     int            `db:"invoice_id" json:"invoice_id"`
+	InvoiceNumber string         `db:"invoice_number" json:"invoice_number"`
+	UserID        int            `db:"user_id" json:"user_id"`
+	CheckoutID    string         `db:"checkout_id" json:"checkout_id"`
+	Status        string         `db:"status" json:"status"`
+	BillingEmail  string         `db:"billing_email" json:"billing_email"` // copied when issued, later email changes don't rewrite old invoices
+	Currency      string         `db:"currency" json:"currency"`
+	Subtotal      int64          `db:"subtotal" json:"subtotal"`
+	TaxRateBps    int            `db:"tax_rate_bps" json:"tax_rate_bps"` // basis points, 1100 is 11%
+	TaxAmount     int64          `db:"tax_amount" json:"tax_amount"`
+	Total         int64          `db:"total" json:"total"`
+	Provider      string         `db:"provider" json:"provider"`
+	IssuedAt      time.Time      `db:"issued_at" json:"issued_at"`
+	RefundedAt    *time.Time     `db:"refunded_at" json:"refunded_at,omitempty"`
+	Lines         []*InvoiceLine `db:"-" json:"lines,omitempty"`
+}
+
+type InvoiceLine struct {
+	LineID      int        `db:"line_id" json:"line_id"`
+	InvoiceID   int        `db:"invoice_id" json:"-"`
+	Description string     `db:"description" json:"description"`
+	PlanID      *string    `db:"plan_id" json:"plan_id,omitempty"`
+	Quantity    int        `db:"quantity" json:"quantity"`
+	UnitAmount  int64      `db:"unit_amount" json:"unit_amount"`
+	Amount      int64      `db:"amount" json:"amount"`
+	PeriodStart *time.Time `db:"period_start" json:"period_start,omitempty"`
+	PeriodEnd   *time.Time `db:"period_end" json:"period_end,omitempty"`
+}
+
+// InvoiceFilter narrows the finance listing, zero values don't filter
+type InvoiceFilter struct {
+	UserID int
+	Status string
+	Since  *time.Time
+	Until  *time.Time
+}
+
+// InvoiceTotals sums the invoices matching a filter per currency and status, for the finance reports
+type InvoiceTotals struct {
+	Currency  string `db:"currency" json:"currency"`
+	Status    string `db:"status" json:"status"`
+	Count     int    `db:"count" json:"count"`
+	Subtotal  int64  `db:"subtotal" json:"subtotal"`
+	TaxAmount int64  `db:"tax_amount" json:"tax_amount"`
+	Total     int64  `db:"total" json:"total"`
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// lifecycle notification kinds, each is sent at most once per dedupe key
+const (
+	NotificationExpiry7Days   = "expiry_reminder_7d"
+	NotificationExpiry1Day    = "expiry_reminder_1d"
+	NotificationPlanExpired   = "plan_expired"
+	NotificationPaymentFailed = "payment_failed"
+	NotificationDowngrade     = "downgrade"
+	NotificationWelcome       = "welcome"
+)
+
+// delivery states, sent, failed and skipped are final
+//
+//	pending --claimed by the scheduler--> sending --> sent, or back to pending to retry until it gives up (failed)
+//	sending --interrupted--> failed, it may have gone out so it is never sent again
+//	pending --outdated when due (plan renewed, account gone)--> skipped
+const (
+	NotificationPending = "pending"
+	NotificationSending = "sending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+	NotificationSkipped = "skipped"
+)
+
+// Notification is one email to a user, DedupeKey names the event it is about so the same event never queues it twice
+type Notification struct {
+	NotificationID int              `db:"notification_id" json:"notification_id"`
+	UserID         int              `db:"user_id" json:"user_id"`
+	Kind           string           `db:"kind" json:"kind"`
+	DedupeKey      string           `db:"dedupe_key" json:"dedupe_key"`
+	Data           NotificationData `db:"data" json:"data"`
+	Status         string           `db:"status" json:"status"`
+	Attempts       int              `db:"attempts" json:"attempts"`
+	LastError      *string          `db:"last_error" json:"last_error,omitempty"`
+	NextAttemptAt  time.Time        `db:"next_attempt_at" json:"next_attempt_at"`
+	ClaimedAt      *time.Time       `db:"claimed_at" json:"-"`
+	SentAt         *time.Time       `db:"sent_at" json:"sent_at,omitempty"`
+	CreatedAt      time.Time        `db:"created_at" json:"created_at"`
+}
+
+// NotificationData is what the email says, stored as jsonb; which fields are set depends on the kind
+type NotificationData struct {
+	PlanID        string     `json:"plan_id,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // reminders and welcome
+	CheckoutID    string     `json:"checkout_id,omitempty"`
+	Reason        string     `json:"reason,omitempty"` // payment failure
+	Files         []string   `json:"files,omitempty"`  // names of the files a downgrade affects
+	ReadOnlyUntil *time.Time `json:"read_only_until,omitempty"`
+	Outcome       string     `json:"outcome,omitempty"` // file access after the read only period
+}
+
+func (d NotificationData) Value() (driver.Value, error) {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+func (d *NotificationData) Scan(value interface{}) error {
+	if value == nil {
+		*d = NotificationData{}
+		return nil
+	}
+	raw, ok := value.([]byte)
+	if !ok {
+		text, isText := value.(string)
+		if !isText {
+			return errors.New("notification data must be json")
+		}
+		raw = []byte(text)
+	}
+	return json.Unmarshal(raw, d)
+}
+
+// ExpiringSubscription is a running subscription whose access ends soon, for the expiry reminders
+type ExpiringSubscription struct {
+	SubscriptionID int       `db:"subscription_id"`
+	UserID         int       `db:"user_id"`
+	PlanID         string    `db:"plan_id"`
+	ExpiresAt      time.Time `db:"expires_at"`
+}
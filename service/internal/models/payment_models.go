@@ -0,0 +1,69 @@
+package models
+
+import "time"
+
+// checkout states, only a verified webhook moves a checkout out of pending
+const (
+	CheckoutPending  = "pending"
+	CheckoutPaid     = "paid"
+	CheckoutFailed   = "failed"
+	CheckoutRefunded = "refunded"
+)
+
+// payment event types, every provider maps its own webhook events onto these
+const (
+	PaymentSucceeded = "payment_succeeded"
+	PaymentFailed    = "payment_failed"
+	PaymentRefunded  = "payment_refunded"
+)
+
+// Checkout is one attempt to buy a plan, the price is copied from the plan when the checkout starts
+type Checkout struct {
+	CheckoutID        string    `db:"checkout_id" json:"checkout_id"`
+	UserID            int       `db:"user_id" json:"-"`
+	PlanID            string    `db:"plan_id" json:"plan_id"`
+	Provider          string    `db:"provider" json:"provider"`
+	ProviderSessionID *string   `db:"provider_session_id" json:"-"`
+	ProviderPaymentID *string   `db:"provider_payment_id" json:"-"` // set once paid, refunds only name the payment
+	CheckoutURL       *string   `db:"checkout_url" json:"checkout_url,omitempty"`
+	Amount            int64     `db:"amount" json:"amount"`                   // what is charged, the discount is already taken off
+	RefundedAmount    int64     `db:"refunded_amount" json:"refunded_amount"` // partial refunds keep the plan
+	PromoCode         *string   `db:"promo_code" json:"promo_code,omitempty"`
+	DiscountAmount    int64     `db:"discount_amount" json:"discount_amount"`
+	Currency          string    `db:"currency" json:"currency"`
+	Status            string    `db:"status" json:"status"`
+	IdempotencyKey    string    `db:"idempotency_key" json:"-"`
+	FailureReason     *string   `db:"failure_reason" json:"failure_reason,omitempty"`
+	CreatedAt         time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time `db:"updated_at" json:"updated_at"`
+	ExpiresAt         time.Time `db:"expires_at" json:"expires_at"`
+}
+
+// CheckoutRequest is what a provider needs to open its hosted payment page
+type CheckoutRequest struct {
+	CheckoutID string
+	Email      string
+	PlanName   string
+	Amount     int64
+	Currency   string
+	SuccessURL string
+	CancelURL  string
+	ExpiresAt  time.Time
+}
+
+// ProviderCheckout is the provider's side of a checkout, the user is sent to URL to pay
+type ProviderCheckout struct {
+	SessionID string
+	URL       string
+}
+
+// PaymentEvent is a verified webhook, EventID is the provider's id and makes redelivered webhooks a no-op
+type PaymentEvent struct {
+	EventID    string
+	Type       string
+	CheckoutID string
+	PaymentID  string // the provider's payment, refund events only carry this one
+	Amount     int64  // for refunds the total refunded so far, not this refund alone
+	Currency   string
+	Reason     string // why a payment failed, as reported by the provider
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// scopes a personal access token can be granted, cookie sessions implicitly have all of them
+const (
+	ScopeFilesRead   = "files:read"
+	ScopeFilesWrite  = "files:write"
+	ScopeBillingRead = "billing:read"
+)
+
+var PersonalAccessTokenScopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeBillingRead}
+
+type PersonalAccessToken struct {
+	TokenID     int            `db:"token_id" json:"token_id"`
+	UserID      int            `db:"user_id" json:"user_id"`
+	Name        string         `db:"name" json:"name"`
+	TokenPrefix string         `db:"token_prefix" json:"token_prefix"` // first characters of the secret so the user can tell tokens apart
+	TokenHash   string         `db:"token_hash" json:"-"`
+	Scopes      pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt   *time.Time     `db:"expires_at" json:"expires_at"` // nil means the token never expires
+	LastUsedAt  *time.Time     `db:"last_used_at" json:"last_used_at"`
+	CreatedAt   time.Time      `db:"created_at" json:"created_at"`
+	Revoked     bool           `db:"revoked" json:"revoked"`
+}
+
+// HasScope reports whether the token was granted scope
+func (t *PersonalAccessToken) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
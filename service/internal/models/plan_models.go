@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Plan is one tier of the catalog (free, premium, ...), users.package and files.uploaded_with_package refer to PlanID
+type Plan struct {
+	PlanID string `db:"plan_id" json:"plan_id"`
+	Name   string `db:"name" json:"name"`
+	// TierRank orders the plans, files uploaded on a plan stay usable on any plan of the same or a higher rank
+	TierRank     int            `db:"tier_rank" json:"tier_rank"`
+	StorageQuota int64          `db:"storage_quota" json:"storage_quota"` // bytes, per user unless an admin overrides it
+	MaxFileSize  int64          `db:"max_file_size" json:"max_file_size"` // bytes
+	Features     pq.StringArray `db:"features" json:"features"`
+	// DurationSeconds is how long the plan lasts once bought, nil means it doesn't expire
+	DurationSeconds *int64 `db:"duration_seconds" json:"duration_seconds"`
+	// TrialSeconds is the free trial a user gets once per plan, nil means the plan has no trial
+	TrialSeconds *int64    `db:"trial_seconds" json:"trial_seconds"`
+	PriceAmount  int64     `db:"price_amount" json:"price_amount"` // in the smallest unit of Currency
+	Currency     string    `db:"currency" json:"currency"`
+	IsDefault    bool      `db:"is_default" json:"is_default"`   // new users and expired plans fall back to it
+	Purchasable  bool      `db:"purchasable" json:"purchasable"` // offered to users, the others are only granted by admins
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Duration is 0 for plans that don't expire
+func (p *Plan) Duration() time.Duration {
+	if p.DurationSeconds == nil {
+		return 0
+	}
+	return time.Duration(*p.DurationSeconds) * time.Second
+}
+
+// TrialDuration is 0 for plans without a trial
+func (p *Plan) TrialDuration() time.Duration {
+	if p.TrialSeconds == nil {
+		return 0
+	}
+	return time.Duration(*p.TrialSeconds) * time.Second
+}
+
+func (p *Plan) HasFeature(feature string) bool {
+	for _, f := range p.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Includes reports whether files uploaded on other are usable on this plan
+func (p *Plan) Includes(other *Plan) bool {
+	return p.TierRank >= other.TierRank
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// promo code kinds, discounts apply at checkout and free days are redeemed directly
+const (
+	PromoPercentOff = "percent"
+	PromoAmountOff  = "fixed"
+	PromoFreeDays   = "free_days"
+)
+
+// redemption states, a checkout's redemption stays pending until the payment goes through
+const (
+	RedemptionPending  = "pending"
+	RedemptionRedeemed = "redeemed"
+	RedemptionReleased = "released"
+)
+
+// PromoCode is a marketing code, Code is stored upper case and matched case insensitively
+type PromoCode struct {
+	Code        string `db:"code" json:"code"`
+	Description string `db:"description" json:"description"`
+	Kind        string `db:"kind" json:"kind"`
+	PercentOff  *int   `db:"percent_off" json:"percent_off,omitempty"` // percent codes, 1 to 99
+	// AmountOff is taken off the price of fixed codes, in the smallest unit of Currency
+	AmountOff *int64  `db:"amount_off" json:"amount_off,omitempty"`
+	Currency  *string `db:"currency" json:"currency,omitempty"`
+	// FreeDays of GrantPlanID are given by free_days codes
+	FreeDays    *int    `db:"free_days" json:"free_days,omitempty"`
+	GrantPlanID *string `db:"grant_plan_id" json:"grant_plan_id,omitempty"`
+	// PlanIDs restricts discounts to these plans, empty means every plan
+	PlanIDs        pq.StringArray `db:"plan_ids" json:"plan_ids"`
+	MaxRedemptions *int           `db:"max_redemptions" json:"max_redemptions"` // nil for no overall limit
+	MaxPerUser     int            `db:"max_per_user" json:"max_per_user"`
+	ValidFrom      *time.Time     `db:"valid_from" json:"valid_from"`
+	ValidUntil     *time.Time     `db:"valid_until" json:"valid_until"`
+	Active         bool           `db:"active" json:"active"`
+	TimesRedeemed  int            `db:"times_redeemed" json:"times_redeemed"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// AppliesTo reports whether a discount code may be used for the plan
+func (p *PromoCode) AppliesTo(planID string) bool {
+	if len(p.PlanIDs) == 0 {
+		return true
+	}
+	for _, id := range p.PlanIDs {
+		if id == planID {
+			return true
+		}
+	}
+	return false
+}
+
+// PromoRedemption is one use of a code, CheckoutID is set for discounts and nil for free days
+type PromoRedemption struct {
+	RedemptionID   int        `db:"redemption_id" json:"redemption_id"`
+	Code           string     `db:"code" json:"code"`
+	UserID         int        `db:"user_id" json:"user_id"`
+	CheckoutID     *string    `db:"checkout_id" json:"checkout_id,omitempty"`
+	PlanID         string     `db:"plan_id" json:"plan_id"`
+	DiscountAmount int64      `db:"discount_amount" json:"discount_amount"`
+	Currency       *string    `db:"currency" json:"currency,omitempty"`
+	FreeDays       *int       `db:"free_days" json:"free_days,omitempty"`
+	Status         string     `db:"status" json:"status"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	RedeemedAt     *time.Time `db:"redeemed_at" json:"redeemed_at,omitempty"`
+}
+
+// PromoCodeReport sums the redeemed uses of one code per currency
+type PromoCodeReport struct {
+	Code            string  `db:"code" json:"code"`
+	Kind            string  `db:"kind" json:"kind"`
+	Redemptions     int     `db:"redemptions" json:"redemptions"`
+	Users           int     `db:"users" json:"users"`
+	Currency        *string `db:"currency" json:"currency,omitempty"`
+	DiscountTotal   int64   `db:"discount_total" json:"discount_total"`
+	FreeDaysGranted int     `db:"free_days_granted" json:"free_days_granted"`
+}
@@ -5,8 +5,46 @@ import "time"
 type RefreshToken struct {
 	RefreshTokenID    int       `db:"refresh_token_id" json:"refresh_token_id"`
 	UserID            int       `db:"user_id" json:"user_id"`
-	RefreshTokenValue string    `db:"refresh_token_value" json:"refresh_token_value" binding:"required"`
+	RefreshTokenValue string    `db:"-" json:"-"`                  // raw token, only ever held in memory before it is hashed
+	RefreshTokenHash  string    `db:"refresh_token_hash" json:"-"` // sha256 (or hmac with pepper) of the raw token
 	ExpiredAt         time.Time `db:"expired_at" json:"expired_at" binding:"required"`
 	CreatedAt         time.Time `db:"created_at" json:"created_at" binding:"required" default:"CURRENT_TIMESTAMP"`
 	Revoked           bool      `db:"revoked" json:"revoked" binding:"required" default:"false"`
+	// session fields, carried over to the new row every time the refresh token is rotated
+	SessionID        string    `db:"session_id" json:"session_id"`
+	SessionLabel     string    `db:"session_label" json:"session_label"`
+	UserAgent        string    `db:"user_agent" json:"user_agent"`
+	IPAddress        string    `db:"ip_address" json:"ip_address"`
+	SessionCreatedAt time.Time `db:"session_created_at" json:"session_created_at"`
+	LastUsedAt       time.Time `db:"last_used_at" json:"last_used_at"`
+	RememberMe       bool      `db:"remember_me" json:"remember_me"` // picks the long refresh lifetime, kept on rotation
+}
+
+// ClientInfo describes the device that is logging in or refreshing, taken from the request by the handlers
+type ClientInfo struct {
+	UserAgent    string
+	IPAddress    string
+	SessionLabel string
+	RememberMe   bool // only read at login
+}
+
+// TokenPair is what a login or refresh hands to the handler, the expiries become the cookie max-ages
+type TokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// Session is a logged in device as shown to the user, one per active refresh token chain
+type Session struct {
+	SessionID    string    `db:"session_id" json:"session_id"`
+	SessionLabel string    `db:"session_label" json:"session_label"`
+	UserAgent    string    `db:"user_agent" json:"user_agent"`
+	IPAddress    string    `db:"ip_address" json:"ip_address"`
+	CreatedAt    time.Time `db:"session_created_at" json:"created_at"`
+	LastUsedAt   time.Time `db:"last_used_at" json:"last_used_at"`
+	ExpiredAt    time.Time `db:"expired_at" json:"expired_at"`
+	RememberMe   bool      `db:"remember_me" json:"remember_me"`
+	Current      bool      `db:"-" json:"current"`
 }
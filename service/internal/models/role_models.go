@@ -0,0 +1,52 @@
+package models
+
+// roles stored in users.role
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+var Roles = []string{RoleUser, RoleSupport, RoleAdmin}
+
+// permissions checked by the RequirePermission middleware, they travel in the access token next to the role
+const (
+	PermissionUsersRead      = "users:read"
+	PermissionPackagesWrite  = "packages:write"
+	PermissionStorageWrite   = "storage:write"
+	PermissionSessionsRevoke = "sessions:revoke"
+	PermissionDeletionsRead  = "deletions:read"
+	PermissionRolesWrite     = "roles:write"
+	PermissionUsersDisable   = "users:disable"
+	PermissionAuditRead      = "audit:read"
+	PermissionPlansWrite     = "plans:write"
+	PermissionInvoicesRead   = "invoices:read"
+	PermissionPromosRead     = "promos:read"
+	PermissionPromosWrite    = "promos:write"
+	PermissionUsageRead      = "usage:read"
+	// impersonation is read only unless the admin also holds the write permission and asks for it
+	PermissionImpersonate      = "users:impersonate"
+	PermissionImpersonateWrite = "users:impersonate_write"
+)
+
+// RolePermissions maps each role to what it may do, plain users have no admin permissions
+var RolePermissions = map[string][]string{
+	RoleUser:    {},
+	RoleSupport: {PermissionUsersRead, PermissionSessionsRevoke, PermissionDeletionsRead, PermissionAuditRead, PermissionImpersonate, PermissionInvoicesRead, PermissionPromosRead, PermissionUsageRead},
+	RoleAdmin: {
+		PermissionUsersRead, PermissionPackagesWrite, PermissionStorageWrite,
+		PermissionSessionsRevoke, PermissionDeletionsRead, PermissionRolesWrite,
+		PermissionUsersDisable, PermissionAuditRead, PermissionImpersonate, PermissionImpersonateWrite,
+		PermissionPlansWrite, PermissionInvoicesRead, PermissionPromosRead, PermissionPromosWrite, PermissionUsageRead,
+	},
+}
+
+func IsKnownRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// PermissionsForRole returns a copy so callers can't change the table, unknown roles get nothing
+func PermissionsForRole(role string) []string {
+	return append([]string{}, RolePermissions[role]...)
+}
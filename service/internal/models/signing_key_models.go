@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// SigningKey is a stored jwt signing key pair, the newest row whose active_from has passed is the one used for signing;
+// a newer key is published in the JWKS from created_at so verifiers know it before it signs anything
+type SigningKey struct {
+	KeyID               string     `db:"kid" json:"kid"`
+	Algorithm           string     `db:"algorithm" json:"algorithm"`
+	EncryptedPrivateKey string     `db:"encrypted_private_key" json:"-"` // never stored in plaintext, see utils.EncryptPrivateKey
+	CreatedAt           time.Time  `db:"created_at" json:"created_at"`
+	ActiveFrom          time.Time  `db:"active_from" json:"active_from"`
+	RotatedAt           *time.Time `db:"rotated_at" json:"rotated_at"` // set when a newer key takes over signing, still used for verification for a while
+}
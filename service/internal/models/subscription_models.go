@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// subscription states, canceled and expired are final and the user is back on the default plan
+//
+//	trialing, active --period end--> past_due (auto renew), canceled (cancel at period end) or expired (no auto renew)
+//	past_due --past due period over--> grace --grace period over--> expired
+//	trialing, past_due, grace --payment--> active
+//
+// subscriptions start without auto renew, it needs a renewal charge the payment providers don't make yet
+const (
+	SubscriptionTrialing = "trialing"
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionGrace    = "grace"
+	SubscriptionCanceled = "canceled"
+	SubscriptionExpired  = "expired"
+)
+
+// Subscription is a user's time on a plan, users.package and users.package_expiry mirror the current one
+type Subscription struct {
+	SubscriptionID     int       `db:"subscription_id" json:"subscription_id"`
+	UserID             int       `db:"user_id" json:"-"`
+	PlanID             string    `db:"plan_id" json:"plan_id"`
+	Status             string    `db:"status" json:"status"`
+	CurrentPeriodStart time.Time `db:"current_period_start" json:"current_period_start"`
+	// CurrentPeriodEnd is nil for plans granted without an end, they never transition on their own
+	CurrentPeriodEnd  *time.Time `db:"current_period_end" json:"current_period_end"`
+	AutoRenew         bool       `db:"auto_renew" json:"auto_renew"`
+	CancelAtPeriodEnd bool       `db:"cancel_at_period_end" json:"cancel_at_period_end"`
+	EndedAt           *time.Time `db:"ended_at" json:"ended_at,omitempty"`
+	CreatedAt         time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// IsCurrent is false once the subscription was canceled or expired
+func (s *Subscription) IsCurrent() bool {
+	return s.Status != SubscriptionCanceled && s.Status != SubscriptionExpired
+}
+
+// SubscriptionTransition is one recorded change of a subscription, FromStatus is nil for the row that created it
+type SubscriptionTransition struct {
+	TransitionID   int       `db:"transition_id" json:"transition_id"`
+	SubscriptionID int       `db:"subscription_id" json:"subscription_id"`
+	FromStatus     *string   `db:"from_status" json:"from_status"`
+	ToStatus       string    `db:"to_status" json:"to_status"`
+	Reason         string    `db:"reason" json:"reason"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+}
+
+// PlanAccess is what users.package and users.package_expiry are set to together with a subscription change
+type PlanAccess struct {
+	Package string
+	Expiry  *time.Time // when access ends without a payment, nil never
+}
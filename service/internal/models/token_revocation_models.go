@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// TokenRevocation is one entry of the access token denylist, either a single token (JTI) or
+// every token of a user issued at or before IssuedBefore. Rows are deleted once ExpiresAt passes.
+type TokenRevocation struct {
+	RevocationID int        `db:"revocation_id" json:"revocation_id"`
+	JTI          *string    `db:"jti" json:"jti"`
+	UserID       *int       `db:"user_id" json:"user_id"`
+	IssuedBefore *time.Time `db:"issued_before" json:"issued_before"`
+	Reason       string     `db:"reason" json:"reason"`
+	ExpiresAt    time.Time  `db:"expires_at" json:"expires_at"`
+	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
+}
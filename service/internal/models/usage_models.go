@@ -0,0 +1,62 @@
+package models
+
+// UsageDay is one user's usage on one UTC day, the storage is the day's latest snapshot and stays nil until the scheduler took one
+type UsageDay struct {
+	Day           string `db:"day" json:"day"` // YYYY-MM-DD
+	StorageBytes  *int64 `db:"storage_bytes" json:"storage_bytes"`
+	FileCount     *int   `db:"file_count" json:"file_count"`
+	DownloadBytes int64  `db:"download_bytes" json:"download_bytes"`
+	UploadBytes   int64  `db:"upload_bytes" json:"upload_bytes"`
+	Downloads     int    `db:"download_count" json:"downloads"`
+	Uploads       int    `db:"upload_count" json:"uploads"`
+}
+
+// UsageTotals sums a range of days, StorageByteDays adds up the snapshots for billing by storage over time
+type UsageTotals struct {
+	DownloadBytes    int64 `json:"download_bytes"`
+	UploadBytes      int64 `json:"upload_bytes"`
+	Downloads        int   `json:"downloads"`
+	Uploads          int   `json:"uploads"`
+	PeakStorageBytes int64 `json:"peak_storage_bytes"`
+	StorageByteDays  int64 `json:"storage_byte_days"`
+}
+
+// UsageSeries is a user's usage for every day from Since to Until, days without activity are included for charts
+type UsageSeries struct {
+	UserID int         `json:"user_id"`
+	Since  string      `json:"since"`
+	Until  string      `json:"until"`
+	Days   []*UsageDay `json:"days"`
+	Totals UsageTotals `json:"totals"`
+}
+
+// UsageReportDay sums the usage of every user on one day, ActiveUsers transferred at least one file
+type UsageReportDay struct {
+	Day           string `db:"day" json:"day"`
+	ActiveUsers   int    `db:"active_users" json:"active_users"`
+	StorageBytes  int64  `db:"storage_bytes" json:"storage_bytes"`
+	DownloadBytes int64  `db:"download_bytes" json:"download_bytes"`
+	UploadBytes   int64  `db:"upload_bytes" json:"upload_bytes"`
+	Downloads     int    `db:"download_count" json:"downloads"`
+	Uploads       int    `db:"upload_count" json:"uploads"`
+}
+
+// UserUsage sums one user's usage over the report range
+type UserUsage struct {
+	UserID           int    `db:"user_id" json:"user_id"`
+	Email            string `db:"email" json:"email"`
+	DownloadBytes    int64  `db:"download_bytes" json:"download_bytes"`
+	UploadBytes      int64  `db:"upload_bytes" json:"upload_bytes"`
+	Downloads        int    `db:"download_count" json:"downloads"`
+	Uploads          int    `db:"upload_count" json:"uploads"`
+	PeakStorageBytes *int64 `db:"peak_storage_bytes" json:"peak_storage_bytes"`
+}
+
+// UsageReport is the usage of every user from Since to Until, TopUsers are ranked by bytes transferred
+type UsageReport struct {
+	Since    string            `json:"since"`
+	Until    string            `json:"until"`
+	Days     []*UsageReportDay `json:"days"`
+	Totals   UsageTotals       `json:"totals"`
+	TopUsers []*UserUsage      `json:"top_users"`
+}
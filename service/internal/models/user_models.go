@@ -3,16 +3,19 @@ package models
 import "time"
 
 type User struct {
-	UserID              int        `db:"user_id" json:"user_id"`
-	Email               string     `db:"email" json:"email" binding:"required,email"`
-	Username            string     `db:"username" json:"username" binding:"required,max=100"`
-	Password            string     `db:"password" json:"password" binding:"required,min=8"`
-	ResetToken          string     `db:"reset_token" json:"reset_token"`
-	ResetTokenExpiry    time.Time  `db:"reset_token_expiry" json:"reset_token_expiry"`
-	Package             string     `db:"package" json:"package"`
-	FreeStorageUsed     int64      `db:"free_storage_used" json:"free_storage_used"`
-	FreeStorageLimit    int64      `db:"free_storage_limit" json:"free_storage_limit"`
-	PremiumStorageUsed  int64      `db:"premium_storage_used" json:"premium_storage_used"`
-	PremiumStorageLimit int64      `db:"premium_storage_limit" json:"premium_storage_limit"`
-	PackageExpiry       *time.Time `db:"package_expiry" json:"package_expiry"`
+	UserID           int        `db:"user_id" json:"user_id"`
+	Email            string     `db:"email" json:"email" binding:"required,email"`
+	Username         string     `db:"username" json:"username" binding:"required,max=100"`
+	Password         string     `db:"password" json:"password" binding:"required"` // length and strength are checked by the password policy
+	ResetTokenHash   string     `db:"reset_token_hash" json:"-"`
+	ResetTokenExpiry *time.Time `db:"reset_token_expiry" json:"-"`
+	Package          string     `db:"package" json:"package"` // plan_id of the current plan
+	Role             string     `db:"role" json:"role"`
+	PackageExpiry    *time.Time `db:"package_expiry" json:"package_expiry"`
+	DisabledAt       *time.Time `db:"disabled_at" json:"-"` // set by an admin, a disabled account can't log in or refresh
+	DisabledReason   *string    `db:"disabled_reason" json:"-"`
+}
+
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
 }
@@ -0,0 +1,181 @@
+package repositories
+
+import (
+	"database/sql"
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type AccountDeletionRepo interface {
+	ScheduleDeletion(userID int, email string, purgeAfter time.Time) (*models.AccountDeletion, error)
+	GetDeletion(userID int) (*models.AccountDeletion, error)
+	CancelDeletion(userID int) error
+	ListPendingDeletions() ([]*models.AccountDeletion, error)
+	ClaimDueDeletions(limit int, staleClaimAfter time.Duration) ([]*models.AccountDeletion, error)
+	PurgeUserRows(userID int, email string, throttleKeys []string) error
+	MarkPurgeFailed(userID int, reason string) error
+	MarkCompleted(userID int) error
+}
+
+type accountDeletionRepo struct {
+	db *sqlx.DB
+}
+
+func NewAccountDeletionRepo(db *sqlx.DB) AccountDeletionRepo {
+	return &accountDeletionRepo{db: db}
+}
+
+const accountDeletionColumns = "user_id, email, status, requested_at, purge_after, claimed_at, attempts, last_error, completed_at"
+
+// ScheduleDeletion is idempotent, asking again keeps the original schedule
+func (r *accountDeletionRepo) ScheduleDeletion(userID int, email string, purgeAfter time.Time) (*models.AccountDeletion, error) {
+	query := "INSERT INTO account_deletions (user_id, email, status, purge_after) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO NOTHING"
+	if _, err := r.db.Exec(query, userID, email, models.AccountDeletionPending, purgeAfter); err != nil {
+		logger.LogError(err, "Failed to schedule account deletion", map[string]interface{}{"layer": "repository", "operation": "ScheduleDeletion", "userID": userID})
+		return nil, err
+	}
+	return r.GetDeletion(userID)
+}
+
+func (r *accountDeletionRepo) GetDeletion(userID int) (*models.AccountDeletion, error) {
+	var deletion models.AccountDeletion
+	err := r.db.Get(&deletion, "SELECT "+accountDeletionColumns+" FROM account_deletions WHERE user_id = $1", userID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.LogError(err, "Failed to get account deletion", map[string]interface{}{"layer": "repository", "operation": "GetDeletion", "userID": userID})
+		}
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+// CancelDeletion only works during the grace period, returns sql.ErrNoRows when nothing is pending
+func (r *accountDeletionRepo) CancelDeletion(userID int) error {
+	result, err := r.db.Exec("DELETE FROM account_deletions WHERE user_id = $1 AND status = $2", userID, models.AccountDeletionPending)
+	if err != nil {
+		logger.LogError(err, "Failed to cancel account deletion", map[string]interface{}{"layer": "repository", "operation": "CancelDeletion", "userID": userID})
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *accountDeletionRepo) ListPendingDeletions() ([]*models.AccountDeletion, error) {
+	var deletions []*models.AccountDeletion
+	query := "SELECT " + accountDeletionColumns + " FROM account_deletions WHERE status IN ($1, $2) ORDER BY purge_after"
+	if err := r.db.Select(&deletions, query, models.AccountDeletionPending, models.AccountDeletionPurging); err != nil {
+		logger.LogError(err, "Failed to list pending account deletions", map[string]interface{}{"layer": "repository", "operation": "ListPendingDeletions"})
+		return nil, err
+	}
+	return deletions, nil
+}
+
+// ClaimDueDeletions marks due deletions as purging for this run; a claim older than staleClaimAfter
+// belongs to a run that died and is taken over, SKIP LOCKED keeps concurrent runs apart
+func (r *accountDeletionRepo) ClaimDueDeletions(limit int, staleClaimAfter time.Duration) ([]*models.AccountDeletion, error) {
+	var deletions []*models.AccountDeletion
+	query := `UPDATE account_deletions SET status = $1, claimed_at = CURRENT_TIMESTAMP, attempts = attempts + 1
+		WHERE user_id IN (
+			SELECT user_id FROM account_deletions
+			WHERE status IN ($2, $1) AND purge_after <= CURRENT_TIMESTAMP AND (claimed_at IS NULL OR claimed_at < $3)
+			ORDER BY purge_after LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + accountDeletionColumns
+	err := r.db.Select(&deletions, query, models.AccountDeletionPurging, models.AccountDeletionPending, time.Now().Add(-staleClaimAfter), limit)
+	if err != nil {
+		logger.LogError(err, "Failed to claim due account deletions", map[string]interface{}{"layer": "repository", "operation": "ClaimDueDeletions"})
+		return nil, err
+	}
+	return deletions, nil
+}
+
+// PurgeUserRows deletes everything the user owns in one transaction, running it again after success is a no-op.
+// Paid checkouts and their invoices are records finance has to keep, they stay with the personal data scrubbed.
+func (r *accountDeletionRepo) PurgeUserRows(userID int, email string, throttleKeys []string) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// tables that reference users cascade, these are listed so nothing depends on the cascade being declared
+	statements := []string{
+		"DELETE FROM files WHERE user_id = $1",
+		"DELETE FROM user_storage WHERE user_id = $1",
+		"DELETE FROM refresh_tokens WHERE user_id = $1",
+		"DELETE FROM personal_access_tokens WHERE user_id = $1",
+		"DELETE FROM access_token_revocations WHERE user_id = $1",
+		"DELETE FROM package_history WHERE user_id = $1",
+		"DELETE FROM data_exports WHERE user_id = $1",
+		"DELETE FROM notifications WHERE user_id = $1",
+		"DELETE FROM usage_daily WHERE user_id = $1",
+		"DELETE FROM subscription_transitions WHERE subscription_id IN (SELECT subscription_id FROM subscriptions WHERE user_id = $1)",
+		"DELETE FROM subscriptions WHERE user_id = $1",
+		// redeemed codes keep counting towards the code's overall limit, they hold nothing about the user but the id
+		"DELETE FROM promo_redemptions WHERE user_id = $1 AND status <> 'redeemed'",
+		// checkouts that never turned into an invoice go with their webhook events
+		`DELETE FROM payment_events WHERE checkout_id IN (
+			SELECT checkout_id FROM checkouts c WHERE c.user_id = $1 AND NOT EXISTS (SELECT 1 FROM invoices i WHERE i.checkout_id = c.checkout_id))`,
+		"DELETE FROM checkouts c WHERE c.user_id = $1 AND NOT EXISTS (SELECT 1 FROM invoices i WHERE i.checkout_id = c.checkout_id)",
+		"UPDATE checkouts SET checkout_url = NULL, failure_reason = NULL WHERE user_id = $1",
+		"UPDATE invoices SET billing_email = '' WHERE user_id = $1",
+		// the audit trail stays, without anything pointing at the person
+		"UPDATE audit_events SET target_user_id = NULL, ip_address = '', user_agent = '', details = details - 'email' WHERE target_user_id = $1",
+		"UPDATE audit_events SET actor_id = NULL, ip_address = '', user_agent = '', details = details - 'email' WHERE actor_id = $1",
+		"DELETE FROM users WHERE user_id = $1",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, userID); err != nil {
+			logger.LogError(err, "Failed to purge user rows", map[string]interface{}{"layer": "repository", "operation": "PurgeUserRows", "userID": userID})
+			return err
+		}
+	}
+	if email != "" {
+		// failed logins for the address that never resolved to the user (unknown email, throttled) only carry the email
+		query := "UPDATE audit_events SET ip_address = '', user_agent = '', details = details - 'email' WHERE lower(details->>'email') = lower($1)"
+		if _, err := tx.Exec(query, email); err != nil {
+			logger.LogError(err, "Failed to scrub audit events", map[string]interface{}{"layer": "repository", "operation": "PurgeUserRows", "userID": userID})
+			return err
+		}
+	}
+	// throttle counters are keyed by email, not user id
+	if len(throttleKeys) > 0 {
+		if _, err := tx.Exec("DELETE FROM auth_throttles WHERE throttle_key = ANY($1)", pq.Array(throttleKeys)); err != nil {
+			logger.LogError(err, "Failed to purge auth throttles", map[string]interface{}{"layer": "repository", "operation": "PurgeUserRows", "userID": userID})
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit user purge", map[string]interface{}{"layer": "repository", "operation": "PurgeUserRows", "userID": userID})
+		return err
+	}
+	logger.LogDebug("User rows purged", map[string]interface{}{"layer": "repository", "operation": "PurgeUserRows", "userID": userID})
+	return nil
+}
+
+// MarkPurgeFailed releases the claim so the next run retries right away
+func (r *accountDeletionRepo) MarkPurgeFailed(userID int, reason string) error {
+	_, err := r.db.Exec("UPDATE account_deletions SET claimed_at = NULL, last_error = $1 WHERE user_id = $2", reason, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to record purge failure", map[string]interface{}{"layer": "repository", "operation": "MarkPurgeFailed", "userID": userID})
+	}
+	return err
+}
+
+// MarkCompleted also forgets the email, the row only proves the deletion happened
+func (r *accountDeletionRepo) MarkCompleted(userID int) error {
+	query := "UPDATE account_deletions SET status = $1, completed_at = CURRENT_TIMESTAMP, claimed_at = NULL, email = NULL, last_error = NULL WHERE user_id = $2"
+	_, err := r.db.Exec(query, models.AccountDeletionCompleted, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to complete account deletion", map[string]interface{}{"layer": "repository", "operation": "MarkCompleted", "userID": userID})
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type AuditEventRepo interface {
+	RecordEvent(event *models.AuditEvent) error
+	ListEvents(filter models.AuditEventFilter, limit, offset int) ([]*models.AuditEvent, error)
+	DeleteEventsBefore(cutoff time.Time, batchSize int) (int64, error)
+}
+
+type auditEventRepo struct {
+	db *sqlx.DB
+}
+
+func NewAuditEventRepo(db *sqlx.DB) AuditEventRepo {
+	return &auditEventRepo{db: db}
+}
+
+func (r *auditEventRepo) RecordEvent(event *models.AuditEvent) error {
+	query := `INSERT INTO audit_events (actor_id, action, target_user_id, ip_address, user_agent, result, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING event_id, created_at`
+	err := r.db.QueryRowx(query, event.ActorID, event.Action, event.TargetUserID, event.IPAddress, event.UserAgent, event.Result, event.Details).
+		Scan(&event.EventID, &event.CreatedAt)
+	if err != nil {
+		logger.LogError(err, "Failed to record audit event", map[string]interface{}{"layer": "repository", "operation": "RecordEvent", "action": event.Action})
+		return err
+	}
+	return nil
+}
+
+// ListEvents returns the newest events first
+func (r *auditEventRepo) ListEvents(filter models.AuditEventFilter, limit, offset int) ([]*models.AuditEvent, error) {
+	var events []*models.AuditEvent
+	query := `SELECT event_id, actor_id, action, target_user_id, ip_address, user_agent, result, details, created_at FROM audit_events
+		WHERE ($1 = 0 OR target_user_id = $1)
+			AND ($2 = 0 OR actor_id = $2)
+			AND ($3 = '' OR action = $3 OR ($3 LIKE '%.' AND action LIKE $3 || '%'))
+			AND ($4::timestamp IS NULL OR created_at >= $4)
+			AND ($5::timestamp IS NULL OR created_at < $5)
+		ORDER BY created_at DESC, event_id DESC LIMIT $6 OFFSET $7`
+	if err := r.db.Select(&events, query, filter.TargetUserID, filter.ActorID, filter.Action, filter.Since, filter.Until, limit, offset); err != nil {
+		logger.LogError(err, "Failed to list audit events", map[string]interface{}{"layer": "repository", "operation": "ListEvents"})
+		return nil, err
+	}
+	return events, nil
+}
+
+// DeleteEventsBefore removes at most batchSize events older than cutoff, small batches keep the table unlocked
+func (r *auditEventRepo) DeleteEventsBefore(cutoff time.Time, batchSize int) (int64, error) {
+	query := "DELETE FROM audit_events WHERE event_id IN (SELECT event_id FROM audit_events WHERE created_at < $1 ORDER BY event_id LIMIT $2)"
+	result, err := r.db.Exec(query, cutoff, batchSize)
+	if err != nil {
+		logger.LogError(err, "Failed to delete old audit events", map[string]interface{}{"layer": "repository", "operation": "DeleteEventsBefore"})
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,11 +1,16 @@
 package repositories
 
 import (
+	"database/sql"
+	"errors"
 	"service/internal/logger"
 	"service/internal/models"
+	"service/internal/utils"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 // Must implement all methods in the interface
@@ -13,12 +18,19 @@ type AuthRepo interface {
 	CreateUser(user *models.User) error
 	GetUserByEmail(email string) (*models.User, error)
 	GetUserByID(userID int) (*models.User, error)
-	ResetPassword(newPassword, resetToken string) error
+	GetUserByResetToken(resetToken string) (*models.User, error)
+	ResetPassword(newPassword, resetToken string) (int, error)
+	UpdatePassword(userID int, newPassword string) error
+	RequestMagicLink(userID int, loginToken, nonce string, expiresAt time.Time) error
+	ConsumeMagicLink(loginToken, nonce string) (int, error)
+	RequestEmailChange(userID int, newEmail, changeToken string, expiresAt time.Time) error
+	ConfirmEmailChange(changeToken string) (int, string, error)
 	RequestingPasswordReset(email, resetToken string, resetTokenExpiredAt time.Time) error
-	UpgradeUserPackage(userID int, newPackage string) error
-	SetPackageExpiry(userID int, expiryTime time.Time) error
-	GetExpiredPremiumUsers() ([]int, error)
-	ClearPackageExpiry(userID int) error
+	GetPackageHistory(userID int) ([]*models.PackageChange, error)
+	SetRole(userID int, role string) error
+	SearchUsers(search string, limit, offset int) ([]*models.AdminUserSummary, error)
+	DisableUser(userID int, reason string) error
+	EnableUser(userID int) error
 }
 
 type authRepo struct {
@@ -33,8 +45,14 @@ func NewAuthRepo(db *sqlx.DB) AuthRepo {
 
 // This function implements the CreateUser method from the AuthRepo interface, it creates a new user in the database, accepts the user models as the params, and returns an error if the query fails
 func (r *authRepo) CreateUser(user *models.User) error {
-	query := "INSERT INTO users (email, username, password, package, free_storage_used, free_storage_limit, premium_storage_used, premium_storage_limit) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING user_id"
-	err := r.db.QueryRow(query, user.Email, user.Username, user.Password, user.Package, 0, 2097152, 0, 5242880).Scan(&user.UserID)
+	// the starting package is the first package_history entry
+	query := `WITH created AS (
+			INSERT INTO users (email, username, password, package) VALUES ($1, $2, $3, $4) RETURNING user_id, package
+		), history AS (
+			INSERT INTO package_history (user_id, package) SELECT user_id, package FROM created
+		)
+		SELECT user_id FROM created`
+	err := r.db.QueryRow(query, user.Email, user.Username, user.Password, user.Package).Scan(&user.UserID)
 	if err != nil {
 		// Log the error if the query fails
 		logger.LogError(err, "Failed to create user", map[string]interface{}{"layer": "repository", "operation": "CreateUser"})
@@ -48,7 +66,7 @@ func (r *authRepo) CreateUser(user *models.User) error {
 func (r *authRepo) GetUserByEmail(email string) (*models.User, error) {
 	// Create a new user struct to store the result
 	var user models.User
-	query := "SELECT user_id, email, username, password, package, free_storage_used, free_storage_limit, premium_storage_used, premium_storage_limit, package_expiry FROM users WHERE email = $1"
+	query := "SELECT user_id, email, username, password, package, role, package_expiry, disabled_at, disabled_reason FROM users WHERE email = $1"
 	// Get the user struct from the database using the query and the username
 	err := r.db.Get(&user, query, email)
 	if err != nil {
@@ -61,7 +79,7 @@ func (r *authRepo) GetUserByEmail(email string) (*models.User, error) {
 
 func (r *authRepo) GetUserByID(userID int) (*models.User, error) {
 	var user models.User
-	query := "SELECT user_id, email, username, password, package, free_storage_used, free_storage_limit, premium_storage_used, premium_storage_limit, package_expiry FROM users WHERE user_id = $1"
+	query := "SELECT user_id, email, username, password, package, role, package_expiry, disabled_at, disabled_reason FROM users WHERE user_id = $1"
 	err := r.db.Get(&user, query, userID)
 	if err != nil {
 		logger.LogError(err, "Failed to get user", map[string]interface{}{"layer": "repository", "operation": "GetUserByID"})
@@ -71,69 +89,175 @@ func (r *authRepo) GetUserByID(userID int) (*models.User, error) {
 	return &user, nil
 }
 
-func (r *authRepo) ResetPassword(newPassword, resetToken string) error {
-	query := "UPDATE users SET password = $1, reset_token = NULL, reset_token_expiry = NULL WHERE reset_token = $2 AND reset_token_expiry > CURRENT_TIMESTAMP"
-	_, err := r.db.Exec(query, newPassword, resetToken)
+// GetUserByResetToken finds the account a still valid reset token belongs to, so the new password can be checked against the user's details
+func (r *authRepo) GetUserByResetToken(resetToken string) (*models.User, error) {
+	var user models.User
+	query := "SELECT user_id, email, username, password, package, role, package_expiry, disabled_at, disabled_reason FROM users WHERE reset_token_hash = $1 AND reset_token_expiry > CURRENT_TIMESTAMP"
+	err := r.db.Get(&user, query, utils.HashToken(resetToken))
+	if err != nil {
+		logger.LogError(err, "Failed to get user by reset token", map[string]interface{}{"layer": "repository", "operation": "GetUserByResetToken"})
+		return nil, err
+	}
+	return &user, nil
+}
+
+// reset tokens are stored hashed, the raw token from the email link is hashed here before the lookup, returns the user id of the reset account
+func (r *authRepo) ResetPassword(newPassword, resetToken string) (int, error) {
+	var userID int
+	query := "UPDATE users SET password = $1, reset_token_hash = NULL, reset_token_expiry = NULL WHERE reset_token_hash = $2 AND reset_token_expiry > CURRENT_TIMESTAMP RETURNING user_id"
+	err := r.db.QueryRow(query, newPassword, utils.HashToken(resetToken)).Scan(&userID)
 	if err != nil {
+		// sql.ErrNoRows means the token is unknown, already used or expired
 		logger.LogError(err, "Failed to reset password", map[string]interface{}{"layer": "repository", "operation": "ResetPassword"})
+		return 0, err
+	}
+	logger.LogDebug("Password reset", map[string]interface{}{"layer": "repository", "operation": "ResetPassword", "userID": userID})
+	return userID, nil
+}
+
+// UpdatePassword stores an already hashed password, any pending reset token is dropped with the old password
+func (r *authRepo) UpdatePassword(userID int, newPassword string) error {
+	query := "UPDATE users SET password = $1, reset_token_hash = NULL, reset_token_expiry = NULL WHERE user_id = $2"
+	_, err := r.db.Exec(query, newPassword, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to update password", map[string]interface{}{"layer": "repository", "operation": "UpdatePassword", "userID": userID})
 		return err
 	}
-	logger.LogDebug("Password reset", map[string]interface{}{"layer": "repository", "operation": "ResetPassword"})
+	logger.LogDebug("Password updated", map[string]interface{}{"layer": "repository", "operation": "UpdatePassword", "userID": userID})
 	return nil
 }
 
-func (r *authRepo) RequestingPasswordReset(email, resetToken string, resetTokenExpiredAt time.Time) error {
-	query := "UPDATE users SET reset_token = $1, reset_token_expiry = $2 WHERE email = $3"
-	_, err := r.db.Exec(query, resetToken, resetTokenExpiredAt, email)
+// RequestMagicLink stores the hashes of the emailed token and the browser nonce, a newer link replaces an older one
+func (r *authRepo) RequestMagicLink(userID int, loginToken, nonce string, expiresAt time.Time) error {
+	query := "UPDATE users SET magic_link_token_hash = $1, magic_link_nonce_hash = $2, magic_link_expiry = $3 WHERE user_id = $4"
+	_, err := r.db.Exec(query, utils.HashToken(loginToken), utils.HashToken(nonce), expiresAt, userID)
 	if err != nil {
-		logger.LogError(err, "Failed to request password reset", map[string]interface{}{"layer": "repository", "operation": "RequestingPasswordReset"})
+		logger.LogError(err, "Failed to store magic link", map[string]interface{}{"layer": "repository", "operation": "RequestMagicLink", "userID": userID})
 		return err
 	}
-	logger.LogDebug("Password reset requested", map[string]interface{}{"layer": "repository", "operation": "RequestingPasswordReset"})
+	logger.LogDebug("Magic link requested", map[string]interface{}{"layer": "repository", "operation": "RequestMagicLink", "userID": userID})
 	return nil
 }
 
-func (r *authRepo) UpgradeUserPackage(userID int, newPackage string) error {
-	query := "UPDATE users SET package = $1 WHERE user_id = $2"
-	_, err := r.db.Exec(query, newPackage, userID)
+// ConsumeMagicLink clears the link in the same statement that checks it so it works only once, sql.ErrNoRows means unknown, used, expired or another browser
+func (r *authRepo) ConsumeMagicLink(loginToken, nonce string) (int, error) {
+	var userID int
+	query := `UPDATE users SET magic_link_token_hash = NULL, magic_link_nonce_hash = NULL, magic_link_expiry = NULL
+		WHERE magic_link_token_hash = $1 AND magic_link_nonce_hash = $2 AND magic_link_expiry > CURRENT_TIMESTAMP
+		RETURNING user_id`
+	err := r.db.QueryRow(query, utils.HashToken(loginToken), utils.HashToken(nonce)).Scan(&userID)
+	if err != nil {
+		logger.LogError(err, "Failed to consume magic link", map[string]interface{}{"layer": "repository", "operation": "ConsumeMagicLink"})
+		return 0, err
+	}
+	logger.LogDebug("Magic link consumed", map[string]interface{}{"layer": "repository", "operation": "ConsumeMagicLink", "userID": userID})
+	return userID, nil
+}
+
+// RequestEmailChange parks the new address until the link sent to it is confirmed, a newer request replaces an older one
+func (r *authRepo) RequestEmailChange(userID int, newEmail, changeToken string, expiresAt time.Time) error {
+	query := "UPDATE users SET pending_email = $1, email_change_token_hash = $2, email_change_expiry = $3 WHERE user_id = $4"
+	_, err := r.db.Exec(query, newEmail, utils.HashToken(changeToken), expiresAt, userID)
 	if err != nil {
-		logger.LogError(err, "Failed to upgrade user package", map[string]interface{}{"layer": "repository", "operation": "UpgradeUserPackage", "userID": userID, "newPackage": newPackage})
+		logger.LogError(err, "Failed to request email change", map[string]interface{}{"layer": "repository", "operation": "RequestEmailChange", "userID": userID})
 		return err
 	}
-	logger.LogDebug("User package upgraded", map[string]interface{}{"layer": "repository", "operation": "UpgradeUserPackage", "userID": userID, "newPackage": newPackage})
+	logger.LogDebug("Email change requested", map[string]interface{}{"layer": "repository", "operation": "RequestEmailChange", "userID": userID})
 	return nil
 }
 
-func (r *authRepo) SetPackageExpiry(userID int, expiryTime time.Time) error {
-	query := "UPDATE users SET package_expiry = $1 WHERE user_id = $2"
-	_, err := r.db.Exec(query, expiryTime, userID)
+// ConfirmEmailChange swaps in the pending address, returns the user id and the new email; sql.ErrNoRows means an unknown or expired token
+func (r *authRepo) ConfirmEmailChange(changeToken string) (int, string, error) {
+	var userID int
+	var email string
+	query := `UPDATE users SET email = pending_email, pending_email = NULL, email_change_token_hash = NULL, email_change_expiry = NULL
+		WHERE email_change_token_hash = $1 AND email_change_expiry > CURRENT_TIMESTAMP AND pending_email IS NOT NULL
+		RETURNING user_id, email`
+	err := r.db.QueryRow(query, utils.HashToken(changeToken)).Scan(&userID, &email)
+	if err != nil {
+		logger.LogError(err, "Failed to confirm email change", map[string]interface{}{"layer": "repository", "operation": "ConfirmEmailChange"})
+		return 0, "", err
+	}
+	logger.LogDebug("Email changed", map[string]interface{}{"layer": "repository", "operation": "ConfirmEmailChange", "userID": userID})
+	return userID, email, nil
+}
+
+func (r *authRepo) RequestingPasswordReset(email, resetToken string, resetTokenExpiredAt time.Time) error {
+	query := "UPDATE users SET reset_token_hash = $1, reset_token_expiry = $2 WHERE email = $3"
+	_, err := r.db.Exec(query, utils.HashToken(resetToken), resetTokenExpiredAt, email)
 	if err != nil {
-		logger.LogError(err, "Failed to set package expiry", map[string]interface{}{"layer": "repository", "operation": "SetPackageExpiry", "userID": userID})
+		logger.LogError(err, "Failed to request password reset", map[string]interface{}{"layer": "repository", "operation": "RequestingPasswordReset"})
 		return err
 	}
-	logger.LogDebug("Package expiry set", map[string]interface{}{"layer": "repository", "operation": "SetPackageExpiry", "userID": userID})
+	logger.LogDebug("Password reset requested", map[string]interface{}{"layer": "repository", "operation": "RequestingPasswordReset"})
 	return nil
 }
 
-func (r *authRepo) GetExpiredPremiumUsers() ([]int, error) {
-	var userIDs []int
-	query := "SELECT user_id FROM users WHERE package = 'premium' AND package_expiry IS NOT NULL AND package_expiry < CURRENT_TIMESTAMP"
-	err := r.db.Select(&userIDs, query)
+func (r *authRepo) GetPackageHistory(userID int) ([]*models.PackageChange, error) {
+	var history []*models.PackageChange
+	query := "SELECT package, changed_at FROM package_history WHERE user_id = $1 ORDER BY changed_at"
+	if err := r.db.Select(&history, query, userID); err != nil {
+		logger.LogError(err, "Failed to get package history", map[string]interface{}{"layer": "repository", "operation": "GetPackageHistory", "userID": userID})
+		return nil, err
+	}
+	return history, nil
+}
+
+func (r *authRepo) SetRole(userID int, role string) error {
+	result, err := r.db.Exec("UPDATE users SET role = $1 WHERE user_id = $2", role, userID)
 	if err != nil {
-		logger.LogError(err, "Failed to get expired premium users", map[string]interface{}{"layer": "repository", "operation": "GetExpiredPremiumUsers"})
+		logger.LogError(err, "Failed to set role", map[string]interface{}{"layer": "repository", "operation": "SetRole", "userID": userID})
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SearchUsers matches the search against email and username, or the exact user id, an empty search lists everyone
+func (r *authRepo) SearchUsers(search string, limit, offset int) ([]*models.AdminUserSummary, error) {
+	var users []*models.AdminUserSummary
+	pattern := "%" + likeEscaper.Replace(search) + "%"
+	query := `SELECT user_id, email, username, role, package, package_expiry, disabled_at FROM users
+		WHERE $1 = '' OR email ILIKE $2 OR username ILIKE $2 OR user_id::text = $1
+		ORDER BY user_id LIMIT $3 OFFSET $4`
+	if err := r.db.Select(&users, query, search, pattern, limit, offset); err != nil {
+		logger.LogError(err, "Failed to search users", map[string]interface{}{"layer": "repository", "operation": "SearchUsers"})
 		return nil, err
 	}
-	logger.LogDebug("Retrieved expired premium users", map[string]interface{}{"layer": "repository", "operation": "GetExpiredPremiumUsers", "count": len(userIDs)})
-	return userIDs, nil
+	return users, nil
 }
 
-func (r *authRepo) ClearPackageExpiry(userID int) error {
-	query := "UPDATE users SET package_expiry = NULL WHERE user_id = $1"
-	_, err := r.db.Exec(query, userID)
+// likeEscaper keeps % and _ typed into a search from acting as wildcards
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (r *authRepo) DisableUser(userID int, reason string) error {
+	result, err := r.db.Exec("UPDATE users SET disabled_at = CURRENT_TIMESTAMP, disabled_reason = $1 WHERE user_id = $2", reason, userID)
 	if err != nil {
-		logger.LogError(err, "Failed to clear package expiry", map[string]interface{}{"layer": "repository", "operation": "ClearPackageExpiry", "userID": userID})
+		logger.LogError(err, "Failed to disable user", map[string]interface{}{"layer": "repository", "operation": "DisableUser", "userID": userID})
 		return err
 	}
-	logger.LogDebug("Package expiry cleared", map[string]interface{}{"layer": "repository", "operation": "ClearPackageExpiry", "userID": userID})
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
+
+func (r *authRepo) EnableUser(userID int) error {
+	result, err := r.db.Exec("UPDATE users SET disabled_at = NULL, disabled_reason = NULL WHERE user_id = $1", userID)
+	if err != nil {
+		logger.LogError(err, "Failed to enable user", map[string]interface{}{"layer": "repository", "operation": "EnableUser", "userID": userID})
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// IsUniqueViolation reports whether err is postgres refusing a duplicate value, e.g. an email someone else registered first
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,105 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type AuthThrottleRepo interface {
+	GetThrottle(throttleKey string) (*models.AuthThrottle, error)
+	RecordFailure(throttleKey string, window time.Duration) (*models.AuthThrottle, error)
+	LockThrottle(throttleKey string, lockedUntil time.Time, unlockTokenHash *string) error
+	ClearThrottle(throttleKey string) error
+	ClearThrottleByUnlockToken(unlockTokenHash string) (string, error)
+	DeleteStaleThrottles(lastFailureBefore time.Time) (int64, error)
+}
+
+type authThrottleRepo struct {
+	db *sqlx.DB
+}
+
+func NewAuthThrottleRepo(db *sqlx.DB) AuthThrottleRepo {
+	return &authThrottleRepo{db: db}
+}
+
+// GetThrottle returns nil without an error when the key has no recorded failures
+func (r *authThrottleRepo) GetThrottle(throttleKey string) (*models.AuthThrottle, error) {
+	var throttle models.AuthThrottle
+	query := "SELECT throttle_key, failures, last_failure_at, locked_until, unlock_token_hash FROM auth_throttles WHERE throttle_key = $1"
+	err := r.db.Get(&throttle, query, throttleKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to get auth throttle", map[string]interface{}{"layer": "repository", "operation": "GetThrottle"})
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+// RecordFailure bumps the failure count, starting over at 1 when the previous failure is older than window
+func (r *authThrottleRepo) RecordFailure(throttleKey string, window time.Duration) (*models.AuthThrottle, error) {
+	var throttle models.AuthThrottle
+	now := time.Now()
+	query := `INSERT INTO auth_throttles (throttle_key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (throttle_key) DO UPDATE SET
+			failures = CASE WHEN auth_throttles.last_failure_at < $3 THEN 1 ELSE auth_throttles.failures + 1 END,
+			last_failure_at = $2
+		RETURNING throttle_key, failures, last_failure_at, locked_until, unlock_token_hash`
+	err := r.db.Get(&throttle, query, throttleKey, now, now.Add(-window))
+	if err != nil {
+		logger.LogError(err, "Failed to record auth failure", map[string]interface{}{"layer": "repository", "operation": "RecordFailure"})
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+func (r *authThrottleRepo) LockThrottle(throttleKey string, lockedUntil time.Time, unlockTokenHash *string) error {
+	query := "UPDATE auth_throttles SET locked_until = $1, unlock_token_hash = $2 WHERE throttle_key = $3"
+	_, err := r.db.Exec(query, lockedUntil, unlockTokenHash, throttleKey)
+	if err != nil {
+		logger.LogError(err, "Failed to lock auth throttle", map[string]interface{}{"layer": "repository", "operation": "LockThrottle"})
+		return err
+	}
+	logger.LogDebug("Auth throttle locked", map[string]interface{}{"layer": "repository", "operation": "LockThrottle"})
+	return nil
+}
+
+func (r *authThrottleRepo) ClearThrottle(throttleKey string) error {
+	_, err := r.db.Exec("DELETE FROM auth_throttles WHERE throttle_key = $1", throttleKey)
+	if err != nil {
+		logger.LogError(err, "Failed to clear auth throttle", map[string]interface{}{"layer": "repository", "operation": "ClearThrottle"})
+		return err
+	}
+	return nil
+}
+
+// ClearThrottleByUnlockToken removes the lock the emailed unlock link belongs to and returns its key
+func (r *authThrottleRepo) ClearThrottleByUnlockToken(unlockTokenHash string) (string, error) {
+	var throttleKey string
+	query := "DELETE FROM auth_throttles WHERE unlock_token_hash = $1 AND locked_until > CURRENT_TIMESTAMP RETURNING throttle_key"
+	err := r.db.Get(&throttleKey, query, unlockTokenHash)
+	if err != nil {
+		logger.LogError(err, "Failed to clear auth throttle by unlock token", map[string]interface{}{"layer": "repository", "operation": "ClearThrottleByUnlockToken"})
+		return "", err
+	}
+	return throttleKey, nil
+}
+
+// DeleteStaleThrottles removes counters without a recent failure that aren't locked, they would start over anyway
+func (r *authThrottleRepo) DeleteStaleThrottles(lastFailureBefore time.Time) (int64, error) {
+	query := "DELETE FROM auth_throttles WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until <= CURRENT_TIMESTAMP)"
+	result, err := r.db.Exec(query, lastFailureBefore)
+	if err != nil {
+		logger.LogError(err, "Failed to delete stale auth throttles", map[string]interface{}{"layer": "repository", "operation": "DeleteStaleThrottles"})
+		return 0, err
+	}
+	deleted, _ := result.RowsAffected()
+	logger.LogDebug("Stale auth throttles deleted", map[string]interface{}{"layer": "repository", "operation": "DeleteStaleThrottles", "count": int(deleted)})
+	return deleted, nil
+}
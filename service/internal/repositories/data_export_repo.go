@@ -0,0 +1,131 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type DataExportRepo interface {
+	CreateExport(userID int) (*models.DataExport, error)
+	ListExportsByUser(userID int) ([]*models.DataExport, error)
+	CountRecentExports(userID int, since time.Time) (int, error)
+	ClaimNextExport(staleAfter time.Duration) (*models.DataExport, error)
+	MarkExportReady(exportID int, objectKey string, sizeBytes int64, downloadTokenHash string, expiresAt time.Time) error
+	MarkExportFailed(exportID int, reason string) error
+	FindReadyExportByTokenHash(downloadTokenHash string) (*models.DataExport, error)
+	GetExpiredExports() ([]*models.DataExport, error)
+	MarkExportExpired(exportID int) error
+}
+
+type dataExportRepo struct {
+	db *sqlx.DB
+}
+
+func NewDataExportRepo(db *sqlx.DB) DataExportRepo {
+	return &dataExportRepo{db: db}
+}
+
+const dataExportColumns = "export_id, user_id, status, object_key, size_bytes, download_token_hash, error, requested_at, started_at, completed_at, expires_at"
+
+func (r *dataExportRepo) CreateExport(userID int) (*models.DataExport, error) {
+	var export models.DataExport
+	query := "INSERT INTO data_exports (user_id, status) VALUES ($1, $2) RETURNING " + dataExportColumns
+	if err := r.db.Get(&export, query, userID, models.DataExportPending); err != nil {
+		logger.LogError(err, "Failed to create data export", map[string]interface{}{"layer": "repository", "operation": "CreateExport", "userID": userID})
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (r *dataExportRepo) ListExportsByUser(userID int) ([]*models.DataExport, error) {
+	var exports []*models.DataExport
+	query := "SELECT " + dataExportColumns + " FROM data_exports WHERE user_id = $1 ORDER BY requested_at DESC LIMIT 20"
+	if err := r.db.Select(&exports, query, userID); err != nil {
+		logger.LogError(err, "Failed to list data exports", map[string]interface{}{"layer": "repository", "operation": "ListExportsByUser", "userID": userID})
+		return nil, err
+	}
+	return exports, nil
+}
+
+// CountRecentExports counts exports that are queued, running or delivered since the given time, failed ones don't use up the quota
+func (r *dataExportRepo) CountRecentExports(userID int, since time.Time) (int, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM data_exports WHERE user_id = $1 AND requested_at > $2 AND status <> $3"
+	if err := r.db.Get(&count, query, userID, since, models.DataExportFailed); err != nil {
+		logger.LogError(err, "Failed to count data exports", map[string]interface{}{"layer": "repository", "operation": "CountRecentExports", "userID": userID})
+		return 0, err
+	}
+	return count, nil
+}
+
+// ClaimNextExport takes the oldest pending export, or one whose worker died (running longer than staleAfter); nil when there is nothing to do
+func (r *dataExportRepo) ClaimNextExport(staleAfter time.Duration) (*models.DataExport, error) {
+	var exports []*models.DataExport
+	query := `UPDATE data_exports SET status = $1, started_at = CURRENT_TIMESTAMP
+		WHERE export_id = (
+			SELECT export_id FROM data_exports
+			WHERE status = $2 OR (status = $1 AND started_at < $3)
+			ORDER BY requested_at LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + dataExportColumns
+	if err := r.db.Select(&exports, query, models.DataExportRunning, models.DataExportPending, time.Now().Add(-staleAfter)); err != nil {
+		logger.LogError(err, "Failed to claim data export", map[string]interface{}{"layer": "repository", "operation": "ClaimNextExport"})
+		return nil, err
+	}
+	if len(exports) == 0 {
+		return nil, nil
+	}
+	return exports[0], nil
+}
+
+func (r *dataExportRepo) MarkExportReady(exportID int, objectKey string, sizeBytes int64, downloadTokenHash string, expiresAt time.Time) error {
+	query := `UPDATE data_exports SET status = $1, object_key = $2, size_bytes = $3, download_token_hash = $4, expires_at = $5, completed_at = CURRENT_TIMESTAMP, error = NULL
+		WHERE export_id = $6`
+	_, err := r.db.Exec(query, models.DataExportReady, objectKey, sizeBytes, downloadTokenHash, expiresAt, exportID)
+	if err != nil {
+		logger.LogError(err, "Failed to mark data export ready", map[string]interface{}{"layer": "repository", "operation": "MarkExportReady", "exportID": exportID})
+	}
+	return err
+}
+
+func (r *dataExportRepo) MarkExportFailed(exportID int, reason string) error {
+	query := "UPDATE data_exports SET status = $1, error = $2, completed_at = CURRENT_TIMESTAMP WHERE export_id = $3"
+	_, err := r.db.Exec(query, models.DataExportFailed, reason, exportID)
+	if err != nil {
+		logger.LogError(err, "Failed to mark data export failed", map[string]interface{}{"layer": "repository", "operation": "MarkExportFailed", "exportID": exportID})
+	}
+	return err
+}
+
+func (r *dataExportRepo) FindReadyExportByTokenHash(downloadTokenHash string) (*models.DataExport, error) {
+	var export models.DataExport
+	query := "SELECT " + dataExportColumns + " FROM data_exports WHERE download_token_hash = $1 AND status = $2 AND expires_at > CURRENT_TIMESTAMP"
+	if err := r.db.Get(&export, query, downloadTokenHash, models.DataExportReady); err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (r *dataExportRepo) GetExpiredExports() ([]*models.DataExport, error) {
+	var exports []*models.DataExport
+	query := "SELECT " + dataExportColumns + " FROM data_exports WHERE status = $1 AND expires_at <= CURRENT_TIMESTAMP"
+	if err := r.db.Select(&exports, query, models.DataExportReady); err != nil {
+		logger.LogError(err, "Failed to get expired data exports", map[string]interface{}{"layer": "repository", "operation": "GetExpiredExports"})
+		return nil, err
+	}
+	return exports, nil
+}
+
+// MarkExportExpired also drops the download token, the archive is gone
+func (r *dataExportRepo) MarkExportExpired(exportID int) error {
+	query := "UPDATE data_exports SET status = $1, download_token_hash = NULL WHERE export_id = $2"
+	_, err := r.db.Exec(query, models.DataExportExpired, exportID)
+	if err != nil {
+		logger.LogError(err, "Failed to mark data export expired", map[string]interface{}{"layer": "repository", "operation": "MarkExportExpired", "exportID": exportID})
+	}
+	return err
+}
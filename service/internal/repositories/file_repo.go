@@ -1,9 +1,12 @@
 package repositories
 
 import (
+	"service/internal/logger"
 	"service/internal/models"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type FileRepo interface {
@@ -11,8 +14,14 @@ type FileRepo interface {
 	GetFileMetadata(fileID int, userID int) (*models.File, error)
 	GetFilesMetadataByUser(userID int) ([]*models.File, error)
 	DeleteFileMetadata(fileID int, userID int) error
-	UpdateUserStorage(userID int, fileSize int64, packageType string) error
+	UpdateUserStorage(userID int, fileSize int64, planID string) error
 	GetUserStorage(userID int) (*models.UserStorage, error)
+	SetStorageLimit(userID int, planID string, storageLimit *int64) error
+	RecalculateUserStorage(userID int) (*models.UserStorage, error)
+	MarkDowngradedPools(now time.Time) ([]*models.DowngradedPool, error)
+	ListFilesToArchive(downgradedBefore time.Time, limit int) ([]*models.File, error)
+	ArchiveFile(fileID int, archiveKey string) (bool, error)
+	MoveFilesToPool(userID int, fileIDs []int, planID string) error
 }
 
 type fileRepo struct {
@@ -23,6 +32,8 @@ func NewFileRepo(db *sqlx.DB) FileRepo {
 	return &fileRepo{db: db}
 }
 
+const fileColumns = "file_id, user_id, file_name, file_size, s3_object_key, content_type, created_at, uploaded_with_package, archived_at"
+
 func (r *fileRepo) CreateFileMetadata(file *models.File) error {
 	query := "INSERT INTO files (user_id, file_name, file_size, s3_object_key, content_type, created_at, uploaded_with_package) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING file_id"
 	return r.db.QueryRowx(query, file.UserID, file.FileName, file.FileSize, file.S3ObjectKey, file.ContentType, file.CreatedAt, file.UploadedWithPackage).Scan(&file.FileID)
@@ -30,14 +41,14 @@ func (r *fileRepo) CreateFileMetadata(file *models.File) error {
 
 func (r *fileRepo) GetFileMetadata(fileID int, userID int) (*models.File, error) {
 	file := &models.File{}
-	query := "SELECT file_id, user_id, file_name, file_size, s3_object_key, content_type, created_at, uploaded_with_package FROM files WHERE file_id = $1 AND user_id = $2"
+	query := "SELECT " + fileColumns + " FROM files WHERE file_id = $1 AND user_id = $2"
 	err := r.db.Get(file, query, fileID, userID)
 	return file, err
 }
 
 func (r *fileRepo) GetFilesMetadataByUser(userID int) ([]*models.File, error) {
 	var files []*models.File
-	query := "SELECT file_id, user_id, file_name, file_size, s3_object_key, content_type, created_at, uploaded_with_package FROM files WHERE user_id = $1"
+	query := "SELECT " + fileColumns + " FROM files WHERE user_id = $1"
 	err := r.db.Select(&files, query, userID)
 	return files, err
 }
@@ -48,20 +59,158 @@ func (r *fileRepo) DeleteFileMetadata(fileID int, userID int) error {
 	return err
 }
 
-func (r *fileRepo) UpdateUserStorage(userID int, fileSize int64, packageType string) error {
-	var query string
-	if packageType == "premium" {
-		query = "UPDATE users SET premium_storage_used = premium_storage_used + $1 WHERE user_id = $2"
-	} else {
-		query = "UPDATE users SET free_storage_used = free_storage_used + $1 WHERE user_id = $2"
-	}
-	_, err := r.db.Exec(query, fileSize, userID)
+// UpdateUserStorage adds fileSize (negative on delete) to the pool of the plan the file was uploaded on
+func (r *fileRepo) UpdateUserStorage(userID int, fileSize int64, planID string) error {
+	query := `INSERT INTO user_storage (user_id, plan_id, storage_used) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, plan_id) DO UPDATE SET storage_used = user_storage.storage_used + EXCLUDED.storage_used`
+	_, err := r.db.Exec(query, userID, planID, fileSize)
 	return err
 }
 
+// GetUserStorage returns the pools the user has a row for plus the pool of their current plan, limits fall back to the plan quota
 func (r *fileRepo) GetUserStorage(userID int) (*models.UserStorage, error) {
-	storage := &models.UserStorage{}
-	query := "SELECT user_id, free_storage_used, free_storage_limit, premium_storage_used, premium_storage_limit FROM users WHERE user_id = $1"
-	err := r.db.Get(storage, query, userID)
+	storage := &models.UserStorage{UserID: userID, Pools: []*models.StoragePool{}}
+	query := `SELECT p.plan_id, COALESCE(s.storage_used, 0) AS storage_used, COALESCE(s.storage_limit, p.storage_quota) AS storage_limit,
+			s.storage_limit IS NOT NULL AS limit_overridden, s.downgraded_at
+		FROM plans p
+		JOIN users u ON u.user_id = $1
+		LEFT JOIN user_storage s ON s.user_id = u.user_id AND s.plan_id = p.plan_id
+		WHERE s.plan_id IS NOT NULL OR p.plan_id = u.package
+		ORDER BY p.tier_rank`
+	err := r.db.Select(&storage.Pools, query, userID)
 	return storage, err
 }
+
+// SetStorageLimit overrides the quota of one pool for the user, a nil limit goes back to the plan quota
+func (r *fileRepo) SetStorageLimit(userID int, planID string, storageLimit *int64) error {
+	query := `INSERT INTO user_storage (user_id, plan_id, storage_limit) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, plan_id) DO UPDATE SET storage_limit = EXCLUDED.storage_limit`
+	if _, err := r.db.Exec(query, userID, planID, storageLimit); err != nil {
+		logger.LogError(err, "Failed to set storage limit", map[string]interface{}{"layer": "repository", "operation": "SetStorageLimit", "userID": userID, "planID": planID})
+		return err
+	}
+	return nil
+}
+
+// RecalculateUserStorage sets the usage counters to the sum of the user's file rows, fixing any drift from failed uploads or deletes
+func (r *fileRepo) RecalculateUserStorage(userID int) (*models.UserStorage, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "RecalculateUserStorage", "userID": userID})
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE user_storage SET storage_used = 0 WHERE user_id = $1", userID); err != nil {
+		logger.LogError(err, "Failed to reset user storage", map[string]interface{}{"layer": "repository", "operation": "RecalculateUserStorage", "userID": userID})
+		return nil, err
+	}
+	query := `INSERT INTO user_storage (user_id, plan_id, storage_used)
+		SELECT user_id, uploaded_with_package, SUM(file_size) FROM files WHERE user_id = $1 GROUP BY user_id, uploaded_with_package
+		ON CONFLICT (user_id, plan_id) DO UPDATE SET storage_used = EXCLUDED.storage_used`
+	if _, err := tx.Exec(query, userID); err != nil {
+		logger.LogError(err, "Failed to recalculate user storage", map[string]interface{}{"layer": "repository", "operation": "RecalculateUserStorage", "userID": userID})
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit user storage", map[string]interface{}{"layer": "repository", "operation": "RecalculateUserStorage", "userID": userID})
+		return nil, err
+	}
+	return r.GetUserStorage(userID)
+}
+
+// MarkDowngradedPools stamps the pools whose plan is above the user's current one with when the user lost it (their plan expiry,
+// or now when that is unknown) and clears the stamp of pools the user has again; an expired plan counts as the default plan
+// even before the scheduler moved the user off it. Returns the pools stamped by this call
+func (r *fileRepo) MarkDowngradedPools(now time.Time) ([]*models.DowngradedPool, error) {
+	var pools []*models.DowngradedPool
+	query := `WITH changed AS (
+			UPDATE user_storage s
+			SET downgraded_at = CASE WHEN p.tier_rank > cur.tier_rank THEN LEAST(COALESCE(u.package_expiry, $1), $1) END
+			FROM users u, plans p, plans cur
+			WHERE u.user_id = s.user_id AND p.plan_id = s.plan_id
+				AND cur.plan_id = CASE WHEN u.package_expiry <= $1 THEN (SELECT plan_id FROM plans WHERE is_default LIMIT 1) ELSE u.package END
+				AND (p.tier_rank > cur.tier_rank) = (s.downgraded_at IS NULL)
+			RETURNING s.user_id, s.plan_id, s.downgraded_at
+		)
+		SELECT user_id, plan_id, downgraded_at FROM changed WHERE downgraded_at IS NOT NULL`
+	if err := r.db.Select(&pools, query, now); err != nil {
+		logger.LogError(err, "Failed to mark downgraded pools", map[string]interface{}{"layer": "repository", "operation": "MarkDowngradedPools"})
+		return nil, err
+	}
+	return pools, nil
+}
+
+// ListFilesToArchive returns files not archived yet from pools downgraded before downgradedBefore
+func (r *fileRepo) ListFilesToArchive(downgradedBefore time.Time, limit int) ([]*models.File, error) {
+	var files []*models.File
+	query := `SELECT f.file_id, f.user_id, f.file_name, f.file_size, f.s3_object_key, f.content_type, f.created_at, f.uploaded_with_package, f.archived_at
+		FROM files f JOIN user_storage s ON s.user_id = f.user_id AND s.plan_id = f.uploaded_with_package
+		WHERE s.downgraded_at <= $1 AND f.archived_at IS NULL
+		ORDER BY s.downgraded_at, f.file_id
+		LIMIT $2`
+	if err := r.db.Select(&files, query, downgradedBefore, limit); err != nil {
+		logger.LogError(err, "Failed to list files to archive", map[string]interface{}{"layer": "repository", "operation": "ListFilesToArchive"})
+		return nil, err
+	}
+	return files, nil
+}
+
+// ArchiveFile points the file at its archived copy, false means it was archived, deleted or kept in the meantime
+func (r *fileRepo) ArchiveFile(fileID int, archiveKey string) (bool, error) {
+	query := `UPDATE files f SET s3_object_key = $2, archived_at = CURRENT_TIMESTAMP
+		FROM user_storage s
+		WHERE f.file_id = $1 AND f.archived_at IS NULL
+			AND s.user_id = f.user_id AND s.plan_id = f.uploaded_with_package AND s.downgraded_at IS NOT NULL`
+	result, err := r.db.Exec(query, fileID, archiveKey)
+	if err != nil {
+		logger.LogError(err, "Failed to archive file", map[string]interface{}{"layer": "repository", "operation": "ArchiveFile", "fileID": fileID})
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// MoveFilesToPool charges the files to the plan's pool instead of the pool they were uploaded on, the usage of both moves with them
+func (r *fileRepo) MoveFilesToPool(userID int, fileIDs []int, planID string) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "MoveFilesToPool", "userID": userID})
+		return err
+	}
+	defer tx.Rollback()
+
+	var moved []struct {
+		PlanID string `db:"plan_id"`
+		Size   int64  `db:"size"`
+	}
+	query := `WITH old AS (
+			SELECT file_id, file_size, uploaded_with_package FROM files
+			WHERE user_id = $1 AND file_id = ANY($2) AND uploaded_with_package <> $3
+			FOR UPDATE
+		), updated AS (
+			UPDATE files f SET uploaded_with_package = $3 FROM old WHERE f.file_id = old.file_id
+		)
+		SELECT uploaded_with_package AS plan_id, SUM(file_size) AS size FROM old GROUP BY uploaded_with_package`
+	if err := tx.Select(&moved, query, userID, pq.Array(fileIDs), planID); err != nil {
+		logger.LogError(err, "Failed to move files", map[string]interface{}{"layer": "repository", "operation": "MoveFilesToPool", "userID": userID})
+		return err
+	}
+	storageQuery := `INSERT INTO user_storage (user_id, plan_id, storage_used) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, plan_id) DO UPDATE SET storage_used = user_storage.storage_used + EXCLUDED.storage_used`
+	for _, pool := range moved {
+		if _, err := tx.Exec(storageQuery, userID, pool.PlanID, -pool.Size); err != nil {
+			logger.LogError(err, "Failed to update user storage", map[string]interface{}{"layer": "repository", "operation": "MoveFilesToPool", "userID": userID})
+			return err
+		}
+		if _, err := tx.Exec(storageQuery, userID, planID, pool.Size); err != nil {
+			logger.LogError(err, "Failed to update user storage", map[string]interface{}{"layer": "repository", "operation": "MoveFilesToPool", "userID": userID})
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit moved files", map[string]interface{}{"layer": "repository", "operation": "MoveFilesToPool", "userID": userID})
+		return err
+	}
+	return nil
+}
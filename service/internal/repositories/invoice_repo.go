@@ -0,0 +1,138 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type InvoiceRepo interface {
+	CreateInvoice(invoice *models.Invoice) (bool, error)
+	GetInvoice(invoiceID int) (*models.Invoice, error)
+	ListInvoicesByUser(userID, limit, offset int) ([]*models.Invoice, error)
+	ListInvoices(filter models.InvoiceFilter, limit, offset int) ([]*models.Invoice, error)
+	SummarizeInvoices(filter models.InvoiceFilter) ([]*models.InvoiceTotals, error)
+	MarkInvoiceRefunded(checkoutID string) error
+}
+
+type invoiceRepo struct {
+	db *sqlx.DB
+}
+
+func NewInvoiceRepo(db *sqlx.DB) InvoiceRepo {
+	return &invoiceRepo{db: db}
+}
+
+const invoiceColumns = "invoice_id, invoice_number, user_id, checkout_id, status, billing_email, currency, subtotal, tax_rate_bps, tax_amount, total, provider, issued_at, refunded_at"
+
+// invoiceFilterCondition matches models.InvoiceFilter passed as $1 to $4
+const invoiceFilterCondition = `($1 = 0 OR user_id = $1)
+	AND ($2 = '' OR status = $2)
+	AND ($3::timestamp IS NULL OR issued_at >= $3)
+	AND ($4::timestamp IS NULL OR issued_at < $4)`
+
+// CreateInvoice inserts the invoice with its lines, false means the checkout already has an invoice
+func (r *invoiceRepo) CreateInvoice(invoice *models.Invoice) (bool, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "CreateInvoice"})
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO invoices (user_id, checkout_id, status, billing_email, currency, subtotal, tax_rate_bps, tax_amount, total, provider)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (checkout_id) DO NOTHING
+		RETURNING invoice_id, invoice_number, issued_at`
+	rows, err := tx.Query(query, invoice.UserID, invoice.CheckoutID, invoice.Status, invoice.BillingEmail, invoice.Currency,
+		invoice.Subtotal, invoice.TaxRateBps, invoice.TaxAmount, invoice.Total, invoice.Provider)
+	if err != nil {
+		logger.LogError(err, "Failed to create invoice", map[string]interface{}{"layer": "repository", "operation": "CreateInvoice", "checkoutID": invoice.CheckoutID})
+		return false, err
+	}
+	created := rows.Next()
+	if created {
+		err = rows.Scan(&invoice.InvoiceID, &invoice.InvoiceNumber, &invoice.IssuedAt)
+	}
+	rows.Close()
+	if err != nil || !created {
+		return false, err
+	}
+
+	for _, line := range invoice.Lines {
+		line.InvoiceID = invoice.InvoiceID
+		query := `INSERT INTO invoice_lines (invoice_id, description, plan_id, quantity, unit_amount, amount, period_start, period_end)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING line_id`
+		err := tx.QueryRowx(query, line.InvoiceID, line.Description, line.PlanID, line.Quantity, line.UnitAmount, line.Amount,
+			line.PeriodStart, line.PeriodEnd).Scan(&line.LineID)
+		if err != nil {
+			logger.LogError(err, "Failed to create invoice line", map[string]interface{}{"layer": "repository", "operation": "CreateInvoice", "invoiceID": invoice.InvoiceID})
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit invoice", map[string]interface{}{"layer": "repository", "operation": "CreateInvoice", "checkoutID": invoice.CheckoutID})
+		return false, err
+	}
+	return true, nil
+}
+
+// GetInvoice returns the invoice with its lines, sql.ErrNoRows when there is none
+func (r *invoiceRepo) GetInvoice(invoiceID int) (*models.Invoice, error) {
+	var invoice models.Invoice
+	if err := r.db.Get(&invoice, "SELECT "+invoiceColumns+" FROM invoices WHERE invoice_id = $1", invoiceID); err != nil {
+		return nil, err
+	}
+	query := `SELECT line_id, invoice_id, description, plan_id, quantity, unit_amount, amount, period_start, period_end
+		FROM invoice_lines WHERE invoice_id = $1 ORDER BY line_id`
+	if err := r.db.Select(&invoice.Lines, query, invoiceID); err != nil {
+		logger.LogError(err, "Failed to get invoice lines", map[string]interface{}{"layer": "repository", "operation": "GetInvoice", "invoiceID": invoiceID})
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+func (r *invoiceRepo) ListInvoicesByUser(userID, limit, offset int) ([]*models.Invoice, error) {
+	var invoices []*models.Invoice
+	query := "SELECT " + invoiceColumns + " FROM invoices WHERE user_id = $1 ORDER BY issued_at DESC, invoice_id DESC LIMIT $2 OFFSET $3"
+	if err := r.db.Select(&invoices, query, userID, limit, offset); err != nil {
+		logger.LogError(err, "Failed to list invoices", map[string]interface{}{"layer": "repository", "operation": "ListInvoicesByUser", "userID": userID})
+		return nil, err
+	}
+	return invoices, nil
+}
+
+func (r *invoiceRepo) ListInvoices(filter models.InvoiceFilter, limit, offset int) ([]*models.Invoice, error) {
+	var invoices []*models.Invoice
+	query := "SELECT " + invoiceColumns + " FROM invoices WHERE " + invoiceFilterCondition + " ORDER BY issued_at DESC, invoice_id DESC LIMIT $5 OFFSET $6"
+	if err := r.db.Select(&invoices, query, filter.UserID, filter.Status, filter.Since, filter.Until, limit, offset); err != nil {
+		logger.LogError(err, "Failed to list invoices", map[string]interface{}{"layer": "repository", "operation": "ListInvoices"})
+		return nil, err
+	}
+	return invoices, nil
+}
+
+// SummarizeInvoices totals every invoice matching the filter, not just one page of them
+func (r *invoiceRepo) SummarizeInvoices(filter models.InvoiceFilter) ([]*models.InvoiceTotals, error) {
+	var totals []*models.InvoiceTotals
+	query := `SELECT currency, status, COUNT(*) AS count, COALESCE(SUM(subtotal), 0) AS subtotal,
+			COALESCE(SUM(tax_amount), 0) AS tax_amount, COALESCE(SUM(total), 0) AS total
+		FROM invoices WHERE ` + invoiceFilterCondition + `
+		GROUP BY currency, status ORDER BY currency, status`
+	if err := r.db.Select(&totals, query, filter.UserID, filter.Status, filter.Since, filter.Until); err != nil {
+		logger.LogError(err, "Failed to summarize invoices", map[string]interface{}{"layer": "repository", "operation": "SummarizeInvoices"})
+		return nil, err
+	}
+	return totals, nil
+}
+
+func (r *invoiceRepo) MarkInvoiceRefunded(checkoutID string) error {
+	query := "UPDATE invoices SET status = $1, refunded_at = CURRENT_TIMESTAMP WHERE checkout_id = $2 AND status = $3"
+	if _, err := r.db.Exec(query, models.InvoiceRefunded, checkoutID, models.InvoicePaid); err != nil {
+		logger.LogError(err, "Failed to mark invoice refunded", map[string]interface{}{"layer": "repository", "operation": "MarkInvoiceRefunded", "checkoutID": checkoutID})
+		return err
+	}
+	return nil
+}
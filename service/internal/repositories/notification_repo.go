@@ -0,0 +1,118 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type NotificationRepo interface {
+	CreateNotification(notification *models.Notification) (bool, error)
+	ListExpiringSubscriptions(now time.Time, lead, minLead time.Duration) ([]*models.ExpiringSubscription, error)
+	FailInterruptedNotifications(claimedBefore time.Time) (int64, error)
+	ClaimDueNotifications(now time.Time, limit int) ([]*models.Notification, error)
+	FinishDelivery(notificationID int, status string, lastError *string, nextAttemptAt time.Time) error
+	ListNotificationsByUser(userID, limit, offset int) ([]*models.Notification, error)
+}
+
+type notificationRepo struct {
+	db *sqlx.DB
+}
+
+func NewNotificationRepo(db *sqlx.DB) NotificationRepo {
+	return &notificationRepo{db: db}
+}
+
+const notificationColumns = "notification_id, user_id, kind, dedupe_key, data, status, attempts, last_error, next_attempt_at, claimed_at, sent_at, created_at"
+
+// CreateNotification queues the notification, false means one with the same dedupe key was queued before
+func (r *notificationRepo) CreateNotification(notification *models.Notification) (bool, error) {
+	query := `INSERT INTO notifications (user_id, kind, dedupe_key, data, status, next_attempt_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (dedupe_key) DO NOTHING
+		RETURNING notification_id, created_at`
+	err := r.db.QueryRowx(query, notification.UserID, notification.Kind, notification.DedupeKey, notification.Data, models.NotificationPending,
+		notification.NextAttemptAt).Scan(&notification.NotificationID, &notification.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to create notification", map[string]interface{}{"layer": "repository", "operation": "CreateNotification", "dedupeKey": notification.DedupeKey})
+		return false, err
+	}
+	notification.Status = models.NotificationPending
+	return true, nil
+}
+
+// ListExpiringSubscriptions returns the running subscriptions whose access ends between now+minLead and now+lead,
+// leaving out the ones whose period started after that reminder point (a plan shorter than the reminder)
+func (r *notificationRepo) ListExpiringSubscriptions(now time.Time, lead, minLead time.Duration) ([]*models.ExpiringSubscription, error) {
+	var expiring []*models.ExpiringSubscription
+	query := `SELECT s.subscription_id, s.user_id, s.plan_id, u.package_expiry AS expires_at
+		FROM subscriptions s JOIN users u ON u.user_id = s.user_id AND u.package = s.plan_id
+		WHERE s.status NOT IN ('canceled', 'expired')
+			AND u.package_expiry > $1 + make_interval(secs => $3) AND u.package_expiry <= $1 + make_interval(secs => $2)
+			AND u.package_expiry - make_interval(secs => $2) >= s.current_period_start`
+	if err := r.db.Select(&expiring, query, now, lead.Seconds(), minLead.Seconds()); err != nil {
+		logger.LogError(err, "Failed to list expiring subscriptions", map[string]interface{}{"layer": "repository", "operation": "ListExpiringSubscriptions"})
+		return nil, err
+	}
+	return expiring, nil
+}
+
+// FailInterruptedNotifications gives up on sends that never finished, the email may have gone out so they aren't retried
+func (r *notificationRepo) FailInterruptedNotifications(claimedBefore time.Time) (int64, error) {
+	query := `UPDATE notifications SET status = $1, last_error = 'delivery was interrupted'
+		WHERE status = $2 AND claimed_at < $3`
+	result, err := r.db.Exec(query, models.NotificationFailed, models.NotificationSending, claimedBefore)
+	if err != nil {
+		logger.LogError(err, "Failed to fail interrupted notifications", map[string]interface{}{"layer": "repository", "operation": "FailInterruptedNotifications"})
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ClaimDueNotifications moves due pending notifications to sending and counts the attempt,
+// concurrent runs skip each other's rows so a notification is only ever sent by one of them
+func (r *notificationRepo) ClaimDueNotifications(now time.Time, limit int) ([]*models.Notification, error) {
+	var notifications []*models.Notification
+	query := `UPDATE notifications SET status = $1, attempts = attempts + 1, claimed_at = $3
+		WHERE notification_id IN (
+			SELECT notification_id FROM notifications
+			WHERE status = $2 AND next_attempt_at <= $3
+			ORDER BY next_attempt_at, notification_id
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + notificationColumns
+	if err := r.db.Select(&notifications, query, models.NotificationSending, models.NotificationPending, now, limit); err != nil {
+		logger.LogError(err, "Failed to claim notifications", map[string]interface{}{"layer": "repository", "operation": "ClaimDueNotifications"})
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// FinishDelivery records how the claimed send went, pending with nextAttemptAt schedules a retry
+func (r *notificationRepo) FinishDelivery(notificationID int, status string, lastError *string, nextAttemptAt time.Time) error {
+	query := `UPDATE notifications SET status = $1, last_error = $2, next_attempt_at = $3,
+			sent_at = CASE WHEN $1 = 'sent' THEN CURRENT_TIMESTAMP END
+		WHERE notification_id = $4 AND status = $5`
+	if _, err := r.db.Exec(query, status, lastError, nextAttemptAt, notificationID, models.NotificationSending); err != nil {
+		logger.LogError(err, "Failed to finish notification delivery", map[string]interface{}{"layer": "repository", "operation": "FinishDelivery", "notificationID": notificationID})
+		return err
+	}
+	return nil
+}
+
+func (r *notificationRepo) ListNotificationsByUser(userID, limit, offset int) ([]*models.Notification, error) {
+	var notifications []*models.Notification
+	query := "SELECT " + notificationColumns + " FROM notifications WHERE user_id = $1 ORDER BY created_at DESC, notification_id DESC LIMIT $2 OFFSET $3"
+	if err := r.db.Select(&notifications, query, userID, limit, offset); err != nil {
+		logger.LogError(err, "Failed to list notifications", map[string]interface{}{"layer": "repository", "operation": "ListNotificationsByUser", "userID": userID})
+		return nil, err
+	}
+	return notifications, nil
+}
@@ -0,0 +1,145 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type PaymentRepo interface {
+	CreateCheckout(checkout *models.Checkout) (bool, error)
+	GetCheckout(checkoutID string) (*models.Checkout, error)
+	GetCheckoutByIdempotencyKey(userID int, idempotencyKey string) (*models.Checkout, error)
+	GetCheckoutByPaymentID(provider, paymentID string) (*models.Checkout, error)
+	SetProviderSession(checkoutID, sessionID, checkoutURL string) error
+	TransitionCheckout(checkoutID string, from []string, to string, paymentID, reason *string) (bool, error)
+	RecordRefundedAmount(checkoutID string, refundedAmount int64) (bool, error)
+	ClaimPaymentEvent(provider, eventID, eventType string) (bool, error)
+	ReleasePaymentEvent(provider, eventID string) error
+	LinkPaymentEvent(provider, eventID, checkoutID string) error
+}
+
+type paymentRepo struct {
+	db *sqlx.DB
+}
+
+func NewPaymentRepo(db *sqlx.DB) PaymentRepo {
+	return &paymentRepo{db: db}
+}
+
+const checkoutColumns = "checkout_id, user_id, plan_id, provider, provider_session_id, provider_payment_id, checkout_url, amount, refunded_amount, promo_code, discount_amount, currency, status, idempotency_key, failure_reason, created_at, updated_at, expires_at"
+
+// CreateCheckout inserts the checkout, false means the user already has a checkout with the same idempotency key
+func (r *paymentRepo) CreateCheckout(checkout *models.Checkout) (bool, error) {
+	query := `INSERT INTO checkouts (checkout_id, user_id, plan_id, provider, amount, promo_code, discount_amount, currency, status, idempotency_key, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (user_id, idempotency_key) DO NOTHING
+		RETURNING created_at, updated_at`
+	rows, err := r.db.Query(query, checkout.CheckoutID, checkout.UserID, checkout.PlanID, checkout.Provider, checkout.Amount,
+		checkout.PromoCode, checkout.DiscountAmount, checkout.Currency, checkout.Status, checkout.IdempotencyKey, checkout.ExpiresAt)
+	if err != nil {
+		logger.LogError(err, "Failed to create checkout", map[string]interface{}{"layer": "repository", "operation": "CreateCheckout", "userID": checkout.UserID})
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	return true, rows.Scan(&checkout.CreatedAt, &checkout.UpdatedAt)
+}
+
+func (r *paymentRepo) GetCheckout(checkoutID string) (*models.Checkout, error) {
+	var checkout models.Checkout
+	if err := r.db.Get(&checkout, "SELECT "+checkoutColumns+" FROM checkouts WHERE checkout_id = $1", checkoutID); err != nil {
+		return nil, err
+	}
+	return &checkout, nil
+}
+
+func (r *paymentRepo) GetCheckoutByIdempotencyKey(userID int, idempotencyKey string) (*models.Checkout, error) {
+	var checkout models.Checkout
+	query := "SELECT " + checkoutColumns + " FROM checkouts WHERE user_id = $1 AND idempotency_key = $2"
+	if err := r.db.Get(&checkout, query, userID, idempotencyKey); err != nil {
+		return nil, err
+	}
+	return &checkout, nil
+}
+
+func (r *paymentRepo) GetCheckoutByPaymentID(provider, paymentID string) (*models.Checkout, error) {
+	var checkout models.Checkout
+	query := "SELECT " + checkoutColumns + " FROM checkouts WHERE provider = $1 AND provider_payment_id = $2"
+	if err := r.db.Get(&checkout, query, provider, paymentID); err != nil {
+		return nil, err
+	}
+	return &checkout, nil
+}
+
+func (r *paymentRepo) SetProviderSession(checkoutID, sessionID, checkoutURL string) error {
+	query := "UPDATE checkouts SET provider_session_id = $1, checkout_url = $2, updated_at = CURRENT_TIMESTAMP WHERE checkout_id = $3"
+	if _, err := r.db.Exec(query, sessionID, checkoutURL, checkoutID); err != nil {
+		logger.LogError(err, "Failed to store provider session", map[string]interface{}{"layer": "repository", "operation": "SetProviderSession", "checkoutID": checkoutID})
+		return err
+	}
+	return nil
+}
+
+// TransitionCheckout moves the checkout to the new status only while it is in one of the from statuses,
+// false means another event got there first; a nil paymentID or reason keeps the stored value
+func (r *paymentRepo) TransitionCheckout(checkoutID string, from []string, to string, paymentID, reason *string) (bool, error) {
+	query := `UPDATE checkouts SET status = $1, provider_payment_id = COALESCE($2, provider_payment_id),
+			failure_reason = COALESCE($3, failure_reason), updated_at = CURRENT_TIMESTAMP
+		WHERE checkout_id = $4 AND status = ANY($5)`
+	result, err := r.db.Exec(query, to, paymentID, reason, checkoutID, pq.Array(from))
+	if err != nil {
+		logger.LogError(err, "Failed to update checkout status", map[string]interface{}{"layer": "repository", "operation": "TransitionCheckout", "checkoutID": checkoutID, "status": to})
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// RecordRefundedAmount raises the refunded total of a paid checkout, false when it was already at least that much
+// (a redelivered or out of order event)
+func (r *paymentRepo) RecordRefundedAmount(checkoutID string, refundedAmount int64) (bool, error) {
+	query := `UPDATE checkouts SET refunded_amount = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE checkout_id = $2 AND status = $3 AND refunded_amount < $1`
+	result, err := r.db.Exec(query, refundedAmount, checkoutID, models.CheckoutPaid)
+	if err != nil {
+		logger.LogError(err, "Failed to record refunded amount", map[string]interface{}{"layer": "repository", "operation": "RecordRefundedAmount", "checkoutID": checkoutID})
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// ClaimPaymentEvent records a webhook event before it is handled, false means it was (or is being) handled already
+func (r *paymentRepo) ClaimPaymentEvent(provider, eventID, eventType string) (bool, error) {
+	query := "INSERT INTO payment_events (provider, event_id, event_type) VALUES ($1, $2, $3) ON CONFLICT (provider, event_id) DO NOTHING"
+	result, err := r.db.Exec(query, provider, eventID, eventType)
+	if err != nil {
+		logger.LogError(err, "Failed to claim payment event", map[string]interface{}{"layer": "repository", "operation": "ClaimPaymentEvent", "eventID": eventID})
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// ReleasePaymentEvent forgets an event whose handling failed, so the provider's redelivery is handled again
+func (r *paymentRepo) ReleasePaymentEvent(provider, eventID string) error {
+	if _, err := r.db.Exec("DELETE FROM payment_events WHERE provider = $1 AND event_id = $2", provider, eventID); err != nil {
+		logger.LogError(err, "Failed to release payment event", map[string]interface{}{"layer": "repository", "operation": "ReleasePaymentEvent", "eventID": eventID})
+		return err
+	}
+	return nil
+}
+
+// LinkPaymentEvent records which checkout a claimed event belongs to, so the event goes when the checkout is purged
+func (r *paymentRepo) LinkPaymentEvent(provider, eventID, checkoutID string) error {
+	if _, err := r.db.Exec("UPDATE payment_events SET checkout_id = $1 WHERE provider = $2 AND event_id = $3", checkoutID, provider, eventID); err != nil {
+		logger.LogError(err, "Failed to link payment event", map[string]interface{}{"layer": "repository", "operation": "LinkPaymentEvent", "eventID": eventID})
+		return err
+	}
+	return nil
+}
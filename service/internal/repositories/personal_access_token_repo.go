@@ -0,0 +1,106 @@
+package repositories
+
+import (
+	"database/sql"
+	"service/internal/logger"
+	"service/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type PersonalAccessTokenRepo interface {
+	CreateToken(token *models.PersonalAccessToken) error
+	ListTokensByUser(userID int) ([]*models.PersonalAccessToken, error)
+	CountActiveTokens(userID int) (int, error)
+	FindValidTokenByHash(tokenHash string) (*models.PersonalAccessToken, error)
+	RevokeToken(userID, tokenID int) error
+	RevokeAllTokens(userID int) error
+	TouchLastUsed(tokenID int) error
+}
+
+type personalAccessTokenRepo struct {
+	db *sqlx.DB
+}
+
+func NewPersonalAccessTokenRepo(db *sqlx.DB) PersonalAccessTokenRepo {
+	return &personalAccessTokenRepo{db: db}
+}
+
+func (r *personalAccessTokenRepo) CreateToken(token *models.PersonalAccessToken) error {
+	query := "INSERT INTO personal_access_tokens (user_id, name, token_prefix, token_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING token_id, created_at"
+	err := r.db.QueryRowx(query, token.UserID, token.Name, token.TokenPrefix, token.TokenHash, token.Scopes, token.ExpiresAt).Scan(&token.TokenID, &token.CreatedAt)
+	if err != nil {
+		logger.LogError(err, "Failed to create personal access token", map[string]interface{}{"layer": "repository", "operation": "CreateToken", "userID": token.UserID})
+		return err
+	}
+	logger.LogDebug("Personal access token created", map[string]interface{}{"layer": "repository", "operation": "CreateToken", "userID": token.UserID})
+	return nil
+}
+
+func (r *personalAccessTokenRepo) ListTokensByUser(userID int) ([]*models.PersonalAccessToken, error) {
+	var tokens []*models.PersonalAccessToken
+	query := "SELECT token_id, user_id, name, token_prefix, token_hash, scopes, expires_at, last_used_at, created_at, revoked FROM personal_access_tokens WHERE user_id = $1 AND revoked = false ORDER BY created_at DESC"
+	err := r.db.Select(&tokens, query, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to list personal access tokens", map[string]interface{}{"layer": "repository", "operation": "ListTokensByUser", "userID": userID})
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (r *personalAccessTokenRepo) CountActiveTokens(userID int) (int, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM personal_access_tokens WHERE user_id = $1 AND revoked = false AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)"
+	err := r.db.Get(&count, query, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to count personal access tokens", map[string]interface{}{"layer": "repository", "operation": "CountActiveTokens", "userID": userID})
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *personalAccessTokenRepo) FindValidTokenByHash(tokenHash string) (*models.PersonalAccessToken, error) {
+	var token models.PersonalAccessToken
+	query := "SELECT token_id, user_id, name, token_prefix, token_hash, scopes, expires_at, last_used_at, created_at, revoked FROM personal_access_tokens WHERE token_hash = $1 AND revoked = false AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)"
+	err := r.db.Get(&token, query, tokenHash)
+	if err != nil {
+		logger.LogError(err, "Failed to find personal access token", map[string]interface{}{"layer": "repository", "operation": "FindValidTokenByHash"})
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *personalAccessTokenRepo) RevokeAllTokens(userID int) error {
+	_, err := r.db.Exec("UPDATE personal_access_tokens SET revoked = true WHERE user_id = $1 AND revoked = false", userID)
+	if err != nil {
+		logger.LogError(err, "Failed to revoke personal access tokens", map[string]interface{}{"layer": "repository", "operation": "RevokeAllTokens", "userID": userID})
+		return err
+	}
+	logger.LogDebug("Personal access tokens revoked", map[string]interface{}{"layer": "repository", "operation": "RevokeAllTokens", "userID": userID})
+	return nil
+}
+
+func (r *personalAccessTokenRepo) RevokeToken(userID, tokenID int) error {
+	query := "UPDATE personal_access_tokens SET revoked = true WHERE token_id = $1 AND user_id = $2 AND revoked = false"
+	result, err := r.db.Exec(query, tokenID, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to revoke personal access token", map[string]interface{}{"layer": "repository", "operation": "RevokeToken", "userID": userID})
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return sql.ErrNoRows
+	}
+	logger.LogDebug("Personal access token revoked", map[string]interface{}{"layer": "repository", "operation": "RevokeToken", "userID": userID})
+	return nil
+}
+
+// TouchLastUsed records usage at most once a minute per token so busy CI jobs don't write on every request
+func (r *personalAccessTokenRepo) TouchLastUsed(tokenID int) error {
+	query := "UPDATE personal_access_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE token_id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')"
+	_, err := r.db.Exec(query, tokenID)
+	if err != nil {
+		logger.LogError(err, "Failed to update personal access token last use", map[string]interface{}{"layer": "repository", "operation": "TouchLastUsed"})
+		return err
+	}
+	return nil
+}
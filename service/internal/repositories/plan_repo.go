@@ -0,0 +1,69 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type PlanRepo interface {
+	ListPlans() ([]*models.Plan, error)
+	SavePlan(plan *models.Plan) error
+}
+
+type planRepo struct {
+	db *sqlx.DB
+}
+
+func NewPlanRepo(db *sqlx.DB) PlanRepo {
+	return &planRepo{db: db}
+}
+
+func (r *planRepo) ListPlans() ([]*models.Plan, error) {
+	var plans []*models.Plan
+	query := "SELECT plan_id, name, tier_rank, storage_quota, max_file_size, features, duration_seconds, trial_seconds, price_amount, currency, is_default, purchasable, created_at, updated_at FROM plans ORDER BY tier_rank, plan_id"
+	if err := r.db.Select(&plans, query); err != nil {
+		logger.LogError(err, "Failed to list plans", map[string]interface{}{"layer": "repository", "operation": "ListPlans"})
+		return nil, err
+	}
+	return plans, nil
+}
+
+// SavePlan creates the plan or updates it by plan_id, a new default plan takes the flag from the old one in the same transaction
+func (r *planRepo) SavePlan(plan *models.Plan) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "SavePlan"})
+		return err
+	}
+	defer tx.Rollback()
+
+	if plan.IsDefault {
+		if _, err := tx.Exec("UPDATE plans SET is_default = false, updated_at = CURRENT_TIMESTAMP WHERE is_default AND plan_id <> $1", plan.PlanID); err != nil {
+			logger.LogError(err, "Failed to clear default plan", map[string]interface{}{"layer": "repository", "operation": "SavePlan", "planID": plan.PlanID})
+			return err
+		}
+	}
+
+	query := `INSERT INTO plans (plan_id, name, tier_rank, storage_quota, max_file_size, features, duration_seconds, price_amount, currency, is_default, purchasable, trial_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (plan_id) DO UPDATE SET name = EXCLUDED.name, tier_rank = EXCLUDED.tier_rank, storage_quota = EXCLUDED.storage_quota,
+			max_file_size = EXCLUDED.max_file_size, features = EXCLUDED.features, duration_seconds = EXCLUDED.duration_seconds, trial_seconds = EXCLUDED.trial_seconds,
+			price_amount = EXCLUDED.price_amount, currency = EXCLUDED.currency, is_default = EXCLUDED.is_default,
+			purchasable = EXCLUDED.purchasable, updated_at = CURRENT_TIMESTAMP
+		RETURNING created_at, updated_at`
+	err = tx.QueryRowx(query, plan.PlanID, plan.Name, plan.TierRank, plan.StorageQuota, plan.MaxFileSize, plan.Features, plan.DurationSeconds,
+		plan.PriceAmount, plan.Currency, plan.IsDefault, plan.Purchasable, plan.TrialSeconds).Scan(&plan.CreatedAt, &plan.UpdatedAt)
+	if err != nil {
+		logger.LogError(err, "Failed to save plan", map[string]interface{}{"layer": "repository", "operation": "SavePlan", "planID": plan.PlanID})
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit plan", map[string]interface{}{"layer": "repository", "operation": "SavePlan", "planID": plan.PlanID})
+		return err
+	}
+	logger.LogDebug("Plan saved", map[string]interface{}{"layer": "repository", "operation": "SavePlan", "planID": plan.PlanID})
+	return nil
+}
@@ -0,0 +1,190 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type PromoRepo interface {
+	ListPromoCodes(limit, offset int) ([]*models.PromoCode, error)
+	GetPromoCode(code string) (*models.PromoCode, error)
+	SavePromoCode(promo *models.PromoCode) error
+	DeletePromoCode(code string) (bool, error)
+	ReserveRedemption(redemption *models.PromoRedemption, check func(promo *models.PromoCode, total, byUser int) error) error
+	SetRedemptionStatus(redemptionID int, from, to string) error
+	SetCheckoutRedemptionStatus(checkoutID, from, to string) error
+	ListRedemptions(code string, limit, offset int) ([]*models.PromoRedemption, error)
+	ReportRedemptions(since, until *time.Time) ([]*models.PromoCodeReport, error)
+}
+
+type promoRepo struct {
+	db *sqlx.DB
+}
+
+func NewPromoRepo(db *sqlx.DB) PromoRepo {
+	return &promoRepo{db: db}
+}
+
+const promoCodeColumns = "code, description, kind, percent_off, amount_off, currency, free_days, grant_plan_id, plan_ids, max_redemptions, max_per_user, valid_from, valid_until, active, created_at, updated_at"
+
+const timesRedeemedColumn = "(SELECT COUNT(*) FROM promo_redemptions r WHERE r.code = promo_codes.code AND r.status = 'redeemed') AS times_redeemed"
+
+const redemptionColumns = "redemption_id, code, user_id, checkout_id, plan_id, discount_amount, currency, free_days, status, created_at, redeemed_at"
+
+// heldRedemptionCondition matches the redemptions of $1 that count against the limits: redeemed ones, and pending ones
+// while they can still go through (their checkout can still be paid, or the free days are being granted right now)
+const heldRedemptionCondition = `r.code = $1 AND (r.status = 'redeemed' OR (r.status = 'pending' AND (
+		r.checkout_id IS NULL
+		OR c.status = 'paid'
+		OR (c.status IN ('pending', 'failed') AND c.expires_at > CURRENT_TIMESTAMP))))`
+
+func (r *promoRepo) ListPromoCodes(limit, offset int) ([]*models.PromoCode, error) {
+	var promos []*models.PromoCode
+	query := "SELECT " + promoCodeColumns + ", " + timesRedeemedColumn + " FROM promo_codes ORDER BY created_at DESC LIMIT $1 OFFSET $2"
+	if err := r.db.Select(&promos, query, limit, offset); err != nil {
+		logger.LogError(err, "Failed to list promo codes", map[string]interface{}{"layer": "repository", "operation": "ListPromoCodes"})
+		return nil, err
+	}
+	return promos, nil
+}
+
+// GetPromoCode returns sql.ErrNoRows for an unknown code
+func (r *promoRepo) GetPromoCode(code string) (*models.PromoCode, error) {
+	var promo models.PromoCode
+	query := "SELECT " + promoCodeColumns + ", " + timesRedeemedColumn + " FROM promo_codes WHERE code = $1"
+	if err := r.db.Get(&promo, query, code); err != nil {
+		return nil, err
+	}
+	return &promo, nil
+}
+
+// SavePromoCode creates the code or replaces every setting of an existing one
+func (r *promoRepo) SavePromoCode(promo *models.PromoCode) error {
+	query := `INSERT INTO promo_codes (code, description, kind, percent_off, amount_off, currency, free_days, grant_plan_id, plan_ids,
+			max_redemptions, max_per_user, valid_from, valid_until, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (code) DO UPDATE SET description = EXCLUDED.description, kind = EXCLUDED.kind, percent_off = EXCLUDED.percent_off,
+			amount_off = EXCLUDED.amount_off, currency = EXCLUDED.currency, free_days = EXCLUDED.free_days,
+			grant_plan_id = EXCLUDED.grant_plan_id, plan_ids = EXCLUDED.plan_ids, max_redemptions = EXCLUDED.max_redemptions,
+			max_per_user = EXCLUDED.max_per_user, valid_from = EXCLUDED.valid_from, valid_until = EXCLUDED.valid_until,
+			active = EXCLUDED.active, updated_at = CURRENT_TIMESTAMP
+		RETURNING created_at, updated_at`
+	err := r.db.QueryRowx(query, promo.Code, promo.Description, promo.Kind, promo.PercentOff, promo.AmountOff, promo.Currency,
+		promo.FreeDays, promo.GrantPlanID, promo.PlanIDs, promo.MaxRedemptions, promo.MaxPerUser, promo.ValidFrom, promo.ValidUntil,
+		promo.Active).Scan(&promo.CreatedAt, &promo.UpdatedAt)
+	if err != nil {
+		logger.LogError(err, "Failed to save promo code", map[string]interface{}{"layer": "repository", "operation": "SavePromoCode", "code": promo.Code})
+		return err
+	}
+	return nil
+}
+
+// DeletePromoCode only deletes codes nobody used, false means it has redemptions (or doesn't exist)
+func (r *promoRepo) DeletePromoCode(code string) (bool, error) {
+	query := "DELETE FROM promo_codes WHERE code = $1 AND NOT EXISTS (SELECT 1 FROM promo_redemptions WHERE code = $1)"
+	result, err := r.db.Exec(query, code)
+	if err != nil {
+		logger.LogError(err, "Failed to delete promo code", map[string]interface{}{"layer": "repository", "operation": "DeletePromoCode", "code": code})
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// ReserveRedemption inserts a pending redemption if check accepts the code, the code's row stays locked
+// from reading the counts to the insert so concurrent redemptions can't go over the limits
+func (r *promoRepo) ReserveRedemption(redemption *models.PromoRedemption, check func(promo *models.PromoCode, total, byUser int) error) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "ReserveRedemption"})
+		return err
+	}
+	defer tx.Rollback()
+
+	var promo models.PromoCode
+	if err := tx.Get(&promo, "SELECT "+promoCodeColumns+" FROM promo_codes WHERE code = $1 FOR UPDATE", redemption.Code); err != nil {
+		return err
+	}
+	var counts struct {
+		Total  int `db:"total"`
+		ByUser int `db:"by_user"`
+	}
+	query := `SELECT COUNT(*) AS total, COUNT(*) FILTER (WHERE r.user_id = $2) AS by_user
+		FROM promo_redemptions r LEFT JOIN checkouts c ON c.checkout_id = r.checkout_id
+		WHERE ` + heldRedemptionCondition
+	if err := tx.Get(&counts, query, redemption.Code, redemption.UserID); err != nil {
+		logger.LogError(err, "Failed to count redemptions", map[string]interface{}{"layer": "repository", "operation": "ReserveRedemption", "code": redemption.Code})
+		return err
+	}
+	if err := check(&promo, counts.Total, counts.ByUser); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO promo_redemptions (code, user_id, checkout_id, plan_id, discount_amount, currency, free_days, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING redemption_id, created_at`
+	err = tx.QueryRowx(query, redemption.Code, redemption.UserID, redemption.CheckoutID, redemption.PlanID, redemption.DiscountAmount,
+		redemption.Currency, redemption.FreeDays, models.RedemptionPending).Scan(&redemption.RedemptionID, &redemption.CreatedAt)
+	if err != nil {
+		logger.LogError(err, "Failed to reserve redemption", map[string]interface{}{"layer": "repository", "operation": "ReserveRedemption", "code": redemption.Code})
+		return err
+	}
+	redemption.Status = models.RedemptionPending
+
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit redemption", map[string]interface{}{"layer": "repository", "operation": "ReserveRedemption", "code": redemption.Code})
+		return err
+	}
+	return nil
+}
+
+func (r *promoRepo) SetRedemptionStatus(redemptionID int, from, to string) error {
+	query := `UPDATE promo_redemptions SET status = $1, redeemed_at = CASE WHEN $1 = 'redeemed' THEN CURRENT_TIMESTAMP ELSE redeemed_at END
+		WHERE redemption_id = $2 AND status = $3`
+	if _, err := r.db.Exec(query, to, redemptionID, from); err != nil {
+		logger.LogError(err, "Failed to update redemption", map[string]interface{}{"layer": "repository", "operation": "SetRedemptionStatus", "redemptionID": redemptionID})
+		return err
+	}
+	return nil
+}
+
+// SetCheckoutRedemptionStatus moves the redemption made with the checkout, checkouts without a code have none and nothing happens
+func (r *promoRepo) SetCheckoutRedemptionStatus(checkoutID, from, to string) error {
+	query := `UPDATE promo_redemptions SET status = $1, redeemed_at = CASE WHEN $1 = 'redeemed' THEN CURRENT_TIMESTAMP ELSE redeemed_at END
+		WHERE checkout_id = $2 AND status = $3`
+	if _, err := r.db.Exec(query, to, checkoutID, from); err != nil {
+		logger.LogError(err, "Failed to update checkout redemption", map[string]interface{}{"layer": "repository", "operation": "SetCheckoutRedemptionStatus", "checkoutID": checkoutID})
+		return err
+	}
+	return nil
+}
+
+func (r *promoRepo) ListRedemptions(code string, limit, offset int) ([]*models.PromoRedemption, error) {
+	var redemptions []*models.PromoRedemption
+	query := "SELECT " + redemptionColumns + " FROM promo_redemptions WHERE code = $1 ORDER BY created_at DESC, redemption_id DESC LIMIT $2 OFFSET $3"
+	if err := r.db.Select(&redemptions, query, code, limit, offset); err != nil {
+		logger.LogError(err, "Failed to list redemptions", map[string]interface{}{"layer": "repository", "operation": "ListRedemptions", "code": code})
+		return nil, err
+	}
+	return redemptions, nil
+}
+
+// ReportRedemptions sums the redeemed uses per code and currency, nil bounds don't filter
+func (r *promoRepo) ReportRedemptions(since, until *time.Time) ([]*models.PromoCodeReport, error) {
+	var report []*models.PromoCodeReport
+	query := `SELECT r.code, p.kind, COUNT(*) AS redemptions, COUNT(DISTINCT r.user_id) AS users, r.currency,
+			COALESCE(SUM(r.discount_amount), 0) AS discount_total, COALESCE(SUM(r.free_days), 0) AS free_days_granted
+		FROM promo_redemptions r JOIN promo_codes p ON p.code = r.code
+		WHERE r.status = 'redeemed'
+			AND ($1::timestamp IS NULL OR r.redeemed_at >= $1)
+			AND ($2::timestamp IS NULL OR r.redeemed_at < $2)
+		GROUP BY r.code, p.kind, r.currency
+		ORDER BY redemptions DESC, r.code`
+	if err := r.db.Select(&report, query, since, until); err != nil {
+		logger.LogError(err, "Failed to report redemptions", map[string]interface{}{"layer": "repository", "operation": "ReportRedemptions"})
+		return nil, err
+	}
+	return report, nil
+}
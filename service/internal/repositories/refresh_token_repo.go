@@ -1,17 +1,26 @@
 package repositories
 
 import (
+	"database/sql"
 	"service/internal/logger"
 	"service/internal/models"
+	"service/internal/utils"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
+// refresh tokens are stored as a hash, every method here accepts the raw token and hashes it before touching the database
 type RefreshTokenRepo interface {
 	StoreRefreshToken(refreshTokenStruct *models.RefreshToken) error
 	RevokeRefreshToken(refreshTokenString string) error
 	FindValidRefreshToken(refreshTokenString string) (*models.RefreshToken, error)
-	RevokeBasedOnUserID(userID int) error
+	FindRotatedRefreshToken(refreshTokenString string) (*models.RefreshToken, time.Time, error)
+	RevokeBasedOnUserID(userID int, exceptSessionID ...string) error
+	ListActiveSessions(userID int) ([]*models.Session, error)
+	RevokeSession(userID int, sessionID string) error
+	IsSessionActive(sessionID string) (bool, error)
 }
 
 type refreshTokenRepo struct {
@@ -23,8 +32,9 @@ func NewTokenRepository(db *sqlx.DB) RefreshTokenRepo {
 }
 
 func (r *refreshTokenRepo) StoreRefreshToken(refreshTokenStruct *models.RefreshToken) error {
-	query := "INSERT INTO refresh_tokens (user_id, refresh_token_value, expired_at, created_at, revoked) VALUES ($1, $2, $3, $4, $5)"
-	_, err := r.db.Exec(query, refreshTokenStruct.UserID, refreshTokenStruct.RefreshTokenValue, refreshTokenStruct.ExpiredAt, refreshTokenStruct.CreatedAt, refreshTokenStruct.Revoked)
+	query := "INSERT INTO refresh_tokens (user_id, refresh_token_hash, expired_at, created_at, revoked, session_id, session_label, user_agent, ip_address, session_created_at, last_used_at, remember_me) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)"
+	_, err := r.db.Exec(query, refreshTokenStruct.UserID, utils.HashToken(refreshTokenStruct.RefreshTokenValue), refreshTokenStruct.ExpiredAt, refreshTokenStruct.CreatedAt, refreshTokenStruct.Revoked,
+		refreshTokenStruct.SessionID, refreshTokenStruct.SessionLabel, refreshTokenStruct.UserAgent, refreshTokenStruct.IPAddress, refreshTokenStruct.SessionCreatedAt, refreshTokenStruct.LastUsedAt, refreshTokenStruct.RememberMe)
 	if err != nil {
 		logger.LogError(err, "Failed to store refresh token", map[string]interface{}{"layer": "repository", "operation": "StoreRefreshToken"})
 		return err
@@ -34,8 +44,8 @@ func (r *refreshTokenRepo) StoreRefreshToken(refreshTokenStruct *models.RefreshT
 }
 
 func (r *refreshTokenRepo) RevokeRefreshToken(refreshTokenString string) error {
-	query := "UPDATE refresh_tokens SET revoked = true WHERE refresh_token_value = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP"
-	_, err := r.db.Exec(query, refreshTokenString)
+	query := "UPDATE refresh_tokens SET revoked = true WHERE refresh_token_hash = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP"
+	_, err := r.db.Exec(query, utils.HashToken(refreshTokenString))
 	if err != nil {
 		logger.LogError(err, "Failed to revoke refresh token", map[string]interface{}{"layer": "repository", "operation": "RevokeRefreshToken"})
 		return err
@@ -46,8 +56,8 @@ func (r *refreshTokenRepo) RevokeRefreshToken(refreshTokenString string) error {
 
 func (r *refreshTokenRepo) FindValidRefreshToken(refreshTokenString string) (*models.RefreshToken, error) {
 	var refreshToken models.RefreshToken
-	query := "SELECT * FROM refresh_tokens WHERE refresh_token_value = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP"
-	err := r.db.Get(&refreshToken, query, refreshTokenString)
+	query := "SELECT refresh_token_id, user_id, refresh_token_hash, expired_at, created_at, revoked, session_id, session_label, user_agent, ip_address, session_created_at, last_used_at, remember_me FROM refresh_tokens WHERE refresh_token_hash = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP"
+	err := r.db.Get(&refreshToken, query, utils.HashToken(refreshTokenString))
 	if err != nil {
 		logger.LogError(err, "Failed to find valid refresh token", map[string]interface{}{"layer": "repository", "operation": "FindValidRefreshToken"})
 		return nil, err
@@ -56,10 +66,32 @@ func (r *refreshTokenRepo) FindValidRefreshToken(refreshTokenString string) (*mo
 	return &refreshToken, nil
 }
 
-// RevokeBasedOnUserID(userUD int) error query := UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP
-func (r *refreshTokenRepo) RevokeBasedOnUserID(userID int) error {
-	query := "UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP"
-	_, err := r.db.Exec(query, userID)
+// FindRotatedRefreshToken finds a revoked refresh token that was replaced by rotation and returns when its successor was issued,
+// presenting one again means the token was copied; tokens revoked by logout have no successor and aren't found
+func (r *refreshTokenRepo) FindRotatedRefreshToken(refreshTokenString string) (*models.RefreshToken, time.Time, error) {
+	var row struct {
+		models.RefreshToken
+		RotatedAt time.Time `db:"rotated_at"`
+	}
+	query := `SELECT t.refresh_token_id, t.user_id, t.refresh_token_hash, t.expired_at, t.created_at, t.revoked, t.session_id, t.session_label, t.user_agent, t.ip_address, t.session_created_at, t.last_used_at, t.remember_me,
+			successor.created_at AS rotated_at
+		FROM refresh_tokens t
+		JOIN LATERAL (SELECT created_at FROM refresh_tokens n WHERE n.session_id = t.session_id AND n.refresh_token_id > t.refresh_token_id ORDER BY n.refresh_token_id LIMIT 1) successor ON true
+		WHERE t.refresh_token_hash = $1 AND t.revoked = true`
+	if err := r.db.Get(&row, query, utils.HashToken(refreshTokenString)); err != nil {
+		return nil, time.Time{}, err
+	}
+	return &row.RefreshToken, row.RotatedAt, nil
+}
+
+// RevokeBasedOnUserID revokes every active refresh token of the user, sessions listed in exceptSessionID are kept (used for "log out everywhere else")
+func (r *refreshTokenRepo) RevokeBasedOnUserID(userID int, exceptSessionID ...string) error {
+	// a nil slice would bind NULL, and NOT (session_id = ANY(NULL)) matches no row at all
+	if exceptSessionID == nil {
+		exceptSessionID = []string{}
+	}
+	query := "UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP AND NOT (session_id = ANY($2))"
+	_, err := r.db.Exec(query, userID, pq.Array(exceptSessionID))
 	if err != nil {
 		logger.LogError(err, "Failed to revoke refresh token", map[string]interface{}{"layer": "repository", "operation": "RevokeBasedOnUserID"})
 		return err
@@ -67,3 +99,42 @@ func (r *refreshTokenRepo) RevokeBasedOnUserID(userID int) error {
 	logger.LogDebug("Refresh token revoked", map[string]interface{}{"layer": "repository", "operation": "RevokeBasedOnUserID"})
 	return nil
 }
+
+// ListActiveSessions returns one row per logged in device, rotation keeps only the newest refresh token of a session unrevoked
+func (r *refreshTokenRepo) ListActiveSessions(userID int) ([]*models.Session, error) {
+	var sessions []*models.Session
+	query := "SELECT session_id, session_label, user_agent, ip_address, session_created_at, last_used_at, expired_at, remember_me FROM refresh_tokens WHERE user_id = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP ORDER BY last_used_at DESC"
+	err := r.db.Select(&sessions, query, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to list active sessions", map[string]interface{}{"layer": "repository", "operation": "ListActiveSessions", "userID": userID})
+		return nil, err
+	}
+	logger.LogDebug("Active sessions listed", map[string]interface{}{"layer": "repository", "operation": "ListActiveSessions", "userID": userID})
+	return sessions, nil
+}
+
+func (r *refreshTokenRepo) RevokeSession(userID int, sessionID string) error {
+	query := "UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND session_id = $2 AND revoked = false AND expired_at > CURRENT_TIMESTAMP"
+	result, err := r.db.Exec(query, userID, sessionID)
+	if err != nil {
+		logger.LogError(err, "Failed to revoke session", map[string]interface{}{"layer": "repository", "operation": "RevokeSession", "userID": userID})
+		return err
+	}
+	// the session does not belong to the user or is already logged out
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return sql.ErrNoRows
+	}
+	logger.LogDebug("Session revoked", map[string]interface{}{"layer": "repository", "operation": "RevokeSession", "userID": userID})
+	return nil
+}
+
+func (r *refreshTokenRepo) IsSessionActive(sessionID string) (bool, error) {
+	var active bool
+	query := "SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE session_id = $1 AND revoked = false AND expired_at > CURRENT_TIMESTAMP)"
+	err := r.db.Get(&active, query, sessionID)
+	if err != nil {
+		logger.LogError(err, "Failed to check session", map[string]interface{}{"layer": "repository", "operation": "IsSessionActive"})
+		return false, err
+	}
+	return active, nil
+}
@@ -0,0 +1,76 @@
+package repositories
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recordingDriver accepts every statement and remembers the arguments it was executed with
+type recordingDriver struct {
+	mu   sync.Mutex
+	args [][]driver.Value
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{driver: d}, nil }
+
+type recordingConn struct{ driver *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{driver: c.driver}, nil
+}
+func (c *recordingConn) Close() error { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type recordingStmt struct{ driver *recordingDriver }
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.driver.mu.Lock()
+	defer s.driver.mu.Unlock()
+	s.driver.args = append(s.driver.args, args)
+	return driver.RowsAffected(0), nil
+}
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("queries are not supported")
+}
+
+var recording = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", recording)
+}
+
+func TestRevokeBasedOnUserIDWithoutExceptionsBindsEmptyArray(t *testing.T) {
+	db, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	repo := NewTokenRepository(sqlx.NewDb(db, "postgres"))
+
+	recording.mu.Lock()
+	recording.args = nil
+	recording.mu.Unlock()
+
+	if err := repo.RevokeBasedOnUserID(42); err != nil {
+		t.Fatalf("RevokeBasedOnUserID: %v", err)
+	}
+
+	recording.mu.Lock()
+	defer recording.mu.Unlock()
+	if len(recording.args) != 1 || len(recording.args[0]) != 2 {
+		t.Fatalf("expected one exec with two arguments, got %v", recording.args)
+	}
+	// NULL would make NOT (session_id = ANY($2)) NULL and revoke nothing
+	if got := recording.args[0][1]; got != "{}" {
+		t.Fatalf("exceptions bound as %#v, want the empty array {}", got)
+	}
+}
@@ -0,0 +1,102 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// advisory lock id so only one instance rotates the signing key at a time
+const signingKeyRotationLockID = 728301
+
+type SigningKeyRepo interface {
+	GetVerificationKeys(verificationGrace time.Duration) ([]*models.SigningKey, error)
+	RotateSigningKey(newKey *models.SigningKey, rotationInterval, verificationGrace, publishLead time.Duration, force bool) (bool, error)
+}
+
+type signingKeyRepo struct {
+	db *sqlx.DB
+}
+
+func NewSigningKeyRepo(db *sqlx.DB) SigningKeyRepo {
+	return &signingKeyRepo{db: db}
+}
+
+// GetVerificationKeys returns the published keys: the next key, the current signing key and every key rotated out less than
+// verificationGrace ago, newest first
+func (r *signingKeyRepo) GetVerificationKeys(verificationGrace time.Duration) ([]*models.SigningKey, error) {
+	var keys []*models.SigningKey
+	query := `SELECT kid, algorithm, encrypted_private_key, created_at, active_from, rotated_at FROM jwt_signing_keys
+		WHERE rotated_at IS NULL OR rotated_at > $1 ORDER BY active_from DESC, created_at DESC`
+	err := r.db.Select(&keys, query, time.Now().Add(-verificationGrace))
+	if err != nil {
+		logger.LogError(err, "Failed to get verification keys", map[string]interface{}{"layer": "repository", "operation": "GetVerificationKeys"})
+		return nil, err
+	}
+	logger.LogDebug("Verification keys retrieved", map[string]interface{}{"layer": "repository", "operation": "GetVerificationKeys", "count": len(keys)})
+	return keys, nil
+}
+
+// RotateSigningKey stores newKey as the next signing key if the current one is older than rotationInterval (or force is set),
+// it takes over signing after publishLead and the current key is retired at that moment; the very first key signs right away.
+// Returns false when another instance already rotated or rotation was not due yet
+func (r *signingKeyRepo) RotateSigningKey(newKey *models.SigningKey, rotationInterval, verificationGrace, publishLead time.Duration, force bool) (bool, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey"})
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// only one instance rotates at a time, the others wait and then find rotation no longer due,
+	// so on a cold start every instance returns with the first key in place
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", signingKeyRotationLockID); err != nil {
+		logger.LogError(err, "Failed to take rotation lock", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey"})
+		return false, err
+	}
+
+	if !force {
+		var due bool
+		query := "SELECT NOT EXISTS (SELECT 1 FROM jwt_signing_keys WHERE rotated_at IS NULL AND created_at > $1)"
+		if err := tx.Get(&due, query, time.Now().Add(-rotationInterval)); err != nil {
+			logger.LogError(err, "Failed to check rotation", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey"})
+			return false, err
+		}
+		if !due {
+			return false, nil
+		}
+	}
+
+	now := time.Now()
+	activeFrom := now.Add(publishLead)
+	result, err := tx.Exec("UPDATE jwt_signing_keys SET rotated_at = $1 WHERE rotated_at IS NULL", activeFrom)
+	if err != nil {
+		logger.LogError(err, "Failed to retire signing key", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey"})
+		return false, err
+	}
+	// nothing signs yet, so there is no verifier to warn ahead
+	if retired, err := result.RowsAffected(); err == nil && retired == 0 {
+		activeFrom = now
+	}
+	query := "INSERT INTO jwt_signing_keys (kid, algorithm, encrypted_private_key, created_at, active_from) VALUES ($1, $2, $3, $4, $5)"
+	if _, err := tx.Exec(query, newKey.KeyID, newKey.Algorithm, newKey.EncryptedPrivateKey, now, activeFrom); err != nil {
+		logger.LogError(err, "Failed to store signing key", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey"})
+		return false, err
+	}
+	// keys past their verification grace can't verify any live token anymore
+	if _, err := tx.Exec("DELETE FROM jwt_signing_keys WHERE rotated_at < $1", now.Add(-verificationGrace)); err != nil {
+		logger.LogError(err, "Failed to delete old signing keys", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey"})
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit key rotation", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey"})
+		return false, err
+	}
+	newKey.CreatedAt = now
+	newKey.ActiveFrom = activeFrom
+	logger.LogDebug("Signing key rotated", map[string]interface{}{"layer": "repository", "operation": "RotateSigningKey", "kid": newKey.KeyID})
+	return true, nil
+}
@@ -0,0 +1,186 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type SubscriptionRepo interface {
+	GetCurrentSubscription(userID int) (*models.Subscription, error)
+	ListSubscriptionsByUser(userID int) ([]*models.Subscription, error)
+	ListTransitions(subscriptionID int) ([]*models.SubscriptionTransition, error)
+	HasSubscribedTo(userID int, planID string) (bool, error)
+	ListDueSubscriptions(now time.Time, pastDuePeriod, gracePeriod time.Duration, limit int) ([]*models.Subscription, error)
+	CreateSubscription(subscription *models.Subscription, reason string, access models.PlanAccess) error
+	SaveSubscription(subscription *models.Subscription, fromStatus, reason string, access models.PlanAccess) (bool, error)
+}
+
+type subscriptionRepo struct {
+	db *sqlx.DB
+}
+
+func NewSubscriptionRepo(db *sqlx.DB) SubscriptionRepo {
+	return &subscriptionRepo{db: db}
+}
+
+const subscriptionColumns = "subscription_id, user_id, plan_id, status, current_period_start, current_period_end, auto_renew, cancel_at_period_end, ended_at, created_at, updated_at"
+
+// GetCurrentSubscription returns sql.ErrNoRows when the user has no subscription that is still running
+func (r *subscriptionRepo) GetCurrentSubscription(userID int) (*models.Subscription, error) {
+	var subscription models.Subscription
+	query := "SELECT " + subscriptionColumns + " FROM subscriptions WHERE user_id = $1 AND status NOT IN ($2, $3)"
+	if err := r.db.Get(&subscription, query, userID, models.SubscriptionCanceled, models.SubscriptionExpired); err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+func (r *subscriptionRepo) ListSubscriptionsByUser(userID int) ([]*models.Subscription, error) {
+	var subscriptions []*models.Subscription
+	query := "SELECT " + subscriptionColumns + " FROM subscriptions WHERE user_id = $1 ORDER BY created_at DESC"
+	if err := r.db.Select(&subscriptions, query, userID); err != nil {
+		logger.LogError(err, "Failed to list subscriptions", map[string]interface{}{"layer": "repository", "operation": "ListSubscriptionsByUser", "userID": userID})
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+func (r *subscriptionRepo) ListTransitions(subscriptionID int) ([]*models.SubscriptionTransition, error) {
+	var transitions []*models.SubscriptionTransition
+	query := `SELECT transition_id, subscription_id, from_status, to_status, reason, created_at FROM subscription_transitions
+		WHERE subscription_id = $1 ORDER BY transition_id`
+	if err := r.db.Select(&transitions, query, subscriptionID); err != nil {
+		logger.LogError(err, "Failed to list subscription transitions", map[string]interface{}{"layer": "repository", "operation": "ListTransitions", "subscriptionID": subscriptionID})
+		return nil, err
+	}
+	return transitions, nil
+}
+
+func (r *subscriptionRepo) HasSubscribedTo(userID int, planID string) (bool, error) {
+	var exists bool
+	if err := r.db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM subscriptions WHERE user_id = $1 AND plan_id = $2)", userID, planID); err != nil {
+		logger.LogError(err, "Failed to check subscriptions", map[string]interface{}{"layer": "repository", "operation": "HasSubscribedTo", "userID": userID})
+		return false, err
+	}
+	return exists, nil
+}
+
+// ListDueSubscriptions finds running subscriptions whose current state is over: trialing and active ones at the end of the period,
+// past_due ones once the past due period after it is over too and grace ones after the grace period on top of that
+func (r *subscriptionRepo) ListDueSubscriptions(now time.Time, pastDuePeriod, gracePeriod time.Duration, limit int) ([]*models.Subscription, error) {
+	var subscriptions []*models.Subscription
+	query := "SELECT " + subscriptionColumns + ` FROM subscriptions
+		WHERE current_period_end IS NOT NULL AND (
+			(status IN ($1, $2) AND current_period_end <= $5)
+			OR (status = $3 AND current_period_end + make_interval(secs => $6) <= $5)
+			OR (status = $4 AND current_period_end + make_interval(secs => $7) <= $5)
+		)
+		ORDER BY current_period_end LIMIT $8`
+	err := r.db.Select(&subscriptions, query, models.SubscriptionTrialing, models.SubscriptionActive, models.SubscriptionPastDue, models.SubscriptionGrace,
+		now, pastDuePeriod.Seconds(), (pastDuePeriod + gracePeriod).Seconds(), limit)
+	if err != nil {
+		logger.LogError(err, "Failed to list due subscriptions", map[string]interface{}{"layer": "repository", "operation": "ListDueSubscriptions"})
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// CreateSubscription inserts the subscription, its first transition and the user's access in one transaction
+func (r *subscriptionRepo) CreateSubscription(subscription *models.Subscription, reason string, access models.PlanAccess) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "CreateSubscription"})
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO subscriptions (user_id, plan_id, status, current_period_start, current_period_end, auto_renew, cancel_at_period_end)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING subscription_id, created_at, updated_at`
+	err = tx.QueryRowx(query, subscription.UserID, subscription.PlanID, subscription.Status, subscription.CurrentPeriodStart,
+		subscription.CurrentPeriodEnd, subscription.AutoRenew, subscription.CancelAtPeriodEnd).
+		Scan(&subscription.SubscriptionID, &subscription.CreatedAt, &subscription.UpdatedAt)
+	if err != nil {
+		logger.LogError(err, "Failed to create subscription", map[string]interface{}{"layer": "repository", "operation": "CreateSubscription", "userID": subscription.UserID})
+		return err
+	}
+	if err := recordTransition(tx, subscription.SubscriptionID, nil, subscription.Status, reason); err != nil {
+		return err
+	}
+	if err := applyPlanAccess(tx, subscription.UserID, access); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit subscription", map[string]interface{}{"layer": "repository", "operation": "CreateSubscription", "userID": subscription.UserID})
+		return err
+	}
+	return nil
+}
+
+// SaveSubscription writes the changed subscription only while it is still in fromStatus, false means a concurrent change got there first;
+// the transition and the user's access are written in the same transaction
+func (r *subscriptionRepo) SaveSubscription(subscription *models.Subscription, fromStatus, reason string, access models.PlanAccess) (bool, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logger.LogError(err, "Failed to begin transaction", map[string]interface{}{"layer": "repository", "operation": "SaveSubscription"})
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE subscriptions SET status = $1, current_period_start = $2, current_period_end = $3, auto_renew = $4,
+			cancel_at_period_end = $5, ended_at = $6, updated_at = CURRENT_TIMESTAMP
+		WHERE subscription_id = $7 AND status = $8
+		RETURNING updated_at`
+	rows, err := tx.Query(query, subscription.Status, subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd, subscription.AutoRenew,
+		subscription.CancelAtPeriodEnd, subscription.EndedAt, subscription.SubscriptionID, fromStatus)
+	if err != nil {
+		logger.LogError(err, "Failed to update subscription", map[string]interface{}{"layer": "repository", "operation": "SaveSubscription", "subscriptionID": subscription.SubscriptionID})
+		return false, err
+	}
+	moved := rows.Next()
+	if moved {
+		err = rows.Scan(&subscription.UpdatedAt)
+	}
+	rows.Close()
+	if err != nil || !moved {
+		return false, err
+	}
+
+	if err := recordTransition(tx, subscription.SubscriptionID, &fromStatus, subscription.Status, reason); err != nil {
+		return false, err
+	}
+	if err := applyPlanAccess(tx, subscription.UserID, access); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.LogError(err, "Failed to commit subscription", map[string]interface{}{"layer": "repository", "operation": "SaveSubscription", "subscriptionID": subscription.SubscriptionID})
+		return false, err
+	}
+	return true, nil
+}
+
+func recordTransition(tx *sqlx.Tx, subscriptionID int, fromStatus *string, toStatus, reason string) error {
+	query := "INSERT INTO subscription_transitions (subscription_id, from_status, to_status, reason) VALUES ($1, $2, $3, $4)"
+	if _, err := tx.Exec(query, subscriptionID, fromStatus, toStatus, reason); err != nil {
+		logger.LogError(err, "Failed to record subscription transition", map[string]interface{}{"layer": "repository", "operation": "recordTransition", "subscriptionID": subscriptionID})
+		return err
+	}
+	return nil
+}
+
+// applyPlanAccess mirrors the subscription onto the user, package_history only gets a row when the package actually changes
+func applyPlanAccess(tx *sqlx.Tx, userID int, access models.PlanAccess) error {
+	query := `WITH previous AS (SELECT package FROM users WHERE user_id = $3 FOR UPDATE),
+		updated AS (UPDATE users SET package = $1, package_expiry = $2 WHERE user_id = $3 RETURNING user_id, package)
+		INSERT INTO package_history (user_id, package)
+		SELECT updated.user_id, updated.package FROM updated, previous WHERE previous.package <> updated.package`
+	if _, err := tx.Exec(query, access.Package, access.Expiry, userID); err != nil {
+		logger.LogError(err, "Failed to apply plan access", map[string]interface{}{"layer": "repository", "operation": "applyPlanAccess", "userID": userID})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type TokenRevocationRepo interface {
+	StoreRevocation(revocation *models.TokenRevocation) error
+	GetRevocationsCreatedAfter(since time.Time) ([]*models.TokenRevocation, error)
+	DeleteExpiredRevocations() (int64, error)
+}
+
+type tokenRevocationRepo struct {
+	db *sqlx.DB
+}
+
+func NewTokenRevocationRepo(db *sqlx.DB) TokenRevocationRepo {
+	return &tokenRevocationRepo{db: db}
+}
+
+func (r *tokenRevocationRepo) StoreRevocation(revocation *models.TokenRevocation) error {
+	query := "INSERT INTO access_token_revocations (jti, user_id, issued_before, reason, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING revocation_id, created_at"
+	err := r.db.QueryRowx(query, revocation.JTI, revocation.UserID, revocation.IssuedBefore, revocation.Reason, revocation.ExpiresAt).Scan(&revocation.RevocationID, &revocation.CreatedAt)
+	if err != nil {
+		logger.LogError(err, "Failed to store token revocation", map[string]interface{}{"layer": "repository", "operation": "StoreRevocation", "reason": revocation.Reason})
+		return err
+	}
+	logger.LogDebug("Token revocation stored", map[string]interface{}{"layer": "repository", "operation": "StoreRevocation", "reason": revocation.Reason})
+	return nil
+}
+
+// GetRevocationsCreatedAfter returns unexpired entries created after since, used to sync the in-memory cache incrementally
+func (r *tokenRevocationRepo) GetRevocationsCreatedAfter(since time.Time) ([]*models.TokenRevocation, error) {
+	var revocations []*models.TokenRevocation
+	query := "SELECT revocation_id, jti, user_id, issued_before, reason, expires_at, created_at FROM access_token_revocations WHERE created_at > $1 AND expires_at > $2 ORDER BY created_at, revocation_id"
+	err := r.db.Select(&revocations, query, since, time.Now())
+	if err != nil {
+		logger.LogError(err, "Failed to get token revocations", map[string]interface{}{"layer": "repository", "operation": "GetRevocationsCreatedAfter"})
+		return nil, err
+	}
+	return revocations, nil
+}
+
+func (r *tokenRevocationRepo) DeleteExpiredRevocations() (int64, error) {
+	result, err := r.db.Exec("DELETE FROM access_token_revocations WHERE expires_at <= $1", time.Now())
+	if err != nil {
+		logger.LogError(err, "Failed to delete expired token revocations", map[string]interface{}{"layer": "repository", "operation": "DeleteExpiredRevocations"})
+		return 0, err
+	}
+	deleted, _ := result.RowsAffected()
+	logger.LogDebug("Expired token revocations deleted", map[string]interface{}{"layer": "repository", "operation": "DeleteExpiredRevocations", "count": int(deleted)})
+	return deleted, nil
+}
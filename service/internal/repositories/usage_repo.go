@@ -0,0 +1,107 @@
+package repositories
+
+import (
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// UsageRepo stores the daily usage rows, days are passed as YYYY-MM-DD in UTC so the database timezone doesn't move them
+type UsageRepo interface {
+	RecordTransfer(userID int, day string, downloadBytes, uploadBytes int64) error
+	SnapshotStorage(day string, at time.Time) (int64, error)
+	GetUserUsage(userID int, since, until string) ([]*models.UsageDay, error)
+	GetUsageByDay(since, until string) ([]*models.UsageReportDay, error)
+	ListTopUsers(since, until string, limit, offset int) ([]*models.UserUsage, error)
+}
+
+type usageRepo struct {
+	db *sqlx.DB
+}
+
+func NewUsageRepo(db *sqlx.DB) UsageRepo {
+	return &usageRepo{db: db}
+}
+
+// RecordTransfer adds one download or upload to the user's day, the zero side isn't counted
+func (r *usageRepo) RecordTransfer(userID int, day string, downloadBytes, uploadBytes int64) error {
+	query := `INSERT INTO usage_daily (user_id, day, download_bytes, upload_bytes, download_count, upload_count)
+		VALUES ($1, $2::date, $3, $4, CASE WHEN $3 > 0 THEN 1 ELSE 0 END, CASE WHEN $4 > 0 THEN 1 ELSE 0 END)
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			download_bytes = usage_daily.download_bytes + EXCLUDED.download_bytes,
+			upload_bytes = usage_daily.upload_bytes + EXCLUDED.upload_bytes,
+			download_count = usage_daily.download_count + EXCLUDED.download_count,
+			upload_count = usage_daily.upload_count + EXCLUDED.upload_count`
+	if _, err := r.db.Exec(query, userID, day, downloadBytes, uploadBytes); err != nil {
+		logger.LogError(err, "Failed to record transfer", map[string]interface{}{"layer": "repository", "operation": "RecordTransfer", "userID": userID})
+		return err
+	}
+	return nil
+}
+
+// SnapshotStorage writes the storage of every user with a storage pool into the day's row, a later snapshot of the same day
+// replaces it; returns how many users were snapshotted
+func (r *usageRepo) SnapshotStorage(day string, at time.Time) (int64, error) {
+	query := `INSERT INTO usage_daily (user_id, day, storage_bytes, file_count, storage_snapshot_at)
+		SELECT s.user_id, $1::date, s.storage_bytes, COALESCE(f.file_count, 0), $2
+		FROM (SELECT user_id, SUM(storage_used) AS storage_bytes FROM user_storage GROUP BY user_id) s
+		LEFT JOIN (SELECT user_id, COUNT(*) AS file_count FROM files GROUP BY user_id) f ON f.user_id = s.user_id
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			storage_bytes = EXCLUDED.storage_bytes,
+			file_count = EXCLUDED.file_count,
+			storage_snapshot_at = EXCLUDED.storage_snapshot_at`
+	result, err := r.db.Exec(query, day, at)
+	if err != nil {
+		logger.LogError(err, "Failed to snapshot storage", map[string]interface{}{"layer": "repository", "operation": "SnapshotStorage", "day": day})
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *usageRepo) GetUserUsage(userID int, since, until string) ([]*models.UsageDay, error) {
+	var days []*models.UsageDay
+	query := `SELECT to_char(day, 'YYYY-MM-DD') AS day, storage_bytes, file_count, download_bytes, upload_bytes, download_count, upload_count
+		FROM usage_daily WHERE user_id = $1 AND day BETWEEN $2::date AND $3::date ORDER BY day`
+	if err := r.db.Select(&days, query, userID, since, until); err != nil {
+		logger.LogError(err, "Failed to get user usage", map[string]interface{}{"layer": "repository", "operation": "GetUserUsage", "userID": userID})
+		return nil, err
+	}
+	return days, nil
+}
+
+func (r *usageRepo) GetUsageByDay(since, until string) ([]*models.UsageReportDay, error) {
+	var days []*models.UsageReportDay
+	query := `SELECT to_char(day, 'YYYY-MM-DD') AS day,
+			COUNT(*) FILTER (WHERE download_count > 0 OR upload_count > 0) AS active_users,
+			COALESCE(SUM(storage_bytes), 0) AS storage_bytes,
+			SUM(download_bytes) AS download_bytes, SUM(upload_bytes) AS upload_bytes,
+			SUM(download_count) AS download_count, SUM(upload_count) AS upload_count
+		FROM usage_daily WHERE day BETWEEN $1::date AND $2::date
+		GROUP BY day ORDER BY day`
+	if err := r.db.Select(&days, query, since, until); err != nil {
+		logger.LogError(err, "Failed to get usage by day", map[string]interface{}{"layer": "repository", "operation": "GetUsageByDay"})
+		return nil, err
+	}
+	return days, nil
+}
+
+// ListTopUsers ranks the users by the bytes they transferred in the range, then by their peak storage
+func (r *usageRepo) ListTopUsers(since, until string, limit, offset int) ([]*models.UserUsage, error) {
+	var users []*models.UserUsage
+	query := `SELECT d.user_id, u.email,
+			SUM(d.download_bytes) AS download_bytes, SUM(d.upload_bytes) AS upload_bytes,
+			SUM(d.download_count) AS download_count, SUM(d.upload_count) AS upload_count,
+			MAX(d.storage_bytes) AS peak_storage_bytes
+		FROM usage_daily d JOIN users u ON u.user_id = d.user_id
+		WHERE d.day BETWEEN $1::date AND $2::date
+		GROUP BY d.user_id, u.email
+		ORDER BY SUM(d.download_bytes + d.upload_bytes) DESC, MAX(d.storage_bytes) DESC NULLS LAST, d.user_id
+		LIMIT $3 OFFSET $4`
+	if err := r.db.Select(&users, query, since, until, limit, offset); err != nil {
+		logger.LogError(err, "Failed to list top users", map[string]interface{}{"layer": "repository", "operation": "ListTopUsers"})
+		return nil, err
+	}
+	return users, nil
+}
@@ -2,53 +2,173 @@ package routes
 
 import (
 	"service/internal/handlers"
+	"service/internal/models"
 	"service/internal/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-func InitializeRoutes(r *gin.Engine, userHandler *handlers.UserHandler, fileHandler *handlers.FileHandler, schedulerHandler *handlers.SchedulerHandler) {
+// Handlers groups every http handler the routes are wired to
+type Handlers struct {
+	User                *handlers.UserHandler
+	File                *handlers.FileHandler
+	Scheduler           *handlers.SchedulerHandler
+	JWKS                *handlers.JWKSHandler
+	PersonalAccessToken *handlers.PersonalAccessTokenHandler
+	AccountDeletion     *handlers.AccountDeletionHandler
+	DataExport          *handlers.DataExportHandler
+	Admin               *handlers.AdminHandler
+	Plan                *handlers.PlanHandler
+	Billing             *handlers.BillingHandler
+	Promo               *handlers.PromoHandler
+	Notification        *handlers.NotificationHandler
+	Usage               *handlers.UsageHandler
+}
+
+// Middlewares groups the auth middlewares, SessionAuth only accepts browser sessions,
+// TokenAuth additionally accepts personal access tokens (routes under it must declare a scope)
+type Middlewares struct {
+	SessionAuth gin.HandlerFunc
+	TokenAuth   gin.HandlerFunc
+}
+
+func InitializeRoutes(r *gin.Engine, h Handlers, m Middlewares) {
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "healthy"})
 	})
 
+	// Public keys for verifying access tokens
+	r.GET("/.well-known/jwks.json", h.JWKS.GetJWKSHandler)
+
 	api := r.Group("/api/v1")
 	{
 		// Public user routes
 		userRoutes := api.Group("/user")
 		{
-			userRoutes.POST("/register", userHandler.RegisterUserHandler)
-			userRoutes.POST("/login", userHandler.LoginUserHandler)
-			userRoutes.POST("/refresh", userHandler.RefreshTokenHandler)
-			userRoutes.POST("/request-password-reset", userHandler.RequestPasswordResetHandler)
-			userRoutes.POST("/reset-password", userHandler.ResetPasswordHandler)
+			userRoutes.GET("/csrf-token", h.User.CSRFTokenHandler)
+			userRoutes.POST("/register", h.User.RegisterUserHandler)
+			userRoutes.POST("/login", h.User.LoginUserHandler)
+			userRoutes.POST("/refresh", h.User.RefreshTokenHandler)
+			userRoutes.POST("/request-password-reset", h.User.RequestPasswordResetHandler)
+			userRoutes.POST("/reset-password", h.User.ResetPasswordHandler)
+			userRoutes.POST("/unlock-account", h.User.UnlockAccountHandler)
+			userRoutes.POST("/magic-link", h.User.RequestMagicLinkHandler)
+			userRoutes.POST("/magic-link/login", h.User.MagicLinkLoginHandler)
+			userRoutes.POST("/confirm-email", h.User.ConfirmEmailChangeHandler)
+			userRoutes.GET("/exports/download/:downloadToken", h.DataExport.DownloadExportHandler)
+			userRoutes.GET("/plans", h.Plan.ListPlansHandler)
 		}
 
-		// Protected routes (require authentication)
+		// Protected routes (require a browser session)
 		authRoutes := api.Group("/auth")
-		authRoutes.Use(utils.ValidateAccessTokenMiddleware())
+		authRoutes.Use(m.SessionAuth)
 		{
 			// User management
-			authRoutes.GET("/user/info", userHandler.ValidateUserAndGetInfoHandler)
-			authRoutes.POST("/user/logout", userHandler.LogoutUserHandler)
-			authRoutes.POST("/billing/upgrade", userHandler.UpgradePackageHandler)
-
-			// File management
-			fileRoutes := authRoutes.Group("/files")
-			{
-				fileRoutes.GET("/billing", fileHandler.GetBillingInfoHandler)
-				fileRoutes.POST("/upload", fileHandler.UploadFileHandler)
-				fileRoutes.GET("/list", fileHandler.ListFilesHandler)
-				fileRoutes.GET("/download/:fileID", fileHandler.DownloadFileHandler)
-				fileRoutes.DELETE("/delete/:fileID", fileHandler.DeleteFileHandler)
-			}
+			authRoutes.GET("/user/info", h.User.ValidateUserAndGetInfoHandler)
+			authRoutes.POST("/user/logout", utils.DenyImpersonation(), h.User.LogoutUserHandler)
+			authRoutes.POST("/user/change-password", utils.DenyImpersonation(), h.User.ChangePasswordHandler)
+			authRoutes.POST("/user/change-email", utils.DenyImpersonation(), h.User.ChangeEmailHandler)
+			authRoutes.POST("/billing/upgrade", utils.DenyImpersonation(), h.User.UpgradePackageHandler)
+			authRoutes.POST("/billing/checkout", utils.DenyImpersonation(), h.Billing.CreateCheckoutHandler)
+			authRoutes.GET("/billing/checkouts/:checkoutID", h.Billing.GetCheckoutHandler)
+			authRoutes.GET("/billing/subscription", h.Billing.GetSubscriptionHandler)
+			authRoutes.POST("/billing/subscription/cancel", utils.DenyImpersonation(), h.Billing.CancelSubscriptionHandler)
+			authRoutes.POST("/billing/subscription/resume", utils.DenyImpersonation(), h.Billing.ResumeSubscriptionHandler)
+			authRoutes.PUT("/billing/subscription/auto-renew", utils.DenyImpersonation(), h.Billing.SetAutoRenewHandler)
+			authRoutes.POST("/billing/trial", utils.DenyImpersonation(), h.Billing.StartTrialHandler)
+			authRoutes.POST("/billing/promo/redeem", utils.DenyImpersonation(), h.Promo.RedeemPromoCodeHandler)
+			authRoutes.GET("/billing/invoices", h.Billing.ListInvoicesHandler)
+			authRoutes.GET("/billing/invoices/:invoiceID", h.Billing.GetInvoiceHandler)
+			authRoutes.GET("/billing/invoices/:invoiceID/download", h.Billing.DownloadInvoiceHandler)
+
+			// Session management
+			authRoutes.GET("/user/sessions", h.User.ListSessionsHandler)
+			authRoutes.GET("/user/audit-events", h.User.ListAuditEventsHandler)
+			authRoutes.DELETE("/user/sessions/:sessionID", utils.DenyImpersonation(), h.User.RevokeSessionHandler)
+			authRoutes.POST("/user/sessions/revoke-others", utils.DenyImpersonation(), h.User.RevokeOtherSessionsHandler)
+
+			// Personal access tokens, managing them needs a real session so a leaked token can't mint more
+			authRoutes.GET("/user/tokens", h.PersonalAccessToken.ListTokensHandler)
+			authRoutes.POST("/user/tokens", utils.DenyImpersonation(), h.PersonalAccessToken.CreateTokenHandler)
+			authRoutes.DELETE("/user/tokens/:tokenID", utils.DenyImpersonation(), h.PersonalAccessToken.RevokeTokenHandler)
+
+			// Account deletion, purged by the scheduler once the grace period is over
+			authRoutes.GET("/user/delete-account", h.AccountDeletion.GetDeletionHandler)
+			authRoutes.POST("/user/delete-account", utils.DenyImpersonation(), h.AccountDeletion.RequestDeletionHandler)
+			authRoutes.POST("/user/delete-account/cancel", utils.DenyImpersonation(), h.AccountDeletion.CancelDeletionHandler)
+
+			// Personal data export, built in the background and delivered by email
+			authRoutes.GET("/user/exports", h.DataExport.ListExportsHandler)
+			authRoutes.POST("/user/exports", utils.DenyImpersonation(), h.DataExport.RequestExportHandler)
+
+			// Impersonation, ended with the impersonation token (utils.ImpersonationEndRoute)
+			authRoutes.POST("/impersonation/end", h.Admin.EndImpersonationHandler)
+		}
+
+		// Admin routes, each one needs a permission of the support or admin role
+		adminRoutes := api.Group("/admin")
+		adminRoutes.Use(m.SessionAuth)
+		{
+			adminRoutes.GET("/users", utils.RequirePermission(models.PermissionUsersRead), h.Admin.SearchUsersHandler)
+			adminRoutes.GET("/users/:userID", utils.RequirePermission(models.PermissionUsersRead), h.Admin.GetUserHandler)
+			adminRoutes.PUT("/users/:userID/package", utils.RequirePermission(models.PermissionPackagesWrite), h.Admin.OverridePackageHandler)
+			adminRoutes.POST("/users/:userID/grant-plan", utils.RequirePermission(models.PermissionPackagesWrite), h.Admin.GrantPlanHandler)
+			adminRoutes.PUT("/users/:userID/storage", utils.RequirePermission(models.PermissionStorageWrite), h.Admin.AdjustStorageLimitHandler)
+			adminRoutes.POST("/users/:userID/storage/reconcile", utils.RequirePermission(models.PermissionStorageWrite), h.Admin.ReconcileStorageHandler)
+			adminRoutes.POST("/users/:userID/disable", utils.RequirePermission(models.PermissionUsersDisable), h.Admin.DisableUserHandler)
+			adminRoutes.POST("/users/:userID/enable", utils.RequirePermission(models.PermissionUsersDisable), h.Admin.EnableUserHandler)
+			adminRoutes.DELETE("/users/:userID/sessions/:sessionID", utils.RequirePermission(models.PermissionSessionsRevoke), h.Admin.RevokeSessionHandler)
+			adminRoutes.POST("/users/:userID/logout", utils.RequirePermission(models.PermissionSessionsRevoke), h.Admin.ForceLogoutHandler)
+			adminRoutes.PUT("/users/:userID/role", utils.RequirePermission(models.PermissionRolesWrite), h.Admin.SetRoleHandler)
+			adminRoutes.GET("/users/:userID/notifications", utils.RequirePermission(models.PermissionUsersRead), h.Notification.AdminListNotificationsHandler)
+			adminRoutes.GET("/users/:userID/usage", utils.RequirePermission(models.PermissionUsageRead), h.Usage.AdminGetUserUsageHandler)
+			adminRoutes.POST("/users/:userID/impersonate", utils.RequirePermission(models.PermissionImpersonate), h.Admin.StartImpersonationHandler)
+			adminRoutes.GET("/audit-log", utils.RequirePermission(models.PermissionAuditRead), h.Admin.ListAuditLogHandler)
+			adminRoutes.GET("/plans", utils.RequirePermission(models.PermissionUsersRead), h.Plan.AdminListPlansHandler)
+			adminRoutes.PUT("/plans/:planID", utils.RequirePermission(models.PermissionPlansWrite), h.Plan.SavePlanHandler)
+			adminRoutes.GET("/account-deletions", utils.RequirePermission(models.PermissionDeletionsRead), h.AccountDeletion.ListPendingDeletionsHandler)
+			adminRoutes.GET("/promo-codes", utils.RequirePermission(models.PermissionPromosRead), h.Promo.ListPromoCodesHandler)
+			adminRoutes.GET("/promo-codes/report", utils.RequirePermission(models.PermissionPromosRead), h.Promo.PromoReportHandler)
+			adminRoutes.GET("/promo-codes/:code", utils.RequirePermission(models.PermissionPromosRead), h.Promo.GetPromoCodeHandler)
+			adminRoutes.GET("/promo-codes/:code/redemptions", utils.RequirePermission(models.PermissionPromosRead), h.Promo.ListRedemptionsHandler)
+			adminRoutes.PUT("/promo-codes/:code", utils.RequirePermission(models.PermissionPromosWrite), h.Promo.SavePromoCodeHandler)
+			adminRoutes.DELETE("/promo-codes/:code", utils.RequirePermission(models.PermissionPromosWrite), h.Promo.DeletePromoCodeHandler)
+			adminRoutes.GET("/usage/report", utils.RequirePermission(models.PermissionUsageRead), h.Usage.UsageReportHandler)
+			adminRoutes.GET("/invoices", utils.RequirePermission(models.PermissionInvoicesRead), h.Billing.SearchInvoicesHandler)
+			adminRoutes.GET("/invoices/:invoiceID", utils.RequirePermission(models.PermissionInvoicesRead), h.Billing.AdminGetInvoiceHandler)
+			adminRoutes.GET("/invoices/:invoiceID/download", utils.RequirePermission(models.PermissionInvoicesRead), h.Billing.AdminDownloadInvoiceHandler)
 		}
 
-		// Scheduler routes (internal use only)
+		// File management (browser session or personal access token with the right scope)
+		fileRoutes := api.Group("/auth/files")
+		fileRoutes.Use(m.TokenAuth)
+		{
+			fileRoutes.GET("/billing", utils.RequireScope(models.ScopeBillingRead), h.File.GetBillingInfoHandler)
+			// storage and bandwidth per day, for the usage charts
+			fileRoutes.GET("/usage", utils.RequireScope(models.ScopeBillingRead), h.Usage.GetUsageHandler)
+			fileRoutes.POST("/upload", utils.RequireScope(models.ScopeFilesWrite), h.File.UploadFileHandler)
+			fileRoutes.GET("/list", utils.RequireScope(models.ScopeFilesRead), h.File.ListFilesHandler)
+			fileRoutes.GET("/download/:fileID", utils.RequireScope(models.ScopeFilesRead), h.File.DownloadFileHandler)
+			fileRoutes.DELETE("/delete/:fileID", utils.RequireScope(models.ScopeFilesWrite), h.File.DeleteFileHandler)
+			// what a downgrade does to the files of the plan, and keeping some of them within the lower plan's quota
+			fileRoutes.GET("/downgrade/preview", utils.RequireScope(models.ScopeFilesRead), h.File.PreviewDowngradeHandler)
+			fileRoutes.POST("/downgrade/keep", utils.RequireScope(models.ScopeFilesWrite), h.File.KeepFilesHandler)
+		}
+
+		// Payment provider webhooks, authenticated by the provider's signature instead of a session
+		api.POST("/billing/webhook", h.Billing.PaymentWebhookHandler)
+
+		// Scheduler routes (internal use only), called by dkron with the shared scheduler token
 		schedulerRoutes := api.Group("/internal/scheduler")
+		schedulerRoutes.Use(utils.RequireSchedulerToken())
 		{
-			schedulerRoutes.POST("/check-expired-packages", schedulerHandler.CheckExpiredPackagesHandler)
+			schedulerRoutes.POST("/check-expired-packages", h.Scheduler.CheckExpiredPackagesHandler)
+			schedulerRoutes.POST("/purge-deleted-accounts", h.AccountDeletion.PurgeDeletedAccountsHandler)
+			schedulerRoutes.POST("/prune-audit-events", h.Scheduler.PruneAuditEventsHandler)
+			schedulerRoutes.POST("/prune-auth-throttles", h.Scheduler.PruneAuthThrottlesHandler)
+			schedulerRoutes.POST("/send-notifications", h.Scheduler.SendNotificationsHandler)
+			schedulerRoutes.POST("/snapshot-usage", h.Scheduler.SnapshotUsageHandler)
 		}
 	}
 }
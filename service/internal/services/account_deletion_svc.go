@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"time"
+)
+
+const (
+	// how many accounts one scheduler run purges
+	accountPurgeBatchSize = 20
+	// a purge claimed longer ago than this is assumed dead and retried
+	accountPurgeStaleClaim = 15 * time.Minute
+)
+
+type AccountDeletionService interface {
+	RequestDeletion(userID int, currentPassword, ipAddress string) (*models.AccountDeletion, error)
+	CancelDeletion(userID int) error
+	GetDeletion(userID int) (*models.AccountDeletion, error)
+	ListPendingDeletions() ([]*models.AccountDeletion, error)
+	PurgeDueAccounts(ctx context.Context) (int, error)
+}
+
+type accountDeletionService struct {
+	deletionRepo      repositories.AccountDeletionRepo
+	patRepo           repositories.PersonalAccessTokenRepo
+	authService       AuthService
+	tokenService      RefreshTokenService
+	revocationService TokenRevocationService
+	fileService       FileService
+	audit             AuditLogger
+	gracePeriod       time.Duration
+}
+
+func NewAccountDeletionService(deletionRepo repositories.AccountDeletionRepo, patRepo repositories.PersonalAccessTokenRepo, authService AuthService, tokenService RefreshTokenService, revocationService TokenRevocationService, fileService FileService, audit AuditLogger) (AccountDeletionService, error) {
+	gracePeriod := 7 * 24 * time.Hour
+	if value := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACCOUNT_DELETION_GRACE_PERIOD: %w", err)
+		}
+		gracePeriod = parsed
+	}
+
+	return &accountDeletionService{
+		deletionRepo:      deletionRepo,
+		patRepo:           patRepo,
+		authService:       authService,
+		tokenService:      tokenService,
+		revocationService: revocationService,
+		fileService:       fileService,
+		audit:             audit,
+		gracePeriod:       gracePeriod,
+	}, nil
+}
+
+// RequestDeletion schedules the purge after the grace period and logs the user out everywhere,
+// logging in again during the grace period is allowed so the deletion can be cancelled
+func (s *accountDeletionService) RequestDeletion(userID int, currentPassword, ipAddress string) (*models.AccountDeletion, error) {
+	user, err := s.authService.Reauthenticate(userID, currentPassword, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	deletion, err := s.deletionRepo.ScheduleDeletion(userID, user.Email, time.Now().Add(s.gracePeriod))
+	if err != nil {
+		logger.LogError(err, "Failed to schedule account deletion", map[string]interface{}{"layer": "service", "operation": "RequestDeletion", "userID": userID})
+		return nil, errors.New("failed to schedule account deletion")
+	}
+
+	if err := s.tokenService.RevokeAllSessions(userID); err != nil {
+		logger.LogError(err, "Failed to revoke sessions for account deletion", map[string]interface{}{"layer": "service", "operation": "RequestDeletion", "userID": userID})
+	}
+	if err := s.revocationService.RevokeUserAccessTokens(userID, "account_deletion"); err != nil {
+		logger.LogError(err, "Failed to revoke access tokens for account deletion", map[string]interface{}{"layer": "service", "operation": "RequestDeletion", "userID": userID})
+	}
+	if err := s.patRepo.RevokeAllTokens(userID); err != nil {
+		logger.LogError(err, "Failed to revoke personal access tokens for account deletion", map[string]interface{}{"layer": "service", "operation": "RequestDeletion", "userID": userID})
+	}
+
+	go func() {
+		if err := utils.SendAccountDeletionScheduledEmail(user.Email, deletion.PurgeAfter, utils.FrontendLink("/login")); err != nil {
+			logger.LogError(err, "Failed to send account deletion scheduled email", map[string]interface{}{"layer": "service", "operation": "RequestDeletion", "userID": userID})
+		}
+	}()
+
+	s.audit.Record(models.NewAuditEvent(models.AuditActionDeletionRequested, userID, userID, models.ClientInfo{IPAddress: ipAddress}, models.AuditResultSuccess, models.AuditDetails{"purge_after": deletion.PurgeAfter}))
+	return deletion, nil
+}
+
+func (s *accountDeletionService) CancelDeletion(userID int) error {
+	if err := s.deletionRepo.CancelDeletion(userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("no pending account deletion")
+		}
+		return errors.New("failed to cancel account deletion")
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionDeletionCancelled, userID, userID, models.ClientInfo{}, models.AuditResultSuccess, nil))
+	return nil
+}
+
+func (s *accountDeletionService) GetDeletion(userID int) (*models.AccountDeletion, error) {
+	deletion, err := s.deletionRepo.GetDeletion(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("no pending account deletion")
+		}
+		return nil, errors.New("failed to get account deletion")
+	}
+	return deletion, nil
+}
+
+func (s *accountDeletionService) ListPendingDeletions() ([]*models.AccountDeletion, error) {
+	deletions, err := s.deletionRepo.ListPendingDeletions()
+	if err != nil {
+		return nil, errors.New("failed to list pending account deletions")
+	}
+	return deletions, nil
+}
+
+// PurgeDueAccounts is run by the scheduler, every step is safe to repeat so a purge interrupted halfway is finished by a later run
+func (s *accountDeletionService) PurgeDueAccounts(ctx context.Context) (int, error) {
+	deletions, err := s.deletionRepo.ClaimDueDeletions(accountPurgeBatchSize, accountPurgeStaleClaim)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	var lastError error
+	for _, deletion := range deletions {
+		if err := s.purge(ctx, deletion); err != nil {
+			logger.LogError(err, "Failed to purge account", map[string]interface{}{"layer": "service", "operation": "PurgeDueAccounts", "userID": deletion.UserID, "attempt": deletion.Attempts})
+			_ = s.deletionRepo.MarkPurgeFailed(deletion.UserID, err.Error())
+			lastError = err
+			continue
+		}
+		purged++
+	}
+
+	if lastError != nil && purged == 0 {
+		return 0, lastError
+	}
+	return purged, nil
+}
+
+func (s *accountDeletionService) purge(ctx context.Context, deletion *models.AccountDeletion) error {
+	// objects first, the file rows are the only other record of what was stored
+	if err := s.fileService.DeleteAllUserObjects(ctx, deletion.UserID); err != nil {
+		return err
+	}
+
+	email := ""
+	if deletion.Email != nil {
+		email = *deletion.Email
+	}
+	var throttleKeys []string
+	if email != "" {
+		throttleKeys = accountThrottleKeys(email)
+	}
+	if err := s.deletionRepo.PurgeUserRows(deletion.UserID, email, throttleKeys); err != nil {
+		return fmt.Errorf("failed to purge user rows: %w", err)
+	}
+
+	// a failed confirmation email doesn't undo the purge, it is only logged
+	if email != "" {
+		if err := utils.SendAccountDeletedEmail(email); err != nil {
+			logger.LogError(err, "Failed to send account deleted email", map[string]interface{}{"layer": "service", "operation": "purge", "userID": deletion.UserID})
+		}
+	}
+
+	if err := s.deletionRepo.MarkCompleted(deletion.UserID); err != nil {
+		return fmt.Errorf("failed to mark deletion completed: %w", err)
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionAccountPurged, 0, deletion.UserID, models.ClientInfo{}, models.AuditResultSuccess, nil))
+	return nil
+}
@@ -0,0 +1,354 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+type AdminService interface {
+	SearchUsers(search string, limit, offset int) ([]*models.AdminUserSummary, error)
+	GetUser(userID int) (*models.AdminUserView, error)
+	OverridePackage(actor models.AdminActor, userID int, newPackage string, expiresAt *time.Time) error
+	GrantPlan(actor models.AdminActor, userID int, planID string, expiresAt time.Time) error
+	AdjustStorageLimit(actor models.AdminActor, userID int, planID string, storageLimit *int64) error
+	ReconcileStorage(ctx context.Context, actor models.AdminActor, userID int) (*models.StorageReconciliation, error)
+	DisableUser(actor models.AdminActor, userID int, reason string) error
+	EnableUser(actor models.AdminActor, userID int) error
+	RevokeSession(actor models.AdminActor, userID int, sessionID string) error
+	ForceLogout(actor models.AdminActor, userID int) error
+	SetRole(actor models.AdminActor, userID int, role string) error
+	StartImpersonation(actor models.AdminActor, userID int, reason string, allowWrites, notifyUser bool) (string, time.Time, error)
+	EndImpersonation(claims *utils.AccessTokenClaims, client models.ClientInfo) error
+	RecordImpersonatedRequest(claims *utils.AccessTokenClaims, client models.ClientInfo, method, path string, status int)
+}
+
+type adminService struct {
+	authRepo          repositories.AuthRepo
+	fileRepo          repositories.FileRepo
+	plans             PlanCatalog
+	subscriptions     SubscriptionService
+	audit             AuditLogger
+	tokenService      RefreshTokenService
+	revocationService TokenRevocationService
+	fileService       FileService
+}
+
+func NewAdminService(authRepo repositories.AuthRepo, fileRepo repositories.FileRepo, plans PlanCatalog, subscriptions SubscriptionService, audit AuditLogger, tokenService RefreshTokenService, revocationService TokenRevocationService, fileService FileService) AdminService {
+	return &adminService{
+		authRepo:          authRepo,
+		fileRepo:          fileRepo,
+		plans:             plans,
+		subscriptions:     subscriptions,
+		audit:             audit,
+		tokenService:      tokenService,
+		revocationService: revocationService,
+		fileService:       fileService,
+	}
+}
+
+func (s *adminService) SearchUsers(search string, limit, offset int) ([]*models.AdminUserSummary, error) {
+	limit, offset = clampPage(limit, offset)
+	users, err := s.authRepo.SearchUsers(strings.TrimSpace(search), limit, offset)
+	if err != nil {
+		return nil, errors.New("failed to search users")
+	}
+	return users, nil
+}
+
+// GetUser shows the profile, storage, sessions and every file, including files the user's current plan hides
+func (s *adminService) GetUser(userID int) (*models.AdminUserView, error) {
+	user, err := s.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := s.fileRepo.GetUserStorage(userID)
+	if err != nil {
+		return nil, errors.New("failed to get user storage")
+	}
+	sessions, err := s.tokenService.ListSessions(userID, "")
+	if err != nil {
+		return nil, errors.New("failed to list sessions")
+	}
+	files, err := s.fileRepo.GetFilesMetadataByUser(userID)
+	if err != nil {
+		logger.LogError(err, "Failed to list files", map[string]interface{}{"layer": "service", "operation": "AdminGetUser", "userID": userID})
+		return nil, errors.New("failed to list files")
+	}
+	return models.NewAdminUserView(user, storage, sessions, files), nil
+}
+
+// OverridePackage sets the plan directly, without payment, any plan can be set including ones users can't buy;
+// a nil expiresAt means the plan doesn't expire
+func (s *adminService) OverridePackage(actor models.AdminActor, userID int, newPackage string, expiresAt *time.Time) error {
+	plan, err := s.plans.GetPlan(newPackage)
+	if err != nil {
+		return err
+	}
+	if _, err := s.getUser(userID); err != nil {
+		return err
+	}
+
+	// the override replaces whatever subscription is running, the default plan ends it
+	if _, err := s.subscriptions.Grant(userID, plan.PlanID, expiresAt, "admin override"); err != nil {
+		return err
+	}
+
+	s.recordAction(actor, userID, "package_override", map[string]interface{}{"package": newPackage, "expires_at": expiresAt})
+	return nil
+}
+
+// GrantPlan moves the user onto a paid plan or moves the expiry of the plan they're on, the expiry is always explicit
+func (s *adminService) GrantPlan(actor models.AdminActor, userID int, planID string, expiresAt time.Time) error {
+	if !expiresAt.After(time.Now()) {
+		return errors.New("expiry must be in the future")
+	}
+	plan, err := s.plans.GetPlan(planID)
+	if err != nil {
+		return err
+	}
+	if plan.IsDefault {
+		return errors.New("the default plan doesn't expire, use the package override instead")
+	}
+	user, err := s.getUser(userID)
+	if err != nil {
+		return err
+	}
+
+	action := "plan_extended"
+	if user.Package != plan.PlanID {
+		action = "plan_granted"
+	}
+	if _, err := s.subscriptions.Grant(userID, plan.PlanID, &expiresAt, "admin grant"); err != nil {
+		return err
+	}
+
+	s.recordAction(actor, userID, action, map[string]interface{}{
+		"plan": plan.PlanID, "previous_plan": user.Package, "previous_expiry": user.PackageExpiry, "expires_at": expiresAt,
+	})
+	return nil
+}
+
+// AdjustStorageLimit overrides the user's quota for one plan, a nil limit goes back to the plan quota
+func (s *adminService) AdjustStorageLimit(actor models.AdminActor, userID int, planID string, storageLimit *int64) error {
+	if storageLimit != nil && *storageLimit < 0 {
+		return errors.New("storage limit can't be negative")
+	}
+	if _, err := s.plans.GetPlan(planID); err != nil {
+		return err
+	}
+	if _, err := s.getUser(userID); err != nil {
+		return err
+	}
+
+	if err := s.fileRepo.SetStorageLimit(userID, planID, storageLimit); err != nil {
+		return errors.New("failed to update storage limit")
+	}
+	s.recordAction(actor, userID, "storage_limits", map[string]interface{}{"plan": planID, "storage_limit": storageLimit})
+	return nil
+}
+
+func (s *adminService) ReconcileStorage(ctx context.Context, actor models.AdminActor, userID int) (*models.StorageReconciliation, error) {
+	if _, err := s.getUser(userID); err != nil {
+		return nil, err
+	}
+	report, err := s.fileService.ReconcileUserStorage(ctx, userID)
+	if err != nil {
+		logger.LogError(err, "Failed to reconcile user storage", map[string]interface{}{"layer": "service", "operation": "ReconcileStorage", "userID": userID})
+		return nil, errors.New("failed to reconcile storage")
+	}
+	s.recordAction(actor, userID, "storage_reconcile", map[string]interface{}{
+		"storage_used_before": report.StorageUsedBefore,
+		"storage_used_after":  report.StorageUsedAfter,
+		"missing_objects":     len(report.MissingObjects),
+		"orphaned_objects":    len(report.OrphanedObjects),
+	})
+	return report, nil
+}
+
+// DisableUser blocks login and refresh and ends every session, personal access tokens stop working while the account is disabled
+func (s *adminService) DisableUser(actor models.AdminActor, userID int, reason string) error {
+	if actor.UserID == userID {
+		return errors.New("you can't disable your own account")
+	}
+	if err := s.authRepo.DisableUser(userID, reason); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("user not found")
+		}
+		return errors.New("failed to disable user")
+	}
+	if err := s.tokenService.RevokeAllSessions(userID); err != nil {
+		logger.LogError(err, "Failed to revoke sessions of disabled user", map[string]interface{}{"layer": "service", "operation": "DisableUser", "userID": userID})
+	}
+	s.revokeAccessTokens(userID, "account_disabled")
+	s.recordAction(actor, userID, "account_disabled", map[string]interface{}{"reason": reason})
+	return nil
+}
+
+func (s *adminService) EnableUser(actor models.AdminActor, userID int) error {
+	if err := s.authRepo.EnableUser(userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("user not found")
+		}
+		return errors.New("failed to enable user")
+	}
+	s.recordAction(actor, userID, "account_enabled", nil)
+	return nil
+}
+
+func (s *adminService) RevokeSession(actor models.AdminActor, userID int, sessionID string) error {
+	if err := s.tokenService.RevokeSession(userID, sessionID); err != nil {
+		return err
+	}
+	s.recordAction(actor, userID, "session_revoked", map[string]interface{}{"session_id": sessionID})
+	return nil
+}
+
+// ForceLogout ends every session of the user right away, refresh and access tokens alike
+func (s *adminService) ForceLogout(actor models.AdminActor, userID int) error {
+	if _, err := s.getUser(userID); err != nil {
+		return err
+	}
+	if err := s.tokenService.RevokeAllSessions(userID); err != nil {
+		return errors.New("failed to revoke sessions")
+	}
+	s.revokeAccessTokens(userID, "forced_logout")
+	s.recordAction(actor, userID, "forced_logout", nil)
+	return nil
+}
+
+func (s *adminService) SetRole(actor models.AdminActor, userID int, role string) error {
+	if !models.IsKnownRole(role) {
+		return errors.New("unknown role")
+	}
+	// an admin demoting themselves could leave nobody able to undo it
+	if actor.UserID == userID {
+		return errors.New("you can't change your own role")
+	}
+
+	if err := s.authRepo.SetRole(userID, role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("user not found")
+		}
+		return errors.New("failed to set role")
+	}
+	// access tokens carry the old role and permissions
+	s.revokeAccessTokens(userID, "role_change")
+	s.recordAction(actor, userID, "role_change", map[string]interface{}{"role": role})
+	return nil
+}
+
+// StartImpersonation issues a token for acting as a plain user, staff accounts can't be impersonated
+// so the token never carries admin permissions
+func (s *adminService) StartImpersonation(actor models.AdminActor, userID int, reason string, allowWrites, notifyUser bool) (string, time.Time, error) {
+	if actor.UserID == userID {
+		return "", time.Time{}, errors.New("you can't impersonate yourself")
+	}
+	actorUser, err := s.getUser(actor.UserID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	user, err := s.getUser(userID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if user.Role != models.RoleUser {
+		return "", time.Time{}, errors.New("staff accounts can't be impersonated")
+	}
+	if user.IsDisabled() {
+		return "", time.Time{}, ErrAccountDisabled
+	}
+
+	token, claims, err := utils.CreateImpersonationToken(user, actorUser, allowWrites)
+	if err != nil {
+		logger.LogError(err, "Failed to create impersonation token", map[string]interface{}{"layer": "service", "operation": "StartImpersonation", "userID": userID})
+		return "", time.Time{}, errors.New("failed to start impersonation")
+	}
+	expiresAt := claims.ExpiresAt.Time
+
+	if notifyUser {
+		go func() {
+			if err := utils.SendImpersonationNoticeEmail(user.Email, reason, expiresAt); err != nil {
+				logger.LogError(err, "Failed to send impersonation notice", map[string]interface{}{"layer": "service", "operation": "StartImpersonation", "userID": userID})
+			}
+		}()
+	}
+
+	s.recordAction(actor, userID, "impersonation_started", map[string]interface{}{
+		"reason": reason, "allow_writes": allowWrites, "user_notified": notifyUser, "token_id": claims.ID, "expires_at": expiresAt,
+	})
+	return token, expiresAt, nil
+}
+
+// EndImpersonation denylists the impersonation token before it expires on its own
+func (s *adminService) EndImpersonation(claims *utils.AccessTokenClaims, client models.ClientInfo) error {
+	if !claims.IsImpersonation() {
+		return errors.New("not impersonating")
+	}
+	if err := s.revocationService.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time, "impersonation_ended"); err != nil {
+		logger.LogError(err, "Failed to revoke impersonation token", map[string]interface{}{"layer": "service", "operation": "EndImpersonation", "userID": claims.UserID})
+		return errors.New("failed to end impersonation")
+	}
+	s.recordAction(models.AdminActor{UserID: claims.Actor.UserID, Client: client}, claims.UserID, "impersonation_ended", map[string]interface{}{"token_id": claims.ID})
+	return nil
+}
+
+// RecordImpersonatedRequest is called by the auth middleware after every request made with an impersonation token
+func (s *adminService) RecordImpersonatedRequest(claims *utils.AccessTokenClaims, client models.ClientInfo, method, path string, status int) {
+	result := models.AuditResultSuccess
+	if status == http.StatusForbidden {
+		result = models.AuditResultDenied
+	} else if status >= http.StatusBadRequest {
+		result = models.AuditResultFailure
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionAdminPrefix+"impersonation_request", claims.Actor.UserID, claims.UserID, client, result, models.AuditDetails{
+		"token_id": claims.ID, "method": method, "path": path, "status": status,
+	}))
+}
+
+func (s *adminService) getUser(userID int) (*models.User, error) {
+	user, err := s.authRepo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("user not found")
+		}
+		return nil, errors.New("failed to get user")
+	}
+	return user, nil
+}
+
+func (s *adminService) revokeAccessTokens(userID int, reason string) {
+	if err := s.revocationService.RevokeUserAccessTokens(userID, reason); err != nil {
+		logger.LogError(err, "Failed to revoke access tokens after admin action", map[string]interface{}{"layer": "service", "operation": "revokeAccessTokens", "userID": userID, "reason": reason})
+	}
+}
+
+// recordAction writes the audit event after the action succeeded
+func (s *adminService) recordAction(actor models.AdminActor, userID int, action string, details map[string]interface{}) {
+	s.audit.Record(models.NewAuditEvent(models.AuditActionAdminPrefix+action, actor.UserID, userID, actor.Client, models.AuditResultSuccess, details))
+}
+
+func clampPage(limit, offset int) (int, int) {
+	if limit <= 0 {
+		limit = defaultAdminPageSize
+	}
+	if limit > maxAdminPageSize {
+		limit = maxAdminPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
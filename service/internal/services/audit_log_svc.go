@@ -0,0 +1,93 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"time"
+)
+
+// how many old events one delete statement removes during pruning
+const auditPruneBatchSize = 5000
+
+type AuditLogger interface {
+	Record(event *models.AuditEvent)
+	ListUserEvents(userID, limit, offset int) ([]*models.AuditEvent, error)
+	ListEvents(filter models.AuditEventFilter, limit, offset int) ([]*models.AuditEvent, error)
+	PruneExpiredEvents() (int64, error)
+}
+
+type auditLogger struct {
+	auditRepo repositories.AuditEventRepo
+	retention time.Duration
+}
+
+func NewAuditLogger(auditRepo repositories.AuditEventRepo) (AuditLogger, error) {
+	retention := 365 * 24 * time.Hour
+	if value := os.Getenv("AUDIT_RETENTION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid AUDIT_RETENTION: %q", value)
+		}
+		retention = parsed
+	}
+	return &auditLogger{auditRepo: auditRepo, retention: retention}, nil
+}
+
+// Record stores the event and mirrors it to the application log, a failed write is logged but never fails the caller
+func (a *auditLogger) Record(event *models.AuditEvent) {
+	if err := a.auditRepo.RecordEvent(event); err != nil {
+		logger.LogError(err, "Failed to write audit event", map[string]interface{}{"layer": "service", "operation": "AuditLogger.Record", "action": event.Action})
+	}
+
+	logEvent := logger.Log.Info()
+	if event.Result != models.AuditResultSuccess {
+		logEvent = logger.Log.Warn()
+	}
+	if event.ActorID != nil {
+		logEvent = logEvent.Int("actor_id", *event.ActorID)
+	}
+	if event.TargetUserID != nil {
+		logEvent = logEvent.Int("userID", *event.TargetUserID)
+	}
+	logEvent.
+		Str("event", event.Action).
+		Str("result", event.Result).
+		Str("ip_address", event.IPAddress).
+		Str("user_agent", event.UserAgent).
+		Fields(map[string]interface{}(event.Details)).
+		Msg("Audit event")
+}
+
+// ListUserEvents lists what happened to the user's account, by the user or by anyone else
+func (a *auditLogger) ListUserEvents(userID, limit, offset int) ([]*models.AuditEvent, error) {
+	return a.ListEvents(models.AuditEventFilter{TargetUserID: userID}, limit, offset)
+}
+
+func (a *auditLogger) ListEvents(filter models.AuditEventFilter, limit, offset int) ([]*models.AuditEvent, error) {
+	limit, offset = clampPage(limit, offset)
+	events, err := a.auditRepo.ListEvents(filter, limit, offset)
+	if err != nil {
+		return nil, errors.New("failed to list audit events")
+	}
+	return events, nil
+}
+
+// PruneExpiredEvents is run by the scheduler and deletes events older than the retention period
+func (a *auditLogger) PruneExpiredEvents() (int64, error) {
+	cutoff := time.Now().Add(-a.retention)
+	var total int64
+	for {
+		deleted, err := a.auditRepo.DeleteEventsBefore(cutoff, auditPruneBatchSize)
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		if deleted < auditPruneBatchSize {
+			return total, nil
+		}
+	}
+}
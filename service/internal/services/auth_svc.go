@@ -2,37 +2,49 @@ package services
 
 import (
 	"errors"
-	"os"
 	"service/internal/logger"
+	"service/internal/metrics"
 	"service/internal/models"
 	"service/internal/repositories"
 	"service/internal/utils"
-	"time"
+	"strings"
 
 	"golang.org/x/sync/errgroup"
 )
 
+// ErrAccountDisabled is returned when an admin disabled the account, only after the password was verified so it doesn't reveal the account to guessers
+var ErrAccountDisabled = errors.New("this account has been disabled, contact support")
+
+// ErrPaymentRequired is returned when a user asks for a paid plan directly, paid plans are only applied by verified payment webhooks
+var ErrPaymentRequired = errors.New("this plan has to be paid for through a checkout")
+
 type AuthService interface {
 	RegisterUser(user *models.User) error
-	LoginUser(email, password string) (string, string, error)
-	RequestPasswordReset(email string) error
-	ResetPassword(resetToken, newPassword string) error
+	LoginUser(email, password string, client models.ClientInfo) (*models.TokenPair, error)
+	RequestPasswordReset(email, ipAddress string) error
+	ResetPassword(resetToken, newPassword, ipAddress string) error
+	RequestMagicLink(email, ipAddress string) (string, error)
+	LoginWithMagicLink(loginToken, nonce string, client models.ClientInfo) (*models.TokenPair, error)
+	ChangePassword(userID int, currentSessionID, currentPassword, newPassword, ipAddress string) error
+	RequestEmailChange(userID int, currentPassword, newEmail, ipAddress string) error
+	ConfirmEmailChange(changeToken string) error
+	Reauthenticate(userID int, currentPassword, ipAddress string) (*models.User, error)
 	UpgradeUserPackage(userID int, newPackage string) error
-	SetSchedulerService(scheduler SchedulerService)
 }
 
 type authService struct {
-	authRepo         repositories.AuthRepo
-	tokenService     RefreshTokenService
-	schedulerService SchedulerService
-}
-
-func NewAuthService(authRepo repositories.AuthRepo, tokenService RefreshTokenService) AuthService {
-	return &authService{authRepo: authRepo, tokenService: tokenService}
+	authRepo          repositories.AuthRepo
+	tokenService      RefreshTokenService
+	revocationService TokenRevocationService
+	throttleService   AuthThrottleService
+	passwordPolicy    PasswordPolicyService
+	plans             PlanCatalog
+	subscriptions     SubscriptionService
+	audit             AuditLogger
 }
 
-func (s *authService) SetSchedulerService(scheduler SchedulerService) {
-	s.schedulerService = scheduler
+func NewAuthService(authRepo repositories.AuthRepo, tokenService RefreshTokenService, revocationService TokenRevocationService, throttleService AuthThrottleService, passwordPolicy PasswordPolicyService, plans PlanCatalog, subscriptions SubscriptionService, audit AuditLogger) AuthService {
+	return &authService{authRepo: authRepo, tokenService: tokenService, revocationService: revocationService, throttleService: throttleService, passwordPolicy: passwordPolicy, plans: plans, subscriptions: subscriptions, audit: audit}
 }
 
 func (s *authService) RegisterUser(userFromHandlers *models.User) error {
@@ -44,6 +56,11 @@ func (s *authService) RegisterUser(userFromHandlers *models.User) error {
 		return errors.New("user with that email already exists")
 	}
 
+	// reject weak or breached passwords, returns a *PasswordPolicyError the handler turns into reasons
+	if err := s.passwordPolicy.Validate(userFromHandlers.Password, userFromHandlers.Email, userFromHandlers.Username); err != nil {
+		return err
+	}
+
 	// hash the password before storing it in the database
 	hashedPassword, err := utils.HashPassword(userFromHandlers.Password)
 	if err != nil {
@@ -53,10 +70,13 @@ func (s *authService) RegisterUser(userFromHandlers *models.User) error {
 	// set the user struct that is passed by the handlers password to the hashed password
 	userFromHandlers.Password = hashedPassword
 
-	// Set default package to free if not provided
-	if userFromHandlers.Package == "" {
-		userFromHandlers.Package = "free"
+	// new users always start on the default plan, paid plans are only reached through an upgrade
+	defaultPlan, err := s.plans.DefaultPlan()
+	if err != nil {
+		logger.LogError(err, "Failed to get default plan", map[string]interface{}{"layer": "service", "operation": "RegisterUser"})
+		return err
 	}
+	userFromHandlers.Package = defaultPlan.PlanID
 
 	// call the repo and create the user using the repo function, if the error is nil then log the error
 	if err := s.authRepo.CreateUser(userFromHandlers); err != nil {
@@ -67,30 +87,59 @@ func (s *authService) RegisterUser(userFromHandlers *models.User) error {
 	return nil
 }
 
-func (s *authService) LoginUser(email, password string) (string, string, error) {
+func (s *authService) LoginUser(email, password string, client models.ClientInfo) (*models.TokenPair, error) {
+	// refuse early while the account or the ip is backing off after failed attempts
+	if err := s.throttleService.CheckAllowed(ThrottleActionLogin, email, client.IPAddress); err != nil {
+		logger.LogError(err, "Login throttled", map[string]interface{}{"layer": "service", "operation": "LoginUser", "ip_address": client.IPAddress})
+		s.audit.Record(models.NewAuditEvent(models.AuditActionLogin, 0, 0, client, models.AuditResultDenied, models.AuditDetails{"reason": "throttled", "email": email}))
+		return nil, err
+	}
+
 	// get the user that wants to login using the email that is passed from handler
 	userThatWantsToLogin, err := s.authRepo.GetUserByEmail(email)
 	if err != nil {
 		logger.LogError(err, "Failed to login", map[string]interface{}{"layer": "service", "operation": "LoginUser"})
-		return "", "", errors.New("invalid email or password")
+		s.recordLoginFailure(email, 0, client, "unknown_email")
+		return nil, errors.New("invalid email or password")
 	}
 
 	// check the password that the user entered with the password in the database (check hash)
 	if !utils.CheckPasswordHash(password, userThatWantsToLogin.Password) {
 		logger.LogError(err, "Failed to login", map[string]interface{}{"layer": "service", "operation": "LoginUser"})
-		return "", "", errors.New("invalid email or password")
+		s.recordLoginFailure(email, userThatWantsToLogin.UserID, client, "wrong_password")
+		return nil, errors.New("invalid email or password")
+	}
+	s.throttleService.RecordSuccess(ThrottleActionLogin, email)
+	if userThatWantsToLogin.IsDisabled() {
+		s.audit.Record(models.NewAuditEvent(models.AuditActionLogin, 0, userThatWantsToLogin.UserID, client, models.AuditResultDenied, models.AuditDetails{"reason": "account_disabled"}))
+		return nil, ErrAccountDisabled
 	}
 
-	accessToken, refreshToken, err := s.tokenService.GenerateAccessRefreshTokenPair(userThatWantsToLogin.UserID)
+	tokens, err := s.tokenService.GenerateAccessRefreshTokenPair(userThatWantsToLogin.UserID, client)
 	if err != nil {
 		logger.LogError(err, "Failed to generate access and refresh token", map[string]interface{}{"layer": "service", "operation": "LoginUser"})
-		return "", "", errors.New("failed to generate access and refresh token")
+		return nil, errors.New("failed to generate access and refresh token")
 	}
 
-	return accessToken, refreshToken, nil
+	s.audit.Record(models.NewAuditEvent(models.AuditActionLogin, userThatWantsToLogin.UserID, userThatWantsToLogin.UserID, client, models.AuditResultSuccess, models.AuditDetails{"method": "password"}))
+	return tokens, nil
+}
+
+// recordLoginFailure feeds the brute force throttle, the failure metric and the audit log, userID is 0 when the email is unknown
+func (s *authService) recordLoginFailure(email string, userID int, client models.ClientInfo, reason string) {
+	metrics.AuthFailures.WithLabelValues(ThrottleActionLogin, reason).Inc()
+	s.throttleService.RecordFailure(ThrottleActionLogin, email, client.IPAddress)
+	s.audit.Record(models.NewAuditEvent(models.AuditActionLogin, 0, userID, client, models.AuditResultFailure, models.AuditDetails{"reason": reason, "email": email}))
 }
 
-func (s *authService) RequestPasswordReset(email string) error {
+func (s *authService) RequestPasswordReset(email, ipAddress string) error {
+	// every reset request counts against the account and ip, so nobody can flood an inbox with reset emails
+	if err := s.throttleService.CheckAllowed(ThrottleActionPasswordReset, email, ipAddress); err != nil {
+		logger.LogError(err, "Password reset throttled", map[string]interface{}{"layer": "service", "operation": "RequestPasswordReset", "ip_address": ipAddress})
+		return err
+	}
+	s.throttleService.RecordFailure(ThrottleActionPasswordReset, email, ipAddress)
+
 	// create a new errgroup to run multiple goroutines concurrently
 	var g errgroup.Group
 	user, err := s.authRepo.GetUserByEmail(email)
@@ -109,12 +158,7 @@ func (s *authService) RequestPasswordReset(email string) error {
 		return errors.New("failed to generate reset tokens")
 	}
 	// generate resetLink using resetToken
-	var resetLink string
-	if os.Getenv("ENVIRONMENT") == "production" {
-		resetLink = "https://tryout.omahti.web.id/forgot-password/" + resetToken
-	} else {
-		resetLink = "http://localhost:3000/forgot-password/" + resetToken
-	}
+	resetLink := utils.FrontendLink("/forgot-password/" + resetToken)
 
 	// run the goroutines concurrently
 	// blacklist the token that is associated with the email, so that when user is requesting password reset, the token is blacklisted
@@ -148,10 +192,20 @@ func (s *authService) RequestPasswordReset(email string) error {
 		return err
 	}
 
+	s.audit.Record(models.NewAuditEvent(models.AuditActionPasswordResetRequested, 0, user.UserID, models.ClientInfo{IPAddress: ipAddress}, models.AuditResultSuccess, nil))
 	return nil
 }
 
-func (s *authService) ResetPassword(resetToken, newPassword string) error {
+func (s *authService) ResetPassword(resetToken, newPassword, ipAddress string) error {
+	// the token owner's details are needed to check the new password against them
+	user, err := s.authRepo.GetUserByResetToken(resetToken)
+	if err != nil {
+		return errors.New("failed to reset password")
+	}
+	if err := s.passwordPolicy.Validate(newPassword, user.Email, user.Username); err != nil {
+		return err
+	}
+
 	newHashedPassword, err := utils.HashPassword(newPassword)
 	if err != nil {
 		logger.LogError(err, "Failed to hash password", map[string]interface{}{"layer": "service", "operation": "ResetPassword"})
@@ -159,33 +213,208 @@ func (s *authService) ResetPassword(resetToken, newPassword string) error {
 	}
 
 	// call the repo and reset the password using the reset token and the new password
-	err = s.authRepo.ResetPassword(newHashedPassword, resetToken)
+	userID, err := s.authRepo.ResetPassword(newHashedPassword, resetToken)
 	if err != nil {
 		logger.LogError(err, "Failed to reset password", map[string]interface{}{"layer": "service", "operation": "ResetPassword"})
 		return errors.New("failed to reset password")
 	}
 
+	// whoever knew the old password is kicked out everywhere, refresh tokens and access tokens alike
+	if err := s.tokenService.RevokeAllSessions(userID); err != nil {
+		logger.LogError(err, "Failed to revoke sessions after password reset", map[string]interface{}{"layer": "service", "operation": "ResetPassword", "userID": userID})
+	}
+	if err := s.revocationService.RevokeUserAccessTokens(userID, "password_reset"); err != nil {
+		logger.LogError(err, "Failed to revoke access tokens after password reset", map[string]interface{}{"layer": "service", "operation": "ResetPassword", "userID": userID})
+	}
+
+	s.audit.Record(models.NewAuditEvent(models.AuditActionPasswordReset, userID, userID, models.ClientInfo{IPAddress: ipAddress}, models.AuditResultSuccess, nil))
 	return nil
 }
 
-func (s *authService) UpgradeUserPackage(userID int, newPackage string) error {
-	if newPackage != "free" && newPackage != "premium" {
-		return errors.New("invalid package type")
+// RequestMagicLink emails a one time login link and returns the nonce the handler sets as a cookie,
+// an unknown email gets a nonce too so the response doesn't reveal which emails are registered
+func (s *authService) RequestMagicLink(email, ipAddress string) (string, error) {
+	if err := s.throttleService.CheckAllowed(ThrottleActionMagicLink, email, ipAddress); err != nil {
+		logger.LogError(err, "Magic link throttled", map[string]interface{}{"layer": "service", "operation": "RequestMagicLink", "ip_address": ipAddress})
+		return "", err
+	}
+	s.throttleService.RecordFailure(ThrottleActionMagicLink, email, ipAddress)
+
+	loginToken, nonce, expiresAt, err := utils.CreateMagicLinkToken()
+	if err != nil {
+		logger.LogError(err, "Failed to generate magic link", map[string]interface{}{"layer": "service", "operation": "RequestMagicLink"})
+		return "", errors.New("failed to generate magic link")
+	}
+
+	user, err := s.authRepo.GetUserByEmail(email)
+	if err != nil || user == nil {
+		logger.LogDebug("Magic link requested for unknown email", map[string]interface{}{"layer": "service", "operation": "RequestMagicLink"})
+		return nonce, nil
+	}
+
+	if err := s.authRepo.RequestMagicLink(user.UserID, loginToken, nonce, expiresAt); err != nil {
+		logger.LogError(err, "Failed to request magic link", map[string]interface{}{"layer": "service", "operation": "RequestMagicLink", "userID": user.UserID})
+		return "", errors.New("failed to request magic link")
+	}
+	if err := utils.SendMagicLinkEmail(user.Email, utils.FrontendLink("/magic-link/"+loginToken), utils.MagicLinkTTL); err != nil {
+		logger.LogError(err, "Failed to send magic link email", map[string]interface{}{"layer": "service", "operation": "RequestMagicLink"})
+		return "", errors.New("failed to send magic link email")
+	}
+	return nonce, nil
+}
+
+// LoginWithMagicLink consumes the link and starts a normal session
+func (s *authService) LoginWithMagicLink(loginToken, nonce string, client models.ClientInfo) (*models.TokenPair, error) {
+	if nonce == "" {
+		return nil, errors.New("open the link in the browser you requested it from")
+	}
+	userID, err := s.authRepo.ConsumeMagicLink(loginToken, nonce)
+	if err != nil {
+		s.audit.Record(models.NewAuditEvent(models.AuditActionLogin, 0, 0, client, models.AuditResultFailure, models.AuditDetails{"method": "magic_link", "reason": "invalid_link"}))
+		return nil, errors.New("invalid or expired login link")
+	}
+
+	tokens, err := s.tokenService.GenerateAccessRefreshTokenPair(userID, client)
+	if errors.Is(err, ErrAccountDisabled) {
+		s.audit.Record(models.NewAuditEvent(models.AuditActionLogin, 0, userID, client, models.AuditResultDenied, models.AuditDetails{"method": "magic_link", "reason": "account_disabled"}))
+		return nil, err
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to generate access and refresh token", map[string]interface{}{"layer": "service", "operation": "LoginWithMagicLink"})
+		return nil, errors.New("failed to generate access and refresh token")
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionLogin, userID, userID, client, models.AuditResultSuccess, models.AuditDetails{"method": "magic_link"}))
+	return tokens, nil
+}
+
+// ChangePassword keeps the current session and logs every other device out
+func (s *authService) ChangePassword(userID int, currentSessionID, currentPassword, newPassword, ipAddress string) error {
+	user, err := s.Reauthenticate(userID, currentPassword, ipAddress)
+	if err != nil {
+		return err
+	}
+
+	if currentPassword == newPassword {
+		return &PasswordPolicyError{Violations: []PasswordViolation{{Reason: PasswordSameAsCurrent, Message: "new password must be different from the current one"}}}
+	}
+	if err := s.passwordPolicy.Validate(newPassword, user.Email, user.Username); err != nil {
+		return err
 	}
 
-	err := s.authRepo.UpgradeUserPackage(userID, newPackage)
+	newHashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		logger.LogError(err, "Failed to hash password", map[string]interface{}{"layer": "service", "operation": "ChangePassword"})
+		return errors.New("failed to hash password")
+	}
+	if err := s.authRepo.UpdatePassword(userID, newHashedPassword); err != nil {
+		logger.LogError(err, "Failed to change password", map[string]interface{}{"layer": "service", "operation": "ChangePassword", "userID": userID})
+		return errors.New("failed to change password")
+	}
+
+	// the handler rotates the current session right after, so only the other devices stay logged out
+	if err := s.tokenService.RevokeOtherSessions(userID, currentSessionID); err != nil {
+		logger.LogError(err, "Failed to revoke other sessions after password change", map[string]interface{}{"layer": "service", "operation": "ChangePassword", "userID": userID})
+	}
+	if err := s.revocationService.RevokeUserAccessTokens(userID, "password_change"); err != nil {
+		logger.LogError(err, "Failed to revoke access tokens after password change", map[string]interface{}{"layer": "service", "operation": "ChangePassword", "userID": userID})
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionPasswordChange, userID, userID, models.ClientInfo{IPAddress: ipAddress}, models.AuditResultSuccess, nil))
+	return nil
+}
+
+// RequestEmailChange needs the current password, the address only changes once the link sent to it is opened
+func (s *authService) RequestEmailChange(userID int, currentPassword, newEmail, ipAddress string) error {
+	user, err := s.Reauthenticate(userID, currentPassword, ipAddress)
 	if err != nil {
-		logger.LogError(err, "Failed to upgrade user package in service", map[string]interface{}{"layer": "service", "operation": "UpgradeUserPackage", "userID": userID, "newPackage": newPackage})
 		return err
 	}
 
-	// If upgrading to premium, schedule expiration after 2 minutes
-	if newPackage == "premium" && s.schedulerService != nil {
-		err = s.schedulerService.SchedulePackageExpiration(userID, 2*time.Minute)
-		if err != nil {
-			logger.LogError(err, "Failed to schedule package expiration", map[string]interface{}{"layer": "service", "operation": "UpgradeUserPackage", "userID": userID})
-			// Don't return error here as the upgrade was successful
+	newEmail = strings.TrimSpace(newEmail)
+	if strings.EqualFold(newEmail, user.Email) {
+		return errors.New("new email is the same as the current one")
+	}
+	if existingUser, _ := s.authRepo.GetUserByEmail(newEmail); existingUser != nil {
+		return errors.New("email already in use")
+	}
+
+	changeToken, expiresAt, err := utils.CreateResetToken()
+	if err != nil {
+		logger.LogError(err, "Failed to generate email change token", map[string]interface{}{"layer": "service", "operation": "RequestEmailChange"})
+		return errors.New("failed to request email change")
+	}
+	if err := s.authRepo.RequestEmailChange(userID, newEmail, changeToken, expiresAt); err != nil {
+		logger.LogError(err, "Failed to store email change", map[string]interface{}{"layer": "service", "operation": "RequestEmailChange", "userID": userID})
+		return errors.New("failed to request email change")
+	}
+
+	var g errgroup.Group
+	// proves the new address belongs to the user
+	g.Go(func() error {
+		if err := utils.SendEmailChangeConfirmationEmail(newEmail, utils.FrontendLink("/confirm-email/"+changeToken)); err != nil {
+			logger.LogError(err, "Failed to send email change confirmation", map[string]interface{}{"layer": "service", "operation": "RequestEmailChange"})
+			return errors.New("failed to send confirmation email")
+		}
+		return nil
+	})
+	// warns the owner in case someone else is using their session
+	g.Go(func() error {
+		if err := utils.SendEmailChangeNotificationEmail(user.Email, newEmail); err != nil {
+			logger.LogError(err, "Failed to send email change notification", map[string]interface{}{"layer": "service", "operation": "RequestEmailChange"})
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+func (s *authService) ConfirmEmailChange(changeToken string) error {
+	userID, _, err := s.authRepo.ConfirmEmailChange(changeToken)
+	if err != nil {
+		if repositories.IsUniqueViolation(err) {
+			return errors.New("email already in use")
 		}
+		return errors.New("invalid or expired confirmation link")
+	}
+
+	// access tokens still carry the old email claim
+	if err := s.revocationService.RevokeUserAccessTokens(userID, "email_change"); err != nil {
+		logger.LogError(err, "Failed to revoke access tokens after email change", map[string]interface{}{"layer": "service", "operation": "ConfirmEmailChange", "userID": userID})
+	}
+	return nil
+}
+
+// Reauthenticate checks the current password before a sensitive change, wrong guesses count against the login throttle
+func (s *authService) Reauthenticate(userID int, currentPassword, ipAddress string) (*models.User, error) {
+	user, err := s.authRepo.GetUserByID(userID)
+	if err != nil {
+		logger.LogError(err, "Failed to get user", map[string]interface{}{"layer": "service", "operation": "reauthenticate", "userID": userID})
+		return nil, errors.New("failed to verify current password")
+	}
+	if err := s.throttleService.CheckAllowed(ThrottleActionLogin, user.Email, ipAddress); err != nil {
+		return nil, err
+	}
+	if !utils.CheckPasswordHash(currentPassword, user.Password) {
+		s.recordLoginFailure(user.Email, userID, models.ClientInfo{IPAddress: ipAddress}, "wrong_current_password")
+		return nil, errors.New("current password is incorrect")
+	}
+	return user, nil
+}
+
+// UpgradeUserPackage switches the user to a free plan right away, paid plans need a checkout
+func (s *authService) UpgradeUserPackage(userID int, newPackage string) error {
+	plan, err := s.plans.GetPlan(newPackage)
+	if err != nil {
+		return err
+	}
+	if !plan.Purchasable {
+		return ErrPlanNotAvailable
+	}
+	if plan.PriceAmount > 0 {
+		return ErrPaymentRequired
+	}
+	// a running paid subscription is canceled right away, users who want to keep it until the period ends cancel it instead
+	if err := s.subscriptions.SwitchToFreePlan(userID, plan.PlanID, "switched to the "+plan.Name+" plan"); err != nil {
+		logger.LogError(err, "Failed to switch to free plan", map[string]interface{}{"layer": "service", "operation": "UpgradeUserPackage", "userID": userID, "newPackage": newPackage})
+		return err
 	}
 
 	logger.LogDebug("User package upgraded in service", map[string]interface{}{"layer": "service", "operation": "UpgradeUserPackage", "userID": userID, "newPackage": newPackage})
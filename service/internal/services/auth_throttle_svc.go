@@ -0,0 +1,235 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"service/internal/logger"
+	"service/internal/metrics"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"strings"
+	"time"
+)
+
+// throttled actions
+const (
+	ThrottleActionLogin         = "login"
+	ThrottleActionPasswordReset = "password_reset"
+	ThrottleActionMagicLink     = "magic_link"
+)
+
+// ThrottledError is returned while an account or ip is backing off or locked, handlers answer 429 with Retry-After
+type ThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many attempts, temporarily locked, try again in %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// throttlePolicy: after softLimit failures every further attempt waits baseDelay doubled per failure (capped at maxDelay),
+// at lockoutThreshold the key is locked for lockoutDuration; failures older than window are forgotten
+type throttlePolicy struct {
+	softLimit        int
+	lockoutThreshold int
+	lockoutDuration  time.Duration
+	window           time.Duration
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+}
+
+var throttlePolicies = map[string]map[string]throttlePolicy{
+	ThrottleActionLogin: {
+		"account": {softLimit: 3, lockoutThreshold: 10, lockoutDuration: 30 * time.Minute, window: time.Hour, baseDelay: time.Second, maxDelay: 5 * time.Minute},
+		"ip":      {softLimit: 10, lockoutThreshold: 50, lockoutDuration: 30 * time.Minute, window: time.Hour, baseDelay: time.Second, maxDelay: 5 * time.Minute},
+	},
+	// every reset request counts, so a victim's inbox can't be flooded
+	ThrottleActionPasswordReset: {
+		"account": {softLimit: 2, lockoutThreshold: 5, lockoutDuration: time.Hour, window: time.Hour, baseDelay: time.Minute, maxDelay: 30 * time.Minute},
+		"ip":      {softLimit: 5, lockoutThreshold: 20, lockoutDuration: time.Hour, window: time.Hour, baseDelay: 30 * time.Second, maxDelay: 30 * time.Minute},
+	},
+	// magic links are emailed like reset links, same limits
+	ThrottleActionMagicLink: {
+		"account": {softLimit: 2, lockoutThreshold: 5, lockoutDuration: time.Hour, window: time.Hour, baseDelay: time.Minute, maxDelay: 30 * time.Minute},
+		"ip":      {softLimit: 5, lockoutThreshold: 20, lockoutDuration: time.Hour, window: time.Hour, baseDelay: 30 * time.Second, maxDelay: 30 * time.Minute},
+	},
+}
+
+type AuthThrottleService interface {
+	CheckAllowed(action, email, ipAddress string) error
+	RecordFailure(action, email, ipAddress string)
+	RecordSuccess(action, email string)
+	UnlockAccount(unlockToken, ipAddress string) error
+	PruneStaleThrottles() (int64, error)
+}
+
+type authThrottleService struct {
+	throttleRepo repositories.AuthThrottleRepo
+	authRepo     repositories.AuthRepo
+	audit        AuditLogger
+}
+
+func NewAuthThrottleService(throttleRepo repositories.AuthThrottleRepo, authRepo repositories.AuthRepo, audit AuditLogger) AuthThrottleService {
+	return &authThrottleService{throttleRepo: throttleRepo, authRepo: authRepo, audit: audit}
+}
+
+func throttleKey(action, scope, subject string) string {
+	return action + ":" + scope + ":" + strings.ToLower(strings.TrimSpace(subject))
+}
+
+// accountThrottleKeys are the keys of every per-account counter of the email
+func accountThrottleKeys(email string) []string {
+	actions := []string{ThrottleActionLogin, ThrottleActionPasswordReset, ThrottleActionMagicLink}
+	keys := make([]string, 0, len(actions))
+	for _, action := range actions {
+		keys = append(keys, throttleKey(action, "account", email))
+	}
+	return keys
+}
+
+// CheckAllowed returns a *ThrottledError when the account or the ip must wait before trying again
+func (s *authThrottleService) CheckAllowed(action, email, ipAddress string) error {
+	for scope, subject := range map[string]string{"account": email, "ip": ipAddress} {
+		policy := throttlePolicies[action][scope]
+		throttle, err := s.throttleRepo.GetThrottle(throttleKey(action, scope, subject))
+		if err != nil {
+			// fail open, a database hiccup shouldn't lock everyone out
+			logger.LogError(err, "Failed to check auth throttle", map[string]interface{}{"layer": "service", "operation": "CheckAllowed", "action": action})
+			continue
+		}
+		if throttle == nil {
+			continue
+		}
+
+		now := time.Now()
+		if throttle.LockedUntil != nil && now.Before(*throttle.LockedUntil) {
+			metrics.AuthFailures.WithLabelValues(action, "locked").Inc()
+			return &ThrottledError{RetryAfter: throttle.LockedUntil.Sub(now), Locked: true}
+		}
+		if now.Sub(throttle.LastFailureAt) > policy.window || throttle.Failures < policy.softLimit {
+			continue
+		}
+		if wait := throttle.LastFailureAt.Add(backoffDelay(policy, throttle.Failures)).Sub(now); wait > 0 {
+			metrics.AuthFailures.WithLabelValues(action, "backoff").Inc()
+			return &ThrottledError{RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+func backoffDelay(policy throttlePolicy, failures int) time.Duration {
+	exponent := failures - policy.softLimit
+	if exponent > 20 {
+		exponent = 20
+	}
+	delay := time.Duration(float64(policy.baseDelay) * math.Pow(2, float64(exponent)))
+	if delay > policy.maxDelay {
+		return policy.maxDelay
+	}
+	return delay
+}
+
+// RecordFailure counts a failed login (or any reset request) against the account and the ip, locking them at the threshold
+func (s *authThrottleService) RecordFailure(action, email, ipAddress string) {
+	for scope, subject := range map[string]string{"account": email, "ip": ipAddress} {
+		policy := throttlePolicies[action][scope]
+		key := throttleKey(action, scope, subject)
+		throttle, err := s.throttleRepo.RecordFailure(key, policy.window)
+		if err != nil {
+			logger.LogError(err, "Failed to record auth failure", map[string]interface{}{"layer": "service", "operation": "RecordFailure", "action": action})
+			continue
+		}
+		// past the threshold every failure after a lock expired locks again, until the window passes quietly
+		if throttle.Failures >= policy.lockoutThreshold && (throttle.LockedUntil == nil || time.Now().After(*throttle.LockedUntil)) {
+			s.lock(action, scope, key, email, ipAddress, policy.lockoutDuration)
+		}
+	}
+}
+
+func (s *authThrottleService) lock(action, scope, key, email, ipAddress string, lockoutDuration time.Duration) {
+	lockedUntil := time.Now().Add(lockoutDuration)
+
+	// only locked accounts get an unlock link, an ip lock just expires
+	var unlockToken string
+	var unlockTokenHash *string
+	if scope == "account" && action == ThrottleActionLogin {
+		token, err := utils.CreateRefreshToken()
+		if err == nil {
+			unlockToken = token
+			hash := utils.HashToken(token)
+			unlockTokenHash = &hash
+		}
+	}
+
+	if err := s.throttleRepo.LockThrottle(key, lockedUntil, unlockTokenHash); err != nil {
+		logger.LogError(err, "Failed to lock after repeated failures", map[string]interface{}{"layer": "service", "operation": "lock", "action": action, "scope": scope})
+		return
+	}
+
+	metrics.AuthLockouts.WithLabelValues(action, scope).Inc()
+
+	// an ip lock isn't about one account, it has no target
+	var user *models.User
+	if scope == "account" {
+		user, _ = s.authRepo.GetUserByEmail(email)
+	}
+	targetUserID := 0
+	if user != nil {
+		targetUserID = user.UserID
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionAccountLockout, 0, targetUserID, models.ClientInfo{IPAddress: ipAddress}, models.AuditResultDenied,
+		models.AuditDetails{"throttled_action": action, "scope": scope, "locked_until": lockedUntil}))
+
+	// don't reveal whether the account exists, only send the email when it does
+	if unlockToken != "" {
+		if user != nil {
+			go func() {
+				if err := utils.SendAccountUnlockEmail(user.Email, utils.FrontendLink("/unlock-account/"+unlockToken), lockoutDuration); err != nil {
+					logger.LogError(err, "Failed to send account unlock email", map[string]interface{}{"layer": "service", "operation": "lock"})
+				}
+			}()
+		}
+	}
+}
+
+// RecordSuccess clears the account counter, the ip counter is left to expire so an attacker can't reset it with their own account
+func (s *authThrottleService) RecordSuccess(action, email string) {
+	if err := s.throttleRepo.ClearThrottle(throttleKey(action, "account", email)); err != nil {
+		logger.LogError(err, "Failed to clear auth throttle", map[string]interface{}{"layer": "service", "operation": "RecordSuccess", "action": action})
+	}
+}
+
+// UnlockAccount consumes the link from the lockout email
+func (s *authThrottleService) UnlockAccount(unlockToken, ipAddress string) error {
+	key, err := s.throttleRepo.ClearThrottleByUnlockToken(utils.HashToken(unlockToken))
+	if err != nil {
+		return errors.New("invalid or expired unlock link")
+	}
+
+	targetUserID := 0
+	email := strings.TrimPrefix(key, throttleKey(ThrottleActionLogin, "account", ""))
+	if user, err := s.authRepo.GetUserByEmail(email); err == nil && user != nil {
+		targetUserID = user.UserID
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionAccountUnlock, 0, targetUserID, models.ClientInfo{IPAddress: ipAddress}, models.AuditResultSuccess, nil))
+	return nil
+}
+
+// PruneStaleThrottles deletes counters older than the longest window, every ip that ever failed a login leaves one behind
+func (s *authThrottleService) PruneStaleThrottles() (int64, error) {
+	var longestWindow time.Duration
+	for _, scopes := range throttlePolicies {
+		for _, policy := range scopes {
+			if policy.window > longestWindow {
+				longestWindow = policy.window
+			}
+		}
+	}
+	return s.throttleRepo.DeleteStaleThrottles(time.Now().Add(-longestWindow))
+}
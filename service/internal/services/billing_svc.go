@@ -0,0 +1,375 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"strings"
+	"time"
+)
+
+// stripe accepts checkout sessions that expire between 30 minutes and 24 hours after they are created
+const checkoutLifetime = 1 * time.Hour
+
+const maxIdempotencyKeyLength = 64
+
+var (
+	ErrCheckoutNotFound     = errors.New("checkout not found")
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different plan")
+)
+
+// BillingService sells plans through the payment provider, a plan is only applied once the provider's signed webhook confirms the payment
+type BillingService interface {
+	StartCheckout(ctx context.Context, userID int, planID, promoCode, idempotencyKey string, client models.ClientInfo) (*models.Checkout, error)
+	GetCheckout(userID int, checkoutID string) (*models.Checkout, error)
+	HandleWebhook(payload []byte, header http.Header) error
+}
+
+type billingService struct {
+	paymentRepo   repositories.PaymentRepo
+	authRepo      repositories.AuthRepo
+	plans         PlanCatalog
+	subscriptions SubscriptionService
+	invoices      InvoiceService
+	promos        PromoService
+	notifications NotificationService
+	provider      PaymentProvider
+	audit         AuditLogger
+}
+
+func NewBillingService(paymentRepo repositories.PaymentRepo, authRepo repositories.AuthRepo, plans PlanCatalog, subscriptions SubscriptionService, invoices InvoiceService, promos PromoService, notifications NotificationService, provider PaymentProvider, audit AuditLogger) BillingService {
+	return &billingService{
+		paymentRepo:   paymentRepo,
+		authRepo:      authRepo,
+		plans:         plans,
+		subscriptions: subscriptions,
+		invoices:      invoices,
+		promos:        promos,
+		notifications: notifications,
+		provider:      provider,
+		audit:         audit,
+	}
+}
+
+// StartCheckout opens a checkout for the plan, retrying with the same idempotency key returns the first checkout instead of a second one;
+// a promo code is held for the checkout and its discount taken off the price
+func (s *billingService) StartCheckout(ctx context.Context, userID int, planID, promoCode, idempotencyKey string, client models.ClientInfo) (*models.Checkout, error) {
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		return nil, fmt.Errorf("idempotency key can't be longer than %d characters", maxIdempotencyKeyLength)
+	}
+	if idempotencyKey == "" {
+		// without a key from the client every request is a new checkout
+		key, err := utils.CreateRefreshToken()
+		if err != nil {
+			return nil, errors.New("failed to start checkout")
+		}
+		idempotencyKey = key
+	} else if existing, err := s.existingCheckout(userID, planID, idempotencyKey); existing != nil || err != nil {
+		return existing, err
+	}
+
+	plan, err := s.plans.GetPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	if !plan.Purchasable {
+		return nil, ErrPlanNotAvailable
+	}
+	if plan.PriceAmount == 0 {
+		return nil, errors.New("this plan is free, upgrade to it directly")
+	}
+	user, err := s.authRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, errors.New("failed to get user")
+	}
+
+	checkoutID, err := utils.CreateRefreshToken()
+	if err != nil {
+		return nil, errors.New("failed to start checkout")
+	}
+	checkout := &models.Checkout{
+		CheckoutID:     checkoutID,
+		UserID:         userID,
+		PlanID:         plan.PlanID,
+		Provider:       s.provider.Name(),
+		Amount:         plan.PriceAmount,
+		Currency:       plan.Currency,
+		Status:         models.CheckoutPending,
+		IdempotencyKey: idempotencyKey,
+		ExpiresAt:      time.Now().Add(checkoutLifetime),
+	}
+	if promoCode != "" {
+		redemption, err := s.promos.ReserveDiscount(userID, plan, promoCode, checkoutID)
+		if err != nil {
+			return nil, err
+		}
+		checkout.PromoCode = &redemption.Code
+		checkout.DiscountAmount = redemption.DiscountAmount
+		checkout.Amount -= redemption.DiscountAmount
+	}
+	created, err := s.paymentRepo.CreateCheckout(checkout)
+	if err != nil || !created {
+		s.releaseDiscount(checkout)
+	}
+	if err != nil {
+		return nil, errors.New("failed to start checkout")
+	}
+	if !created {
+		// a concurrent request with the same key won the insert
+		return s.existingCheckout(userID, planID, idempotencyKey)
+	}
+
+	providerCheckout, err := s.provider.CreateCheckout(ctx, models.CheckoutRequest{
+		CheckoutID: checkout.CheckoutID,
+		Email:      user.Email,
+		PlanName:   plan.Name,
+		Amount:     checkout.Amount,
+		Currency:   checkout.Currency,
+		SuccessURL: utils.FrontendLink("/billing/success?checkout_id=" + url.QueryEscape(checkout.CheckoutID)),
+		CancelURL:  utils.FrontendLink("/billing/cancel?checkout_id=" + url.QueryEscape(checkout.CheckoutID)),
+		ExpiresAt:  checkout.ExpiresAt,
+	})
+	if err != nil {
+		logger.LogError(err, "Failed to create provider checkout", map[string]interface{}{"layer": "service", "operation": "StartCheckout", "userID": userID, "checkoutID": checkout.CheckoutID})
+		reason := "the payment provider refused the checkout"
+		if _, err := s.paymentRepo.TransitionCheckout(checkout.CheckoutID, []string{models.CheckoutPending}, models.CheckoutFailed, nil, &reason); err != nil {
+			logger.LogError(err, "Failed to mark checkout failed", map[string]interface{}{"layer": "service", "operation": "StartCheckout", "checkoutID": checkout.CheckoutID})
+		}
+		s.releaseDiscount(checkout)
+		return nil, errors.New("failed to start checkout, try again later")
+	}
+	if err := s.paymentRepo.SetProviderSession(checkout.CheckoutID, providerCheckout.SessionID, providerCheckout.URL); err != nil {
+		return nil, errors.New("failed to start checkout")
+	}
+	checkout.ProviderSessionID = &providerCheckout.SessionID
+	checkout.CheckoutURL = &providerCheckout.URL
+
+	s.audit.Record(models.NewAuditEvent(models.AuditActionCheckoutStarted, userID, userID, client, models.AuditResultSuccess, models.AuditDetails{
+		"checkout_id": checkout.CheckoutID, "plan": plan.PlanID, "amount": checkout.Amount, "currency": checkout.Currency, "provider": checkout.Provider,
+		"promo_code": checkout.PromoCode, "discount": checkout.DiscountAmount,
+	}))
+	return checkout, nil
+}
+
+// releaseDiscount gives back the promo code held for a checkout that never opened
+func (s *billingService) releaseDiscount(checkout *models.Checkout) {
+	if checkout.PromoCode == nil {
+		return
+	}
+	if err := s.promos.ReleaseDiscount(checkout.CheckoutID); err != nil {
+		logger.LogError(err, "Failed to release promo code", map[string]interface{}{"layer": "service", "operation": "releaseDiscount", "checkoutID": checkout.CheckoutID})
+	}
+}
+
+// existingCheckout returns the checkout already opened with the key, nil when there is none
+func (s *billingService) existingCheckout(userID int, planID, idempotencyKey string) (*models.Checkout, error) {
+	checkout, err := s.paymentRepo.GetCheckoutByIdempotencyKey(userID, idempotencyKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to get checkout by idempotency key", map[string]interface{}{"layer": "service", "operation": "existingCheckout", "userID": userID})
+		return nil, errors.New("failed to start checkout")
+	}
+	if checkout.PlanID != planID {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return checkout, nil
+}
+
+func (s *billingService) GetCheckout(userID int, checkoutID string) (*models.Checkout, error) {
+	checkout, err := s.paymentRepo.GetCheckout(checkoutID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && checkout.UserID != userID) {
+		return nil, ErrCheckoutNotFound
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to get checkout", map[string]interface{}{"layer": "service", "operation": "GetCheckout", "checkoutID": checkoutID})
+		return nil, errors.New("failed to get checkout")
+	}
+	return checkout, nil
+}
+
+// HandleWebhook verifies and applies a provider event, every event is handled once however often the provider delivers it
+func (s *billingService) HandleWebhook(payload []byte, header http.Header) error {
+	event, err := s.provider.ParseWebhook(payload, header)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidWebhookSignature) {
+			logger.LogError(err, "Failed to parse payment webhook", map[string]interface{}{"layer": "service", "operation": "HandleWebhook", "provider": s.provider.Name()})
+		}
+		return err
+	}
+	if event == nil {
+		return nil
+	}
+
+	claimed, err := s.paymentRepo.ClaimPaymentEvent(s.provider.Name(), event.EventID, event.Type)
+	if err != nil {
+		return errors.New("failed to record payment event")
+	}
+	if !claimed {
+		logger.LogDebug("Payment event already handled", map[string]interface{}{"layer": "service", "operation": "HandleWebhook", "eventID": event.EventID})
+		return nil
+	}
+
+	if err := s.applyEvent(event); err != nil {
+		logger.LogError(err, "Failed to apply payment event", map[string]interface{}{"layer": "service", "operation": "HandleWebhook", "eventID": event.EventID, "type": event.Type})
+		if err := s.paymentRepo.ReleasePaymentEvent(s.provider.Name(), event.EventID); err != nil {
+			logger.LogError(err, "Failed to release payment event", map[string]interface{}{"layer": "service", "operation": "HandleWebhook", "eventID": event.EventID})
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *billingService) applyEvent(event *models.PaymentEvent) error {
+	checkout, err := s.findCheckout(event)
+	if err != nil {
+		return err
+	}
+	if checkout == nil {
+		// not one of ours (e.g. another integration on the same account), retrying won't change that
+		logger.Log.Warn().Str("eventID", event.EventID).Str("type", event.Type).Msg("Payment event for unknown checkout ignored")
+		return nil
+	}
+	if err := s.paymentRepo.LinkPaymentEvent(s.provider.Name(), event.EventID, checkout.CheckoutID); err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case models.PaymentSucceeded:
+		return s.applyPayment(checkout, event)
+	case models.PaymentFailed:
+		reason := event.Reason
+		if reason == "" {
+			reason = "payment failed"
+		}
+		moved, err := s.paymentRepo.TransitionCheckout(checkout.CheckoutID, []string{models.CheckoutPending}, models.CheckoutFailed, nil, &reason)
+		if err != nil {
+			return err
+		}
+		if moved {
+			s.recordPaymentEvent(models.AuditActionPaymentFailed, checkout, models.AuditResultFailure, models.AuditDetails{"reason": reason})
+			s.notifications.NotifyPaymentFailed(checkout, reason)
+		}
+		return nil
+	case models.PaymentRefunded:
+		return s.applyRefund(checkout, event)
+	}
+	return nil
+}
+
+func (s *billingService) findCheckout(event *models.PaymentEvent) (*models.Checkout, error) {
+	var checkout *models.Checkout
+	var err error
+	if event.CheckoutID != "" {
+		checkout, err = s.paymentRepo.GetCheckout(event.CheckoutID)
+	} else if event.PaymentID != "" {
+		checkout, err = s.paymentRepo.GetCheckoutByPaymentID(s.provider.Name(), event.PaymentID)
+	} else {
+		return nil, nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return checkout, err
+}
+
+// applyPayment marks the checkout paid and gives the user the plan, a payment that doesn't match the checkout's price never applies it
+func (s *billingService) applyPayment(checkout *models.Checkout, event *models.PaymentEvent) error {
+	if event.Amount != checkout.Amount || !strings.EqualFold(event.Currency, checkout.Currency) {
+		reason := fmt.Sprintf("paid %d %s, expected %d %s", event.Amount, event.Currency, checkout.Amount, checkout.Currency)
+		moved, err := s.paymentRepo.TransitionCheckout(checkout.CheckoutID, []string{models.CheckoutPending, models.CheckoutFailed}, models.CheckoutFailed, nil, &reason)
+		if err != nil {
+			return err
+		}
+		// a paid or refunded checkout keeps its state, the stray payment isn't a failure of it
+		if moved {
+			s.recordPaymentEvent(models.AuditActionPaymentFailed, checkout, models.AuditResultFailure, models.AuditDetails{"reason": reason})
+		}
+		return nil
+	}
+
+	// a card declined first and accepted on the second try fails the checkout before it succeeds
+	moved, err := s.paymentRepo.TransitionCheckout(checkout.CheckoutID, []string{models.CheckoutPending, models.CheckoutFailed}, models.CheckoutPaid, &event.PaymentID, nil)
+	if err != nil {
+		return err
+	}
+	if !moved {
+		// already paid, a redelivery after the code or the invoice failed to be written finishes it now
+		return s.finishPayment(checkout, nil)
+	}
+	subscription, err := s.subscriptions.ActivatePaid(checkout.UserID, checkout.PlanID, "payment for checkout "+checkout.CheckoutID)
+	if err != nil {
+		// put the checkout back so the redelivered event applies the plan
+		if _, rollbackErr := s.paymentRepo.TransitionCheckout(checkout.CheckoutID, []string{models.CheckoutPaid}, models.CheckoutPending, nil, nil); rollbackErr != nil {
+			logger.LogError(rollbackErr, "Failed to reset checkout after plan change failed", map[string]interface{}{"layer": "service", "operation": "applyPayment", "checkoutID": checkout.CheckoutID})
+		}
+		return fmt.Errorf("failed to apply plan: %w", err)
+	}
+
+	s.recordPaymentEvent(models.AuditActionPaymentSucceeded, checkout, models.AuditResultSuccess, nil)
+	// the plan stays applied if these fail, the redelivered event only confirms the code and issues the invoice
+	return s.finishPayment(checkout, subscription)
+}
+
+func (s *billingService) finishPayment(checkout *models.Checkout, subscription *models.Subscription) error {
+	if checkout.PromoCode != nil {
+		if err := s.promos.ConfirmDiscount(checkout.CheckoutID); err != nil {
+			return err
+		}
+	}
+	return s.invoices.IssueInvoice(checkout, subscription)
+}
+
+// applyRefund ends the subscription when the user is still on the plan the refunded checkout bought,
+// the checkout is only marked refunded after the downgrade and the invoice so a failure is retried with the redelivery.
+// A partial refund keeps the plan and the invoice, it is only recorded on the checkout.
+func (s *billingService) applyRefund(checkout *models.Checkout, event *models.PaymentEvent) error {
+	if checkout.Status != models.CheckoutPaid {
+		return nil
+	}
+	raised, err := s.paymentRepo.RecordRefundedAmount(checkout.CheckoutID, event.Amount)
+	if err != nil {
+		return err
+	}
+	if event.Amount < checkout.Amount {
+		if raised {
+			s.recordPaymentEvent(models.AuditActionPaymentRefunded, checkout, models.AuditResultSuccess, models.AuditDetails{"amount": event.Amount, "partial": true})
+		}
+		return nil
+	}
+
+	if err := s.subscriptions.EndSubscription(checkout.UserID, checkout.PlanID, models.SubscriptionCanceled, "payment for checkout "+checkout.CheckoutID+" refunded"); err != nil {
+		return fmt.Errorf("failed to end refunded subscription: %w", err)
+	}
+	if err := s.invoices.MarkRefunded(checkout.CheckoutID); err != nil {
+		return err
+	}
+
+	moved, err := s.paymentRepo.TransitionCheckout(checkout.CheckoutID, []string{models.CheckoutPaid}, models.CheckoutRefunded, nil, nil)
+	if err != nil {
+		return err
+	}
+	if moved {
+		s.recordPaymentEvent(models.AuditActionPaymentRefunded, checkout, models.AuditResultSuccess, models.AuditDetails{"amount": event.Amount})
+	}
+	return nil
+}
+
+// recordPaymentEvent audits a webhook driven change, there is no actor since the provider made the call
+func (s *billingService) recordPaymentEvent(action string, checkout *models.Checkout, result string, details models.AuditDetails) {
+	if details == nil {
+		details = models.AuditDetails{}
+	}
+	details["checkout_id"] = checkout.CheckoutID
+	details["plan"] = checkout.PlanID
+	details["provider"] = checkout.Provider
+	s.audit.Record(models.NewAuditEvent(action, 0, checkout.UserID, models.ClientInfo{}, result, details))
+}
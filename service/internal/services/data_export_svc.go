@@ -0,0 +1,297 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"time"
+)
+
+const (
+	// how often the worker looks for queued exports
+	dataExportPollInterval = 15 * time.Second
+	// how often ready archives past their expiry are deleted
+	dataExportCleanupInterval = time.Hour
+	// a running export older than this belonged to a worker that died and is built again
+	dataExportStaleAfter = 30 * time.Minute
+	// how long the download link works before the archive is deleted
+	dataExportTTL = 48 * time.Hour
+	// exports per user per day
+	maxDataExportsPerDay = 2
+)
+
+type DataExportService interface {
+	Start(ctx context.Context)
+	RequestExport(userID int) (*models.DataExport, error)
+	ListExports(userID int) ([]*models.DataExport, error)
+	OpenExport(downloadToken string) (io.ReadCloser, *models.DataExport, error)
+}
+
+type dataExportService struct {
+	exportRepo   repositories.DataExportRepo
+	authRepo     repositories.AuthRepo
+	fileRepo     repositories.FileRepo
+	patRepo      repositories.PersonalAccessTokenRepo
+	tokenService RefreshTokenService
+	fileService  FileService
+	audit        AuditLogger
+	wake         chan struct{}
+}
+
+func NewDataExportService(exportRepo repositories.DataExportRepo, authRepo repositories.AuthRepo, fileRepo repositories.FileRepo, patRepo repositories.PersonalAccessTokenRepo, tokenService RefreshTokenService, fileService FileService, audit AuditLogger) DataExportService {
+	return &dataExportService{
+		exportRepo:   exportRepo,
+		authRepo:     authRepo,
+		fileRepo:     fileRepo,
+		patRepo:      patRepo,
+		tokenService: tokenService,
+		fileService:  fileService,
+		audit:        audit,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Start runs the export worker and the expiry cleanup in the background until ctx is done,
+// the queue lives in Postgres so any instance can build any export
+func (s *dataExportService) Start(ctx context.Context) {
+	go func() {
+		pollTicker := time.NewTicker(dataExportPollInterval)
+		cleanupTicker := time.NewTicker(dataExportCleanupInterval)
+		defer pollTicker.Stop()
+		defer cleanupTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+				s.processQueue(ctx)
+			case <-pollTicker.C:
+				s.processQueue(ctx)
+			case <-cleanupTicker.C:
+				s.cleanupExpired(ctx)
+			}
+		}
+	}()
+}
+
+func (s *dataExportService) RequestExport(userID int) (*models.DataExport, error) {
+	count, err := s.exportRepo.CountRecentExports(userID, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return nil, errors.New("failed to request data export")
+	}
+	if count >= maxDataExportsPerDay {
+		return nil, fmt.Errorf("you can request at most %d exports per day", maxDataExportsPerDay)
+	}
+
+	export, err := s.exportRepo.CreateExport(userID)
+	if err != nil {
+		return nil, errors.New("failed to request data export")
+	}
+
+	// don't wait for the next poll when this instance is idle
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return export, nil
+}
+
+func (s *dataExportService) ListExports(userID int) ([]*models.DataExport, error) {
+	exports, err := s.exportRepo.ListExportsByUser(userID)
+	if err != nil {
+		return nil, errors.New("failed to list data exports")
+	}
+	return exports, nil
+}
+
+// OpenExport resolves the emailed download token, the caller closes the returned reader
+func (s *dataExportService) OpenExport(downloadToken string) (io.ReadCloser, *models.DataExport, error) {
+	export, err := s.exportRepo.FindReadyExportByTokenHash(utils.HashToken(downloadToken))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.LogError(err, "Failed to find data export", map[string]interface{}{"layer": "service", "operation": "OpenExport"})
+		}
+		return nil, nil, errors.New("invalid or expired download link")
+	}
+
+	object, err := s.fileService.OpenObject(context.Background(), *export.ObjectKey)
+	if err != nil {
+		logger.LogError(err, "Failed to open data export archive", map[string]interface{}{"layer": "service", "operation": "OpenExport", "exportID": export.ExportID})
+		return nil, nil, errors.New("failed to open data export")
+	}
+	return object, export, nil
+}
+
+func (s *dataExportService) processQueue(ctx context.Context) {
+	for ctx.Err() == nil {
+		export, err := s.exportRepo.ClaimNextExport(dataExportStaleAfter)
+		if err != nil || export == nil {
+			return
+		}
+		if err := s.buildExport(ctx, export); err != nil {
+			logger.LogError(err, "Failed to build data export", map[string]interface{}{"layer": "service", "operation": "processQueue", "exportID": export.ExportID, "userID": export.UserID})
+			_ = s.exportRepo.MarkExportFailed(export.ExportID, err.Error())
+		}
+	}
+}
+
+// exportManifest is export.json at the root of the archive
+type exportManifest struct {
+	ExportedAt           time.Time                     `json:"exported_at"`
+	Profile              exportProfile                 `json:"profile"`
+	PackageHistory       []*models.PackageChange       `json:"package_history"`
+	Sessions             []*models.Session             `json:"sessions"`
+	PersonalAccessTokens []*models.PersonalAccessToken `json:"personal_access_tokens"`
+	Files                []exportFile                  `json:"files"`
+}
+
+type exportProfile struct {
+	UserID        int                 `json:"user_id"`
+	Email         string              `json:"email"`
+	Username      string              `json:"username"`
+	Package       string              `json:"package"`
+	PackageExpiry *time.Time          `json:"package_expiry"`
+	Storage       *models.UserStorage `json:"storage"`
+}
+
+type exportFile struct {
+	*models.File
+	ArchivePath string `json:"archive_path"`
+}
+
+func (s *dataExportService) buildExport(ctx context.Context, export *models.DataExport) error {
+	user, err := s.authRepo.GetUserByID(export.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	files, err := s.fileRepo.GetFilesMetadataByUser(export.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	storage, err := s.fileRepo.GetUserStorage(export.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get storage: %w", err)
+	}
+	history, err := s.authRepo.GetPackageHistory(export.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get package history: %w", err)
+	}
+	sessions, err := s.tokenService.ListSessions(export.UserID, "")
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	tokens, err := s.patRepo.ListTokensByUser(export.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to list personal access tokens: %w", err)
+	}
+
+	manifest := exportManifest{
+		ExportedAt: time.Now(),
+		Profile: exportProfile{
+			UserID:        user.UserID,
+			Email:         user.Email,
+			Username:      user.Username,
+			Package:       user.Package,
+			PackageExpiry: user.PackageExpiry,
+			Storage:       storage,
+		},
+		PackageHistory:       history,
+		Sessions:             sessions,
+		PersonalAccessTokens: tokens,
+	}
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, exportFile{File: file, ArchivePath: fmt.Sprintf("files/%d_%s", file.FileID, file.FileName)})
+	}
+
+	// the zip is streamed straight into minio, nothing is buffered on disk or in memory
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(s.writeArchive(ctx, pipeWriter, &manifest))
+	}()
+
+	// under the user's prefix so an account purge removes it too
+	objectKey := fmt.Sprintf("%d/.exports/%d.zip", export.UserID, export.ExportID)
+	size, err := s.fileService.StoreObject(ctx, objectKey, pipeReader, "application/zip")
+	pipeReader.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	downloadToken, err := utils.CreateRefreshToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate download token: %w", err)
+	}
+	expiresAt := time.Now().Add(dataExportTTL)
+	if err := s.exportRepo.MarkExportReady(export.ExportID, objectKey, size, utils.HashToken(downloadToken), expiresAt); err != nil {
+		return err
+	}
+
+	if err := utils.SendDataExportReadyEmail(user.Email, utils.FrontendLink("/download-export/"+downloadToken), expiresAt); err != nil {
+		logger.LogError(err, "Failed to send data export email", map[string]interface{}{"layer": "service", "operation": "buildExport", "exportID": export.ExportID})
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionDataExportReady, 0, export.UserID, models.ClientInfo{}, models.AuditResultSuccess, models.AuditDetails{"export_id": export.ExportID, "size_bytes": size}))
+	return nil
+}
+
+func (s *dataExportService) writeArchive(ctx context.Context, w io.Writer, manifest *exportManifest) error {
+	archive := zip.NewWriter(w)
+
+	manifestWriter, err := archive.Create("export.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(manifestWriter)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+
+	for _, file := range manifest.Files {
+		if err := s.copyFileIntoArchive(ctx, archive, file); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func (s *dataExportService) copyFileIntoArchive(ctx context.Context, archive *zip.Writer, file exportFile) error {
+	object, err := s.fileService.OpenObject(ctx, file.S3ObjectKey)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: file.ArchivePath, Method: zip.Deflate, Modified: file.CreatedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, object); err != nil {
+		return fmt.Errorf("failed to copy %s into the archive: %w", file.S3ObjectKey, err)
+	}
+	return nil
+}
+
+// cleanupExpired deletes archives whose download link has expired
+func (s *dataExportService) cleanupExpired(ctx context.Context) {
+	exports, err := s.exportRepo.GetExpiredExports()
+	if err != nil {
+		return
+	}
+	for _, export := range exports {
+		if export.ObjectKey != nil {
+			if err := s.fileService.RemoveObject(ctx, *export.ObjectKey); err != nil {
+				logger.LogError(err, "Failed to remove expired data export", map[string]interface{}{"layer": "service", "operation": "cleanupExpired", "exportID": export.ExportID})
+				continue
+			}
+		}
+		_ = s.exportRepo.MarkExportExpired(export.ExportID)
+	}
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"service/internal/models"
+)
+
+// FakeSignatureHeader carries the hex hmac-sha256 of the body, keyed with FAKE_PAYMENT_WEBHOOK_SECRET
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// fakePaymentProvider takes no money, it lets development and tests drive the whole checkout flow
+// by posting signed webhooks like {"event_id":"evt_1","type":"payment_succeeded","checkout_id":"...","amount":499,"currency":"USD"}
+type fakePaymentProvider struct {
+	webhookSecret string
+}
+
+func NewFakePaymentProvider(webhookSecret string) PaymentProvider {
+	return &fakePaymentProvider{webhookSecret: webhookSecret}
+}
+
+func (p *fakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakePaymentProvider) CreateCheckout(ctx context.Context, req models.CheckoutRequest) (*models.ProviderCheckout, error) {
+	return &models.ProviderCheckout{
+		SessionID: "fake_" + req.CheckoutID,
+		URL:       req.SuccessURL, // nothing to pay, the webhook is posted by hand or by the test
+	}, nil
+}
+
+func (p *fakePaymentProvider) ParseWebhook(payload []byte, header http.Header) (*models.PaymentEvent, error) {
+	signature, err := hex.DecodeString(header.Get(FakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, SignFakeWebhook(p.webhookSecret, payload)) {
+		return nil, ErrInvalidWebhookSignature
+	}
+
+	var event struct {
+		EventID    string `json:"event_id"`
+		Type       string `json:"type"`
+		CheckoutID string `json:"checkout_id"`
+		PaymentID  string `json:"payment_id"`
+		Amount     int64  `json:"amount"`
+		Currency   string `json:"currency"`
+		Reason     string `json:"reason"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to decode fake payment event: %w", err)
+	}
+	switch event.Type {
+	case models.PaymentSucceeded, models.PaymentFailed, models.PaymentRefunded:
+	default:
+		return nil, nil
+	}
+	if event.EventID == "" {
+		return nil, fmt.Errorf("fake payment event has no event_id")
+	}
+	if event.PaymentID == "" {
+		event.PaymentID = "fake_payment_" + event.CheckoutID
+	}
+	return &models.PaymentEvent{
+		EventID:    event.EventID,
+		Type:       event.Type,
+		CheckoutID: event.CheckoutID,
+		PaymentID:  event.PaymentID,
+		Amount:     event.Amount,
+		Currency:   event.Currency,
+		Reason:     event.Reason,
+	}, nil
+}
+
+// SignFakeWebhook returns the signature the fake provider expects for the payload
+func SignFakeWebhook(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
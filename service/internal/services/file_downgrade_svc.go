@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"service/internal/logger"
+	"service/internal/models"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// files of a lost plan stay downloadable this long before the policy applies
+	defaultDowngradeReadOnlyPeriod = 14 * 24 * time.Hour
+	// files archived per scheduler run, the rest are picked up by the next run
+	downgradeArchiveBatchSize = 200
+)
+
+var ErrFileNotAffected = errors.New("file is not affected by a downgrade")
+
+// DowngradePolicy says what happens to the files of a plan the user lost, they are read only for ReadOnlyPeriod
+// and then archived or locked depending on AfterReadOnly
+type DowngradePolicy struct {
+	ReadOnlyPeriod time.Duration
+	AfterReadOnly  string // models.DowngradeArchive or models.DowngradeChoose
+}
+
+// DowngradePolicyFromEnv reads DOWNGRADE_READ_ONLY_PERIOD and DOWNGRADE_POLICY
+func DowngradePolicyFromEnv() (DowngradePolicy, error) {
+	readOnlyPeriod, err := durationFromEnv("DOWNGRADE_READ_ONLY_PERIOD", defaultDowngradeReadOnlyPeriod)
+	if err != nil {
+		return DowngradePolicy{}, err
+	}
+	afterReadOnly := os.Getenv("DOWNGRADE_POLICY")
+	switch afterReadOnly {
+	case "":
+		afterReadOnly = models.DowngradeChoose
+	case models.DowngradeArchive, models.DowngradeChoose:
+	default:
+		return DowngradePolicy{}, fmt.Errorf("invalid DOWNGRADE_POLICY %q, use archive or choose", afterReadOnly)
+	}
+	return DowngradePolicy{ReadOnlyPeriod: readOnlyPeriod, AfterReadOnly: afterReadOnly}, nil
+}
+
+// access is the access to files of a lost plan once the read only period is over
+func (p DowngradePolicy) access() string {
+	if p.AfterReadOnly == models.DowngradeArchive {
+		return models.FileAccessArchived
+	}
+	return models.FileAccessLocked
+}
+
+// PreviewDowngrade lists what happens to the user's files when their plan ends and the default plan takes over,
+// a user already on the default plan sees where the files of the plans they lost are at
+func (s *fileService) PreviewDowngrade(userID int) (*models.DowngradePreview, error) {
+	state, err := s.accessState(userID)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.plans.DefaultPlan()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default plan: %w", err)
+	}
+	files, err := s.fileRepo.GetFilesMetadataByUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file metadata: %w", err)
+	}
+
+	preview := &models.DowngradePreview{
+		CurrentPlan:           state.plan.PlanID,
+		TargetPlan:            target.PlanID,
+		Policy:                s.downgrade.AfterReadOnly,
+		ReadOnlyPeriodSeconds: int64(s.downgrade.ReadOnlyPeriod / time.Second),
+		Files:                 []*models.DowngradePreviewFile{},
+	}
+	// files the current plan includes become read only when it ends, or right away when it doesn't end on its own
+	downgradeAt := state.now
+	if state.plan.PlanID != target.PlanID && state.expiry != nil {
+		preview.DowngradeAt = state.expiry
+		downgradeAt = *state.expiry
+	}
+
+	preview.TargetStorageLimit = target.StorageQuota
+	var targetUsed int64
+	if pool := state.storage.Pool(target.PlanID); pool != nil {
+		preview.TargetStorageLimit, targetUsed = pool.StorageLimit, pool.StorageUsed
+	}
+	preview.TargetStorageFree = max(preview.TargetStorageLimit-targetUsed, 0)
+
+	for _, file := range files {
+		uploadedOn, err := s.fileAccess(state, file)
+		if err != nil {
+			return nil, err
+		}
+		if target.Includes(uploadedOn) {
+			continue
+		}
+		if file.Access == models.FileAccessFull {
+			readOnlyUntil := downgradeAt.Add(s.downgrade.ReadOnlyPeriod)
+			file.ReadOnlyUntil = &readOnlyUntil
+		}
+		preview.AffectedSize += file.FileSize
+		preview.Files = append(preview.Files, &models.DowngradePreviewFile{
+			FileID:        file.FileID,
+			FileName:      file.FileName,
+			FileSize:      file.FileSize,
+			PlanID:        file.UploadedWithPackage,
+			Access:        file.Access,
+			ReadOnlyUntil: file.ReadOnlyUntil,
+			Outcome:       s.downgrade.access(),
+			Keepable:      file.Access != models.FileAccessArchived && file.FileSize <= target.MaxFileSize,
+		})
+	}
+	return preview, nil
+}
+
+// KeepFiles moves read only or locked files of a lost plan into the pool of the user's current plan,
+// they have to fit its file size limit and the room left in its quota; the rest can be deleted or are archived
+func (s *fileService) KeepFiles(userID int, fileIDs []int) (*models.UserStorage, error) {
+	state, err := s.accessState(userID)
+	if err != nil {
+		return nil, err
+	}
+	plan := state.plan
+
+	var total int64
+	seen := make(map[int]bool, len(fileIDs))
+	for _, fileID := range fileIDs {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+		file, err := s.fileRepo.GetFileMetadata(fileID, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: file %d not found", ErrFileNotAffected, fileID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file metadata: %w", err)
+		}
+		if _, err := s.fileAccess(state, file); err != nil {
+			return nil, err
+		}
+		if file.Access != models.FileAccessReadOnly && file.Access != models.FileAccessLocked {
+			return nil, fmt.Errorf("%w: file %d is %s", ErrFileNotAffected, fileID, file.Access)
+		}
+		if file.FileSize > plan.MaxFileSize {
+			return nil, fmt.Errorf("%w: file %d is larger than the %d bytes the %s plan allows", ErrFileTooLarge, fileID, plan.MaxFileSize, plan.Name)
+		}
+		total += file.FileSize
+	}
+
+	used, limit := int64(0), plan.StorageQuota
+	if pool := state.storage.Pool(plan.PlanID); pool != nil {
+		used, limit = pool.StorageUsed, pool.StorageLimit
+	}
+	if used+total > limit {
+		return nil, fmt.Errorf("%w. Available: %d bytes, Files to keep: %d bytes", ErrStorageLimitExceeded, limit-used, total)
+	}
+
+	if err := s.fileRepo.MoveFilesToPool(userID, fileIDs, plan.PlanID); err != nil {
+		return nil, errors.New("failed to keep files")
+	}
+	logger.Log.Info().
+		Int("userID", userID).
+		Ints("fileIDs", fileIDs).
+		Str("planID", plan.PlanID).
+		Msg("Downgraded files kept")
+	return s.fileRepo.GetUserStorage(userID)
+}
+
+// MarkDowngradedPools stamps the pools of plans users lost since the last run, the read only period counts from the stamp;
+// returns the newly stamped pools that hold files, with what happens to them, for the downgrade notices
+func (s *fileService) MarkDowngradedPools(now time.Time) ([]*models.DowngradedPool, error) {
+	stamped, err := s.fileRepo.MarkDowngradedPools(now)
+	if err != nil {
+		return nil, err
+	}
+	var pools []*models.DowngradedPool
+	for _, pool := range stamped {
+		files, err := s.fileRepo.GetFilesMetadataByUser(pool.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file metadata: %w", err)
+		}
+		for _, file := range files {
+			if file.UploadedWithPackage == pool.PlanID {
+				pool.Files = append(pool.Files, file.FileName)
+			}
+		}
+		if len(pool.Files) == 0 {
+			continue
+		}
+		pool.ReadOnlyUntil = pool.DowngradedAt.Add(s.downgrade.ReadOnlyPeriod)
+		pool.Outcome = s.downgrade.access()
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// ArchiveDowngradedFiles moves the files whose read only period is over under the user's .archive/ prefix when the policy
+// is archive; called by the scheduler after MarkDowngradedPools, returns how many files were archived
+func (s *fileService) ArchiveDowngradedFiles(ctx context.Context, now time.Time) (int, error) {
+	if s.downgrade.AfterReadOnly != models.DowngradeArchive {
+		return 0, nil
+	}
+
+	files, err := s.fileRepo.ListFilesToArchive(now.Add(-s.downgrade.ReadOnlyPeriod), downgradeArchiveBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	archived := 0
+	var lastError error
+	for _, file := range files {
+		moved, err := s.archiveFile(ctx, file)
+		if err != nil {
+			logger.LogError(err, "Failed to archive file", map[string]interface{}{"layer": "service", "operation": "ArchiveDowngradedFiles", "fileID": file.FileID})
+			lastError = err
+			continue
+		}
+		if moved {
+			archived++
+		}
+	}
+
+	// Return error only if nothing was archived
+	if archived == 0 && lastError != nil {
+		return 0, lastError
+	}
+	return archived, nil
+}
+
+// archiveFile copies the object to the archive prefix before pointing the row at it, a file deleted or kept
+// in between leaves only the copy behind and that is removed again (moved is false then)
+func (s *fileService) archiveFile(ctx context.Context, file *models.File) (bool, error) {
+	archiveKey := fmt.Sprintf("%d/.archive/%d/%s", file.UserID, file.FileID, file.FileName)
+	_, err := s.minioClient.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucketName, Object: archiveKey},
+		minio.CopySrcOptions{Bucket: s.bucketName, Object: file.S3ObjectKey})
+	if err != nil {
+		return false, fmt.Errorf("failed to copy object in minio: %w", err)
+	}
+
+	moved, err := s.fileRepo.ArchiveFile(file.FileID, archiveKey)
+	if err != nil || !moved {
+		_ = s.minioClient.RemoveObject(ctx, s.bucketName, archiveKey, minio.RemoveObjectOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to archive file metadata: %w", err)
+		}
+		return false, nil
+	}
+
+	if err := s.minioClient.RemoveObject(ctx, s.bucketName, file.S3ObjectKey, minio.RemoveObjectOptions{}); err != nil {
+		// the archived copy is in place, the original is only left over as an orphan for reconciliation to report
+		logger.LogError(err, "Failed to remove archived original", map[string]interface{}{"layer": "service", "operation": "archiveFile", "fileID": file.FileID})
+	}
+	return true, nil
+}
@@ -2,11 +2,15 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"os"
 	"service/internal/models"
 	"service/internal/repositories"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -19,16 +23,33 @@ type FileService interface {
 	DeleteFile(ctx context.Context, userID int, fileID int) error
 	GetUserStorageInfo(userID int) (*models.UserStorage, error)
 	ListUserFiles(userID int) ([]*models.File, error)
+	DeleteAllUserObjects(ctx context.Context, userID int) error
+	OpenObject(ctx context.Context, objectKey string) (*minio.Object, error)
+	StoreObject(ctx context.Context, objectKey string, reader io.Reader, contentType string) (int64, error)
+	RemoveObject(ctx context.Context, objectKey string) error
+	ReconcileUserStorage(ctx context.Context, userID int) (*models.StorageReconciliation, error)
+	PreviewDowngrade(userID int) (*models.DowngradePreview, error)
+	KeepFiles(userID int, fileIDs []int) (*models.UserStorage, error)
+	MarkDowngradedPools(now time.Time) ([]*models.DowngradedPool, error)
+	ArchiveDowngradedFiles(ctx context.Context, now time.Time) (int, error)
 }
 
+var (
+	ErrFileTooLarge         = errors.New("file is too large for your plan")
+	ErrStorageLimitExceeded = errors.New("storage limit exceeded")
+	ErrFileNotAccessible    = errors.New("file not accessible on your plan")
+)
+
 type fileService struct {
 	fileRepo    repositories.FileRepo
 	authRepo    repositories.AuthRepo
+	plans       PlanCatalog
+	downgrade   DowngradePolicy
 	minioClient *minio.Client
 	bucketName  string
 }
 
-func NewFileService(fileRepo repositories.FileRepo, authRepo repositories.AuthRepo) (FileService, error) {
+func NewFileService(fileRepo repositories.FileRepo, authRepo repositories.AuthRepo, plans PlanCatalog, downgrade DowngradePolicy) (FileService, error) {
 	endpoint := os.Getenv("MINIO_ENDPOINT")
 	accessKeyID := os.Getenv("MINIO_ACCESS_KEY_ID")
 	secretAccessKey := os.Getenv("MINIO_SECRET_ACCESS_KEY")
@@ -59,59 +80,126 @@ func NewFileService(fileRepo repositories.FileRepo, authRepo repositories.AuthRe
 	return &fileService{
 		fileRepo:    fileRepo,
 		authRepo:    authRepo,
+		plans:       plans,
+		downgrade:   downgrade,
 		minioClient: minioClient,
 		bucketName:  bucketName,
 	}, nil
 }
 
-// checkUserPackageValidity checks if user's premium package is still valid
-func (s *fileService) checkUserPackageValidity(userID int) (string, bool, error) {
+// fileAccessState is what deciding the access to a user's files needs, loaded once per request;
+// a plan that expired before the scheduler downgraded it counts as the default plan and isValid is false
+type fileAccessState struct {
+	plan    *models.Plan
+	isValid bool
+	expiry  *time.Time // the user's package expiry
+	storage *models.UserStorage
+	now     time.Time
+}
+
+func (s *fileService) accessState(userID int) (*fileAccessState, error) {
 	user, err := s.authRepo.GetUserByID(userID)
 	if err != nil {
-		return "", false, fmt.Errorf("failed to get user: %w", err)
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
+	state := &fileAccessState{isValid: true, expiry: user.PackageExpiry, now: time.Now()}
 
-	// If user has premium package, check expiry
-	if user.Package == "premium" {
-		if user.PackageExpiry != nil && time.Now().After(*user.PackageExpiry) {
-			// Package has expired, treat as free user
-			return "free", false, nil
+	if user.PackageExpiry != nil && state.now.After(*user.PackageExpiry) {
+		state.plan, err = s.plans.DefaultPlan()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get default plan: %w", err)
 		}
-		return "premium", true, nil
+		state.isValid = false
+	} else {
+		state.plan, err = s.plans.GetPlan(user.Package)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get plan %q: %w", user.Package, err)
+		}
+	}
+
+	state.storage, err = s.fileRepo.GetUserStorage(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user storage: %w", err)
+	}
+	return state, nil
+}
+
+// fileAccess sets the file's Access and ReadOnlyUntil: full on a plan that includes the plan it was uploaded on,
+// otherwise what the downgrade policy allows since the user lost that plan; returns the plan it was uploaded on
+func (s *fileService) fileAccess(state *fileAccessState, file *models.File) (*models.Plan, error) {
+	uploadedOn, err := s.plans.GetPlan(file.UploadedWithPackage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get plan %q: %w", file.UploadedWithPackage, err)
+	}
+	file.ReadOnlyUntil = nil
+	if state.plan.Includes(uploadedOn) {
+		file.Access = models.FileAccessFull
+		return uploadedOn, nil
+	}
+
+	// the scheduler stamps the pool shortly after the downgrade, until then it counts from the plan expiry or from now
+	downgradedAt := state.now
+	if pool := state.storage.Pool(file.UploadedWithPackage); pool != nil && pool.DowngradedAt != nil {
+		downgradedAt = *pool.DowngradedAt
+	} else if state.expiry != nil && state.expiry.Before(downgradedAt) {
+		downgradedAt = *state.expiry
+	}
+	readOnlyUntil := downgradedAt.Add(s.downgrade.ReadOnlyPeriod)
+	file.ReadOnlyUntil = &readOnlyUntil
+	if state.now.Before(readOnlyUntil) {
+		file.Access = models.FileAccessReadOnly
+	} else {
+		file.Access = s.downgrade.access()
 	}
+	return uploadedOn, nil
+}
 
-	return "free", true, nil
+// checkFileAccess refuses the file unless the user's access to it is one of allowed, verb says what was refused
+func (s *fileService) checkFileAccess(state *fileAccessState, file *models.File, verb string, allowed ...string) error {
+	uploadedOn, err := s.fileAccess(state, file)
+	if err != nil {
+		return err
+	}
+	for _, access := range allowed {
+		if file.Access == access {
+			return nil
+		}
+	}
+	switch {
+	case file.Access == models.FileAccessArchived:
+		return fmt.Errorf("%w: this file was uploaded with the %s plan and has been archived. Please upgrade to %s to %s it", ErrFileNotAccessible, uploadedOn.Name, uploadedOn.Name, verb)
+	case file.Access == models.FileAccessLocked:
+		return fmt.Errorf("%w: this file was uploaded with the %s plan and its read only period is over. Keep it within your plan's storage or upgrade to %s to %s it", ErrFileNotAccessible, uploadedOn.Name, uploadedOn.Name, verb)
+	case !state.isValid:
+		return fmt.Errorf("%w: this file was uploaded with the %s plan, but your plan has expired. Please upgrade to %s to %s it", ErrFileNotAccessible, uploadedOn.Name, uploadedOn.Name, verb)
+	}
+	return fmt.Errorf("%w: this file was uploaded with the %s plan. Please upgrade to %s to %s it", ErrFileNotAccessible, uploadedOn.Name, uploadedOn.Name, verb)
 }
 
 func (s *fileService) UploadFile(ctx context.Context, userID int, fileHeader *multipart.FileHeader, currentUserPackage string) (*models.File, error) {
-	// Check if user's package is still valid
-	actualPackage, isValid, err := s.checkUserPackageValidity(userID)
+	// Check if user's plan is still valid
+	state, err := s.accessState(userID)
 	if err != nil {
 		return nil, err
 	}
+	plan := state.plan
 
-	if !isValid {
-		return nil, fmt.Errorf("your premium package has expired. Please upgrade to continue uploading files")
+	if !state.isValid {
+		return nil, fmt.Errorf("your plan has expired. Please upgrade to continue uploading files")
 	}
 
-	// Check user storage limit based on actual package status
-	userStorage, err := s.fileRepo.GetUserStorage(userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user storage: %w", err)
+	if fileHeader.Size > plan.MaxFileSize {
+		return nil, fmt.Errorf("%w: the %s plan allows files up to %d bytes", ErrFileTooLarge, plan.Name, plan.MaxFileSize)
 	}
 
-	// Determine which storage to use and check limits
-	var currentStorageUsed, storageLimit int64
-	if actualPackage == "premium" {
-		currentStorageUsed = userStorage.PremiumStorageUsed
-		storageLimit = userStorage.PremiumStorageLimit
-	} else {
-		currentStorageUsed = userStorage.FreeStorageUsed
-		storageLimit = userStorage.FreeStorageLimit
+	// the file goes into the pool of the current plan, a user without a row yet gets the plan quota
+	currentStorageUsed, storageLimit := int64(0), plan.StorageQuota
+	if pool := state.storage.Pool(plan.PlanID); pool != nil {
+		currentStorageUsed, storageLimit = pool.StorageUsed, pool.StorageLimit
 	}
 
 	if currentStorageUsed+fileHeader.Size > storageLimit {
-		return nil, fmt.Errorf("storage limit exceeded. Available: %d bytes, File size: %d bytes", storageLimit-currentStorageUsed, fileHeader.Size)
+		return nil, fmt.Errorf("%w. Available: %d bytes, File size: %d bytes", ErrStorageLimitExceeded, storageLimit-currentStorageUsed, fileHeader.Size)
 	}
 
 	file, err := fileHeader.Open()
@@ -133,7 +221,7 @@ func (s *fileService) UploadFile(ctx context.Context, userID int, fileHeader *mu
 		FileSize:            fileHeader.Size,
 		S3ObjectKey:         s3ObjectKey,
 		ContentType:         fileHeader.Header.Get("Content-Type"),
-		UploadedWithPackage: actualPackage, // Use actual package status
+		UploadedWithPackage: plan.PlanID, // Use actual plan status
 	}
 
 	if err := s.fileRepo.CreateFileMetadata(fileMetadata); err != nil {
@@ -142,7 +230,7 @@ func (s *fileService) UploadFile(ctx context.Context, userID int, fileHeader *mu
 		return nil, fmt.Errorf("failed to create file metadata: %w", err)
 	}
 
-	if err := s.fileRepo.UpdateUserStorage(userID, fileHeader.Size, actualPackage); err != nil {
+	if err := s.fileRepo.UpdateUserStorage(userID, fileHeader.Size, plan.PlanID); err != nil {
 		// Attempt to delete the object from Minio and metadata if storage update fails
 		_ = s.minioClient.RemoveObject(ctx, s.bucketName, s3ObjectKey, minio.RemoveObjectOptions{})
 		_ = s.fileRepo.DeleteFileMetadata(fileMetadata.FileID, userID) // Assuming FileID is populated after CreateFileMetadata
@@ -153,8 +241,8 @@ func (s *fileService) UploadFile(ctx context.Context, userID int, fileHeader *mu
 }
 
 func (s *fileService) DownloadFile(ctx context.Context, userID int, fileID int, currentUserPackage string) (*minio.Object, *models.File, error) {
-	// Check if user's package is still valid
-	actualPackage, isValid, err := s.checkUserPackageValidity(userID)
+	// Check if user's plan is still valid
+	state, err := s.accessState(userID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -164,15 +252,10 @@ func (s *fileService) DownloadFile(ctx context.Context, userID int, fileID int,
 		return nil, nil, fmt.Errorf("failed to get file metadata: %w", err)
 	}
 
-	// Check access permissions based on file upload package and current package status
-	if fileMetadata.UploadedWithPackage == "premium" {
-		if actualPackage != "premium" {
-			if !isValid {
-				return nil, nil, fmt.Errorf("this file was uploaded with a premium package, but your premium subscription has expired. Please upgrade to premium to access it")
-			} else {
-				return nil, nil, fmt.Errorf("this file was uploaded with a premium package. Please upgrade to premium to access it")
-			}
-		}
+	// Check access permissions based on the plan the file was uploaded on and the current plan,
+	// files of a lost plan can still be downloaded while they are read only
+	if err := s.checkFileAccess(state, fileMetadata, "access", models.FileAccessFull, models.FileAccessReadOnly); err != nil {
+		return nil, fileMetadata, err
 	}
 
 	object, err := s.minioClient.GetObject(ctx, s.bucketName, fileMetadata.S3ObjectKey, minio.GetObjectOptions{})
@@ -183,8 +266,8 @@ func (s *fileService) DownloadFile(ctx context.Context, userID int, fileID int,
 }
 
 func (s *fileService) DeleteFile(ctx context.Context, userID int, fileID int) error {
-	// Check if user's package is still valid for modifications
-	actualPackage, isValid, err := s.checkUserPackageValidity(userID)
+	// Check if user's plan is still valid for modifications
+	state, err := s.accessState(userID)
 	if err != nil {
 		return err
 	}
@@ -194,15 +277,9 @@ func (s *fileService) DeleteFile(ctx context.Context, userID int, fileID int) er
 		return fmt.Errorf("failed to get file metadata: %w", err)
 	}
 
-	// Check if user can delete this file based on package status
-	if fileMetadata.UploadedWithPackage == "premium" {
-		if actualPackage != "premium" {
-			if !isValid {
-				return fmt.Errorf("this file was uploaded with a premium package, but your premium subscription has expired. Please upgrade to premium to manage it")
-			} else {
-				return fmt.Errorf("this file was uploaded with a premium package. Please upgrade to premium to manage it")
-			}
-		}
+	// Check if user can delete this file based on plan status, deleting frees space so only archived files are refused
+	if err := s.checkFileAccess(state, fileMetadata, "manage", models.FileAccessFull, models.FileAccessReadOnly, models.FileAccessLocked); err != nil {
+		return err
 	}
 
 	err = s.minioClient.RemoveObject(ctx, s.bucketName, fileMetadata.S3ObjectKey, minio.RemoveObjectOptions{})
@@ -215,7 +292,7 @@ func (s *fileService) DeleteFile(ctx context.Context, userID int, fileID int) er
 		return fmt.Errorf("failed to delete file metadata: %w", err)
 	}
 
-	// Update the appropriate storage based on the file's uploaded package
+	// Update the pool of the plan the file was uploaded on
 	if err := s.fileRepo.UpdateUserStorage(userID, -fileMetadata.FileSize, fileMetadata.UploadedWithPackage); err != nil {
 		// This is problematic, as the file is deleted but storage isn't updated.
 		// Log this error critically.
@@ -225,24 +302,123 @@ func (s *fileService) DeleteFile(ctx context.Context, userID int, fileID int) er
 	return nil
 }
 
-func (s *fileService) GetUserStorageInfo(userID int) (*models.UserStorage, error) {
-	// Check current package status
-	_, _, err := s.checkUserPackageValidity(userID)
+// OpenObject, StoreObject and RemoveObject give other services (data export) access to the bucket without their own minio client
+func (s *fileService) OpenObject(ctx context.Context, objectKey string) (*minio.Object, error) {
+	object, err := s.minioClient.GetObject(ctx, s.bucketName, objectKey, minio.GetObjectOptions{})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get object from minio: %w", err)
 	}
+	return object, nil
+}
 
-	userStorage, err := s.fileRepo.GetUserStorage(userID)
+// StoreObject uploads a stream of unknown length, returns the stored size
+func (s *fileService) StoreObject(ctx context.Context, objectKey string, reader io.Reader, contentType string) (int64, error) {
+	info, err := s.minioClient.PutObject(ctx, s.bucketName, objectKey, reader, -1, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload object to minio: %w", err)
+	}
+	return info.Size, nil
+}
+
+func (s *fileService) RemoveObject(ctx context.Context, objectKey string) error {
+	if err := s.minioClient.RemoveObject(ctx, s.bucketName, objectKey, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to remove object from minio: %w", err)
+	}
+	return nil
+}
+
+// DeleteAllUserObjects removes every object under the user's prefix, objects already gone are simply not listed
+func (s *fileService) DeleteAllUserObjects(ctx context.Context, userID int) error {
+	objects := s.minioClient.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{Prefix: fmt.Sprintf("%d/", userID), Recursive: true})
+	toRemove := make(chan minio.ObjectInfo)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(toRemove)
+		for object := range objects {
+			if object.Err != nil {
+				listErr <- object.Err
+				return
+			}
+			toRemove <- object
+		}
+	}()
+
+	// drain every result so neither minio's goroutine nor the lister is left blocked
+	var firstErr error
+	for removeErr := range s.minioClient.RemoveObjects(ctx, s.bucketName, toRemove, minio.RemoveObjectsOptions{}) {
+		if removeErr.Err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove object %s from minio: %w", removeErr.ObjectName, removeErr.Err)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	select {
+	case err := <-listErr:
+		return fmt.Errorf("failed to list objects in minio: %w", err)
+	default:
+		return nil
+	}
+}
+
+// ReconcileUserStorage compares the user's file rows with the objects under their prefix and recalculates the usage counters from the rows,
+// mismatched objects are only reported, deciding what to do with them is left to whoever asked
+func (s *fileService) ReconcileUserStorage(ctx context.Context, userID int) (*models.StorageReconciliation, error) {
+	before, err := s.fileRepo.GetUserStorage(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user storage: %w", err)
+	}
+	files, err := s.fileRepo.GetFilesMetadataByUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file metadata: %w", err)
+	}
+
+	stored := make(map[string]bool)
+	for object := range s.minioClient.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{Prefix: fmt.Sprintf("%d/", userID), Recursive: true}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list objects in minio: %w", object.Err)
+		}
+		// data export archives live under the prefix too but aren't files
+		if strings.Contains(object.Key, "/.exports/") {
+			continue
+		}
+		stored[object.Key] = true
+	}
+
+	report := &models.StorageReconciliation{UserID: userID, MissingObjects: []string{}, OrphanedObjects: []string{}}
+	for _, file := range files {
+		if !stored[file.S3ObjectKey] {
+			report.MissingObjects = append(report.MissingObjects, file.S3ObjectKey)
+		}
+		delete(stored, file.S3ObjectKey)
+	}
+	for key := range stored {
+		report.OrphanedObjects = append(report.OrphanedObjects, key)
+	}
+	sort.Strings(report.OrphanedObjects)
+
+	after, err := s.fileRepo.RecalculateUserStorage(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recalculate user storage: %w", err)
+	}
+	report.StorageUsedBefore = before.UsedByPlan()
+	report.StorageUsedAfter = after.UsedByPlan()
+	return report, nil
+}
+
+func (s *fileService) GetUserStorageInfo(userID int) (*models.UserStorage, error) {
+	// Check current plan status
+	state, err := s.accessState(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	return userStorage, nil
+	return state.storage, nil
 }
 
 func (s *fileService) ListUserFiles(userID int) ([]*models.File, error) {
-	// Check if user's package is still valid
-	actualPackage, _, err := s.checkUserPackageValidity(userID)
+	// Check if user's plan is still valid
+	state, err := s.accessState(userID)
 	if err != nil {
 		return nil, err
 	}
@@ -252,12 +428,11 @@ func (s *fileService) ListUserFiles(userID int) ([]*models.File, error) {
 		return nil, err
 	}
 
-	// Filter files based on current package status
+	// Filter files based on current plan status
 	var accessibleFiles []*models.File
 	for _, file := range files {
-		// If file was uploaded with premium but user no longer has valid premium
-		if file.UploadedWithPackage == "premium" && actualPackage != "premium" {
-			// Skip premium files if user doesn't have valid premium access
+		// Skip archived files of a plan the user lost, read only and locked ones stay listed so they can be kept or deleted
+		if s.checkFileAccess(state, file, "access", models.FileAccessFull, models.FileAccessReadOnly, models.FileAccessLocked) != nil {
 			continue
 		}
 		accessibleFiles = append(accessibleFiles, file)
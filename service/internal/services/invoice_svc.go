@@ -0,0 +1,176 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"strconv"
+)
+
+var ErrInvoiceNotFound = errors.New("invoice not found")
+
+// InvoiceService issues an invoice for every successful charge and serves the billing history to users and finance
+type InvoiceService interface {
+	IssueInvoice(checkout *models.Checkout, subscription *models.Subscription) error
+	MarkRefunded(checkoutID string) error
+	ListInvoices(userID, limit, offset int) ([]*models.Invoice, error)
+	GetInvoice(userID, invoiceID int) (*models.Invoice, error)
+	SearchInvoices(filter models.InvoiceFilter, limit, offset int) ([]*models.Invoice, []*models.InvoiceTotals, error)
+	GetAnyInvoice(invoiceID int) (*models.Invoice, error)
+}
+
+type invoiceService struct {
+	invoiceRepo repositories.InvoiceRepo
+	authRepo    repositories.AuthRepo
+	plans       PlanCatalog
+	taxRateBps  int
+}
+
+func NewInvoiceService(invoiceRepo repositories.InvoiceRepo, authRepo repositories.AuthRepo, plans PlanCatalog) (InvoiceService, error) {
+	taxRateBps, err := taxRateFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &invoiceService{invoiceRepo: invoiceRepo, authRepo: authRepo, plans: plans, taxRateBps: taxRateBps}, nil
+}
+
+// taxRateFromEnv reads INVOICE_TAX_RATE as a percentage (e.g. 11 or 7.5) into basis points, unset means no tax
+func taxRateFromEnv() (int, error) {
+	value := os.Getenv("INVOICE_TAX_RATE")
+	if value == "" {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid INVOICE_TAX_RATE %q, use a percentage between 0 and 100", value)
+	}
+	return int(percent*100 + 0.5), nil
+}
+
+// IssueInvoice writes the invoice for a paid checkout, calling it again for the same checkout does nothing;
+// plan prices include the tax, so the tax is taken out of the amount charged rather than added on top
+func (s *invoiceService) IssueInvoice(checkout *models.Checkout, subscription *models.Subscription) error {
+	user, err := s.authRepo.GetUserByID(checkout.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	description := checkout.PlanID + " plan"
+	if plan, err := s.plans.GetPlan(checkout.PlanID); err == nil {
+		description = plan.Name + " plan"
+	}
+
+	taxAmount := s.includedTax(checkout.Amount)
+	subtotal := checkout.Amount - taxAmount
+	// a discount gets its own line, the plan line is the net price before it so the lines add up to the subtotal
+	discount := checkout.DiscountAmount - s.includedTax(checkout.DiscountAmount)
+	line := &models.InvoiceLine{
+		Description: description,
+		PlanID:      &checkout.PlanID,
+		Quantity:    1,
+		UnitAmount:  subtotal + discount,
+		Amount:      subtotal + discount,
+	}
+	if subscription != nil && subscription.PlanID == checkout.PlanID {
+		line.PeriodStart = &subscription.CurrentPeriodStart
+		line.PeriodEnd = subscription.CurrentPeriodEnd
+	}
+	lines := []*models.InvoiceLine{line}
+	if checkout.PromoCode != nil {
+		lines = append(lines, &models.InvoiceLine{
+			Description: "Promo code " + *checkout.PromoCode,
+			Quantity:    1,
+			UnitAmount:  -discount,
+			Amount:      -discount,
+		})
+	}
+	invoice := &models.Invoice{
+		UserID:       checkout.UserID,
+		CheckoutID:   checkout.CheckoutID,
+		Status:       models.InvoicePaid,
+		BillingEmail: user.Email,
+		Currency:     checkout.Currency,
+		Subtotal:     subtotal,
+		TaxRateBps:   s.taxRateBps,
+		TaxAmount:    taxAmount,
+		Total:        checkout.Amount,
+		Provider:     checkout.Provider,
+		Lines:        lines,
+	}
+
+	created, err := s.invoiceRepo.CreateInvoice(invoice)
+	if err != nil {
+		return errors.New("failed to issue invoice")
+	}
+	if created {
+		logger.Log.Info().
+			Int("userID", invoice.UserID).
+			Str("invoiceNumber", invoice.InvoiceNumber).
+			Str("checkoutID", invoice.CheckoutID).
+			Msg("Invoice issued")
+	}
+	return nil
+}
+
+// includedTax is the tax contained in a tax inclusive amount, rounded half up
+func (s *invoiceService) includedTax(amount int64) int64 {
+	rate := int64(s.taxRateBps)
+	return (amount*rate + (10000+rate)/2) / (10000 + rate)
+}
+
+func (s *invoiceService) MarkRefunded(checkoutID string) error {
+	if err := s.invoiceRepo.MarkInvoiceRefunded(checkoutID); err != nil {
+		return errors.New("failed to mark invoice refunded")
+	}
+	return nil
+}
+
+func (s *invoiceService) ListInvoices(userID, limit, offset int) ([]*models.Invoice, error) {
+	limit, offset = clampPage(limit, offset)
+	invoices, err := s.invoiceRepo.ListInvoicesByUser(userID, limit, offset)
+	if err != nil {
+		return nil, errors.New("failed to list invoices")
+	}
+	return invoices, nil
+}
+
+// GetInvoice only returns the user's own invoices, someone else's look like they don't exist
+func (s *invoiceService) GetInvoice(userID, invoiceID int) (*models.Invoice, error) {
+	invoice, err := s.GetAnyInvoice(invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.UserID != userID {
+		return nil, ErrInvoiceNotFound
+	}
+	return invoice, nil
+}
+
+// SearchInvoices lists one page of the matching invoices for finance, the totals cover all of them
+func (s *invoiceService) SearchInvoices(filter models.InvoiceFilter, limit, offset int) ([]*models.Invoice, []*models.InvoiceTotals, error) {
+	limit, offset = clampPage(limit, offset)
+	invoices, err := s.invoiceRepo.ListInvoices(filter, limit, offset)
+	if err != nil {
+		return nil, nil, errors.New("failed to list invoices")
+	}
+	totals, err := s.invoiceRepo.SummarizeInvoices(filter)
+	if err != nil {
+		return nil, nil, errors.New("failed to summarize invoices")
+	}
+	return invoices, totals, nil
+}
+
+func (s *invoiceService) GetAnyInvoice(invoiceID int) (*models.Invoice, error) {
+	invoice, err := s.invoiceRepo.GetInvoice(invoiceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvoiceNotFound
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to get invoice", map[string]interface{}{"layer": "service", "operation": "GetAnyInvoice", "invoiceID": invoiceID})
+		return nil, errors.New("failed to get invoice")
+	}
+	return invoice, nil
+}
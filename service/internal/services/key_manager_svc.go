@@ -0,0 +1,240 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"sync"
+	"time"
+)
+
+const (
+	// how often every instance reloads keys from the database and checks whether rotation is due
+	keyReloadInterval = 1 * time.Minute
+	// minimum gap between reloads triggered by an unknown kid, so junk tokens can't hammer the database
+	keyMissReloadInterval = 10 * time.Second
+	// how long verifiers may cache the JWKS
+	JWKSCacheMaxAge = 5 * time.Minute
+	// a new key is in every instance's JWKS and out of every verifier's cache before it signs
+	keyPublishLead = keyReloadInterval + JWKSCacheMaxAge
+	// kept on top of the access token lifetime before a rotated key stops verifying, covers instances that sign
+	// with it until their next reload and clock skew
+	keyVerificationMargin = 45 * time.Minute
+)
+
+type KeyManagerService interface {
+	utils.KeyProvider
+	Start(ctx context.Context) error
+	RotateKeys(force bool) error
+	JWKS() []utils.JWK
+}
+
+type keyManagerService struct {
+	signingKeyRepo    repositories.SigningKeyRepo
+	keyEncryptionKey  []byte
+	algorithm         string
+	rotationInterval  time.Duration
+	verificationGrace time.Duration
+
+	mu         sync.RWMutex
+	currentKID string
+	// creation time of the newest key, published or signing, rotation is due once it is older than the interval
+	latestCreatedAt time.Time
+	keys            map[string]*utils.SigningKey
+	lastReload      time.Time
+}
+
+func NewKeyManagerService(signingKeyRepo repositories.SigningKeyRepo, accessTokenTTL time.Duration) (KeyManagerService, error) {
+	algorithm := os.Getenv("JWT_SIGNING_ALG")
+	if algorithm == "" {
+		algorithm = utils.SigningAlgEdDSA
+	}
+	if algorithm != utils.SigningAlgEdDSA && algorithm != utils.SigningAlgRS256 {
+		return nil, fmt.Errorf("unsupported JWT_SIGNING_ALG %q, use %s or %s", algorithm, utils.SigningAlgEdDSA, utils.SigningAlgRS256)
+	}
+
+	rotationInterval := 30 * 24 * time.Hour
+	if value := os.Getenv("JWT_KEY_ROTATION_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_KEY_ROTATION_INTERVAL: %w", err)
+		}
+		rotationInterval = parsed
+	}
+
+	// private keys are only ever written to the database encrypted with this key
+	keyEncryptionKey, err := utils.LoadKeyEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyManagerService{
+		signingKeyRepo:   signingKeyRepo,
+		keyEncryptionKey: keyEncryptionKey,
+		algorithm:        algorithm,
+		rotationInterval: rotationInterval,
+		// a rotated key must outlive every access token it signed, plus time for other instances to reload
+		verificationGrace: accessTokenTTL + keyVerificationMargin,
+		keys:              map[string]*utils.SigningKey{},
+	}, nil
+}
+
+// Start loads the keys, creates the first one on an empty database and keeps reloading/rotating in the background until ctx is done
+func (s *keyManagerService) Start(ctx context.Context) error {
+	if err := s.RotateKeys(false); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(keyReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.RotateKeys(false); err != nil {
+					logger.LogError(err, "Failed to rotate or reload signing keys", map[string]interface{}{"layer": "service", "operation": "KeyManagerService.Start"})
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// RotateKeys creates a new signing key when the current one is older than the rotation interval (or always when force is set), then reloads
+func (s *keyManagerService) RotateKeys(force bool) error {
+	// skip generating a key pair (slow for rsa) while the loaded key is still fresh, the repo re-checks under a lock anyway
+	s.mu.RLock()
+	fresh := s.currentKID != "" && time.Since(s.latestCreatedAt) < s.rotationInterval
+	s.mu.RUnlock()
+	if fresh && !force {
+		return s.reload()
+	}
+
+	newKey, err := utils.GenerateSigningKey(s.algorithm)
+	if err != nil {
+		logger.LogError(err, "Failed to generate signing key", map[string]interface{}{"layer": "service", "operation": "RotateKeys"})
+		return err
+	}
+	privateKeyPEM, err := utils.MarshalPrivateKeyPEM(newKey)
+	if err != nil {
+		logger.LogError(err, "Failed to encode signing key", map[string]interface{}{"layer": "service", "operation": "RotateKeys"})
+		return err
+	}
+	encryptedPrivateKey, err := utils.EncryptPrivateKey(s.keyEncryptionKey, newKey.KeyID, privateKeyPEM)
+	if err != nil {
+		logger.LogError(err, "Failed to encrypt signing key", map[string]interface{}{"layer": "service", "operation": "RotateKeys"})
+		return err
+	}
+
+	stored := &models.SigningKey{
+		KeyID:               newKey.KeyID,
+		Algorithm:           newKey.Algorithm,
+		EncryptedPrivateKey: encryptedPrivateKey,
+	}
+	rotated, err := s.signingKeyRepo.RotateSigningKey(stored, s.rotationInterval, s.verificationGrace, keyPublishLead, force)
+	if err != nil {
+		logger.LogError(err, "Failed to rotate signing key", map[string]interface{}{"layer": "service", "operation": "RotateKeys"})
+		return err
+	}
+	if rotated {
+		logger.Log.Info().Str("kid", newKey.KeyID).Str("algorithm", newKey.Algorithm).Time("active_from", stored.ActiveFrom).Msg("JWT signing key rotated")
+	}
+
+	return s.reload()
+}
+
+// reload replaces the in-memory key set with what is in the database
+func (s *keyManagerService) reload() error {
+	storedKeys, err := s.signingKeyRepo.GetVerificationKeys(s.verificationGrace)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*utils.SigningKey, len(storedKeys))
+	currentKID := ""
+	var latestCreatedAt time.Time
+	now := time.Now()
+	for _, stored := range storedKeys {
+		privateKeyPEM, err := utils.DecryptPrivateKey(s.keyEncryptionKey, stored.KeyID, stored.EncryptedPrivateKey)
+		if err != nil {
+			logger.LogError(err, "Failed to decrypt stored signing key", map[string]interface{}{"layer": "service", "operation": "reload", "kid": stored.KeyID})
+			continue
+		}
+		key, err := utils.ParsePrivateKeyPEM(stored.KeyID, stored.Algorithm, privateKeyPEM)
+		if err != nil {
+			logger.LogError(err, "Failed to parse stored signing key", map[string]interface{}{"layer": "service", "operation": "reload", "kid": stored.KeyID})
+			continue
+		}
+		keys[key.KeyID] = key
+		if stored.CreatedAt.After(latestCreatedAt) {
+			latestCreatedAt = stored.CreatedAt
+		}
+		// rows come newest first, the first one already active is the signing key and a newer one is only published
+		if currentKID == "" && !stored.ActiveFrom.After(now) {
+			currentKID = key.KeyID
+		}
+	}
+	if currentKID == "" {
+		return errors.New("no usable signing key found")
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.currentKID = currentKID
+	s.latestCreatedAt = latestCreatedAt
+	s.lastReload = now
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *keyManagerService) CurrentSigningKey() (*utils.SigningKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[s.currentKID]
+	if !ok {
+		return nil, errors.New("no signing key loaded")
+	}
+	return key, nil
+}
+
+// VerificationKey looks up a key by kid, an unknown kid may have just been rotated in by another instance so it triggers a reload
+func (s *keyManagerService) VerificationKey(kid string) (*utils.SigningKey, error) {
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	canReload := time.Since(s.lastReload) > keyMissReloadInterval
+	s.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if canReload {
+		if err := s.reload(); err != nil {
+			logger.LogError(err, "Failed to reload signing keys", map[string]interface{}{"layer": "service", "operation": "VerificationKey"})
+		}
+		s.mu.RLock()
+		key, ok = s.keys[kid]
+		s.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// JWKS returns the public keys of every key that can still verify tokens
+func (s *keyManagerService) JWKS() []utils.JWK {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jwks := make([]utils.JWK, 0, len(s.keys))
+	for _, key := range s.keys {
+		jwks = append(jwks, key.PublicJWK())
+	}
+	return jwks
+}
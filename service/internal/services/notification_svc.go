@@ -0,0 +1,224 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"time"
+)
+
+const (
+	// notifications sent per scheduler run, each send can take up to the smtp timeout
+	notificationSendBatchSize = 20
+	// a failed send is retried this many times, waiting notificationRetryDelay times the attempts in between
+	notificationMaxAttempts = 5
+	notificationRetryDelay  = 15 * time.Minute
+	// a send still unfinished after this long was interrupted (the process died), it is failed rather than risk a second email
+	notificationSendTimeout = 10 * time.Minute
+)
+
+// NotificationService queues the plan lifecycle emails and delivers them from the scheduler, every notification has a dedupe key
+// naming its event and is claimed before it is sent, so neither a repeated event nor overlapping runs send it twice
+type NotificationService interface {
+	NotifyWelcome(subscription *models.Subscription)
+	NotifyPlanExpired(subscription *models.Subscription)
+	NotifyPaymentFailed(checkout *models.Checkout, reason string)
+	NotifyDowngrade(pool *models.DowngradedPool)
+	QueueExpiryReminders(now time.Time) (int, error)
+	SendDueNotifications(now time.Time) (int, error)
+	ListNotifications(userID, limit, offset int) ([]*models.Notification, error)
+}
+
+type notificationService struct {
+	notificationRepo repositories.NotificationRepo
+	authRepo         repositories.AuthRepo
+	plans            PlanCatalog
+}
+
+func NewNotificationService(notificationRepo repositories.NotificationRepo, authRepo repositories.AuthRepo, plans PlanCatalog) NotificationService {
+	return &notificationService{notificationRepo: notificationRepo, authRepo: authRepo, plans: plans}
+}
+
+// expiryReminders are sent this long before the plan ends, the first window is from lead down to the next one's lead
+var expiryReminders = []struct {
+	kind string
+	lead time.Duration
+}{
+	{models.NotificationExpiry7Days, 7 * 24 * time.Hour},
+	{models.NotificationExpiry1Day, 24 * time.Hour},
+}
+
+// NotifyWelcome greets a user on a new subscription to a plan above the default one
+func (s *notificationService) NotifyWelcome(subscription *models.Subscription) {
+	if plan, err := s.plans.GetPlan(subscription.PlanID); err != nil || plan.IsDefault {
+		return
+	}
+	s.queue(subscription.UserID, models.NotificationWelcome, fmt.Sprintf("welcome:%d", subscription.SubscriptionID), models.NotificationData{
+		PlanID:    subscription.PlanID,
+		ExpiresAt: subscription.CurrentPeriodEnd,
+	})
+}
+
+// NotifyPlanExpired tells the user the subscription ended on its own and they are back on the default plan
+func (s *notificationService) NotifyPlanExpired(subscription *models.Subscription) {
+	s.queue(subscription.UserID, models.NotificationPlanExpired, fmt.Sprintf("expired:%d", subscription.SubscriptionID), models.NotificationData{
+		PlanID: subscription.PlanID,
+	})
+}
+
+func (s *notificationService) NotifyPaymentFailed(checkout *models.Checkout, reason string) {
+	s.queue(checkout.UserID, models.NotificationPaymentFailed, "payment_failed:"+checkout.CheckoutID, models.NotificationData{
+		PlanID:     checkout.PlanID,
+		CheckoutID: checkout.CheckoutID,
+		Reason:     reason,
+	})
+}
+
+// NotifyDowngrade lists the files of the pool the user lost the plan of, once per downgrade
+func (s *notificationService) NotifyDowngrade(pool *models.DowngradedPool) {
+	readOnlyUntil := pool.ReadOnlyUntil
+	s.queue(pool.UserID, models.NotificationDowngrade, fmt.Sprintf("downgrade:%d:%s:%d", pool.UserID, pool.PlanID, pool.DowngradedAt.Unix()), models.NotificationData{
+		PlanID:        pool.PlanID,
+		Files:         pool.Files,
+		ReadOnlyUntil: &readOnlyUntil,
+		Outcome:       pool.Outcome,
+	})
+}
+
+// queue stores the notification for the scheduler to send, failing to queue one is logged and never fails what triggered it
+func (s *notificationService) queue(userID int, kind, dedupeKey string, data models.NotificationData) {
+	notification := &models.Notification{UserID: userID, Kind: kind, DedupeKey: dedupeKey, Data: data, NextAttemptAt: time.Now()}
+	if _, err := s.notificationRepo.CreateNotification(notification); err != nil {
+		logger.LogError(err, "Failed to queue notification", map[string]interface{}{"layer": "service", "operation": "queueNotification", "userID": userID, "kind": kind})
+	}
+}
+
+// QueueExpiryReminders queues the reminders of every subscription that ends within a reminder's lead, the plan expiry is part of
+// the dedupe key so a renewed subscription is reminded again before its new end; returns how many were queued
+func (s *notificationService) QueueExpiryReminders(now time.Time) (int, error) {
+	queued := 0
+	for i, reminder := range expiryReminders {
+		// a subscription inside the next reminder's window only gets that one
+		var minLead time.Duration
+		if i+1 < len(expiryReminders) {
+			minLead = expiryReminders[i+1].lead
+		}
+		expiring, err := s.notificationRepo.ListExpiringSubscriptions(now, reminder.lead, minLead)
+		if err != nil {
+			return queued, err
+		}
+		for _, subscription := range expiring {
+			expiresAt := subscription.ExpiresAt
+			notification := &models.Notification{
+				UserID:        subscription.UserID,
+				Kind:          reminder.kind,
+				DedupeKey:     fmt.Sprintf("%s:%d:%d", reminder.kind, subscription.SubscriptionID, expiresAt.Unix()),
+				Data:          models.NotificationData{PlanID: subscription.PlanID, ExpiresAt: &expiresAt},
+				NextAttemptAt: now,
+			}
+			created, err := s.notificationRepo.CreateNotification(notification)
+			if err != nil {
+				return queued, err
+			}
+			if created {
+				queued++
+			}
+		}
+	}
+	return queued, nil
+}
+
+// SendDueNotifications sends a batch of the due notifications and records how each went, returns how many were sent
+func (s *notificationService) SendDueNotifications(now time.Time) (int, error) {
+	if interrupted, err := s.notificationRepo.FailInterruptedNotifications(now.Add(-notificationSendTimeout)); err != nil {
+		return 0, err
+	} else if interrupted > 0 {
+		logger.Log.Warn().Int64("count", interrupted).Msg("Interrupted notification sends failed")
+	}
+
+	notifications, err := s.notificationRepo.ClaimDueNotifications(now, notificationSendBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, notification := range notifications {
+		status, sendErr := s.deliver(notification, now)
+		var lastError *string
+		nextAttemptAt := notification.NextAttemptAt
+		if sendErr != nil {
+			message := sendErr.Error()
+			lastError = &message
+			status = models.NotificationFailed
+			if notification.Attempts < notificationMaxAttempts {
+				status = models.NotificationPending
+				nextAttemptAt = now.Add(time.Duration(notification.Attempts) * notificationRetryDelay)
+			}
+			logger.LogError(sendErr, "Failed to send notification", map[string]interface{}{"layer": "service", "operation": "SendDueNotifications", "notificationID": notification.NotificationID, "attempts": notification.Attempts})
+		}
+		if err := s.notificationRepo.FinishDelivery(notification.NotificationID, status, lastError, nextAttemptAt); err != nil {
+			continue
+		}
+		if status == models.NotificationSent {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// deliver sends the email of the notification, a notification the user can't use anymore is skipped instead
+func (s *notificationService) deliver(notification *models.Notification, now time.Time) (string, error) {
+	user, err := s.authRepo.GetUserByID(notification.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.NotificationSkipped, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.IsDisabled() {
+		return models.NotificationSkipped, nil
+	}
+	planName := notification.Data.PlanID
+	if plan, err := s.plans.GetPlan(notification.Data.PlanID); err == nil {
+		planName = plan.Name
+	}
+	data := notification.Data
+
+	switch notification.Kind {
+	case models.NotificationExpiry7Days, models.NotificationExpiry1Day:
+		// renewed, switched or already over since it was queued
+		if user.PackageExpiry == nil || data.ExpiresAt == nil || !user.PackageExpiry.Equal(*data.ExpiresAt) || !now.Before(*data.ExpiresAt) {
+			return models.NotificationSkipped, nil
+		}
+		err = utils.SendPlanExpiryReminderEmail(user.Email, planName, *data.ExpiresAt, utils.FrontendLink("/billing"))
+	case models.NotificationPlanExpired:
+		err = utils.SendPlanExpiredEmail(user.Email, planName, utils.FrontendLink("/billing"))
+	case models.NotificationPaymentFailed:
+		err = utils.SendPaymentFailedEmail(user.Email, planName, data.Reason, utils.FrontendLink("/billing"))
+	case models.NotificationDowngrade:
+		if data.ReadOnlyUntil == nil {
+			return models.NotificationSkipped, nil
+		}
+		err = utils.SendDowngradeNoticeEmail(user.Email, planName, data.Files, *data.ReadOnlyUntil, data.Outcome == models.FileAccessArchived, utils.FrontendLink("/files"))
+	case models.NotificationWelcome:
+		err = utils.SendPlanWelcomeEmail(user.Email, planName, data.ExpiresAt, utils.FrontendLink("/files"))
+	default:
+		return models.NotificationSkipped, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return models.NotificationSent, nil
+}
+
+func (s *notificationService) ListNotifications(userID, limit, offset int) ([]*models.Notification, error) {
+	limit, offset = clampPage(limit, offset)
+	notifications, err := s.notificationRepo.ListNotificationsByUser(userID, limit, offset)
+	if err != nil {
+		return nil, errors.New("failed to list notifications")
+	}
+	return notifications, nil
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"service/internal/logger"
+	"service/internal/utils"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt silently ignores everything after 72 bytes
+	maxPasswordBytes = 72
+	// zxcvbn score 3 is "safely unguessable" against an online attack and mostly against a slow offline one
+	minPasswordScore = 3
+)
+
+// password policy violation reasons, returned to the client so the ui can explain what to fix
+const (
+	PasswordTooShort        = "too_short"
+	PasswordTooLong         = "too_long"
+	PasswordTooWeak         = "too_weak"
+	PasswordBreached        = "breached"
+	PasswordSameAsCurrent   = "same_as_current"
+	PasswordContainsPersona = "contains_personal_info"
+)
+
+type PasswordViolation struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule the password broke, handlers send the list as "reasons"
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+type PasswordPolicyService interface {
+	Validate(password string, userInputs ...string) error
+}
+
+type passwordPolicyService struct {
+	breachedPasswords utils.BreachedPasswordChecker
+}
+
+// NewPasswordPolicyService takes a nil checker when no breached password corpus is configured
+func NewPasswordPolicyService(breachedPasswords utils.BreachedPasswordChecker) PasswordPolicyService {
+	return &passwordPolicyService{breachedPasswords: breachedPasswords}
+}
+
+// Validate returns a *PasswordPolicyError when the password is rejected, userInputs are the user's email and username
+func (s *passwordPolicyService) Validate(password string, userInputs ...string) error {
+	var violations []PasswordViolation
+
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		violations = append(violations, PasswordViolation{Reason: PasswordTooShort, Message: "password must be at least 8 characters"})
+	}
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, PasswordViolation{Reason: PasswordTooLong, Message: "password must be at most 72 bytes"})
+	}
+	if containsUserInput(password, userInputs) {
+		violations = append(violations, PasswordViolation{Reason: PasswordContainsPersona, Message: "password must not contain your email or username"})
+	}
+	if strength := utils.EstimatePasswordStrength(password, userInputs...); strength.Score < minPasswordScore {
+		violations = append(violations, PasswordViolation{Reason: PasswordTooWeak, Message: "password is too easy to guess, use a longer passphrase or mix unrelated words"})
+	}
+
+	if s.breachedPasswords != nil {
+		breached, err := s.breachedPasswords.IsBreached(password)
+		if err != nil {
+			// fail open, the other rules still apply
+			logger.LogError(err, "Failed to check breached password corpus", map[string]interface{}{"layer": "service", "operation": "PasswordPolicy.Validate"})
+		} else if breached {
+			violations = append(violations, PasswordViolation{Reason: PasswordBreached, Message: "password has appeared in a data breach, choose a different one"})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func containsUserInput(password string, userInputs []string) bool {
+	lowered := strings.ToLower(password)
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		local, _, _ := strings.Cut(input, "@")
+		if len(local) >= 4 && strings.Contains(lowered, local) {
+			return true
+		}
+	}
+	return false
+}
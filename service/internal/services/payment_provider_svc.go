@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"service/internal/models"
+)
+
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// the webhook secret earlier example configs shipped with, anyone could sign a fake payment with it
+const publicFakeWebhookSecret = "dev-payment-webhook-secret"
+
+// PaymentProvider is a hosted checkout page plus the signed webhooks telling us how the payment went
+type PaymentProvider interface {
+	Name() string
+	// CreateCheckout opens a payment page for the checkout, req.CheckoutID doubles as the provider's idempotency key
+	CreateCheckout(ctx context.Context, req models.CheckoutRequest) (*models.ProviderCheckout, error)
+	// ParseWebhook verifies the signature and maps the event onto ours, a nil event is one we don't act on
+	ParseWebhook(payload []byte, header http.Header) (*models.PaymentEvent, error)
+}
+
+// NewPaymentProviderFromEnv picks the provider from PAYMENT_PROVIDER, the fake provider is the default in development
+// and can't be used anywhere else since its webhooks grant plans without any money moving
+func NewPaymentProviderFromEnv() (PaymentProvider, error) {
+	provider := os.Getenv("PAYMENT_PROVIDER")
+	development := os.Getenv("ENVIRONMENT") == "development"
+	if provider == "" && development {
+		provider = "fake"
+	}
+
+	switch provider {
+	case "stripe":
+		secretKey, webhookSecret := os.Getenv("STRIPE_SECRET_KEY"), os.Getenv("STRIPE_WEBHOOK_SECRET")
+		if secretKey == "" || webhookSecret == "" {
+			return nil, errors.New("STRIPE_SECRET_KEY and STRIPE_WEBHOOK_SECRET are required for the stripe payment provider")
+		}
+		return NewStripeProvider(secretKey, webhookSecret), nil
+	case "fake":
+		if !development {
+			return nil, errors.New("the fake payment provider can only be used with ENVIRONMENT=development")
+		}
+		webhookSecret := os.Getenv("FAKE_PAYMENT_WEBHOOK_SECRET")
+		if webhookSecret == "" {
+			return nil, errors.New("FAKE_PAYMENT_WEBHOOK_SECRET is required for the fake payment provider")
+		}
+		if webhookSecret == publicFakeWebhookSecret {
+			return nil, errors.New("FAKE_PAYMENT_WEBHOOK_SECRET is the public example value, set a secret of your own")
+		}
+		return NewFakePaymentProvider(webhookSecret), nil
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is required outside development")
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", provider)
+	}
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"strings"
+	"time"
+)
+
+const (
+	// every personal access token starts with this, the auth middleware uses it to tell them apart from jwts
+	personalAccessTokenPrefix = "dkpat_"
+	maxPersonalAccessTokens   = 20
+)
+
+type PersonalAccessTokenService interface {
+	CreateToken(userID int, name string, scopes []string, expiresIn time.Duration) (string, *models.PersonalAccessToken, error)
+	ListTokens(userID int) ([]*models.PersonalAccessToken, error)
+	RevokeToken(userID, tokenID int) error
+	ValidatePersonalAccessToken(rawToken string) (*models.User, *models.PersonalAccessToken, error)
+}
+
+type personalAccessTokenService struct {
+	patRepo  repositories.PersonalAccessTokenRepo
+	authRepo repositories.AuthRepo
+}
+
+func NewPersonalAccessTokenService(patRepo repositories.PersonalAccessTokenRepo, authRepo repositories.AuthRepo) PersonalAccessTokenService {
+	return &personalAccessTokenService{patRepo: patRepo, authRepo: authRepo}
+}
+
+// CreateToken returns the raw secret once, only its hash is stored; expiresIn of zero means no expiry
+func (s *personalAccessTokenService) CreateToken(userID int, name string, scopes []string, expiresIn time.Duration) (string, *models.PersonalAccessToken, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !isKnownScope(scope) {
+			return "", nil, errors.New("unknown scope " + scope)
+		}
+	}
+
+	count, err := s.patRepo.CountActiveTokens(userID)
+	if err != nil {
+		logger.LogError(err, "Failed to count personal access tokens", map[string]interface{}{"layer": "service", "operation": "CreateToken", "userID": userID})
+		return "", nil, errors.New("failed to create token")
+	}
+	if count >= maxPersonalAccessTokens {
+		return "", nil, errors.New("too many active tokens, revoke one first")
+	}
+
+	secret, err := utils.CreateRefreshToken()
+	if err != nil {
+		logger.LogError(err, "Failed to generate personal access token", map[string]interface{}{"layer": "service", "operation": "CreateToken", "userID": userID})
+		return "", nil, errors.New("failed to create token")
+	}
+	rawToken := personalAccessTokenPrefix + secret
+
+	token := &models.PersonalAccessToken{
+		UserID:      userID,
+		Name:        name,
+		TokenPrefix: rawToken[:len(personalAccessTokenPrefix)+6],
+		TokenHash:   utils.HashToken(rawToken),
+		Scopes:      scopes,
+	}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := s.patRepo.CreateToken(token); err != nil {
+		logger.LogError(err, "Failed to store personal access token", map[string]interface{}{"layer": "service", "operation": "CreateToken", "userID": userID})
+		return "", nil, errors.New("failed to create token")
+	}
+	return rawToken, token, nil
+}
+
+func (s *personalAccessTokenService) ListTokens(userID int) ([]*models.PersonalAccessToken, error) {
+	tokens, err := s.patRepo.ListTokensByUser(userID)
+	if err != nil {
+		logger.LogError(err, "Failed to list personal access tokens", map[string]interface{}{"layer": "service", "operation": "ListTokens", "userID": userID})
+		return nil, errors.New("failed to list tokens")
+	}
+	return tokens, nil
+}
+
+func (s *personalAccessTokenService) RevokeToken(userID, tokenID int) error {
+	if err := s.patRepo.RevokeToken(userID, tokenID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("token not found")
+		}
+		logger.LogError(err, "Failed to revoke personal access token", map[string]interface{}{"layer": "service", "operation": "RevokeToken", "userID": userID})
+		return errors.New("failed to revoke token")
+	}
+	return nil
+}
+
+// ValidatePersonalAccessToken is called by the auth middleware for Bearer tokens carrying the personal access token prefix
+func (s *personalAccessTokenService) ValidatePersonalAccessToken(rawToken string) (*models.User, *models.PersonalAccessToken, error) {
+	if !strings.HasPrefix(rawToken, personalAccessTokenPrefix) {
+		return nil, nil, errors.New("not a personal access token")
+	}
+
+	token, err := s.patRepo.FindValidTokenByHash(utils.HashToken(rawToken))
+	if err != nil {
+		return nil, nil, errors.New("invalid or expired token")
+	}
+
+	// the user row gives the current package, unlike a jwt claim it can't be stale
+	user, err := s.authRepo.GetUserByID(token.UserID)
+	if err != nil || user.IsDisabled() {
+		return nil, nil, errors.New("invalid or expired token")
+	}
+
+	if err := s.patRepo.TouchLastUsed(token.TokenID); err != nil {
+		logger.LogError(err, "Failed to record personal access token use", map[string]interface{}{"layer": "service", "operation": "ValidatePersonalAccessToken"})
+	}
+	return user, token, nil
+}
+
+func isKnownScope(scope string) bool {
+	for _, known := range models.PersonalAccessTokenScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
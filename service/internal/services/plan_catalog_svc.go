@@ -0,0 +1,154 @@
+package services
+
+import (
+	"errors"
+	"regexp"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"strings"
+	"sync"
+	"time"
+)
+
+// plans change rarely, every instance reloads them at most this often (and right after saving one itself)
+const planReloadInterval = 1 * time.Minute
+
+var (
+	ErrUnknownPlan      = errors.New("unknown plan")
+	ErrPlanNotAvailable = errors.New("plan is not available")
+)
+
+var planIDPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+// PlanCatalog is the single source of plan names, quotas, limits, durations and prices
+type PlanCatalog interface {
+	ListPlans(purchasableOnly bool) ([]*models.Plan, error)
+	GetPlan(planID string) (*models.Plan, error)
+	DefaultPlan() (*models.Plan, error)
+	SavePlan(plan *models.Plan) error
+}
+
+type planCatalog struct {
+	planRepo repositories.PlanRepo
+
+	mu         sync.RWMutex
+	plans      []*models.Plan
+	lastReload time.Time
+}
+
+func NewPlanCatalog(planRepo repositories.PlanRepo) PlanCatalog {
+	return &planCatalog{planRepo: planRepo}
+}
+
+// load returns the cached plans, reloading them once they are older than planReloadInterval
+func (c *planCatalog) load() ([]*models.Plan, error) {
+	c.mu.RLock()
+	plans, fresh := c.plans, time.Since(c.lastReload) < planReloadInterval
+	c.mu.RUnlock()
+	if fresh {
+		return plans, nil
+	}
+	return c.reload()
+}
+
+func (c *planCatalog) reload() ([]*models.Plan, error) {
+	plans, err := c.planRepo.ListPlans()
+	if err != nil {
+		c.mu.RLock()
+		cached := c.plans
+		c.mu.RUnlock()
+		// keep serving the plans we already have rather than failing every upload while the database is unreachable
+		if cached != nil {
+			logger.LogError(err, "Failed to reload plans, using cached plans", map[string]interface{}{"layer": "service", "operation": "PlanCatalog.reload"})
+			return cached, nil
+		}
+		return nil, errors.New("failed to load plans")
+	}
+
+	c.mu.Lock()
+	c.plans = plans
+	c.lastReload = time.Now()
+	c.mu.Unlock()
+	return plans, nil
+}
+
+func (c *planCatalog) ListPlans(purchasableOnly bool) ([]*models.Plan, error) {
+	plans, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]*models.Plan, 0, len(plans))
+	for _, plan := range plans {
+		if purchasableOnly && !plan.Purchasable {
+			continue
+		}
+		listed = append(listed, plan)
+	}
+	return listed, nil
+}
+
+func (c *planCatalog) GetPlan(planID string) (*models.Plan, error) {
+	plans, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, plan := range plans {
+		if plan.PlanID == planID {
+			return plan, nil
+		}
+	}
+	return nil, ErrUnknownPlan
+}
+
+func (c *planCatalog) DefaultPlan() (*models.Plan, error) {
+	plans, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, plan := range plans {
+		if plan.IsDefault {
+			return plan, nil
+		}
+	}
+	return nil, errors.New("no default plan is configured")
+}
+
+// SavePlan creates or updates a plan, the default plan can't be unset directly, only replaced by another default
+func (c *planCatalog) SavePlan(plan *models.Plan) error {
+	if !planIDPattern.MatchString(plan.PlanID) {
+		return errors.New("plan id must be 2 to 32 lowercase letters, digits, dashes or underscores")
+	}
+	if strings.TrimSpace(plan.Name) == "" {
+		return errors.New("plan name is required")
+	}
+	if plan.StorageQuota < 0 || plan.MaxFileSize <= 0 || plan.PriceAmount < 0 {
+		return errors.New("storage quota and price can't be negative and the max file size must be positive")
+	}
+	if plan.DurationSeconds != nil && *plan.DurationSeconds <= 0 {
+		return errors.New("duration must be positive, omit it for a plan that doesn't expire")
+	}
+	if plan.IsDefault && plan.DurationSeconds != nil {
+		return errors.New("the default plan can't expire")
+	}
+	if plan.TrialSeconds != nil && (*plan.TrialSeconds <= 0 || plan.DurationSeconds == nil || plan.PriceAmount == 0) {
+		return errors.New("a trial must be positive and only paid plans that expire can have one")
+	}
+	if len(plan.Currency) != 3 {
+		return errors.New("currency must be a 3 letter ISO 4217 code")
+	}
+	plan.Currency = strings.ToUpper(plan.Currency)
+	if plan.Features == nil {
+		plan.Features = []string{}
+	}
+
+	if existing, err := c.GetPlan(plan.PlanID); err == nil && existing.IsDefault && !plan.IsDefault {
+		return errors.New("make another plan the default instead of unsetting it")
+	}
+
+	if err := c.planRepo.SavePlan(plan); err != nil {
+		return errors.New("failed to save plan")
+	}
+	_, err := c.reload()
+	return err
+}
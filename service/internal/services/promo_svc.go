@@ -0,0 +1,313 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"strings"
+	"time"
+)
+
+// the longest free time a single code can give
+const maxPromoFreeDays = 366
+
+var (
+	ErrPromoCodeNotFound      = errors.New("promo code not found")
+	ErrPromoCodeInvalid       = errors.New("this code is not valid")
+	ErrPromoCodeUsedUp        = errors.New("this code has been used up")
+	ErrPromoCodeAlreadyUsed   = errors.New("you already used this code")
+	ErrPromoCodeNotApplicable = errors.New("this code can't be used for this plan")
+	ErrPromoCodeForCheckout   = errors.New("this code gives a discount, enter it at checkout")
+	ErrPromoCodeForRedeem     = errors.New("this code gives free days, redeem it instead")
+	ErrPromoCodeInUse         = errors.New("promo code was already used, deactivate it instead")
+)
+
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// PromoService owns the promo codes: discounts are reserved when a checkout starts and count once it is paid,
+// free days codes are redeemed directly onto the user's subscription
+type PromoService interface {
+	ReserveDiscount(userID int, plan *models.Plan, code, checkoutID string) (*models.PromoRedemption, error)
+	ConfirmDiscount(checkoutID string) error
+	ReleaseDiscount(checkoutID string) error
+	Redeem(userID int, code string) (*models.PromoRedemption, *models.Subscription, error)
+	ListCodes(limit, offset int) ([]*models.PromoCode, error)
+	GetCode(code string) (*models.PromoCode, error)
+	SaveCode(promo *models.PromoCode) error
+	DeleteCode(code string) error
+	ListRedemptions(code string, limit, offset int) ([]*models.PromoRedemption, error)
+	Report(since, until *time.Time) ([]*models.PromoCodeReport, error)
+}
+
+type promoService struct {
+	promoRepo     repositories.PromoRepo
+	plans         PlanCatalog
+	subscriptions SubscriptionService
+}
+
+func NewPromoService(promoRepo repositories.PromoRepo, plans PlanCatalog, subscriptions SubscriptionService) PromoService {
+	return &promoService{promoRepo: promoRepo, plans: plans, subscriptions: subscriptions}
+}
+
+// NormalizePromoCode is how codes are stored, users may type them in any case
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ReserveDiscount holds one use of the code for the checkout and returns the discount off the plan price,
+// the use only counts for good once ConfirmDiscount is called for the paid checkout
+func (s *promoService) ReserveDiscount(userID int, plan *models.Plan, code, checkoutID string) (*models.PromoRedemption, error) {
+	redemption := &models.PromoRedemption{
+		Code:       NormalizePromoCode(code),
+		UserID:     userID,
+		CheckoutID: &checkoutID,
+		PlanID:     plan.PlanID,
+		Currency:   &plan.Currency,
+	}
+	err := s.promoRepo.ReserveRedemption(redemption, func(promo *models.PromoCode, total, byUser int) error {
+		if err := checkPromoUsable(promo, total, byUser); err != nil {
+			return err
+		}
+		if promo.Kind == models.PromoFreeDays {
+			return ErrPromoCodeForRedeem
+		}
+		if !promo.AppliesTo(plan.PlanID) {
+			return ErrPromoCodeNotApplicable
+		}
+		discount, err := promoDiscount(promo, plan)
+		if err != nil {
+			return err
+		}
+		redemption.DiscountAmount = discount
+		return nil
+	})
+	if err != nil {
+		return nil, promoRedemptionError(err, "ReserveDiscount")
+	}
+	return redemption, nil
+}
+
+func (s *promoService) ConfirmDiscount(checkoutID string) error {
+	if err := s.promoRepo.SetCheckoutRedemptionStatus(checkoutID, models.RedemptionPending, models.RedemptionRedeemed); err != nil {
+		return errors.New("failed to confirm promo code")
+	}
+	return nil
+}
+
+// ReleaseDiscount gives the held use back when the checkout couldn't be opened
+func (s *promoService) ReleaseDiscount(checkoutID string) error {
+	if err := s.promoRepo.SetCheckoutRedemptionStatus(checkoutID, models.RedemptionPending, models.RedemptionReleased); err != nil {
+		return errors.New("failed to release promo code")
+	}
+	return nil
+}
+
+// Redeem applies a free days code, the days are added to a running subscription of the code's plan or start a new one
+func (s *promoService) Redeem(userID int, code string) (*models.PromoRedemption, *models.Subscription, error) {
+	redemption := &models.PromoRedemption{Code: NormalizePromoCode(code), UserID: userID}
+	err := s.promoRepo.ReserveRedemption(redemption, func(promo *models.PromoCode, total, byUser int) error {
+		if err := checkPromoUsable(promo, total, byUser); err != nil {
+			return err
+		}
+		if promo.Kind != models.PromoFreeDays {
+			return ErrPromoCodeForCheckout
+		}
+		redemption.PlanID = *promo.GrantPlanID
+		redemption.FreeDays = promo.FreeDays
+		return nil
+	})
+	if err != nil {
+		return nil, nil, promoRedemptionError(err, "Redeem")
+	}
+
+	duration := time.Duration(*redemption.FreeDays) * 24 * time.Hour
+	subscription, err := s.subscriptions.AddFreeTime(userID, redemption.PlanID, duration, "promo code "+redemption.Code)
+	if err != nil {
+		if releaseErr := s.promoRepo.SetRedemptionStatus(redemption.RedemptionID, models.RedemptionPending, models.RedemptionReleased); releaseErr != nil {
+			logger.LogError(releaseErr, "Failed to release promo redemption", map[string]interface{}{"layer": "service", "operation": "Redeem", "redemptionID": redemption.RedemptionID})
+		}
+		return nil, nil, err
+	}
+	if err := s.promoRepo.SetRedemptionStatus(redemption.RedemptionID, models.RedemptionPending, models.RedemptionRedeemed); err != nil {
+		// the free time was given, a redemption left pending still counts against the limits
+		logger.LogError(err, "Failed to mark promo redemption redeemed", map[string]interface{}{"layer": "service", "operation": "Redeem", "redemptionID": redemption.RedemptionID})
+	}
+	redemption.Status = models.RedemptionRedeemed
+	return redemption, subscription, nil
+}
+
+// checkPromoUsable checks the code against the validity window and the limits, with the counts of uses it already has
+func checkPromoUsable(promo *models.PromoCode, total, byUser int) error {
+	now := time.Now()
+	if !promo.Active || (promo.ValidFrom != nil && now.Before(*promo.ValidFrom)) || (promo.ValidUntil != nil && !now.Before(*promo.ValidUntil)) {
+		return ErrPromoCodeInvalid
+	}
+	if promo.MaxRedemptions != nil && total >= *promo.MaxRedemptions {
+		return ErrPromoCodeUsedUp
+	}
+	if byUser >= promo.MaxPerUser {
+		return ErrPromoCodeAlreadyUsed
+	}
+	return nil
+}
+
+// promoDiscount is what the code takes off the plan price, the provider can't charge nothing so a discount never covers all of it
+func promoDiscount(promo *models.PromoCode, plan *models.Plan) (int64, error) {
+	var discount int64
+	switch promo.Kind {
+	case models.PromoPercentOff:
+		discount = plan.PriceAmount * int64(*promo.PercentOff) / 100
+	case models.PromoAmountOff:
+		if !strings.EqualFold(*promo.Currency, plan.Currency) {
+			return 0, ErrPromoCodeNotApplicable
+		}
+		discount = *promo.AmountOff
+	}
+	if discount <= 0 || discount >= plan.PriceAmount {
+		return 0, ErrPromoCodeNotApplicable
+	}
+	return discount, nil
+}
+
+func promoRedemptionError(err error, operation string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrPromoCodeInvalid
+	}
+	switch err {
+	case ErrPromoCodeInvalid, ErrPromoCodeUsedUp, ErrPromoCodeAlreadyUsed, ErrPromoCodeNotApplicable, ErrPromoCodeForCheckout, ErrPromoCodeForRedeem:
+		return err
+	}
+	logger.LogError(err, "Failed to redeem promo code", map[string]interface{}{"layer": "service", "operation": operation})
+	return errors.New("failed to redeem promo code")
+}
+
+func (s *promoService) ListCodes(limit, offset int) ([]*models.PromoCode, error) {
+	limit, offset = clampPage(limit, offset)
+	promos, err := s.promoRepo.ListPromoCodes(limit, offset)
+	if err != nil {
+		return nil, errors.New("failed to list promo codes")
+	}
+	return promos, nil
+}
+
+func (s *promoService) GetCode(code string) (*models.PromoCode, error) {
+	promo, err := s.promoRepo.GetPromoCode(NormalizePromoCode(code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPromoCodeNotFound
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to get promo code", map[string]interface{}{"layer": "service", "operation": "GetCode", "code": code})
+		return nil, errors.New("failed to get promo code")
+	}
+	return promo, nil
+}
+
+// SaveCode creates or replaces a code, the settings that don't belong to its kind are dropped
+func (s *promoService) SaveCode(promo *models.PromoCode) error {
+	promo.Code = NormalizePromoCode(promo.Code)
+	if !promoCodePattern.MatchString(promo.Code) {
+		return errors.New("code must be 3 to 32 letters, digits, dashes or underscores")
+	}
+	switch promo.Kind {
+	case models.PromoPercentOff:
+		if promo.PercentOff == nil || *promo.PercentOff < 1 || *promo.PercentOff > 99 {
+			return errors.New("percent_off must be between 1 and 99")
+		}
+		promo.AmountOff, promo.Currency, promo.FreeDays, promo.GrantPlanID = nil, nil, nil, nil
+	case models.PromoAmountOff:
+		if promo.AmountOff == nil || *promo.AmountOff <= 0 || promo.Currency == nil || len(*promo.Currency) != 3 {
+			return errors.New("fixed codes need a positive amount_off and a currency")
+		}
+		currency := strings.ToUpper(*promo.Currency)
+		promo.Currency = &currency
+		promo.PercentOff, promo.FreeDays, promo.GrantPlanID = nil, nil, nil
+	case models.PromoFreeDays:
+		if promo.FreeDays == nil || *promo.FreeDays < 1 || *promo.FreeDays > maxPromoFreeDays {
+			return fmt.Errorf("free_days must be between 1 and %d", maxPromoFreeDays)
+		}
+		if promo.GrantPlanID == nil {
+			return errors.New("free days codes need the plan they give")
+		}
+		plan, err := s.plans.GetPlan(*promo.GrantPlanID)
+		if err != nil {
+			return err
+		}
+		if plan.IsDefault {
+			return errors.New("free days can't be given on the default plan")
+		}
+		promo.PercentOff, promo.AmountOff, promo.Currency, promo.PlanIDs = nil, nil, nil, nil
+	default:
+		return fmt.Errorf("kind must be %s, %s or %s", models.PromoPercentOff, models.PromoAmountOff, models.PromoFreeDays)
+	}
+	for _, planID := range promo.PlanIDs {
+		if _, err := s.plans.GetPlan(planID); err != nil {
+			return err
+		}
+	}
+	if promo.PlanIDs == nil {
+		promo.PlanIDs = []string{}
+	}
+	if promo.MaxRedemptions != nil && *promo.MaxRedemptions < 1 {
+		return errors.New("max_redemptions must be positive, omit it for no limit")
+	}
+	if promo.MaxPerUser < 1 {
+		return errors.New("max_per_user must be at least 1")
+	}
+	if promo.ValidFrom != nil && promo.ValidUntil != nil && !promo.ValidUntil.After(*promo.ValidFrom) {
+		return errors.New("valid_until must be after valid_from")
+	}
+
+	existing, err := s.promoRepo.GetPromoCode(promo.Code)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.LogError(err, "Failed to get promo code", map[string]interface{}{"layer": "service", "operation": "SaveCode", "code": promo.Code})
+		return errors.New("failed to save promo code")
+	}
+	if existing != nil && existing.Kind != promo.Kind && existing.TimesRedeemed > 0 {
+		return errors.New("the kind of a redeemed code can't change, create a new code instead")
+	}
+
+	if err := s.promoRepo.SavePromoCode(promo); err != nil {
+		return errors.New("failed to save promo code")
+	}
+	if existing != nil {
+		promo.TimesRedeemed = existing.TimesRedeemed
+	}
+	return nil
+}
+
+// DeleteCode only removes codes nobody redeemed, used ones are kept for the reports and can be deactivated
+func (s *promoService) DeleteCode(code string) error {
+	code = NormalizePromoCode(code)
+	if _, err := s.GetCode(code); err != nil {
+		return err
+	}
+	deleted, err := s.promoRepo.DeletePromoCode(code)
+	if err != nil {
+		return errors.New("failed to delete promo code")
+	}
+	if !deleted {
+		return ErrPromoCodeInUse
+	}
+	return nil
+}
+
+func (s *promoService) ListRedemptions(code string, limit, offset int) ([]*models.PromoRedemption, error) {
+	limit, offset = clampPage(limit, offset)
+	redemptions, err := s.promoRepo.ListRedemptions(NormalizePromoCode(code), limit, offset)
+	if err != nil {
+		return nil, errors.New("failed to list redemptions")
+	}
+	return redemptions, nil
+}
+
+func (s *promoService) Report(since, until *time.Time) ([]*models.PromoCodeReport, error) {
+	report, err := s.promoRepo.ReportRedemptions(since, until)
+	if err != nil {
+		return nil, errors.New("failed to report redemptions")
+	}
+	return report, nil
+}
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"database/sql"
+	"errors"
 	"service/internal/logger"
 	"service/internal/models"
 	"service/internal/repositories"
@@ -9,96 +11,180 @@ import (
 )
 
 type RefreshTokenService interface {
-	GenerateAccessRefreshTokenPair(userID int) (string, string, error)
-	ValidateRefreshToken(refreshToken string) (string, string, error)
+	GenerateAccessRefreshTokenPair(userID int, client models.ClientInfo) (*models.TokenPair, error)
+	ValidateRefreshToken(refreshToken string, client models.ClientInfo) (*models.TokenPair, error)
 	BlacklistRefreshToken(refreshToken string) error
 	BlacklistTokenOnEmail(email string) error
+	ListSessions(userID int, currentSessionID string) ([]*models.Session, error)
+	RevokeSession(userID int, sessionID string) error
+	RevokeOtherSessions(userID int, currentSessionID string) error
+	RevokeAllSessions(userID int) error
+	IsSessionActive(sessionID string) bool
 }
 
+// a rotated refresh token presented again within this window is taken for two tabs refreshing at once, not for a stolen copy
+const refreshReuseGracePeriod = 10 * time.Second
+
+// ErrRefreshTokenReused is returned when a refresh token that was already rotated comes back, the whole session is revoked
+var ErrRefreshTokenReused = errors.New("refresh token was already used, the session has been revoked")
+
 type refreshTokenService struct {
 	refreshTokenRepo repositories.RefreshTokenRepo
 	authRepo         repositories.AuthRepo
+	audit            AuditLogger
 }
 
-func NewRefreshTokenService(refreshTokenRepo repositories.RefreshTokenRepo, authRepo repositories.AuthRepo) RefreshTokenService {
-	return &refreshTokenService{refreshTokenRepo: refreshTokenRepo, authRepo: authRepo}
+func NewRefreshTokenService(refreshTokenRepo repositories.RefreshTokenRepo, authRepo repositories.AuthRepo, audit AuditLogger) RefreshTokenService {
+	return &refreshTokenService{refreshTokenRepo: refreshTokenRepo, authRepo: authRepo, audit: audit}
 }
 
-func (s *refreshTokenService) GenerateAccessRefreshTokenPair(userID int) (string, string, error) {
+// GenerateAccessRefreshTokenPair starts a brand new session for the user (login), client.RememberMe picks the refresh lifetime
+func (s *refreshTokenService) GenerateAccessRefreshTokenPair(userID int, client models.ClientInfo) (*models.TokenPair, error) {
+	sessionID, err := utils.CreateRandomID()
+	if err != nil {
+		logger.LogError(err, "Failed to generate session id", map[string]interface{}{"layer": "service", "operation": "GenerateAccessRefreshTokenPair"})
+		return nil, err
+	}
+
+	label := client.SessionLabel
+	if label == "" {
+		label = utils.DescribeUserAgent(client.UserAgent)
+	}
+
+	now := time.Now()
+	return s.issueTokenPair(userID, &models.RefreshToken{
+		SessionID:        sessionID,
+		SessionLabel:     label,
+		UserAgent:        client.UserAgent,
+		IPAddress:        client.IPAddress,
+		SessionCreatedAt: now,
+		LastUsedAt:       now,
+		RememberMe:       client.RememberMe,
+	})
+}
+
+// issueTokenPair creates the access token and stores a new refresh token for the session described by session
+func (s *refreshTokenService) issueTokenPair(userID int, session *models.RefreshToken) (*models.TokenPair, error) {
 	// Get user using user id so that it can be used to generate the access token
 	user, err := s.authRepo.GetUserByID(userID)
 	if err != nil {
 		logger.LogError(err, "Failed to get user for token pair generation", map[string]interface{}{"layer": "service", "operation": "GenerateAccessRefreshTokenPair"})
-		return "", "", err
+		return nil, err
+	}
+	// a disabled account keeps no way to get new tokens, refresh included
+	if user.IsDisabled() {
+		return nil, ErrAccountDisabled
 	}
 
 	// generate access token using the user that we fetched
-	accessToken, err := utils.CreateAccessToken(user.UserID, user.Username, user.Email, user.Package)
+	accessToken, accessExpiresAt, err := utils.CreateAccessToken(user, session.SessionID)
 	if err != nil {
 		logger.LogError(err, "Failed to generate access token", map[string]interface{}{"layer": "service", "operation": "GenerateAccessRefreshTokenPair"})
-		return "", "", err
+		return nil, err
 	}
 
 	// generate opqaue refresh token and later store in the database for later check
 	refreshToken, err := utils.CreateRefreshToken()
 	if err != nil {
 		logger.LogError(err, "Failed to generate refresh token", map[string]interface{}{"layer": "service", "operation": "GenerateAccessRefreshTokenPair"})
-		return "", "", err
+		return nil, err
 	}
 
-	// store the refresh token in the database
+	// store the refresh token in the database, the cookie max-age is derived from the same expiry
+	now := time.Now()
+	refreshExpiresAt := utils.GetAuthConfig().RefreshTokenExpiry(session.SessionCreatedAt, session.RememberMe, now)
 	err = s.refreshTokenRepo.StoreRefreshToken(&models.RefreshToken{
 		UserID:            userID,
 		RefreshTokenValue: refreshToken,
-		ExpiredAt:         time.Now().Add(7 * 24 * time.Hour),
-		CreatedAt:         time.Now(),
+		ExpiredAt:         refreshExpiresAt,
+		CreatedAt:         now,
 		Revoked:           false,
+		SessionID:         session.SessionID,
+		SessionLabel:      session.SessionLabel,
+		UserAgent:         session.UserAgent,
+		IPAddress:         session.IPAddress,
+		SessionCreatedAt:  session.SessionCreatedAt,
+		LastUsedAt:        session.LastUsedAt,
+		RememberMe:        session.RememberMe,
 	})
 	if err != nil {
 		logger.LogError(err, "Failed to store refresh token", map[string]interface{}{"layer": "service", "operation": "GenerateAccessRefreshTokenPair"})
-		return "", "", err
+		return nil, err
 	}
 	// return the access token and refresh token for handler or auth service to send to the client
-	return accessToken, refreshToken, nil
+	return &models.TokenPair{AccessToken: accessToken, AccessExpiresAt: accessExpiresAt, RefreshToken: refreshToken, RefreshExpiresAt: refreshExpiresAt}, nil
 }
 
-func (s *refreshTokenService) ValidateRefreshToken(refreshTokenString string) (string, string, error) {
+// ValidateRefreshToken rotates the refresh token, the new pair stays in the same session
+func (s *refreshTokenService) ValidateRefreshToken(refreshTokenString string, client models.ClientInfo) (*models.TokenPair, error) {
 	// find the refresh token in the database
 	refreshToken, err := s.refreshTokenRepo.FindValidRefreshToken(refreshTokenString)
 	if err != nil {
 		logger.LogError(err, "Failed to find valid refresh token", map[string]interface{}{"layer": "service", "operation": "ValidateRefreshToken"})
-		return "", "", err
+		if reuseErr := s.detectReuse(refreshTokenString, client); reuseErr != nil {
+			return nil, reuseErr
+		}
+		s.audit.Record(models.NewAuditEvent(models.AuditActionTokenRefresh, 0, 0, client, models.AuditResultFailure, models.AuditDetails{"reason": "invalid_token"}))
+		return nil, err
 	}
 
 	// revoke the refresh token so that it can't be used again
 	err = s.refreshTokenRepo.RevokeRefreshToken(refreshTokenString)
 	if err != nil {
 		logger.LogError(err, "Failed to revoke refresh token", map[string]interface{}{"layer": "service", "operation": "ValidateRefreshToken"})
-		return "", "", err
+		return nil, err
+	}
+
+	// keep the session identity, but record where and when it was last used
+	refreshToken.LastUsedAt = time.Now()
+	if client.UserAgent != "" {
+		refreshToken.UserAgent = client.UserAgent
+	}
+	if client.IPAddress != "" {
+		refreshToken.IPAddress = client.IPAddress
 	}
 
 	// generate new token pair for the user
-	newAccessToken, newRefreshToken, err := s.GenerateAccessRefreshTokenPair(refreshToken.UserID)
+	tokens, err := s.issueTokenPair(refreshToken.UserID, refreshToken)
 	if err != nil {
 		logger.LogError(err, "Failed to generate new token pair while validating refresh token", map[string]interface{}{"layer": "service", "operation": "ValidateRefreshToken"})
-		return "", "", err
+		s.audit.Record(models.NewAuditEvent(models.AuditActionTokenRefresh, refreshToken.UserID, refreshToken.UserID, client, models.AuditResultFailure, models.AuditDetails{"session_id": refreshToken.SessionID, "reason": err.Error()}))
+		return nil, err
 	}
 
-	return newAccessToken, newRefreshToken, nil
+	s.audit.Record(models.NewAuditEvent(models.AuditActionTokenRefresh, refreshToken.UserID, refreshToken.UserID, client, models.AuditResultSuccess, models.AuditDetails{"session_id": refreshToken.SessionID}))
+	return tokens, nil
+}
 
+// detectReuse revokes the session when an already rotated refresh token is presented, whoever holds the copy and the real
+// owner are both logged out of that session; returns nil when the token was simply unknown, expired or logged out
+func (s *refreshTokenService) detectReuse(refreshTokenString string, client models.ClientInfo) error {
+	rotated, rotatedAt, err := s.refreshTokenRepo.FindRotatedRefreshToken(refreshTokenString)
+	if err != nil {
+		return nil
+	}
+	if time.Since(rotatedAt) < refreshReuseGracePeriod {
+		return errors.New("refresh token was just rotated, use the new one")
+	}
+
+	if err := s.refreshTokenRepo.RevokeSession(rotated.UserID, rotated.SessionID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.LogError(err, "Failed to revoke session after refresh token reuse", map[string]interface{}{"layer": "service", "operation": "detectReuse", "userID": rotated.UserID})
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionTokenReuse, 0, rotated.UserID, client, models.AuditResultDenied, models.AuditDetails{"session_id": rotated.SessionID}))
+	return ErrRefreshTokenReused
 }
 
 // sole purpose is for the logout handler to blacklist the refresh token
 func (s *refreshTokenService) BlacklistRefreshToken(refreshTokenString string) error {
 	// make sure the token is valid
-	refreshToken, err := s.refreshTokenRepo.FindValidRefreshToken(refreshTokenString)
+	_, err := s.refreshTokenRepo.FindValidRefreshToken(refreshTokenString)
 	if err != nil {
-		logger.LogError(err, "Failed to find valid refresh token", map[string]interface{}{"layer": "service", "operation": "ValidateRefreshToken"})
+		logger.LogError(err, "Failed to find valid refresh token", map[string]interface{}{"layer": "service", "operation": "BlacklistRefreshToken"})
 		return err
 	}
 
-	// revoke the token
-	if err := s.refreshTokenRepo.RevokeRefreshToken(refreshToken.RefreshTokenValue); err != nil {
+	// revoke the token, only the hash is stored so pass the raw token from the cookie
+	if err := s.refreshTokenRepo.RevokeRefreshToken(refreshTokenString); err != nil {
 		logger.LogError(err, "Failed to blacklist refresh token", map[string]interface{}{"layer": "service", "operation": "BlacklistRefreshToken"})
 		return err
 	}
@@ -111,6 +197,7 @@ func (s *refreshTokenService) BlacklistTokenOnEmail(email string) error {
 	user, err := s.authRepo.GetUserByEmail(email)
 	if err != nil {
 		logger.LogError(err, "Failed to get user for token pair generation", map[string]interface{}{"layer": "service", "operation": "BlacklistTokenOnEmail"})
+		return err
 	}
 
 	// revoke all the refresh tokens of the user
@@ -120,3 +207,56 @@ func (s *refreshTokenService) BlacklistTokenOnEmail(email string) error {
 	}
 	return nil
 }
+
+// ListSessions returns the devices the user is logged in on, flagging the one making the request
+func (s *refreshTokenService) ListSessions(userID int, currentSessionID string) ([]*models.Session, error) {
+	sessions, err := s.refreshTokenRepo.ListActiveSessions(userID)
+	if err != nil {
+		logger.LogError(err, "Failed to list sessions", map[string]interface{}{"layer": "service", "operation": "ListSessions", "userID": userID})
+		return nil, errors.New("failed to list sessions")
+	}
+	for _, session := range sessions {
+		session.Current = session.SessionID == currentSessionID
+	}
+	return sessions, nil
+}
+
+// RevokeSession logs a single device out, its access tokens stop working on the next request
+func (s *refreshTokenService) RevokeSession(userID int, sessionID string) error {
+	if err := s.refreshTokenRepo.RevokeSession(userID, sessionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("session not found")
+		}
+		logger.LogError(err, "Failed to revoke session", map[string]interface{}{"layer": "service", "operation": "RevokeSession", "userID": userID})
+		return errors.New("failed to revoke session")
+	}
+	return nil
+}
+
+// RevokeOtherSessions logs out every device except the one making the request
+func (s *refreshTokenService) RevokeOtherSessions(userID int, currentSessionID string) error {
+	if err := s.refreshTokenRepo.RevokeBasedOnUserID(userID, currentSessionID); err != nil {
+		logger.LogError(err, "Failed to revoke other sessions", map[string]interface{}{"layer": "service", "operation": "RevokeOtherSessions", "userID": userID})
+		return errors.New("failed to revoke other sessions")
+	}
+	return nil
+}
+
+// RevokeAllSessions logs the user out of every device, used after a password reset
+func (s *refreshTokenService) RevokeAllSessions(userID int) error {
+	if err := s.refreshTokenRepo.RevokeBasedOnUserID(userID); err != nil {
+		logger.LogError(err, "Failed to revoke all sessions", map[string]interface{}{"layer": "service", "operation": "RevokeAllSessions", "userID": userID})
+		return errors.New("failed to revoke all sessions")
+	}
+	return nil
+}
+
+// IsSessionActive is used by the access token middleware, a failed lookup is treated as inactive
+func (s *refreshTokenService) IsSessionActive(sessionID string) bool {
+	active, err := s.refreshTokenRepo.IsSessionActive(sessionID)
+	if err != nil {
+		logger.LogError(err, "Failed to check session", map[string]interface{}{"layer": "service", "operation": "IsSessionActive"})
+		return false
+	}
+	return active
+}
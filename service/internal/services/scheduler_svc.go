@@ -1,106 +1,110 @@
 package services
 
 import (
+	"context"
 	"service/internal/logger"
-	"service/internal/repositories"
 	"time"
 )
 
 type SchedulerService interface {
 	CheckAndDowngradeExpiredPackages() (int, error)
-	SchedulePackageExpiration(userID int, duration time.Duration) error
+	SendNotifications() (int, error)
+	SnapshotUsage() (int64, error)
 }
 
 type schedulerService struct {
-	authRepo repositories.AuthRepo
+	subscriptions SubscriptionService
+	fileService   FileService
+	notifications NotificationService
+	usage         UsageService
 }
 
-func NewSchedulerService(authRepo repositories.AuthRepo) SchedulerService {
-	return &schedulerService{
-		authRepo: authRepo,
-	}
+func NewSchedulerService(subscriptions SubscriptionService, fileService FileService, notifications NotificationService, usage UsageService) SchedulerService {
+	return &schedulerService{subscriptions: subscriptions, fileService: fileService, notifications: notifications, usage: usage}
 }
 
-// SchedulePackageExpiration sets a package expiration time for a user
-func (s *schedulerService) SchedulePackageExpiration(userID int, duration time.Duration) error {
-	expiryTime := time.Now().Add(duration)
-	err := s.authRepo.SetPackageExpiry(userID, expiryTime)
+// CheckAndDowngradeExpiredPackages advances every subscription whose period, past due or grace time is over,
+// the ones that end put their user back on the default plan; then applies the downgrade policy to the files of lost plans
+func (s *schedulerService) CheckAndDowngradeExpiredPackages() (int, error) {
+	now := time.Now()
+	advanced, err := s.subscriptions.AdvanceDueSubscriptions(now)
+	if err != nil {
+		logger.LogError(err, "Failed to advance due subscriptions", map[string]interface{}{
+			"layer":     "service",
+			"operation": "CheckAndDowngradeExpiredPackages",
+		})
+		return 0, err
+	}
+
+	// a failed downgrade run is retried by the next one, it doesn't fail the subscription check
+	pools, err := s.fileService.MarkDowngradedPools(now)
+	if err != nil {
+		logger.LogError(err, "Failed to mark downgraded pools", map[string]interface{}{
+			"layer":     "service",
+			"operation": "CheckAndDowngradeExpiredPackages",
+		})
+	}
+	for _, pool := range pools {
+		s.notifications.NotifyDowngrade(pool)
+	}
+	archived, err := s.fileService.ArchiveDowngradedFiles(context.Background(), now)
 	if err != nil {
-		logger.LogError(err, "Failed to set package expiry", map[string]interface{}{
+		logger.LogError(err, "Failed to apply downgrade policy", map[string]interface{}{
 			"layer":     "service",
-			"operation": "SchedulePackageExpiration",
-			"userID":    userID,
+			"operation": "CheckAndDowngradeExpiredPackages",
 		})
-		return err
 	}
 
 	logger.Log.Info().
-		Int("userID", userID).
-		Time("expiryTime", expiryTime).
-		Msg("Package expiration scheduled")
+		Int("advanced", advanced).
+		Int("archived", archived).
+		Msg("Subscription check completed")
 
-	return nil
+	return advanced, nil
 }
 
-// CheckAndDowngradeExpiredPackages processes all expired premium packages
-func (s *schedulerService) CheckAndDowngradeExpiredPackages() (int, error) {
-	expiredUsers, err := s.authRepo.GetExpiredPremiumUsers()
+// SendNotifications queues the expiry reminders that are due and sends a batch of the queued notifications
+func (s *schedulerService) SendNotifications() (int, error) {
+	now := time.Now()
+	queued, err := s.notifications.QueueExpiryReminders(now)
 	if err != nil {
-		logger.LogError(err, "Failed to get expired premium users", map[string]interface{}{
+		logger.LogError(err, "Failed to queue expiry reminders", map[string]interface{}{
 			"layer":     "service",
-			"operation": "CheckAndDowngradeExpiredPackages",
+			"operation": "SendNotifications",
 		})
-		return 0, err
 	}
 
-	if len(expiredUsers) == 0 {
-		logger.Log.Info().Msg("No expired premium packages found")
-		return 0, nil
+	sent, err := s.notifications.SendDueNotifications(now)
+	if err != nil {
+		logger.LogError(err, "Failed to send notifications", map[string]interface{}{
+			"layer":     "service",
+			"operation": "SendNotifications",
+		})
+		return 0, err
 	}
 
-	processedCount := 0
-	var lastError error
-
-	for _, userID := range expiredUsers {
-		// Downgrade to free package with 2MB storage limit
-		err := s.authRepo.UpgradeUserPackage(userID, "free") // 2MB = 2 * 1024 * 1024
-		if err != nil {
-			logger.LogError(err, "Failed to downgrade expired user", map[string]interface{}{
-				"layer":     "service",
-				"operation": "CheckAndDowngradeExpiredPackages",
-				"userID":    userID,
-			})
-			lastError = err
-			continue
-		}
+	logger.Log.Info().
+		Int("queued", queued).
+		Int("sent", sent).
+		Msg("Notification run completed")
 
-		// Clear package expiry
-		err = s.authRepo.ClearPackageExpiry(userID)
-		if err != nil {
-			logger.LogError(err, "Failed to clear package expiry", map[string]interface{}{
-				"layer":     "service",
-				"operation": "CheckAndDowngradeExpiredPackages",
-				"userID":    userID,
-			})
-			lastError = err
-			// Don't continue here as the downgrade was successful
-		}
+	return sent, nil
+}
 
-		processedCount++
-		logger.Log.Info().
-			Int("userID", userID).
-			Msg("User package downgraded due to expiration")
+// SnapshotUsage records today's storage of every user, later runs of the same day replace the snapshot
+func (s *schedulerService) SnapshotUsage() (int64, error) {
+	count, err := s.usage.SnapshotStorage(time.Now())
+	if err != nil {
+		logger.LogError(err, "Failed to snapshot usage", map[string]interface{}{
+			"layer":     "service",
+			"operation": "SnapshotUsage",
+		})
+		return 0, err
 	}
 
 	logger.Log.Info().
-		Int("total_found", len(expiredUsers)).
-		Int("processed_successfully", processedCount).
-		Msg("Package expiration check completed")
-
-	// Return error only if no users were processed successfully
-	if processedCount == 0 && lastError != nil {
-		return 0, lastError
-	}
+		Int64("users", count).
+		Msg("Usage snapshot completed")
 
-	return processedCount, nil
+	return count, nil
 }
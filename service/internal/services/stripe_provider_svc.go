@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"service/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stripeAPIBase = "https://api.stripe.com"
+	// stripe signs the timestamp too, older deliveries are refused so a captured webhook can't be replayed later
+	stripeSignatureTolerance = 5 * time.Minute
+)
+
+type stripeProvider struct {
+	secretKey     string
+	webhookSecret string
+	apiBase       string
+	client        *http.Client
+}
+
+func NewStripeProvider(secretKey, webhookSecret string) PaymentProvider {
+	return &stripeProvider{
+		secretKey:     secretKey,
+		webhookSecret: webhookSecret,
+		apiBase:       stripeAPIBase,
+		client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (p *stripeProvider) Name() string {
+	return "stripe"
+}
+
+func (p *stripeProvider) CreateCheckout(ctx context.Context, req models.CheckoutRequest) (*models.ProviderCheckout, error) {
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("client_reference_id", req.CheckoutID)
+	form.Set("customer_email", req.Email)
+	form.Set("success_url", req.SuccessURL)
+	form.Set("cancel_url", req.CancelURL)
+	form.Set("expires_at", strconv.FormatInt(req.ExpiresAt.Unix(), 10))
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(req.Currency))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(req.Amount, 10))
+	form.Set("line_items[0][price_data][product_data][name]", req.PlanName)
+	// the payment intent carries the checkout id as well, its failure events don't include the session
+	form.Set("metadata[checkout_id]", req.CheckoutID)
+	form.Set("payment_intent_data[metadata][checkout_id]", req.CheckoutID)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.apiBase+"/v1/checkout/sessions", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.SetBasicAuth(p.secretKey, "")
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Idempotency-Key", req.CheckoutID)
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach stripe: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var session struct {
+		ID    string `json:"id"`
+		URL   string `json:"url"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, fmt.Errorf("failed to decode stripe response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if session.Error != nil {
+			return nil, fmt.Errorf("stripe refused the checkout session: %s", session.Error.Message)
+		}
+		return nil, fmt.Errorf("stripe refused the checkout session with status %d", resp.StatusCode)
+	}
+	return &models.ProviderCheckout{SessionID: session.ID, URL: session.URL}, nil
+}
+
+// stripeObject holds the fields we read from the checkout sessions, payment intents and charges in webhook events
+type stripeObject struct {
+	ID               string            `json:"id"`
+	Metadata         map[string]string `json:"metadata"`
+	PaymentStatus    string            `json:"payment_status"`
+	PaymentIntent    string            `json:"payment_intent"`
+	AmountTotal      int64             `json:"amount_total"`
+	Amount           int64             `json:"amount"`
+	AmountRefunded   int64             `json:"amount_refunded"`
+	Currency         string            `json:"currency"`
+	Refunded         bool              `json:"refunded"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+}
+
+func (p *stripeProvider) ParseWebhook(payload []byte, header http.Header) (*models.PaymentEvent, error) {
+	if err := p.verifySignature(payload, header.Get("Stripe-Signature"), time.Now()); err != nil {
+		return nil, err
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object stripeObject `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to decode stripe event: %w", err)
+	}
+	object := event.Data.Object
+	paymentEvent := &models.PaymentEvent{
+		EventID:    event.ID,
+		CheckoutID: object.Metadata["checkout_id"],
+		Currency:   strings.ToUpper(object.Currency),
+	}
+
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		// bank transfers and the like complete the session unpaid and succeed later
+		if object.PaymentStatus != "paid" {
+			return nil, nil
+		}
+		paymentEvent.Type = models.PaymentSucceeded
+		paymentEvent.PaymentID = object.PaymentIntent
+		paymentEvent.Amount = object.AmountTotal
+	case "checkout.session.async_payment_failed":
+		paymentEvent.Type = models.PaymentFailed
+		paymentEvent.PaymentID = object.PaymentIntent
+		paymentEvent.Amount = object.AmountTotal
+		paymentEvent.Reason = "asynchronous payment failed"
+	case "payment_intent.payment_failed":
+		paymentEvent.Type = models.PaymentFailed
+		paymentEvent.PaymentID = object.ID
+		paymentEvent.Amount = object.Amount
+		if object.LastPaymentError != nil {
+			paymentEvent.Reason = object.LastPaymentError.Message
+		}
+	case "charge.refunded":
+		// amount_refunded is the running total, billing keeps the plan until it covers the charge
+		if object.AmountRefunded <= 0 {
+			return nil, nil
+		}
+		paymentEvent.Type = models.PaymentRefunded
+		paymentEvent.PaymentID = object.PaymentIntent
+		paymentEvent.Amount = object.AmountRefunded
+	default:
+		return nil, nil
+	}
+	return paymentEvent, nil
+}
+
+// verifySignature checks the Stripe-Signature header, "t=<unix time>,v1=<hex hmac-sha256 of t.payload>", v1 may repeat while the secret is rolled
+func (p *stripeProvider) verifySignature(payload []byte, signatureHeader string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(signatureHeader, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidWebhookSignature
+	}
+	if age := now.Sub(time.Unix(signedAt, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return ErrInvalidWebhookSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(p.webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		decoded, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidWebhookSignature
+}
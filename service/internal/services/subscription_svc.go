@@ -0,0 +1,586 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"time"
+)
+
+const (
+	// an auto renewing subscription keeps its plan this long after the period ended while the renewal is unpaid (past_due)...
+	defaultSubscriptionPastDuePeriod = 72 * time.Hour
+	// ...and this long on top of that (grace) before it expires
+	defaultSubscriptionGracePeriod = 72 * time.Hour
+	// subscriptions advanced per scheduler run, the rest are picked up by the next run
+	subscriptionAdvanceBatchSize = 500
+)
+
+var (
+	ErrNoSubscription      = errors.New("no running subscription")
+	ErrTrialNotAvailable   = errors.New("this plan has no trial or you already had one")
+	ErrSubscriptionRunning = errors.New("you already have a running subscription")
+	// nothing charges a renewal yet, so auto renew would only stretch the plan through past due and grace for free
+	ErrAutoRenewUnavailable = errors.New("automatic renewal isn't available, pay for the next period before this one ends")
+)
+
+// SubscriptionService owns the subscription state machine, it is the only place that moves users between plans
+type SubscriptionService interface {
+	GetCurrent(userID int) (*models.Subscription, []*models.SubscriptionTransition, error)
+	ListSubscriptions(userID int) ([]*models.Subscription, error)
+	StartTrial(userID int, planID string) (*models.Subscription, error)
+	ActivatePaid(userID int, planID, reason string) (*models.Subscription, error)
+	Grant(userID int, planID string, until *time.Time, reason string) (*models.Subscription, error)
+	AddFreeTime(userID int, planID string, duration time.Duration, reason string) (*models.Subscription, error)
+	SwitchToFreePlan(userID int, planID, reason string) error
+	EndSubscription(userID int, planID, status, reason string) error
+	SetCancelAtPeriodEnd(userID int, cancel bool) (*models.Subscription, error)
+	SetAutoRenew(userID int, autoRenew bool) (*models.Subscription, error)
+	AdvanceDueSubscriptions(now time.Time) (int, error)
+}
+
+type subscriptionService struct {
+	subscriptionRepo  repositories.SubscriptionRepo
+	plans             PlanCatalog
+	revocationService TokenRevocationService
+	notifications     NotificationService
+	audit             AuditLogger
+	pastDuePeriod     time.Duration
+	gracePeriod       time.Duration
+}
+
+func NewSubscriptionService(subscriptionRepo repositories.SubscriptionRepo, plans PlanCatalog, revocationService TokenRevocationService, notifications NotificationService, audit AuditLogger) (SubscriptionService, error) {
+	pastDuePeriod, err := durationFromEnv("SUBSCRIPTION_PAST_DUE_PERIOD", defaultSubscriptionPastDuePeriod)
+	if err != nil {
+		return nil, err
+	}
+	gracePeriod, err := durationFromEnv("SUBSCRIPTION_GRACE_PERIOD", defaultSubscriptionGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	return &subscriptionService{
+		subscriptionRepo:  subscriptionRepo,
+		plans:             plans,
+		revocationService: revocationService,
+		notifications:     notifications,
+		audit:             audit,
+		pastDuePeriod:     pastDuePeriod,
+		gracePeriod:       gracePeriod,
+	}, nil
+}
+
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return parsed, nil
+}
+
+func (s *subscriptionService) GetCurrent(userID int) (*models.Subscription, []*models.SubscriptionTransition, error) {
+	subscription, err := s.current(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subscription == nil {
+		return nil, nil, ErrNoSubscription
+	}
+	transitions, err := s.subscriptionRepo.ListTransitions(subscription.SubscriptionID)
+	if err != nil {
+		return nil, nil, errors.New("failed to get subscription history")
+	}
+	return subscription, transitions, nil
+}
+
+func (s *subscriptionService) ListSubscriptions(userID int) ([]*models.Subscription, error) {
+	subscriptions, err := s.subscriptionRepo.ListSubscriptionsByUser(userID)
+	if err != nil {
+		return nil, errors.New("failed to list subscriptions")
+	}
+	return subscriptions, nil
+}
+
+// StartTrial gives a user without a running subscription the plan's trial, once per plan
+func (s *subscriptionService) StartTrial(userID int, planID string) (*models.Subscription, error) {
+	plan, err := s.plans.GetPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	if !plan.Purchasable {
+		return nil, ErrPlanNotAvailable
+	}
+	if plan.TrialDuration() == 0 {
+		return nil, ErrTrialNotAvailable
+	}
+	if current, err := s.current(userID); err != nil {
+		return nil, err
+	} else if current != nil {
+		return nil, ErrSubscriptionRunning
+	}
+	hadPlan, err := s.subscriptionRepo.HasSubscribedTo(userID, plan.PlanID)
+	if err != nil {
+		return nil, errors.New("failed to start trial")
+	}
+	if hadPlan {
+		return nil, ErrTrialNotAvailable
+	}
+
+	now := time.Now()
+	trialEnd := now.Add(plan.TrialDuration())
+	subscription := &models.Subscription{
+		UserID:             userID,
+		PlanID:             plan.PlanID,
+		Status:             models.SubscriptionTrialing,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   &trialEnd,
+	}
+	if err := s.create(subscription, "trial started"); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// ActivatePaid applies a confirmed payment: it converts a trial, renews a past_due or grace subscription from where its period ended,
+// extends an active one by a period, or replaces a subscription to another plan
+func (s *subscriptionService) ActivatePaid(userID int, planID, reason string) (*models.Subscription, error) {
+	plan, err := s.plans.GetPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.current(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if current != nil && current.PlanID == plan.PlanID {
+		updated := *current
+		updated.Status = models.SubscriptionActive
+		updated.CancelAtPeriodEnd = false
+		switch {
+		case current.CurrentPeriodEnd == nil:
+			// granted without an end, paying changes nothing about the period
+		case current.Status == models.SubscriptionTrialing:
+			updated.CurrentPeriodStart = now
+			updated.CurrentPeriodEnd = periodEnd(now, plan)
+		default:
+			// renewals start where the last period ended, early ones too, so nobody pays twice for the same days,
+			// unless the renewal was paid so late that the new period would already be over
+			start := *current.CurrentPeriodEnd
+			if end := periodEnd(start, plan); end != nil && !end.After(now) {
+				start = now
+			}
+			updated.CurrentPeriodStart = start
+			updated.CurrentPeriodEnd = periodEnd(start, plan)
+		}
+		if err := s.save(&updated, current.Status, reason); err != nil {
+			return nil, err
+		}
+		return &updated, nil
+	}
+
+	if current != nil {
+		if err := s.end(current, models.SubscriptionCanceled, fmt.Sprintf("replaced by the %s plan", plan.Name), false); err != nil {
+			return nil, err
+		}
+	}
+	subscription := &models.Subscription{
+		UserID:             userID,
+		PlanID:             plan.PlanID,
+		Status:             models.SubscriptionActive,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   periodEnd(now, plan),
+	}
+	if err := s.create(subscription, reason); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// Grant puts the user on the plan until the given time (nil for no end) without payment, granted subscriptions don't auto renew
+func (s *subscriptionService) Grant(userID int, planID string, until *time.Time, reason string) (*models.Subscription, error) {
+	plan, err := s.plans.GetPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.IsDefault {
+		return nil, s.SwitchToFreePlan(userID, plan.PlanID, reason)
+	}
+	current, err := s.current(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && current.PlanID == plan.PlanID {
+		updated := *current
+		updated.Status = models.SubscriptionActive
+		updated.CurrentPeriodEnd = until
+		updated.AutoRenew = false
+		updated.CancelAtPeriodEnd = false
+		if err := s.save(&updated, current.Status, reason); err != nil {
+			return nil, err
+		}
+		return &updated, nil
+	}
+
+	if current != nil {
+		if err := s.end(current, models.SubscriptionCanceled, fmt.Sprintf("replaced by the %s plan", plan.Name), false); err != nil {
+			return nil, err
+		}
+	}
+	subscription := &models.Subscription{
+		UserID:             userID,
+		PlanID:             plan.PlanID,
+		Status:             models.SubscriptionActive,
+		CurrentPeriodStart: time.Now(),
+		CurrentPeriodEnd:   until,
+	}
+	if err := s.create(subscription, reason); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// AddFreeTime gives the plan for the duration without payment: a running subscription to the plan is extended,
+// a user without one gets a subscription that doesn't auto renew
+func (s *subscriptionService) AddFreeTime(userID int, planID string, duration time.Duration, reason string) (*models.Subscription, error) {
+	plan, err := s.plans.GetPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.IsDefault {
+		return nil, errors.New("free time can't be given on the default plan")
+	}
+	current, err := s.current(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if current != nil {
+		if current.PlanID != plan.PlanID {
+			return nil, ErrSubscriptionRunning
+		}
+		if current.CurrentPeriodEnd == nil {
+			return nil, errors.New("you already have this plan without an end")
+		}
+		updated := *current
+		switch current.Status {
+		case models.SubscriptionTrialing, models.SubscriptionActive:
+			end := current.CurrentPeriodEnd.Add(duration)
+			updated.CurrentPeriodEnd = &end
+		default:
+			// the period is over and unpaid, the free time starts a new one
+			end := now.Add(duration)
+			updated.Status = models.SubscriptionActive
+			updated.CurrentPeriodStart = now
+			updated.CurrentPeriodEnd = &end
+		}
+		if err := s.save(&updated, current.Status, reason); err != nil {
+			return nil, err
+		}
+		return &updated, nil
+	}
+
+	end := now.Add(duration)
+	subscription := &models.Subscription{
+		UserID:             userID,
+		PlanID:             plan.PlanID,
+		Status:             models.SubscriptionActive,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   &end,
+	}
+	if err := s.create(subscription, reason); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// SwitchToFreePlan cancels the running subscription right away and moves the user to a free plan
+func (s *subscriptionService) SwitchToFreePlan(userID int, planID, reason string) error {
+	plan, err := s.plans.GetPlan(planID)
+	if err != nil {
+		return err
+	}
+	if plan.PriceAmount > 0 {
+		return ErrPaymentRequired
+	}
+	current, err := s.current(userID)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		// ending it puts the user on the default plan, which is usually the plan asked for
+		if err := s.end(current, models.SubscriptionCanceled, reason, true); err != nil {
+			return err
+		}
+		if plan.IsDefault {
+			return nil
+		}
+	}
+
+	// free plans other than the default get a subscription without an end so the state stays in one place
+	if plan.IsDefault {
+		return nil
+	}
+	subscription := &models.Subscription{
+		UserID:             userID,
+		PlanID:             plan.PlanID,
+		Status:             models.SubscriptionActive,
+		CurrentPeriodStart: time.Now(),
+	}
+	return s.create(subscription, reason)
+}
+
+// EndSubscription ends the running subscription to the plan right away (e.g. after a refund), nothing happens when the user is on another plan
+func (s *subscriptionService) EndSubscription(userID int, planID, status, reason string) error {
+	current, err := s.current(userID)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.PlanID != planID {
+		return nil
+	}
+	return s.end(current, status, reason, true)
+}
+
+// SetCancelAtPeriodEnd makes the subscription end with the current period, or takes that back while the period is still running
+func (s *subscriptionService) SetCancelAtPeriodEnd(userID int, cancel bool) (*models.Subscription, error) {
+	current, err := s.current(userID)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, ErrNoSubscription
+	}
+	if current.CurrentPeriodEnd == nil {
+		return nil, errors.New("this subscription has no end to cancel at")
+	}
+	if current.Status != models.SubscriptionActive && current.Status != models.SubscriptionTrialing {
+		return nil, errors.New("only an active or trialing subscription can be canceled at period end, pay the renewal or let it expire")
+	}
+
+	updated := *current
+	updated.CancelAtPeriodEnd = cancel
+	reason := "resumed"
+	if cancel {
+		reason = "cancellation at period end requested"
+	}
+	if err := s.save(&updated, current.Status, reason); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// SetAutoRenew turns renewals off, turning them on is refused until a renewal can actually be charged
+func (s *subscriptionService) SetAutoRenew(userID int, autoRenew bool) (*models.Subscription, error) {
+	if autoRenew {
+		return nil, ErrAutoRenewUnavailable
+	}
+	current, err := s.current(userID)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, ErrNoSubscription
+	}
+
+	updated := *current
+	updated.AutoRenew = autoRenew
+	reason := "auto renew turned off"
+	if autoRenew {
+		reason = "auto renew turned on"
+	}
+	if err := s.save(&updated, current.Status, reason); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// AdvanceDueSubscriptions moves every subscription whose state is over on to the next one, called by the scheduler;
+// a subscription overdue by several states (the scheduler was down) walks through each of them so every step is recorded
+func (s *subscriptionService) AdvanceDueSubscriptions(now time.Time) (int, error) {
+	due, err := s.subscriptionRepo.ListDueSubscriptions(now, s.pastDuePeriod, s.gracePeriod, subscriptionAdvanceBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	advanced := 0
+	var lastError error
+	for _, subscription := range due {
+		for {
+			next, reason, ok := s.nextState(subscription, now)
+			if !ok {
+				break
+			}
+			from := subscription.Status
+			if next == models.SubscriptionCanceled || next == models.SubscriptionExpired {
+				if err = s.end(subscription, next, reason, true); err == nil {
+					s.notifications.NotifyPlanExpired(subscription)
+				}
+			} else {
+				subscription.Status = next
+				err = s.save(subscription, from, reason)
+			}
+			if err != nil {
+				logger.LogError(err, "Failed to advance subscription", map[string]interface{}{"layer": "service", "operation": "AdvanceDueSubscriptions", "subscriptionID": subscription.SubscriptionID, "from": from, "to": next})
+				lastError = err
+				break
+			}
+			advanced++
+		}
+	}
+
+	// Return error only if nothing was advanced
+	if advanced == 0 && lastError != nil {
+		return 0, lastError
+	}
+	return advanced, nil
+}
+
+// nextState is where the subscription goes once its current state is over at now, ok is false while it isn't
+func (s *subscriptionService) nextState(subscription *models.Subscription, now time.Time) (string, string, bool) {
+	if subscription.CurrentPeriodEnd == nil {
+		return "", "", false
+	}
+	periodEnd := *subscription.CurrentPeriodEnd
+	switch subscription.Status {
+	case models.SubscriptionTrialing, models.SubscriptionActive:
+		if now.Before(periodEnd) {
+			return "", "", false
+		}
+		if subscription.CancelAtPeriodEnd {
+			return models.SubscriptionCanceled, "canceled at period end", true
+		}
+		if !subscription.AutoRenew {
+			return models.SubscriptionExpired, "period ended without auto renew", true
+		}
+		return models.SubscriptionPastDue, "renewal payment due", true
+	case models.SubscriptionPastDue:
+		if now.Before(periodEnd.Add(s.pastDuePeriod)) {
+			return "", "", false
+		}
+		return models.SubscriptionGrace, "renewal payment overdue", true
+	case models.SubscriptionGrace:
+		if now.Before(periodEnd.Add(s.pastDuePeriod + s.gracePeriod)) {
+			return "", "", false
+		}
+		return models.SubscriptionExpired, "grace period ended without payment", true
+	}
+	return "", "", false
+}
+
+// accessUntil is when the user loses the plan unless something changes, the file service enforces it in real time
+// even before the scheduler gets to the subscription
+func (s *subscriptionService) accessUntil(subscription *models.Subscription) *time.Time {
+	if subscription.CurrentPeriodEnd == nil {
+		return nil
+	}
+	end := *subscription.CurrentPeriodEnd
+	if subscription.CancelAtPeriodEnd || !subscription.AutoRenew {
+		return &end
+	}
+	end = end.Add(s.pastDuePeriod + s.gracePeriod)
+	return &end
+}
+
+func (s *subscriptionService) current(userID int) (*models.Subscription, error) {
+	subscription, err := s.subscriptionRepo.GetCurrentSubscription(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.LogError(err, "Failed to get current subscription", map[string]interface{}{"layer": "service", "operation": "currentSubscription", "userID": userID})
+		return nil, errors.New("failed to get subscription")
+	}
+	return subscription, nil
+}
+
+func (s *subscriptionService) create(subscription *models.Subscription, reason string) error {
+	access := models.PlanAccess{Package: subscription.PlanID, Expiry: s.accessUntil(subscription)}
+	if err := s.subscriptionRepo.CreateSubscription(subscription, reason, access); err != nil {
+		return errors.New("failed to create subscription")
+	}
+	s.planChanged(subscription, "", reason)
+	s.notifications.NotifyWelcome(subscription)
+	return nil
+}
+
+func (s *subscriptionService) save(subscription *models.Subscription, fromStatus, reason string) error {
+	access := models.PlanAccess{Package: subscription.PlanID, Expiry: s.accessUntil(subscription)}
+	moved, err := s.subscriptionRepo.SaveSubscription(subscription, fromStatus, reason, access)
+	if err != nil {
+		return errors.New("failed to update subscription")
+	}
+	if !moved {
+		return errors.New("the subscription was changed concurrently, try again")
+	}
+	s.logTransition(subscription, fromStatus, reason)
+	return nil
+}
+
+// end finishes the subscription, the user goes back to the default plan unless another subscription is about to replace it
+func (s *subscriptionService) end(subscription *models.Subscription, status, reason string, downgrade bool) error {
+	defaultPlan, err := s.plans.DefaultPlan()
+	if err != nil {
+		return err
+	}
+	from := subscription.Status
+	now := time.Now()
+	subscription.Status = status
+	subscription.EndedAt = &now
+
+	access := models.PlanAccess{Package: defaultPlan.PlanID}
+	if !downgrade {
+		// the replacing subscription writes the access right after, keep the plan until then
+		access = models.PlanAccess{Package: subscription.PlanID, Expiry: s.accessUntil(subscription)}
+	}
+	moved, err := s.subscriptionRepo.SaveSubscription(subscription, from, reason, access)
+	if err != nil {
+		return errors.New("failed to end subscription")
+	}
+	if !moved {
+		return errors.New("the subscription was changed concurrently, try again")
+	}
+	s.logTransition(subscription, from, reason)
+	if downgrade {
+		s.planChanged(&models.Subscription{UserID: subscription.UserID, PlanID: defaultPlan.PlanID}, subscription.PlanID, reason)
+	}
+	return nil
+}
+
+// planChanged revokes the access tokens carrying the old package claim and records the change
+func (s *subscriptionService) planChanged(subscription *models.Subscription, previousPlan, reason string) {
+	if err := s.revocationService.RevokeUserAccessTokens(subscription.UserID, "package_change"); err != nil {
+		logger.LogError(err, "Failed to revoke access tokens after plan change", map[string]interface{}{"layer": "service", "operation": "planChanged", "userID": subscription.UserID})
+	}
+	s.audit.Record(models.NewAuditEvent(models.AuditActionPackageChange, 0, subscription.UserID, models.ClientInfo{}, models.AuditResultSuccess, models.AuditDetails{
+		"package": subscription.PlanID, "previous_package": previousPlan, "reason": reason,
+	}))
+}
+
+func (s *subscriptionService) logTransition(subscription *models.Subscription, fromStatus, reason string) {
+	logger.Log.Info().
+		Int("userID", subscription.UserID).
+		Int("subscriptionID", subscription.SubscriptionID).
+		Str("from", fromStatus).
+		Str("to", subscription.Status).
+		Str("reason", reason).
+		Msg("Subscription transition")
+}
+
+func periodEnd(start time.Time, plan *models.Plan) *time.Time {
+	if plan.Duration() == 0 {
+		return nil
+	}
+	end := start.Add(plan.Duration())
+	return &end
+}
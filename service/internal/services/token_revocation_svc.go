@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"service/internal/utils"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the cache pulls revocations written by other instances
+	revocationSyncInterval = 10 * time.Second
+	// how far back each sync re-reads, a row's created_at is its transaction start so it can commit after newer rows were already synced
+	revocationSyncOverlap = time.Minute
+	// how often expired denylist rows are deleted from the database
+	revocationCleanupInterval = 5 * time.Minute
+)
+
+type TokenRevocationService interface {
+	Start(ctx context.Context) error
+	RevokeAccessToken(jti string, expiresAt time.Time, reason string) error
+	RevokeUserAccessTokens(userID int, reason string) error
+	IsAccessTokenRevoked(claims *utils.AccessTokenClaims) bool
+}
+
+// tokenRevocationService keeps the denylist in Postgres so every instance sees it, and in memory so the middleware never waits on the database
+type tokenRevocationService struct {
+	revocationRepo repositories.TokenRevocationRepo
+
+	mu           sync.RWMutex
+	lastSyncedAt time.Time            // newest created_at seen by sync
+	appliedIDs   map[int]time.Time    // revocation id -> when the entry can be dropped, skips rows seen again in the overlap
+	revokedJTIs  map[string]time.Time // jti -> when the entry can be dropped
+	userCutoffs  map[int]cutoff       // user id -> tokens issued at or before this are revoked
+}
+
+type cutoff struct {
+	issuedBefore time.Time
+	expiresAt    time.Time
+}
+
+func NewTokenRevocationService(revocationRepo repositories.TokenRevocationRepo) TokenRevocationService {
+	return &tokenRevocationService{
+		revocationRepo: revocationRepo,
+		appliedIDs:     map[int]time.Time{},
+		revokedJTIs:    map[string]time.Time{},
+		userCutoffs:    map[int]cutoff{},
+	}
+}
+
+// Start loads the denylist and keeps it in sync (and cleaned up) in the background until ctx is done
+func (s *tokenRevocationService) Start(ctx context.Context) error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+
+	go func() {
+		syncTicker := time.NewTicker(revocationSyncInterval)
+		cleanupTicker := time.NewTicker(revocationCleanupInterval)
+		defer syncTicker.Stop()
+		defer cleanupTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-syncTicker.C:
+				if err := s.sync(); err != nil {
+					logger.LogError(err, "Failed to sync token revocations", map[string]interface{}{"layer": "service", "operation": "TokenRevocationService.Start"})
+				}
+			case <-cleanupTicker.C:
+				s.cleanup()
+			}
+		}
+	}()
+	return nil
+}
+
+// RevokeAccessToken puts a single access token on the denylist until it would have expired anyway (logout)
+func (s *tokenRevocationService) RevokeAccessToken(jti string, expiresAt time.Time, reason string) error {
+	if jti == "" {
+		return nil
+	}
+	revocation := &models.TokenRevocation{JTI: &jti, Reason: reason, ExpiresAt: expiresAt}
+	if err := s.revocationRepo.StoreRevocation(revocation); err != nil {
+		logger.LogError(err, "Failed to revoke access token", map[string]interface{}{"layer": "service", "operation": "RevokeAccessToken", "reason": reason})
+		return err
+	}
+	s.apply(revocation)
+	return nil
+}
+
+// RevokeUserAccessTokens revokes every access token of the user issued up to now (password reset, package change)
+func (s *tokenRevocationService) RevokeUserAccessTokens(userID int, reason string) error {
+	// iat has second precision, so a token issued in the same second as this call is revoked too
+	issuedBefore := time.Now().Truncate(time.Second)
+	revocation := &models.TokenRevocation{
+		UserID:       &userID,
+		IssuedBefore: &issuedBefore,
+		Reason:       reason,
+		ExpiresAt:    issuedBefore.Add(longestAccessTokenTTL()), // every access token it covers is expired by then
+	}
+	if err := s.revocationRepo.StoreRevocation(revocation); err != nil {
+		logger.LogError(err, "Failed to revoke user access tokens", map[string]interface{}{"layer": "service", "operation": "RevokeUserAccessTokens", "userID": userID, "reason": reason})
+		return err
+	}
+	s.apply(revocation)
+	return nil
+}
+
+// IsAccessTokenRevoked only reads the in-memory cache, it is called on every authenticated request
+func (s *tokenRevocationService) IsAccessTokenRevoked(claims *utils.AccessTokenClaims) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if claims.ID != "" {
+		if _, revoked := s.revokedJTIs[claims.ID]; revoked {
+			return true
+		}
+	}
+	if userCutoff, ok := s.userCutoffs[claims.UserID]; ok {
+		if claims.IssuedAt == nil || !claims.IssuedAt.Time.After(userCutoff.issuedBefore) {
+			return true
+		}
+	}
+	return false
+}
+
+// sync pulls entries written since the last sync (by this or another instance), re-reading an overlap so rows committed late are not skipped
+func (s *tokenRevocationService) sync() error {
+	s.mu.RLock()
+	since := s.lastSyncedAt
+	s.mu.RUnlock()
+	if !since.IsZero() {
+		since = since.Add(-revocationSyncOverlap)
+	}
+
+	revocations, err := s.revocationRepo.GetRevocationsCreatedAfter(since)
+	if err != nil {
+		return err
+	}
+	for _, revocation := range revocations {
+		s.apply(revocation)
+	}
+
+	s.mu.Lock()
+	for _, revocation := range revocations {
+		if revocation.CreatedAt.After(s.lastSyncedAt) {
+			s.lastSyncedAt = revocation.CreatedAt
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *tokenRevocationService) apply(revocation *models.TokenRevocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, applied := s.appliedIDs[revocation.RevocationID]; applied {
+		return
+	}
+	s.appliedIDs[revocation.RevocationID] = revocation.ExpiresAt
+	if revocation.JTI != nil {
+		s.revokedJTIs[*revocation.JTI] = revocation.ExpiresAt
+	}
+	if revocation.UserID != nil && revocation.IssuedBefore != nil {
+		// keep the latest cutoff, it covers every earlier one
+		if existing, ok := s.userCutoffs[*revocation.UserID]; !ok || revocation.IssuedBefore.After(existing.issuedBefore) {
+			s.userCutoffs[*revocation.UserID] = cutoff{issuedBefore: *revocation.IssuedBefore, expiresAt: revocation.ExpiresAt}
+		}
+	}
+}
+
+// longestAccessTokenTTL is how long any access token can live, impersonation tokens have their own fixed TTL
+func longestAccessTokenTTL() time.Duration {
+	ttl := utils.GetAuthConfig().AccessTokenTTL
+	if utils.ImpersonationTTL > ttl {
+		ttl = utils.ImpersonationTTL
+	}
+	return ttl
+}
+
+// cleanup drops expired entries from memory and the database, the tokens they covered are expired by now
+func (s *tokenRevocationService) cleanup() {
+	now := time.Now()
+	s.mu.Lock()
+	for revocationID, expiresAt := range s.appliedIDs {
+		if now.After(expiresAt) {
+			delete(s.appliedIDs, revocationID)
+		}
+	}
+	for jti, expiresAt := range s.revokedJTIs {
+		if now.After(expiresAt) {
+			delete(s.revokedJTIs, jti)
+		}
+	}
+	for userID, userCutoff := range s.userCutoffs {
+		if now.After(userCutoff.expiresAt) {
+			delete(s.userCutoffs, userID)
+		}
+	}
+	s.mu.Unlock()
+
+	if _, err := s.revocationRepo.DeleteExpiredRevocations(); err != nil {
+		logger.LogError(err, "Failed to clean up token revocations", map[string]interface{}{"layer": "service", "operation": "cleanup"})
+	}
+}
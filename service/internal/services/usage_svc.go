@@ -0,0 +1,158 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"service/internal/logger"
+	"service/internal/models"
+	"service/internal/repositories"
+	"time"
+)
+
+const (
+	// a usage range without since covers this many days up to until
+	defaultUsageDays = 30
+	// longest range a usage series or report covers
+	maxUsageDays   = 366
+	usageDayLayout = "2006-01-02"
+)
+
+var ErrInvalidUsageRange = errors.New("invalid usage range")
+
+// UsageService meters what users store and transfer per UTC day: bandwidth is counted as files go through,
+// storage is snapshotted by the scheduler; the rows back the usage charts and the admin reports
+type UsageService interface {
+	RecordDownload(userID int, bytes int64)
+	RecordUpload(userID int, bytes int64)
+	SnapshotStorage(now time.Time) (int64, error)
+	GetUserUsage(userID int, since, until *time.Time) (*models.UsageSeries, error)
+	Report(since, until *time.Time, limit, offset int) (*models.UsageReport, error)
+}
+
+type usageService struct {
+	usageRepo repositories.UsageRepo
+}
+
+func NewUsageService(usageRepo repositories.UsageRepo) UsageService {
+	return &usageService{usageRepo: usageRepo}
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format(usageDayLayout)
+}
+
+func (s *usageService) RecordDownload(userID int, bytes int64) {
+	s.recordTransfer(userID, bytes, 0)
+}
+
+func (s *usageService) RecordUpload(userID int, bytes int64) {
+	s.recordTransfer(userID, 0, bytes)
+}
+
+// recordTransfer counts the bytes into today's row, metering is logged on failure and never fails the transfer itself
+func (s *usageService) recordTransfer(userID int, downloadBytes, uploadBytes int64) {
+	if downloadBytes <= 0 && uploadBytes <= 0 {
+		return
+	}
+	if err := s.usageRepo.RecordTransfer(userID, usageDay(time.Now()), downloadBytes, uploadBytes); err != nil {
+		logger.LogError(err, "Failed to record usage", map[string]interface{}{"layer": "service", "operation": "recordTransfer", "userID": userID})
+	}
+}
+
+// SnapshotStorage records every user's storage for the current day, returns how many users were snapshotted
+func (s *usageService) SnapshotStorage(now time.Time) (int64, error) {
+	return s.usageRepo.SnapshotStorage(usageDay(now), now)
+}
+
+// usageRange turns the optional bounds into UTC days, until defaults to today and since to defaultUsageDays before it
+func usageRange(since, until *time.Time) (time.Time, time.Time, error) {
+	end := time.Now().UTC()
+	if until != nil {
+		end = until.UTC()
+	}
+	end = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+	start := end.AddDate(0, 0, -(defaultUsageDays - 1))
+	if since != nil {
+		start = since.UTC()
+		start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	if start.After(end) {
+		return start, end, fmt.Errorf("%w: since is after until", ErrInvalidUsageRange)
+	}
+	if days := int(end.Sub(start)/(24*time.Hour)) + 1; days > maxUsageDays {
+		return start, end, fmt.Errorf("%w: at most %d days can be asked for at once", ErrInvalidUsageRange, maxUsageDays)
+	}
+	return start, end, nil
+}
+
+// addToTotals adds a day to the totals, storage only counts when the day was snapshotted
+func addToTotals(totals *models.UsageTotals, downloadBytes, uploadBytes int64, downloads, uploads int, storageBytes *int64) {
+	totals.DownloadBytes += downloadBytes
+	totals.UploadBytes += uploadBytes
+	totals.Downloads += downloads
+	totals.Uploads += uploads
+	if storageBytes != nil {
+		totals.StorageByteDays += *storageBytes
+		totals.PeakStorageBytes = max(totals.PeakStorageBytes, *storageBytes)
+	}
+}
+
+// GetUserUsage returns the user's usage for every day of the range, days without a row are filled in without a storage snapshot
+func (s *usageService) GetUserUsage(userID int, since, until *time.Time) (*models.UsageSeries, error) {
+	start, end, err := usageRange(since, until)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.usageRepo.GetUserUsage(userID, start.Format(usageDayLayout), end.Format(usageDayLayout))
+	if err != nil {
+		return nil, errors.New("failed to get usage")
+	}
+	byDay := make(map[string]*models.UsageDay, len(rows))
+	for _, row := range rows {
+		byDay[row.Day] = row
+	}
+
+	series := &models.UsageSeries{UserID: userID, Since: start.Format(usageDayLayout), Until: end.Format(usageDayLayout), Days: []*models.UsageDay{}}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		key := day.Format(usageDayLayout)
+		row, ok := byDay[key]
+		if !ok {
+			row = &models.UsageDay{Day: key}
+		}
+		series.Days = append(series.Days, row)
+		addToTotals(&series.Totals, row.DownloadBytes, row.UploadBytes, row.Downloads, row.Uploads, row.StorageBytes)
+	}
+	return series, nil
+}
+
+// Report sums the usage of every user per day of the range and ranks the users by what they transferred
+func (s *usageService) Report(since, until *time.Time, limit, offset int) (*models.UsageReport, error) {
+	start, end, err := usageRange(since, until)
+	if err != nil {
+		return nil, err
+	}
+	limit, offset = clampPage(limit, offset)
+	sinceDay, untilDay := start.Format(usageDayLayout), end.Format(usageDayLayout)
+
+	days, err := s.usageRepo.GetUsageByDay(sinceDay, untilDay)
+	if err != nil {
+		return nil, errors.New("failed to report usage")
+	}
+	topUsers, err := s.usageRepo.ListTopUsers(sinceDay, untilDay, limit, offset)
+	if err != nil {
+		return nil, errors.New("failed to report usage")
+	}
+
+	report := &models.UsageReport{Since: sinceDay, Until: untilDay, Days: days, TopUsers: topUsers}
+	if report.Days == nil {
+		report.Days = []*models.UsageReportDay{}
+	}
+	if report.TopUsers == nil {
+		report.TopUsers = []*models.UserUsage{}
+	}
+	for _, day := range days {
+		storageBytes := day.StorageBytes
+		addToTotals(&report.Totals, day.DownloadBytes, day.UploadBytes, day.Downloads, day.Uploads, &storageBytes)
+	}
+	return report, nil
+}
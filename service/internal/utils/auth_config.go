@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// AuthConfig holds the token and session lifetimes, the jwt exp, the refresh token expired_at and the cookie max-age
+// are all derived from it so they can't drift apart
+type AuthConfig struct {
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a session lives without "remember me", RememberMeRefreshTTL with it
+	RefreshTokenTTL      time.Duration
+	RememberMeRefreshTTL time.Duration
+	// SessionAbsoluteLifetime caps a session from login on, however often it is refreshed
+	SessionAbsoluteLifetime time.Duration
+	// SessionIdleTimeout ends a session that wasn't refreshed for this long
+	SessionIdleTimeout time.Duration
+}
+
+func DefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		AccessTokenTTL:          15 * time.Minute,
+		RefreshTokenTTL:         24 * time.Hour,
+		RememberMeRefreshTTL:    30 * 24 * time.Hour,
+		SessionAbsoluteLifetime: 90 * 24 * time.Hour,
+		SessionIdleTimeout:      14 * 24 * time.Hour,
+	}
+}
+
+// LoadAuthConfig reads the lifetimes from the environment, unset values keep the defaults
+func LoadAuthConfig() (AuthConfig, error) {
+	cfg := DefaultAuthConfig()
+	durations := []struct {
+		env    string
+		target *time.Duration
+	}{
+		{"ACCESS_TOKEN_TTL", &cfg.AccessTokenTTL},
+		{"REFRESH_TOKEN_TTL", &cfg.RefreshTokenTTL},
+		{"REMEMBER_ME_REFRESH_TTL", &cfg.RememberMeRefreshTTL},
+		{"SESSION_ABSOLUTE_LIFETIME", &cfg.SessionAbsoluteLifetime},
+		{"SESSION_IDLE_TIMEOUT", &cfg.SessionIdleTimeout},
+	}
+	for _, d := range durations {
+		value := os.Getenv(d.env)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return AuthConfig{}, fmt.Errorf("invalid %s: %q", d.env, value)
+		}
+		*d.target = parsed
+	}
+
+	if cfg.AccessTokenTTL >= cfg.RefreshTokenTTL {
+		return AuthConfig{}, fmt.Errorf("ACCESS_TOKEN_TTL (%s) must be shorter than REFRESH_TOKEN_TTL (%s)", cfg.AccessTokenTTL, cfg.RefreshTokenTTL)
+	}
+	if cfg.RememberMeRefreshTTL < cfg.RefreshTokenTTL {
+		return AuthConfig{}, fmt.Errorf("REMEMBER_ME_REFRESH_TTL (%s) must not be shorter than REFRESH_TOKEN_TTL (%s)", cfg.RememberMeRefreshTTL, cfg.RefreshTokenTTL)
+	}
+	if cfg.SessionAbsoluteLifetime < cfg.RefreshTokenTTL {
+		return AuthConfig{}, fmt.Errorf("SESSION_ABSOLUTE_LIFETIME (%s) must not be shorter than REFRESH_TOKEN_TTL (%s)", cfg.SessionAbsoluteLifetime, cfg.RefreshTokenTTL)
+	}
+	return cfg, nil
+}
+
+// RefreshTokenExpiry is when a refresh token issued now for the session runs out, the earliest of the
+// refresh lifetime, the idle timeout and the absolute session lifetime
+func (cfg AuthConfig) RefreshTokenExpiry(sessionCreatedAt time.Time, rememberMe bool, now time.Time) time.Time {
+	ttl := cfg.RefreshTokenTTL
+	if rememberMe {
+		ttl = cfg.RememberMeRefreshTTL
+	}
+	if cfg.SessionIdleTimeout < ttl {
+		ttl = cfg.SessionIdleTimeout
+	}
+	expiry := now.Add(ttl)
+	if limit := sessionCreatedAt.Add(cfg.SessionAbsoluteLifetime); limit.Before(expiry) {
+		expiry = limit
+	}
+	return expiry
+}
+
+var authConfig = DefaultAuthConfig()
+
+// SetAuthConfig is called once at startup, before any token is issued
+func SetAuthConfig(cfg AuthConfig) {
+	authConfig = cfg
+}
+
+func GetAuthConfig() AuthConfig {
+	return authConfig
+}
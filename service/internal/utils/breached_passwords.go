@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// BreachedPasswordChecker reports whether a password appears in a known breach
+type BreachedPasswordChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// BreachedPasswordCorpus looks passwords up in a local copy of the Pwned Passwords list
+// ("SHA1HASH:count" per line, ordered by hash). Like the k-anonymity range api only the
+// 5 character hash prefix is searched for, then the matching range is compared locally.
+type BreachedPasswordCorpus struct {
+	file *os.File
+	size int64
+}
+
+const breachedHashPrefixLength = 5
+
+func OpenBreachedPasswordCorpus(path string) (*BreachedPasswordCorpus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		file.Close()
+		return nil, errors.New("breached password corpus is empty")
+	}
+	return &BreachedPasswordCorpus{file: file, size: info.Size()}, nil
+}
+
+func (c *BreachedPasswordCorpus) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := c.Range(hash[:breachedHashPrefixLength])
+	if err != nil {
+		return false, err
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[breachedHashPrefixLength:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Range returns the hash suffixes sharing the prefix, the same answer the online range api gives
+func (c *BreachedPasswordCorpus) Range(prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+
+	// binary search for the first line whose hash prefix is >= prefix, the file is sorted so the range follows it
+	lo, hi := int64(0), c.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		_, line, err := c.lineFrom(mid)
+		if err == io.EOF || (err == nil && linePrefix(line) >= prefix) {
+			hi = mid
+		} else if err != nil {
+			return nil, err
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	start, _, err := c.lineFrom(lo)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var suffixes []string
+	scanner := bufio.NewScanner(io.NewSectionReader(c.file, start, c.size-start))
+	for scanner.Scan() {
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if linePrefix(line) != prefix {
+			break
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		suffixes = append(suffixes, hash[breachedHashPrefixLength:])
+	}
+	return suffixes, scanner.Err()
+}
+
+// lineFrom returns the first complete line starting at or after offset
+func (c *BreachedPasswordCorpus) lineFrom(offset int64) (int64, string, error) {
+	start := offset
+	if offset > 0 {
+		// skip the rest of the line offset falls into, unless offset is exactly a line start
+		buf := make([]byte, 128)
+		n, err := c.file.ReadAt(buf, offset-1)
+		if err != nil && err != io.EOF {
+			return 0, "", err
+		}
+		newline := bytes.IndexByte(buf[:n], '\n')
+		if newline < 0 {
+			return 0, "", io.EOF
+		}
+		start = offset + int64(newline)
+	}
+	if start >= c.size {
+		return 0, "", io.EOF
+	}
+
+	buf := make([]byte, 128)
+	n, err := c.file.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	line := buf[:n]
+	if newline := bytes.IndexByte(line, '\n'); newline >= 0 {
+		line = line[:newline]
+	}
+	return start, strings.ToUpper(strings.TrimSpace(string(line))), nil
+}
+
+func linePrefix(line string) string {
+	if len(line) < breachedHashPrefixLength {
+		return line
+	}
+	return line[:breachedHashPrefixLength]
+}
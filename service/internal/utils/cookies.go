@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"net/http"
 	"os"
+	"service/internal/models"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -9,7 +13,22 @@ import (
 // later we have to have a way to set the tryout cookie so that when user is accessing the try out, the cookie doesnt expire that fast
 var cookieDomain = os.Getenv("COOKIE_DOMAIN")
 
+// every cookie gets an explicit SameSite, lax unless COOKIE_SAMESITE says strict or none (a frontend on another site needs none)
+var cookieSameSite = parseSameSite(os.Getenv("COOKIE_SAMESITE"))
+
+func parseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
 func SetCookie(c *gin.Context, name, value string, maxAge int, path, domain string, secure, httpOnly bool) {
+	c.SetSameSite(cookieSameSite)
 	c.SetCookie(
 		name,
 		value,
@@ -20,12 +39,27 @@ func SetCookie(c *gin.Context, name, value string, maxAge int, path, domain stri
 		httpOnly)
 }
 
-func SetAccessAndRefresh(c *gin.Context, accessToken, refreshToken string) error {
-	SetCookie(c, "access_token", accessToken, 15*60, "/", cookieDomain, true, true)        // access token, 15 mins
-	SetCookie(c, "refresh_token", refreshToken, 7*24*60*60, "/", cookieDomain, true, true) // refresh token, 7 days
+// SetAccessAndRefresh sets both cookies to expire together with the tokens they carry
+func SetAccessAndRefresh(c *gin.Context, tokens *models.TokenPair) error {
+	SetCookie(c, "access_token", tokens.AccessToken, maxAgeUntil(tokens.AccessExpiresAt), "/", cookieDomain, true, true)
+	SetCookie(c, "refresh_token", tokens.RefreshToken, maxAgeUntil(tokens.RefreshExpiresAt), "/", cookieDomain, true, true)
 	return nil
 }
 
+// maxAgeUntil converts an expiry to a cookie max-age, at least a second so the cookie isn't deleted right away
+func maxAgeUntil(expiresAt time.Time) int {
+	seconds := int(time.Until(expiresAt).Seconds())
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// SetMagicLinkNonce binds a magic link to the browser that asked for it, the link only works alongside this cookie
+func SetMagicLinkNonce(c *gin.Context, nonce string) {
+	SetCookie(c, "magic_link_nonce", nonce, int(MagicLinkTTL.Seconds()), "/", cookieDomain, true, true)
+}
+
 func GetCookie(c *gin.Context, name string) (string, error) {
 	cookie, err := c.Cookie(name)
 	if err != nil {
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// double submit csrf protection, the token sits in a cookie javascript can read and has to be echoed in the header,
+// a cross site form can make the browser send the cookie but can't read it to set the header
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// csrfExemptPrefixes are called by other services, never by a browser holding our cookies
+var csrfExemptPrefixes = []string{"/api/v1/internal/scheduler/", "/api/v1/billing/webhook"}
+
+// IssueCSRFToken returns the csrf token of the browser, a new one is set in the cookie when there is none yet
+// so several tabs keep sharing one token
+func IssueCSRFToken(c *gin.Context) (string, error) {
+	if token, err := c.Cookie(CSRFCookieName); err == nil && token != "" {
+		return token, nil
+	}
+	token, err := CreateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	// lives as long as the longest session so a logged in browser never loses it
+	SetCookie(c, CSRFCookieName, token, int(GetAuthConfig().SessionAbsoluteLifetime.Seconds()), "/", cookieDomain, true, false)
+	return token, nil
+}
+
+// CSRFMiddleware rejects state changing requests whose X-CSRF-Token header doesn't match the csrf cookie,
+// requests with an Authorization bearer header don't rely on cookies and are exempt
+func CSRFMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if _, ok := bearerToken(c); ok {
+			c.Next()
+			return
+		}
+		for _, prefix := range csrfExemptPrefixes {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				c.Next()
+				return
+			}
+		}
+
+		cookie, err := c.Cookie(CSRFCookieName)
+		header := c.GetHeader(CSRFHeaderName)
+		if err != nil || cookie == "" || header == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+			c.JSON(http.StatusForbidden, gin.H{"message": "CSRF token missing or invalid", "error": "send the token from GET /api/v1/user/csrf-token in the " + CSRFHeaderName + " header"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -4,54 +4,188 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wneessen/go-mail"
 )
 
+// FrontendLink builds a link into the web app, FRONTEND_URL overrides the defaults per environment
+func FrontendLink(path string) string {
+	if base := os.Getenv("FRONTEND_URL"); base != "" {
+		return base + path
+	}
+	if os.Getenv("ENVIRONMENT") == "production" {
+		return "https://tryout.omahti.web.id" + path
+	}
+	return "http://localhost:3000" + path
+}
+
 func SendPasswordResetEmail(to, resetLink string) error {
-	// Validate SMTP credentials
-	smtpUser := os.Getenv("BREVO_SMTP_USER")
-	smtpPass := os.Getenv("BREVO_SMTP_PASS")
-	smtpHost := os.Getenv("BREVO_SMTP_HOST")
-	smtpPort := getSMTPPort()
+	return sendEmail(to, `OmahTryOut <noreply-password-reset@omahti.web.id>`, "Password Reset Request - OmahTryOut",
+		fmt.Sprintf("Click this link to reset your password: %s", resetLink),
+		renderEmail("Password Reset Request",
+			"<p>We received a request to reset your password. Click the button below to set a new password:</p>",
+			"Reset Password", resetLink,
+			"<p>If you didn’t request this, please ignore this email or contact us on Instagram @omahti_ugm.</p>"))
+}
 
-	if smtpUser == "" || smtpPass == "" || smtpHost == "" {
-		return errors.New("SMTP credentials are missing")
-	}
+// SendAccountUnlockEmail is sent when too many failed logins lock the account
+func SendAccountUnlockEmail(to, unlockLink string, lockedFor time.Duration) error {
+	return sendEmail(to, `OmahTryOut <noreply-security@omahti.web.id>`, "Your account has been locked - OmahTryOut",
+		fmt.Sprintf("We locked your account for %s after too many failed login attempts. If this was you, unlock it now: %s", lockedFor, unlockLink),
+		renderEmail("Account Temporarily Locked",
+			fmt.Sprintf("<p>We noticed too many failed login attempts and locked your account for %s.</p><p>If this was you, you can unlock it right away:</p>", html.EscapeString(lockedFor.String())),
+			"Unlock Account", unlockLink,
+			"<p>If this wasn’t you, someone may be guessing your password. Consider resetting it once the lock expires.</p>"))
+}
 
-	// create a new mailer
-	mailer, err := mail.NewClient(
-		smtpHost,
-		mail.WithPort(smtpPort),
-		mail.WithSMTPAuth(mail.SMTPAuthPlain),
-		mail.WithUsername(smtpUser),
-		mail.WithPassword(smtpPass),
-		mail.WithTLSPortPolicy(mail.TLSMandatory),
-	)
-	if err != nil {
-		return err
-	}
+func SendEmailChangeConfirmationEmail(to, confirmLink string) error {
+	return sendEmail(to, `OmahTryOut <noreply-security@omahti.web.id>`, "Confirm your new email - OmahTryOut",
+		fmt.Sprintf("Click this link to confirm your new email address: %s", confirmLink),
+		renderEmail("Confirm Your New Email",
+			"<p>We received a request to use this address for your OmahTryOut account. Click the button below to confirm it:</p>",
+			"Confirm Email", confirmLink,
+			"<p>If you didn’t request this, you can ignore this email, nothing changes until it is confirmed.</p>"))
+}
 
-	msg := mail.NewMsg()
-	if err := msg.From(`OmahTryOut <noreply-password-reset@omahti.web.id>`); err != nil {
-		return err
+// SendEmailChangeNotificationEmail goes to the old address so the owner notices a change they didn't make
+func SendEmailChangeNotificationEmail(to, newEmail string) error {
+	return sendEmail(to, `OmahTryOut <noreply-security@omahti.web.id>`, "Email change requested - OmahTryOut",
+		fmt.Sprintf("Someone asked to change the email of your account to %s. If this wasn't you, reset your password right away.", newEmail),
+		renderEmail("Email Change Requested",
+			fmt.Sprintf("<p>Someone asked to change the email of your account to <b>%s</b>. The change only happens once the new address is confirmed.</p>", html.EscapeString(newEmail)),
+			"", "",
+			"<p>If this wasn’t you, reset your password right away or contact us on Instagram @omahti_ugm.</p>"))
+}
+
+func SendMagicLinkEmail(to, loginLink string, validFor time.Duration) error {
+	return sendEmail(to, `OmahTryOut <noreply-login@omahti.web.id>`, "Your login link - OmahTryOut",
+		fmt.Sprintf("Click this link to log in, it works once within %s and only in the browser you requested it from: %s", validFor, loginLink),
+		renderEmail("Log In to OmahTryOut",
+			fmt.Sprintf("<p>Click the button below to log in. The link works once, expires in %s and only in the browser you requested it from.</p>", html.EscapeString(validFor.String())),
+			"Log In", loginLink,
+			"<p>If you didn’t request this, you can ignore this email.</p>"))
+}
+
+func SendAccountDeletionScheduledEmail(to string, purgeAfter time.Time, loginLink string) error {
+	when := purgeAfter.UTC().Format("2 January 2006 15:04 MST")
+	return sendEmail(to, `OmahTryOut <noreply-security@omahti.web.id>`, "Your account is scheduled for deletion - OmahTryOut",
+		fmt.Sprintf("Your account and all your files will be deleted on %s. Changed your mind? Log in and cancel the deletion before then: %s", when, loginLink),
+		renderEmail("Account Deletion Scheduled",
+			fmt.Sprintf("<p>Your account and all your files will be permanently deleted on <b>%s</b>. You have been logged out everywhere.</p><p>Changed your mind? Log in and cancel the deletion before then.</p>", html.EscapeString(when)),
+			"Log In", loginLink,
+			"<p>If you didn’t request this, log in, cancel the deletion and change your password.</p>"))
+}
+
+func SendAccountDeletedEmail(to string) error {
+	return sendEmail(to, `OmahTryOut <noreply-security@omahti.web.id>`, "Your account has been deleted - OmahTryOut",
+		"Your OmahTryOut account and all your files have been permanently deleted.",
+		renderEmail("Account Deleted",
+			"<p>Your OmahTryOut account and all your files have been permanently deleted. This is the last email you will get from us.</p>",
+			"", "",
+			"<p>Thanks for having been with us.</p>"))
+}
+
+func SendDataExportReadyEmail(to, downloadLink string, expiresAt time.Time) error {
+	until := expiresAt.UTC().Format("2 January 2006 15:04 MST")
+	return sendEmail(to, `OmahTryOut <noreply@omahti.web.id>`, "Your data export is ready - OmahTryOut",
+		fmt.Sprintf("Your data export is ready. Download it before %s: %s", until, downloadLink),
+		renderEmail("Your Data Export Is Ready",
+			fmt.Sprintf("<p>The archive with your files and account data is ready. The link works until <b>%s</b>, after that the archive is deleted.</p>", html.EscapeString(until)),
+			"Download Export", downloadLink,
+			"<p>If you didn’t request this export, change your password, anyone with this link can download your data.</p>"))
+}
+
+// SendImpersonationNoticeEmail tells the user a support admin is looking at their account
+func SendImpersonationNoticeEmail(to, reason string, until time.Time) error {
+	when := until.UTC().Format("2 January 2006 15:04 MST")
+	return sendEmail(to, `OmahTryOut <noreply-security@omahti.web.id>`, "Support is accessing your account - OmahTryOut",
+		fmt.Sprintf("A member of our support team is viewing your account until %s to look into: %s", when, reason),
+		renderEmail("Support Is Accessing Your Account",
+			fmt.Sprintf("<p>A member of our support team is viewing your account until <b>%s</b> to look into:</p><p>%s</p>", html.EscapeString(when), html.EscapeString(reason)),
+			"", "",
+			"<p>Every action taken on your account is recorded. If you didn’t ask us for help, contact us on Instagram @omahti_ugm.</p>"))
+}
+
+// SendPlanExpiryReminderEmail warns ahead of the plan ending, sent a week and a day before
+func SendPlanExpiryReminderEmail(to, planName string, expiresAt time.Time, billingLink string) error {
+	when := expiresAt.UTC().Format("2 January 2006 15:04 MST")
+	return sendEmail(to, `OmahTryOut <noreply-billing@omahti.web.id>`, fmt.Sprintf("Your %s plan ends soon - OmahTryOut", planName),
+		fmt.Sprintf("Your %s plan ends on %s. Renew it to keep uploading and downloading your files: %s", planName, when, billingLink),
+		renderEmail("Your Plan Ends Soon",
+			fmt.Sprintf("<p>Your <b>%s</b> plan ends on <b>%s</b>.</p><p>Renew it to keep full access to the files you uploaded with it.</p>", html.EscapeString(planName), html.EscapeString(when)),
+			"Renew Plan", billingLink,
+			"<p>If you already renewed, you can ignore this email.</p>"))
+}
+
+func SendPlanExpiredEmail(to, planName, billingLink string) error {
+	return sendEmail(to, `OmahTryOut <noreply-billing@omahti.web.id>`, fmt.Sprintf("Your %s plan has ended - OmahTryOut", planName),
+		fmt.Sprintf("Your %s plan has ended and your account is back on the free plan. Upgrade again any time: %s", planName, billingLink),
+		renderEmail("Your Plan Has Ended",
+			fmt.Sprintf("<p>Your <b>%s</b> plan has ended and your account is back on the free plan.</p><p>You can upgrade again any time.</p>", html.EscapeString(planName)),
+			"Upgrade", billingLink,
+			""))
+}
+
+func SendPaymentFailedEmail(to, planName, reason, billingLink string) error {
+	return sendEmail(to, `OmahTryOut <noreply-billing@omahti.web.id>`, "Your payment didn't go through - OmahTryOut",
+		fmt.Sprintf("Your payment for the %s plan failed (%s). Try again with another payment method: %s", planName, reason, billingLink),
+		renderEmail("Payment Failed",
+			fmt.Sprintf("<p>Your payment for the <b>%s</b> plan didn’t go through:</p><p>%s</p><p>Nothing was charged. You can try again with another payment method.</p>", html.EscapeString(planName), html.EscapeString(reason)),
+			"Try Again", billingLink,
+			""))
+}
+
+// SendDowngradeNoticeEmail lists the files of a lost plan, until when they stay read only and what happens after
+func SendDowngradeNoticeEmail(to, planName string, files []string, readOnlyUntil time.Time, archived bool, filesLink string) error {
+	until := readOnlyUntil.UTC().Format("2 January 2006 15:04 MST")
+	after := "they are locked until you choose which ones to keep within your storage"
+	if archived {
+		after = "they are archived and hidden until you upgrade again"
 	}
-	if err := msg.To(to); err != nil {
-		return err
+	items := ""
+	for _, name := range files {
+		items += "<li>" + html.EscapeString(name) + "</li>"
 	}
+	return sendEmail(to, `OmahTryOut <noreply-billing@omahti.web.id>`, "Your files after the downgrade - OmahTryOut",
+		fmt.Sprintf("These files were uploaded with the %s plan you no longer have: %s. You can download or delete them until %s, after that %s. Manage them here: %s",
+			planName, strings.Join(files, ", "), until, after, filesLink),
+		renderEmail("Your Files After the Downgrade",
+			fmt.Sprintf("<p>These files were uploaded with the <b>%s</b> plan you no longer have:</p><ul>%s</ul><p>You can download or delete them until <b>%s</b>, after that %s.</p>",
+				html.EscapeString(planName), items, html.EscapeString(until), after),
+			"Manage Files", filesLink,
+			"<p>Upgrading again gives you full access to all of them.</p>"))
+}
 
-	msg.Subject("Password Reset Request - OmahTryOut")
+// SendPlanWelcomeEmail is sent when a subscription to a plan above the free one starts, expiresAt is nil for plans without an end
+func SendPlanWelcomeEmail(to, planName string, expiresAt *time.Time, filesLink string) error {
+	until := ""
+	if expiresAt != nil {
+		until = " until " + expiresAt.UTC().Format("2 January 2006 15:04 MST")
+	}
+	return sendEmail(to, `OmahTryOut <noreply-billing@omahti.web.id>`, fmt.Sprintf("Welcome to %s - OmahTryOut", planName),
+		fmt.Sprintf("Your %s plan is active%s. Enjoy the extra storage and larger uploads: %s", planName, until, filesLink),
+		renderEmail(fmt.Sprintf("Welcome to %s", planName),
+			fmt.Sprintf("<p>Your <b>%s</b> plan is active%s.</p><p>Enjoy the extra storage and larger uploads.</p>", html.EscapeString(planName), html.EscapeString(until)),
+			"Upload Files", filesLink,
+			""))
+}
 
-	// Create a formatted HTML body
-	// Create a formatted HTML body
-	htmlBody := fmt.Sprintf(`
+// renderEmail wraps the body in the shared html layout, buttonLink may be empty for emails without a call to action
+func renderEmail(title, bodyHTML, buttonText, buttonLink, footerHTML string) string {
+	button := ""
+	if buttonLink != "" {
+		button = fmt.Sprintf(`<p><a class="button" href="%s">%s</a></p>`, html.EscapeString(buttonLink), html.EscapeString(buttonText))
+	}
+	return fmt.Sprintf(`
 		<!DOCTYPE html>
 		<html>
 		<head>
-			<title>Password Reset</title>
+			<title>%s</title>
 			<style>
 				.container {
 					width: 100%%;
@@ -82,18 +216,53 @@ func SendPasswordResetEmail(to, resetLink string) error {
 		</head>
 		<body>
 			<div class="container">
-				<h2>Password Reset Request</h2>
-				<p>We received a request to reset your password. Click the button below to set a new password:</p>
-				<p><a class="button" href="%s">Reset Password</a></p>
-				<p>If you didn’t request this, please ignore this email or contact us on Instagram @omahti_ugm.</p>
+				<h2>%s</h2>
+				%s
+				%s
+				%s
 				<div class="footer">
 					<p>Best regards,<br>OmahTI</p>
 				</div>
 			</div>
 		</body>
-		</html>`, resetLink)
+		</html>`, html.EscapeString(title), html.EscapeString(title), bodyHTML, button, footerHTML)
+}
+
+// sendEmail sends a plain text + html email through the brevo smtp relay
+func sendEmail(to, from, subject, plainBody, htmlBody string) error {
+	// Validate SMTP credentials
+	smtpUser := os.Getenv("BREVO_SMTP_USER")
+	smtpPass := os.Getenv("BREVO_SMTP_PASS")
+	smtpHost := os.Getenv("BREVO_SMTP_HOST")
+	smtpPort := getSMTPPort()
+
+	if smtpUser == "" || smtpPass == "" || smtpHost == "" {
+		return errors.New("SMTP credentials are missing")
+	}
+
+	// create a new mailer
+	mailer, err := mail.NewClient(
+		smtpHost,
+		mail.WithPort(smtpPort),
+		mail.WithSMTPAuth(mail.SMTPAuthPlain),
+		mail.WithUsername(smtpUser),
+		mail.WithPassword(smtpPass),
+		mail.WithTLSPortPolicy(mail.TLSMandatory),
+	)
+	if err != nil {
+		return err
+	}
+
+	msg := mail.NewMsg()
+	if err := msg.From(from); err != nil {
+		return err
+	}
+	if err := msg.To(to); err != nil {
+		return err
+	}
 
-	msg.SetBodyString(mail.TypeTextPlain, fmt.Sprintf("Click this link to reset your password: %s", resetLink))
+	msg.Subject(subject)
+	msg.SetBodyString(mail.TypeTextPlain, plainBody)
 	msg.SetBodyString(mail.TypeTextHTML, htmlBody)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
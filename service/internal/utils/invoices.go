@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"service/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invoices are issued by the same company that sends the emails
+const (
+	invoiceSellerName   = "OmahTryOut"
+	invoiceSellerDetail = "tryout.omahti.web.id"
+	invoiceDateLayout   = "2006-01-02"
+)
+
+// currencies without a minor unit, every other one has cents
+var zeroDecimalCurrencies = map[string]bool{"JPY": true, "KRW": true, "VND": true, "CLP": true}
+
+// FormatAmount turns an amount in the smallest currency unit into e.g. "USD 4.99"
+func FormatAmount(amount int64, currency string) string {
+	currency = strings.ToUpper(currency)
+	if zeroDecimalCurrencies[currency] {
+		return fmt.Sprintf("%s %d", currency, amount)
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s %s%d.%02d", currency, sign, amount/100, amount%100)
+}
+
+func formatTaxRate(bps int) string {
+	return strconv.FormatFloat(float64(bps)/100, 'f', -1, 64) + "%"
+}
+
+func formatInvoicePeriod(line *models.InvoiceLine) string {
+	if line.PeriodStart == nil {
+		return ""
+	}
+	if line.PeriodEnd == nil {
+		return "from " + line.PeriodStart.Format(invoiceDateLayout)
+	}
+	return line.PeriodStart.Format(invoiceDateLayout) + " - " + line.PeriodEnd.Format(invoiceDateLayout)
+}
+
+func invoiceStatusText(invoice *models.Invoice) string {
+	if invoice.Status == models.InvoiceRefunded && invoice.RefundedAt != nil {
+		return "Refunded on " + invoice.RefundedAt.Format(invoiceDateLayout)
+	}
+	return strings.ToUpper(invoice.Status[:1]) + invoice.Status[1:]
+}
+
+// RenderInvoiceHTML renders a standalone printable page for the invoice
+func RenderInvoiceHTML(invoice *models.Invoice) string {
+	var lines strings.Builder
+	for _, line := range invoice.Lines {
+		fmt.Fprintf(&lines, "<tr><td>%s</td><td>%s</td><td class=\"num\">%d</td><td class=\"num\">%s</td><td class=\"num\">%s</td></tr>",
+			html.EscapeString(line.Description), html.EscapeString(formatInvoicePeriod(line)), line.Quantity,
+			html.EscapeString(FormatAmount(line.UnitAmount, invoice.Currency)), html.EscapeString(FormatAmount(line.Amount, invoice.Currency)))
+	}
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Invoice %s</title>
+	<style>
+		body { font-family: Arial, sans-serif; color: #222; }
+		.container { max-width: 720px; margin: 0 auto; padding: 32px; }
+		.header { display: flex; justify-content: space-between; }
+		table { width: 100%%; border-collapse: collapse; margin-top: 24px; }
+		th, td { padding: 8px; border-bottom: 1px solid #ddd; text-align: left; }
+		.num { text-align: right; }
+		.totals td { border: none; }
+		.footer { margin-top: 32px; font-size: 12px; color: #666; }
+	</style>
+</head>
+<body>
+	<div class="container">
+		<div class="header">
+			<h1>Invoice</h1>
+			<p><b>%s</b><br>%s</p>
+		</div>
+		<p>
+			Invoice number: <b>%s</b><br>
+			Issued: %s<br>
+			Status: %s<br>
+			Billed to: %s
+		</p>
+		<table>
+			<tr><th>Description</th><th>Period</th><th class="num">Qty</th><th class="num">Unit price</th><th class="num">Amount</th></tr>
+			%s
+		</table>
+		<table class="totals">
+			<tr><td></td><td class="num">Subtotal</td><td class="num">%s</td></tr>
+			<tr><td></td><td class="num">Tax (%s)</td><td class="num">%s</td></tr>
+			<tr><td></td><td class="num"><b>Total</b></td><td class="num"><b>%s</b></td></tr>
+		</table>
+		<div class="footer">
+			<p>Prices include tax. Paid through %s.</p>
+		</div>
+	</div>
+</body>
+</html>`,
+		html.EscapeString(invoice.InvoiceNumber),
+		html.EscapeString(invoiceSellerName), html.EscapeString(invoiceSellerDetail),
+		html.EscapeString(invoice.InvoiceNumber), invoice.IssuedAt.Format(invoiceDateLayout),
+		html.EscapeString(invoiceStatusText(invoice)), html.EscapeString(invoice.BillingEmail),
+		lines.String(),
+		html.EscapeString(FormatAmount(invoice.Subtotal, invoice.Currency)),
+		html.EscapeString(formatTaxRate(invoice.TaxRateBps)), html.EscapeString(FormatAmount(invoice.TaxAmount, invoice.Currency)),
+		html.EscapeString(FormatAmount(invoice.Total, invoice.Currency)),
+		html.EscapeString(invoice.Provider))
+}
+
+// RenderInvoicePDF renders the invoice as a single page A4 pdf with the standard helvetica fonts, so no font files are needed
+func RenderInvoicePDF(invoice *models.Invoice) []byte {
+	page := &pdfPage{}
+	page.text(50, 780, 22, true, "Invoice")
+	page.text(380, 785, 12, true, invoiceSellerName)
+	page.text(380, 770, 9, false, invoiceSellerDetail)
+
+	page.text(50, 735, 10, false, "Invoice number: "+invoice.InvoiceNumber)
+	page.text(50, 720, 10, false, "Issued: "+invoice.IssuedAt.Format(invoiceDateLayout))
+	page.text(50, 705, 10, false, "Status: "+invoiceStatusText(invoice))
+	page.text(50, 690, 10, false, "Billed to: "+invoice.BillingEmail)
+
+	y := 650.0
+	page.text(50, y, 10, true, "Description")
+	page.text(230, y, 10, true, "Period")
+	page.text(380, y, 10, true, "Qty")
+	page.text(415, y, 10, true, "Unit price")
+	page.text(490, y, 10, true, "Amount")
+	page.line(50, y-6, 545, y-6)
+	for _, line := range invoice.Lines {
+		y -= 20
+		page.text(50, y, 10, false, truncate(line.Description, 32))
+		page.text(230, y, 9, false, formatInvoicePeriod(line))
+		page.text(380, y, 10, false, strconv.Itoa(line.Quantity))
+		page.text(415, y, 10, false, FormatAmount(line.UnitAmount, invoice.Currency))
+		page.text(490, y, 10, false, FormatAmount(line.Amount, invoice.Currency))
+	}
+	page.line(50, y-8, 545, y-8)
+
+	y -= 28
+	page.text(380, y, 10, false, "Subtotal")
+	page.text(490, y, 10, false, FormatAmount(invoice.Subtotal, invoice.Currency))
+	y -= 16
+	page.text(380, y, 10, false, "Tax ("+formatTaxRate(invoice.TaxRateBps)+")")
+	page.text(490, y, 10, false, FormatAmount(invoice.TaxAmount, invoice.Currency))
+	y -= 18
+	page.text(380, y, 11, true, "Total")
+	page.text(490, y, 11, true, FormatAmount(invoice.Total, invoice.Currency))
+
+	page.text(50, 60, 8, false, "Prices include tax. Paid through "+invoice.Provider+". Generated "+time.Now().UTC().Format(invoiceDateLayout)+".")
+	return page.render()
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max-3] + "..."
+}
+
+// pdfPage collects the drawing operators of one page, F1 is helvetica and F2 helvetica bold
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, x, y, pdfEscape(s))
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&p.content, "0.5 w %.1f %.1f m %.1f %.1f l S\n", x1, y1, x2, y2)
+}
+
+// render writes the document with its cross reference table, objects are numbered in the order they are written
+func (p *pdfPage) render() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()),
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape escapes a string literal, characters outside ascii are replaced since the standard fonts can't be relied on for them
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// supported asymmetric signing algorithms, picked with JWT_SIGNING_ALG (defaults to EdDSA)
+const (
+	SigningAlgRS256 = "RS256"
+	SigningAlgEdDSA = "EdDSA"
+)
+
+var (
+	jwtIssuer   = getEnvOrDefault("JWT_ISSUER", "dalam-kemasan-service")
+	jwtAudience = getEnvOrDefault("JWT_AUDIENCE", "dalam-kemasan")
+
+	keyProviderMu sync.RWMutex
+	keyProvider   KeyProvider
+)
+
+// SigningKey is a parsed key pair identified by its kid
+type SigningKey struct {
+	KeyID      string
+	Algorithm  string
+	PrivateKey crypto.Signer
+}
+
+// KeyProvider hands out the current signing key and looks up verification keys by kid (implemented by the key manager service)
+type KeyProvider interface {
+	CurrentSigningKey() (*SigningKey, error)
+	VerificationKey(kid string) (*SigningKey, error)
+}
+
+// SetKeyProvider wires the key manager into the token helpers, must be called before any token is created or validated
+func SetKeyProvider(provider KeyProvider) {
+	keyProviderMu.Lock()
+	defer keyProviderMu.Unlock()
+	keyProvider = provider
+}
+
+func getKeyProvider() (KeyProvider, error) {
+	keyProviderMu.RLock()
+	defer keyProviderMu.RUnlock()
+	if keyProvider == nil {
+		return nil, errors.New("jwt key provider is not configured")
+	}
+	return keyProvider, nil
+}
+
+// SigningMethod returns the jwt library signing method for the key's algorithm
+func (k *SigningKey) SigningMethod() jwt.SigningMethod {
+	if k.Algorithm == SigningAlgRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// GenerateSigningKey creates a new key pair for the given algorithm with a random kid
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	kid, err := CreateRandomID()
+	if err != nil {
+		return nil, err
+	}
+
+	var privateKey crypto.Signer
+	switch algorithm {
+	case SigningAlgRS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case SigningAlgEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{KeyID: kid, Algorithm: algorithm, PrivateKey: privateKey}, nil
+}
+
+// MarshalPrivateKeyPEM encodes the private key as PKCS#8 PEM for storage
+func MarshalPrivateKeyPEM(key *SigningKey) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParsePrivateKeyPEM is the reverse of MarshalPrivateKeyPEM
+func ParsePrivateKeyPEM(kid, algorithm, privateKeyPEM string) (*SigningKey, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, errors.New("invalid private key pem")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if algorithm != SigningAlgRS256 {
+			return nil, fmt.Errorf("key %s is rsa but algorithm is %s", kid, algorithm)
+		}
+		return &SigningKey{KeyID: kid, Algorithm: algorithm, PrivateKey: key}, nil
+	case ed25519.PrivateKey:
+		if algorithm != SigningAlgEdDSA {
+			return nil, fmt.Errorf("key %s is ed25519 but algorithm is %s", kid, algorithm)
+		}
+		return &SigningKey{KeyID: kid, Algorithm: algorithm, PrivateKey: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type for key %s", kid)
+	}
+}
+
+// JWK is the public part of a signing key as published on /.well-known/jwks.json
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// PublicJWK converts the public half of the key to a JWK
+func (k *SigningKey) PublicJWK() JWK {
+	jwk := JWK{KeyID: k.KeyID, Use: "sig", Algorithm: k.Algorithm}
+	switch pub := k.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk
+}
+
+func getEnvOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
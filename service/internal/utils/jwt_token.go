@@ -1,45 +1,123 @@
 package utils
 
 import (
-	"os"
+	"errors"
 	"time"
 
 	"crypto/rand"
 	"encoding/hex"
+	"service/internal/models"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtAccessSecretKey = []byte(os.Getenv("JWT_ACCESS_SECRET"))
+// ImpersonationTTL is fixed and short, an impersonation token can't be refreshed and has to be started again
+const ImpersonationTTL = 10 * time.Minute
 
 type AccessTokenClaims struct {
-	UserID   int    `json:"user_id"`
-	Email    string `json:"email"`
-	Username string `json:"username"`
-	Package  string `json:"package"` // Added field for user package type
+	UserID      int          `json:"user_id"`
+	Email       string       `json:"email"`
+	Username    string       `json:"username"`
+	Package     string       `json:"package"`       // Added field for user package type
+	SessionID   string       `json:"sid"`           // session (refresh token chain) the access token was issued for
+	Role        string       `json:"role"`          // user, support or admin
+	Permissions []string     `json:"perms"`         // what the role may do at issue time, checked by RequirePermission
+	Actor       *ActorClaims `json:"act,omitempty"` // only on impersonation tokens, the admin acting as the user
 	jwt.RegisteredClaims
 }
 
-// Create AccessToken for the user to later be sent via cookies to the frontend (used for authentication and authorization)
-func CreateAccessToken(userID int, username, email, userPackage string) (string, error) { // Added userPackage parameter
-	expirationTime := time.Now().Add(15 * time.Minute)
+// ActorClaims is the "act" claim of RFC 8693, who is really behind an impersonation token
+type ActorClaims struct {
+	UserID      int    `json:"user_id"`
+	Email       string `json:"email"`
+	AllowWrites bool   `json:"allow_writes"` // write requests are refused unless the impersonation was started with this
+}
+
+// IsImpersonation reports whether the token was issued to an admin acting as the user
+func (c *AccessTokenClaims) IsImpersonation() bool {
+	return c.Actor != nil
+}
+
+// Create AccessToken for the user to later be sent via cookies to the frontend (used for authentication and authorization),
+// the expiry is returned so the cookie max-age matches the exp claim
+func CreateAccessToken(user *models.User, sessionID string) (string, time.Time, error) {
+	expirationTime := time.Now().Add(GetAuthConfig().AccessTokenTTL)
+	// jti lets a single access token be put on the revocation denylist (logout)
+	tokenID, err := CreateRandomID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
 	claims := AccessTokenClaims{
-		UserID:   userID,
-		Email:    email,
-		Username: username,
-		Package:  userPackage, // Set the package claim
+		UserID:      user.UserID,
+		Email:       user.Email,
+		Username:    user.Username,
+		Package:     user.Package, // Set the package claim
+		SessionID:   sessionID,
+		Role:        user.Role,
+		Permissions: models.PermissionsForRole(user.Role),
 		// RegisteredClaims is a struct that contains the standard claims (exp, iat, nbf, iss, aud, sub, jti)
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    jwtIssuer,
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ID:        tokenID,
+		},
+	}
+	token, err := signAccessToken(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expirationTime, nil
+}
+
+// CreateImpersonationToken issues a short lived access token for user carrying actor in the act claim,
+// it has no session and no permissions so it can't reach admin routes or be refreshed
+func CreateImpersonationToken(user, actor *models.User, allowWrites bool) (string, *AccessTokenClaims, error) {
+	tokenID, err := CreateRandomID()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	claims := AccessTokenClaims{
+		UserID:   user.UserID,
+		Email:    user.Email,
+		Username: user.Username,
+		Package:  user.Package,
+		Role:     user.Role,
+		Actor:    &ActorClaims{UserID: actor.UserID, Email: actor.Email, AllowWrites: allowWrites},
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ImpersonationTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    jwtIssuer,
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ID:        tokenID,
 		},
 	}
+	token, err := signAccessToken(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &claims, nil
+}
+
+func signAccessToken(claims AccessTokenClaims) (string, error) {
+	// get the current signing key from the key manager
+	provider, err := getKeyProvider()
+	if err != nil {
+		return "", err
+	}
+	signingKey, err := provider.CurrentSigningKey()
+	if err != nil {
+		return "", err
+	}
 
-	// Create a new token with the claims and the signing method
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	// Create a new token with the claims and the signing method, the kid header tells verifiers which public key to use
+	token := jwt.NewWithClaims(signingKey.SigningMethod(), claims)
+	token.Header["kid"] = signingKey.KeyID
 
-	// Sign the token with the secret key
-	return token.SignedString(jwtAccessSecretKey)
+	// Sign the token with the private key
+	return token.SignedString(signingKey.PrivateKey)
 }
 
 // Create an opaque refresh token (doesn't contain any credentials, just for refreshing purpose) for the user to later be stored in the database (used for refreshing the access token)
@@ -56,10 +134,32 @@ func CreateRefreshToken() (string, error) {
 // Validate AccessToken to check if it's valid, returns a pointer to AccessTokenClaims if valid
 func ValidateAccessToken(accessToken string) (*AccessTokenClaims, error) {
 
-	// Parse the token, use the accessToken to extract the claims into the AccessTokenClaims struct, and validate the token using the secret key in our .env file
+	provider, err := getKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the token, use the accessToken to extract the claims into the AccessTokenClaims struct, and validate the token using the public key picked by the kid header
 	token, err := jwt.ParseWithClaims(accessToken, &AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtAccessSecretKey, nil // lookup function to get the secret key
-	})
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, errors.New("token has no kid header")
+		}
+		verificationKey, err := provider.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// the alg header must match the key, otherwise someone could swap the algorithm
+		if token.Method.Alg() != verificationKey.Algorithm {
+			return nil, errors.New("token algorithm does not match the key")
+		}
+		return verificationKey.PrivateKey.Public(), nil // lookup function to get the public key
+	},
+		jwt.WithValidMethods([]string{SigningAlgRS256, SigningAlgEdDSA}),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithAudience(jwtAudience),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil {
 		return nil, err
@@ -74,6 +174,31 @@ func ValidateAccessToken(accessToken string) (*AccessTokenClaims, error) {
 	return nil, jwt.ErrTokenInvalidClaims
 }
 
+// Create a random 128 bit identifier (session ids, jwt kid and jti)
+func CreateRandomID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// MagicLinkTTL is kept short, the emailed link logs in without a password
+const MagicLinkTTL = 10 * time.Minute
+
+// CreateMagicLinkToken returns the emailed login token and the nonce that binds it to the requesting browser
+func CreateMagicLinkToken() (string, string, time.Time, error) {
+	token, err := CreateRefreshToken()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	nonce, err := CreateRandomID()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return token, nonce, time.Now().Add(MagicLinkTTL), nil
+}
+
 func CreateResetToken() (string, time.Time, error) {
 	resetToken, err := CreateRefreshToken()
 	if err != nil {
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// prefix of stored private keys sealed with the key encryption key, bumped if the scheme ever changes
+const encryptedKeyPrefix = "v1:"
+
+// LoadKeyEncryptionKey reads JWT_KEY_ENCRYPTION_KEY, the base64 AES-256 key the signing keys are encrypted with in the database
+func LoadKeyEncryptionKey() ([]byte, error) {
+	value := os.Getenv("JWT_KEY_ENCRYPTION_KEY")
+	if value == "" {
+		return nil, errors.New("JWT_KEY_ENCRYPTION_KEY is required")
+	}
+	kek, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEY_ENCRYPTION_KEY: %w", err)
+	}
+	if len(kek) != 32 {
+		return nil, fmt.Errorf("JWT_KEY_ENCRYPTION_KEY must be 32 bytes, got %d", len(kek))
+	}
+	return kek, nil
+}
+
+// EncryptPrivateKey seals the private key pem with AES-GCM, the kid is bound as additional data so rows can't be swapped
+func EncryptPrivateKey(kek []byte, kid, privateKeyPEM string) (string, error) {
+	gcm, err := newKeyCipher(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(privateKeyPEM), []byte(kid))
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptPrivateKey is the reverse of EncryptPrivateKey
+func DecryptPrivateKey(kek []byte, kid, encrypted string) (string, error) {
+	if !strings.HasPrefix(encrypted, encryptedKeyPrefix) {
+		return "", fmt.Errorf("key %s is not encrypted", kid)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, encryptedKeyPrefix))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newKeyCipher(kek)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("key %s is truncated", kid)
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(kid))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt key %s: %w", kid, err)
+	}
+	return string(plaintext), nil
+}
+
+func newKeyCipher(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -17,13 +17,17 @@ func ReqLoggingMiddleware() gin.HandlerFunc {
 
 		duration := time.Since(start)
 
-		logger.Log.Info().
+		event := logger.Log.Info().
 			Str("method", c.Request.Method).
 			Str("path", c.Request.URL.Path).
 			Int("status", c.Writer.Status()).
 			Dur("duration", duration).
-			Str("ip_address", c.ClientIP()).
-			Msg("Request processed")
+			Str("ip_address", c.ClientIP())
+		// requests made by an admin acting as a user are tagged so they can't be mistaken for the user's own
+		if impersonatorID, ok := c.Get("impersonator_id"); ok {
+			event = event.Bool("impersonated", true).Interface("impersonator_id", impersonatorID)
+		}
+		event.Msg("Request processed")
 	}
 }
 
@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// PasswordStrength is a zxcvbn-style estimate: the password is split into the cheapest mix of known patterns
+// (common passwords, the user's own details, sequences, repeats, years) and brute-forced characters
+type PasswordStrength struct {
+	Guesses float64 // estimated guesses an attacker needs
+	Score   int     // 0 (too guessable) .. 4 (very unguessable), same thresholds as zxcvbn
+}
+
+// common passwords and words, ordered roughly by frequency, the rank is what makes an earlier entry cheaper to guess
+var commonPasswords = []string{
+	"password", "123456", "12345678", "qwerty", "123456789", "12345", "1234", "111111", "1234567", "dragon",
+	"123123", "baseball", "abc123", "football", "monkey", "letmein", "696969", "shadow", "master", "666666",
+	"qwertyuiop", "123321", "mustang", "1234567890", "michael", "654321", "superman", "1qaz2wsx", "7777777", "121212",
+	"000000", "qazwsx", "123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou", "2000", "charlie",
+	"robert", "thomas", "hockey", "ranger", "daniel", "starwars", "klaster", "112233", "george", "computer",
+	"michelle", "jessica", "pepper", "1111", "zxcvbn", "555555", "11111111", "131313", "freedom", "777777",
+	"pass", "maggie", "159753", "aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+	"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access", "yankees", "987654321", "dallas",
+	"austin", "thunder", "taylor", "matrix", "welcome", "admin", "login", "secret", "qwerty123", "passw0rd",
+	"indonesia", "jakarta", "sayang", "bismillah", "cinta", "rahasia", "omahti", "tryout", "ugm", "yogyakarta",
+}
+
+var commonPasswordRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, word := range commonPasswords {
+		ranks[word] = i + 1
+	}
+	return ranks
+}()
+
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm", "1234567890"}
+
+var leetSubstitutions = map[rune]rune{'@': 'a', '4': 'a', '0': 'o', '1': 'i', '!': 'i', '3': 'e', '$': 's', '5': 's', '7': 't', '8': 'b'}
+
+type passwordMatch struct {
+	start, end int // rune indexes, end exclusive
+	guesses    float64
+}
+
+// EstimatePasswordStrength scores a password, userInputs (email, username) count as the cheapest words of all
+func EstimatePasswordStrength(password string, userInputs ...string) PasswordStrength {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return PasswordStrength{Guesses: 1, Score: 0}
+	}
+
+	var matches []passwordMatch
+	matches = append(matches, dictionaryMatches(runes, userInputs)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+
+	// cheapest cover of the password in log10 guesses, every uncovered character costs a brute force guess
+	bruteForcePerChar := math.Log10(float64(passwordCardinality(runes)))
+	best := make([]float64, len(runes)+1)
+	for end := 1; end <= len(runes); end++ {
+		best[end] = best[end-1] + bruteForcePerChar
+		for _, match := range matches {
+			if match.end == end {
+				// every extra pattern also has to be guessed in combination, like zxcvbn's sequence penalty
+				if cost := best[match.start] + math.Log10(match.guesses) + math.Log10(2); cost < best[end] {
+					best[end] = cost
+				}
+			}
+		}
+	}
+
+	log10Guesses := best[len(runes)]
+	return PasswordStrength{Guesses: math.Pow(10, log10Guesses), Score: strengthScore(log10Guesses)}
+}
+
+func strengthScore(log10Guesses float64) int {
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func passwordCardinality(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	cardinality := 0
+	if lower {
+		cardinality += 26
+	}
+	if upper {
+		cardinality += 26
+	}
+	if digit {
+		cardinality += 10
+	}
+	if symbol {
+		cardinality += 33
+	}
+	if other {
+		cardinality += 100
+	}
+	return cardinality
+}
+
+// dictionaryMatches finds common passwords and the user's own details anywhere in the password,
+// also through capitalisation and leet substitutions (p@ssw0rd)
+func dictionaryMatches(runes []rune, userInputs []string) []passwordMatch {
+	ranks := commonPasswordRanks
+	if len(userInputs) > 0 {
+		ranks = make(map[string]int, len(commonPasswordRanks)+len(userInputs)*2)
+		for word, rank := range commonPasswordRanks {
+			ranks[word] = rank
+		}
+		for _, input := range userInputs {
+			for _, word := range userInputWords(input) {
+				ranks[word] = 1
+			}
+		}
+	}
+
+	lowered := []rune(strings.ToLower(string(runes)))
+	unleeted := make([]rune, len(lowered))
+	for i, r := range lowered {
+		if sub, ok := leetSubstitutions[r]; ok {
+			unleeted[i] = sub
+		} else {
+			unleeted[i] = r
+		}
+	}
+
+	var matches []passwordMatch
+	for start := 0; start < len(runes); start++ {
+		for end := start + 3; end <= len(runes); end++ {
+			word := string(lowered[start:end])
+			rank, ok := ranks[word]
+			leet := false
+			if !ok {
+				if rank, ok = ranks[string(unleeted[start:end])]; !ok {
+					continue
+				}
+				leet = true
+			}
+			guesses := float64(rank) * uppercaseVariations(runes[start:end])
+			if leet {
+				guesses *= 2
+			}
+			matches = append(matches, passwordMatch{start: start, end: end, guesses: guesses})
+		}
+	}
+	return matches
+}
+
+// userInputWords splits an email or username into the parts someone would reuse in a password
+func userInputWords(input string) []string {
+	input = strings.ToLower(strings.TrimSpace(input))
+	parts := strings.FieldsFunc(input, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	words := []string{}
+	if local, _, found := strings.Cut(input, "@"); found && len(local) >= 3 {
+		words = append(words, local)
+	}
+	for _, part := range parts {
+		if len([]rune(part)) >= 3 {
+			words = append(words, part)
+		}
+	}
+	return words
+}
+
+func uppercaseVariations(runes []rune) float64 {
+	upper := 0
+	for _, r := range runes {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case upper == 1 && unicode.IsUpper(runes[0]), upper == len(runes):
+		// "Password" and "PASSWORD" are the first things tried
+		return 2
+	default:
+		return math.Pow(2, float64(upper))
+	}
+}
+
+// sequenceMatches finds runs like abcd, 4321 and keyboard rows like qwerty or asdf
+func sequenceMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+	lowered := []rune(strings.ToLower(string(runes)))
+
+	for start := 0; start < len(lowered)-2; {
+		delta := lowered[start+1] - lowered[start]
+		end := start + 1
+		if delta == 1 || delta == -1 {
+			for end+1 < len(lowered) && lowered[end+1]-lowered[end] == delta {
+				end++
+			}
+		}
+		if length := end - start + 1; length >= 3 {
+			matches = append(matches, passwordMatch{start: start, end: end + 1, guesses: 26 * float64(length)})
+			start = end
+			continue
+		}
+		start++
+	}
+
+	for _, row := range keyboardRows {
+		for start := 0; start < len(lowered)-2; start++ {
+			length := 0
+			for length < len(lowered)-start && strings.ContainsRune(row, lowered[start+length]) &&
+				(length == 0 || strings.Index(row, string(lowered[start+length])) == strings.Index(row, string(lowered[start+length-1]))+1) {
+				length++
+			}
+			if length >= 3 {
+				matches = append(matches, passwordMatch{start: start, end: start + length, guesses: float64(len(keyboardRows)) * 10 * float64(length)})
+			}
+		}
+	}
+	return matches
+}
+
+// repeatMatches finds aaaa and abcabc, priced as the repeated unit times the number of repeats
+func repeatMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+	cardinality := float64(passwordCardinality(runes))
+	for start := 0; start < len(runes); start++ {
+		for unit := 1; unit <= (len(runes)-start)/2; unit++ {
+			repeats := 1
+			for start+(repeats+1)*unit <= len(runes) && string(runes[start+repeats*unit:start+(repeats+1)*unit]) == string(runes[start:start+unit]) {
+				repeats++
+			}
+			if repeats >= 2 && repeats*unit >= 3 {
+				guesses := math.Pow(cardinality, float64(unit)) * float64(repeats)
+				matches = append(matches, passwordMatch{start: start, end: start + repeats*unit, guesses: guesses})
+			}
+		}
+	}
+	return matches
+}
+
+// yearMatches finds 1900-2049, years are the most common thing appended to a password
+func yearMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+	for start := 0; start+4 <= len(runes); start++ {
+		year := string(runes[start : start+4])
+		if (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && isDigits(year) && year < "2050" {
+			matches = append(matches, passwordMatch{start: start, end: start + 4, guesses: 150})
+		}
+	}
+	return matches
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"service/internal/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SchedulerTokenHeader carries the shared secret dkron sends with every job request
+const SchedulerTokenHeader = "X-Scheduler-Token"
+
+// RequireSchedulerToken only lets through requests carrying SCHEDULER_TOKEN, the scheduler endpoints purge accounts and
+// prune the audit log so without a configured token every request is refused
+func RequireSchedulerToken() gin.HandlerFunc {
+	token := []byte(os.Getenv("SCHEDULER_TOKEN"))
+	if len(token) == 0 {
+		logger.Log.Warn().Msg("SCHEDULER_TOKEN is not set, scheduler endpoints refuse every request")
+	}
+	return func(c *gin.Context) {
+		sent := []byte(c.GetHeader(SchedulerTokenHeader))
+		if len(token) == 0 || subtle.ConstantTimeCompare(sent, token) != 1 {
+			logger.Log.Warn().Str("path", c.FullPath()).Str("client_ip", c.ClientIP()).Msg("Unauthorized scheduler request")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
+
+// optional server-side pepper, when set the token hash becomes an HMAC so a leaked database alone can't be brute forced
+var tokenHashPepper = []byte(os.Getenv("TOKEN_HASH_PEPPER"))
+
+// HashToken hashes an opaque bearer token (refresh token, reset token) so only the digest is stored in the database
+func HashToken(token string) string {
+	if len(tokenHashPepper) == 0 {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, tokenHashPepper)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
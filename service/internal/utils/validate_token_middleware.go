@@ -2,22 +2,68 @@ package utils
 
 import (
 	"net/http"
+	"service/internal/models"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func ValidateAccessTokenMiddleware() gin.HandlerFunc {
+// auth methods stored in the context under "auth_method"
+const (
+	AuthMethodSession             = "session"
+	AuthMethodPersonalAccessToken = "personal_access_token"
+	AuthMethodImpersonation       = "impersonation"
+)
+
+// ImpersonationEndRoute is the one write request an impersonation token may always make
+const ImpersonationEndRoute = "/api/v1/auth/impersonation/end"
+
+// SessionValidator reports whether the login session an access token belongs to is still active (not logged out or revoked)
+type SessionValidator interface {
+	IsSessionActive(sessionID string) bool
+}
+
+// TokenRevocationChecker reports whether an otherwise valid access token has been put on the denylist
+type TokenRevocationChecker interface {
+	IsAccessTokenRevoked(claims *AccessTokenClaims) bool
+}
+
+// PersonalAccessTokenValidator resolves a personal access token (Authorization: Bearer dkpat_...) to its user
+type PersonalAccessTokenValidator interface {
+	ValidatePersonalAccessToken(rawToken string) (*models.User, *models.PersonalAccessToken, error)
+}
+
+// ImpersonationRecorder writes every request made with an impersonation token to the audit log
+type ImpersonationRecorder interface {
+	RecordImpersonatedRequest(claims *AccessTokenClaims, client models.ClientInfo, method, path string, status int)
+}
+
+// AuthValidators groups what the auth middleware checks a request against,
+// leaving PersonalAccessTokens or Impersonations nil makes the middleware reject that kind of token
+type AuthValidators struct {
+	Sessions             SessionValidator
+	Revocations          TokenRevocationChecker
+	PersonalAccessTokens PersonalAccessTokenValidator
+	Impersonations       ImpersonationRecorder
+}
+
+func ValidateAccessTokenMiddleware(validators AuthValidators) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.URL.Path == "/auth/logout" {
 			c.Next()
 			return
 		}
-		// get the access token from the context cookie sent by the client
-		accessToken, err := c.Cookie("access_token")
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get access token"})
-			c.Abort()
-			return
+
+		// scripts send "Authorization: Bearer <token>", browsers send the access_token cookie
+		accessToken, fromHeader := bearerToken(c)
+		if !fromHeader {
+			cookie, err := c.Cookie("access_token")
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to get access token"})
+				c.Abort()
+				return
+			}
+			accessToken = cookie
 		}
 		if accessToken == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Access token is required"})
@@ -25,6 +71,11 @@ func ValidateAccessTokenMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if fromHeader && strings.HasPrefix(accessToken, "dkpat_") {
+			authenticatePersonalAccessToken(c, validators.PersonalAccessTokens, accessToken)
+			return
+		}
+
 		// validate the access token using the ValidateAccessToken function in the same utils package
 		accessTokenClaims, err := ValidateAccessToken(accessToken)
 		if err != nil {
@@ -33,12 +84,161 @@ func ValidateAccessTokenMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// logged out, password reset or package changed since the token was issued
+		if validators.Revocations.IsAccessTokenRevoked(accessTokenClaims) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Access token has been revoked"})
+			c.Abort()
+			return
+		}
+
+		// a revoked session kills its access tokens right away instead of waiting for them to expire
+		if accessTokenClaims.SessionID != "" && !validators.Sessions.IsSessionActive(accessTokenClaims.SessionID) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			c.Abort()
+			return
+		}
+
+		if accessTokenClaims.IsImpersonation() {
+			authenticateImpersonation(c, validators.Impersonations, accessTokenClaims)
+			return
+		}
+
 		// set the user information to the context
-		c.Set("user_id", accessTokenClaims.UserID)
-		c.Set("email", accessTokenClaims.Email)
-		c.Set("username", accessTokenClaims.Username)
-		c.Set("package", accessTokenClaims.Package) // Added package to context
+		setClaimsContext(c, accessTokenClaims)
+		c.Set("auth_method", AuthMethodSession)
 		// proceed the request further
 		c.Next()
 	}
 }
+
+func setClaimsContext(c *gin.Context, claims *AccessTokenClaims) {
+	c.Set("user_id", claims.UserID)
+	c.Set("email", claims.Email)
+	c.Set("username", claims.Username)
+	c.Set("package", claims.Package) // Added package to context
+	c.Set("session_id", claims.SessionID)
+	c.Set("role", claims.Role)
+	c.Set("access_token_claims", claims) // kept so logout can denylist this exact token
+}
+
+// authenticateImpersonation lets an admin act as the user, read only unless the impersonation allowed writes,
+// every request is recorded whether it was let through or not
+func authenticateImpersonation(c *gin.Context, recorder ImpersonationRecorder, claims *AccessTokenClaims) {
+	if recorder == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Impersonation tokens can't be used for this endpoint"})
+		c.Abort()
+		return
+	}
+	defer func() {
+		client := models.ClientInfo{UserAgent: c.Request.UserAgent(), IPAddress: c.ClientIP()}
+		recorder.RecordImpersonatedRequest(claims, client, c.Request.Method, c.Request.URL.Path, c.Writer.Status())
+	}()
+
+	setClaimsContext(c, claims)
+	c.Set("auth_method", AuthMethodImpersonation)
+	c.Set("impersonator_id", claims.Actor.UserID)
+
+	if !claims.Actor.AllowWrites && !isReadOnlyMethod(c.Request.Method) && c.FullPath() != ImpersonationEndRoute {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Write operations are blocked while impersonating"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func isReadOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// DenyImpersonation guards account security routes (credentials, sessions, tokens, deletion) that an admin
+// acting as the user must never reach, even when the impersonation allows writes
+func DenyImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("auth_method") == AuthMethodImpersonation {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not available while impersonating"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func authenticatePersonalAccessToken(c *gin.Context, validator PersonalAccessTokenValidator, rawToken string) {
+	if validator == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Personal access tokens can't be used for this endpoint"})
+		c.Abort()
+		return
+	}
+
+	user, token, err := validator.ValidatePersonalAccessToken(rawToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid personal access token"})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", user.UserID)
+	c.Set("email", user.Email)
+	c.Set("username", user.Username)
+	c.Set("package", user.Package)
+	c.Set("role", user.Role)
+	c.Set("personal_access_token", token)
+	c.Set("auth_method", AuthMethodPersonalAccessToken)
+	c.Next()
+}
+
+// RequireScope guards a route that personal access tokens may call, cookie sessions always pass
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("auth_method") != AuthMethodPersonalAccessToken {
+			c.Next()
+			return
+		}
+		value, _ := c.Get("personal_access_token")
+		token, ok := value.(*models.PersonalAccessToken)
+		if !ok || !token.HasScope(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token is missing the " + scope + " scope"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePermission guards privileged routes, only browser sessions whose access token carries the permission pass;
+// personal access tokens and impersonation tokens never do, whatever the owner's role
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing the " + permission + " permission"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// HasPermission is RequirePermission for handlers that only need the permission for part of what they do
+func HasPermission(c *gin.Context, permission string) bool {
+	value, _ := c.Get("access_token_claims")
+	claims, ok := value.(*AccessTokenClaims)
+	return ok && c.GetString("auth_method") == AuthMethodSession && hasPermission(claims.Permissions, permission)
+}
+
+func hasPermission(granted []string, permission string) bool {
+	for _, p := range granted {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, ok is false when there is no such header
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
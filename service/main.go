@@ -66,28 +66,138 @@ func main() {
 	}
 
 	// Setup repositories and services
+	// token and session lifetimes, fixed for the life of the process; the key manager keeps keys verifying as long as access tokens live
+	authConfig, err := utils.LoadAuthConfig()
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Invalid auth configuration")
+	}
+	utils.SetAuthConfig(authConfig)
+
+	// jwt signing keys come next, every token helper depends on them
+	signingKeyRepo := repositories.NewSigningKeyRepo(db)
+	keyManager, err := services.NewKeyManagerService(signingKeyRepo, authConfig.AccessTokenTTL)
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to initialize key manager")
+	}
+	if err := keyManager.Start(ctx); err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to load jwt signing keys")
+	}
+	utils.SetKeyProvider(keyManager)
+	jwksHandler := handlers.NewJWKSHandler(keyManager)
+
+	// access token denylist, loaded before serving so revoked tokens are rejected from the first request
+	revocationRepo := repositories.NewTokenRevocationRepo(db)
+	revocationService := services.NewTokenRevocationService(revocationRepo)
+	if err := revocationService.Start(ctx); err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to load access token revocations")
+	}
+
+	auditRepo := repositories.NewAuditEventRepo(db)
+	auditLogger, err := services.NewAuditLogger(auditRepo)
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to initialize audit logger")
+	}
+
+	// plan names, quotas and prices, read from the database instead of being hardcoded
+	planRepo := repositories.NewPlanRepo(db)
+	planCatalog := services.NewPlanCatalog(planRepo)
+	if _, err := planCatalog.DefaultPlan(); err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to load plan catalog")
+	}
+	planHandler := handlers.NewPlanHandler(planCatalog, auditLogger)
+
 	authRepo := repositories.NewAuthRepo(db)
 	refreshTokenRepo := repositories.NewTokenRepository(db)
-	tokenService := services.NewRefreshTokenService(refreshTokenRepo, authRepo)
-	schedulerService := services.NewSchedulerService(authRepo)
-	authService := services.NewAuthService(authRepo, tokenService)
-	authService.SetSchedulerService(schedulerService)
-	userHandler := handlers.NewUserHandler(authService, tokenService)
-	schedulerHandler := handlers.NewSchedulerHandler(schedulerService)
+	tokenService := services.NewRefreshTokenService(refreshTokenRepo, authRepo, auditLogger)
+	// lifecycle emails are queued by the services and sent by the scheduler
+	notificationRepo := repositories.NewNotificationRepo(db)
+	notificationService := services.NewNotificationService(notificationRepo, authRepo, planCatalog)
+	notificationHandler := handlers.NewNotificationHandler(notificationService)
+	// the subscription state machine is the only place users move between plans
+	subscriptionRepo := repositories.NewSubscriptionRepo(db)
+	subscriptionService, err := services.NewSubscriptionService(subscriptionRepo, planCatalog, revocationService, notificationService, auditLogger)
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to initialize subscription service")
+	}
+	throttleRepo := repositories.NewAuthThrottleRepo(db)
+	throttleService := services.NewAuthThrottleService(throttleRepo, authRepo, auditLogger)
+	// the breached password corpus is optional, without it the policy still checks length and strength
+	var breachedPasswords utils.BreachedPasswordChecker
+	if corpusPath := os.Getenv("BREACHED_PASSWORDS_FILE"); corpusPath != "" {
+		corpus, err := utils.OpenBreachedPasswordCorpus(corpusPath)
+		if err != nil {
+			logger.Log.Fatal().Err(err).Msg("Failed to open breached password corpus")
+		}
+		breachedPasswords = corpus
+	} else {
+		logger.Log.Warn().Msg("BREACHED_PASSWORDS_FILE is not set, breached password check is disabled")
+	}
+	passwordPolicy := services.NewPasswordPolicyService(breachedPasswords)
+	authService := services.NewAuthService(authRepo, tokenService, revocationService, throttleService, passwordPolicy, planCatalog, subscriptionService, auditLogger)
+	userHandler := handlers.NewUserHandler(authService, tokenService, revocationService, throttleService, auditLogger)
 
 	fileRepo := repositories.NewFileRepo(db)
-	fileService, err := services.NewFileService(fileRepo, authRepo)
+	// what happens to the files of a plan the user lost, applied by the scheduler
+	downgradePolicy, err := services.DowngradePolicyFromEnv()
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to read downgrade policy")
+	}
+	fileService, err := services.NewFileService(fileRepo, authRepo, planCatalog, downgradePolicy)
 	if err != nil {
 		logger.Log.Fatal().Err(err).Msg("Failed to initialize file service")
 	}
-	fileHandler := handlers.NewFileHandler(fileService)
+	// storage and bandwidth per user and day, snapshotted by the scheduler and counted as files go through
+	usageRepo := repositories.NewUsageRepo(db)
+	usageService := services.NewUsageService(usageRepo)
+	usageHandler := handlers.NewUsageHandler(usageService)
+	fileHandler := handlers.NewFileHandler(fileService, usageService, auditLogger)
+	schedulerService := services.NewSchedulerService(subscriptionService, fileService, notificationService, usageService)
+	schedulerHandler := handlers.NewSchedulerHandler(schedulerService, throttleService, auditLogger)
+
+	patRepo := repositories.NewPersonalAccessTokenRepo(db)
+	patService := services.NewPersonalAccessTokenService(patRepo, authRepo)
+	patHandler := handlers.NewPersonalAccessTokenHandler(patService)
+
+	deletionRepo := repositories.NewAccountDeletionRepo(db)
+	deletionService, err := services.NewAccountDeletionService(deletionRepo, patRepo, authService, tokenService, revocationService, fileService, auditLogger)
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to initialize account deletion service")
+	}
+	deletionHandler := handlers.NewAccountDeletionHandler(deletionService)
+
+	exportRepo := repositories.NewDataExportRepo(db)
+	exportService := services.NewDataExportService(exportRepo, authRepo, fileRepo, patRepo, tokenService, fileService, auditLogger)
+	exportService.Start(ctx)
+	exportHandler := handlers.NewDataExportHandler(exportService)
+
+	paymentProvider, err := services.NewPaymentProviderFromEnv()
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to initialize payment provider")
+	}
+	paymentRepo := repositories.NewPaymentRepo(db)
+	promoRepo := repositories.NewPromoRepo(db)
+	promoService := services.NewPromoService(promoRepo, planCatalog, subscriptionService)
+	promoHandler := handlers.NewPromoHandler(promoService, auditLogger)
+	invoiceRepo := repositories.NewInvoiceRepo(db)
+	invoiceService, err := services.NewInvoiceService(invoiceRepo, authRepo, planCatalog)
+	if err != nil {
+		logger.Log.Fatal().Err(err).Msg("Failed to initialize invoice service")
+	}
+	billingService := services.NewBillingService(paymentRepo, authRepo, planCatalog, subscriptionService, invoiceService, promoService, notificationService, paymentProvider, auditLogger)
+	billingHandler := handlers.NewBillingHandler(billingService, subscriptionService, invoiceService)
+
+	adminService := services.NewAdminService(authRepo, fileRepo, planCatalog, subscriptionService, auditLogger, tokenService, revocationService, fileService)
+	adminHandler := handlers.NewAdminHandler(adminService, auditLogger)
 
 	// Gin router setup
 	r := gin.New()
 	r.Use(gin.Recovery())
 	r.Use(utils.ReqLoggingMiddleware())
 	r.Use(securityHeadersMiddleware())
-	r.SetTrustedProxies([]string{"0.0.0.0/0"})
+	// only the ingress may set X-Forwarded-For, anyone else could pick the ip the auth throttles and rate limits see
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		logger.Log.Fatal().Err(err).Msg("Invalid TRUSTED_PROXIES")
+	}
 
 	// Prometheus metrics endpoint
 	r.Use(utils.PrometheusMiddleware())
@@ -97,7 +207,7 @@ func main() {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     allowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Content-Type", "Authorization", utils.CSRFHeaderName, "Idempotency-Key"},
 		ExposeHeaders:    []string{"Content-Length", "Authorization", "Content-Type"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
@@ -106,8 +216,28 @@ func main() {
 	r.Use(rateLimiterMiddleware())
 	r.Use(requestSizeLimitMiddleware(2 << 20))
 	r.Use(timeoutMiddleware(20 * time.Second))
+	r.Use(utils.CSRFMiddleware())
 
-	routes.InitializeRoutes(r, userHandler, fileHandler, schedulerHandler)
+	sessionValidators := utils.AuthValidators{Sessions: tokenService, Revocations: revocationService, Impersonations: adminService}
+	tokenValidators := utils.AuthValidators{Sessions: tokenService, Revocations: revocationService, PersonalAccessTokens: patService, Impersonations: adminService}
+	routes.InitializeRoutes(r, routes.Handlers{
+		User:                userHandler,
+		File:                fileHandler,
+		Scheduler:           schedulerHandler,
+		JWKS:                jwksHandler,
+		PersonalAccessToken: patHandler,
+		AccountDeletion:     deletionHandler,
+		DataExport:          exportHandler,
+		Admin:               adminHandler,
+		Plan:                planHandler,
+		Billing:             billingHandler,
+		Promo:               promoHandler,
+		Notification:        notificationHandler,
+		Usage:               usageHandler,
+	}, routes.Middlewares{
+		SessionAuth: utils.ValidateAccessTokenMiddleware(sessionValidators),
+		TokenAuth:   utils.ValidateAccessTokenMiddleware(tokenValidators),
+	})
 
 	// Server configuration
 	port := os.Getenv("PORT")
@@ -149,6 +279,17 @@ func main() {
 }
 
 // securityHeadersMiddleware adds security headers to all responses
+// trustedProxies reads TRUSTED_PROXIES (comma separated ips or cidrs), empty trusts no proxy and uses the peer address
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
 func securityHeadersMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("X-Content-Type-Options", "nosniff")